@@ -4,6 +4,9 @@ import (
 	"flag"
 	"gamma/internal/apps/dmb"
 	"gamma/internal/apps/gateway"
+	"gamma/pkg/credential"
+	"gamma/pkg/metrics"
+	"gamma/pkg/topicscheme"
 	"os"
 
 	log "github.com/sirupsen/logrus"
@@ -14,13 +17,25 @@ func main() {
 	environment := flag.String("env", "production", "実行環境 [\"production\", \"development\"]")
 	logLevel := flag.String("level", "warn", "ログレベル [\"trace\", \"debug\", \"info\", \"warn\", \"error\", \"fatal\", \"panic\"]")
 	setReportCaller := flag.Bool("caller", false, "ログに行番号を表示する")
+	managerMBScheme := flag.String("managerScheme", "tcp", "Manager MQTT broker scheme [\"tcp\", \"ssl\", \"ws\", \"wss\"]")
+	managerMBPath := flag.String("managerPath", "", "Manager MQTT broker path [ws, wss のみ] (例: \"/mqtt\")")
 	managerMBHost := flag.String("managerHost", "localhost", "Manager MQTT broker host")
 	managerMBPort := flag.Int("managerPort", 1883, "Manager MQTT broker port")
+	managerMBProtocolVersion := flag.Uint("managerProtocolVersion", 0, "Manager MQTT broker protocol version [0 (3.1.1), 3 (3.1), 4 (3.1.1), 5 (5.0)]")
+	distributedMBScheme := flag.String("dmbScheme", "tcp", "Distributed MQTT broker scheme [\"tcp\", \"ssl\", \"ws\", \"wss\"]")
+	distributedMBPath := flag.String("dmbPath", "", "Distributed MQTT broker path [ws, wss のみ] (例: \"/mqtt\")")
 	distributedMBHost := flag.String("dmbHost", "localhost", "Distributed MQTT broker host")
 	distributedMBPort := flag.Int("dmbPort", 1883, "Distributed MQTT broker port")
+	distributedMBProtocolVersion := flag.Uint("dmbProtocolVersion", 0, "Gateway が分散ブローカへ接続する際の MQTT のプロトコルバージョン [0 (3.1.1), 3 (3.1), 4 (3.1.1), 5 (5.0)]")
+	distributedMBCredentialRef := flag.String("dmbCredentialRef", "", "Gateway が分散ブローカへ接続する際に使用する認証情報の参照名")
 	distributedMBTopic := flag.String("dmbTopic", "/", "Distributed MQTT broker topic")
+	distributedMBReplica := flag.Bool("dmbReplica", false, "dmbTopic を担当している既存の分散ブローカのレプリカとして登録する")
+	distributedMBSpare := flag.Bool("dmbSpare", false, "担当トピックを持たない予備の分散ブローカとして登録する (dmbTopic は使用せず、マネージャが負荷に応じて割り当てる)")
 	baseRetransmissionIntervalMilliSeconds := flag.Int("baseRetransmissionIntervalMilliSeconds", 10, "Base retransmission interval (milli sec)")
 	maxRetransmissionIntervalMilliSeconds := flag.Int("maxRetransmissionIntervalMilliSeconds", 5000, "Base retransmission interval (milli sec)")
+	topicScheme := flag.String("topicScheme", "quadkey", "ルーティング用トピックの形式 [\"quadkey\", \"geohash\"]")
+	credentialFile := flag.String("credentials", "", "MQTT ブローカへ接続する際の認証情報・TLS の設定を記述した JSON ファイル (空の場合は認証情報なし)")
+	metricsAddr := flag.String("metricsAddr", "", "メトリクスを Prometheus/OpenMetrics 形式で公開する HTTP サーバのアドレス (例: \":9100\"。空の場合は公開しない)")
 	flag.Parse()
 
 	// 標準エラー出力でなく標準出力とする
@@ -64,10 +79,47 @@ func main() {
 	}
 	log.WithFields(log.Fields{"environment": *environment}).Info()
 	log.WithFields(log.Fields{"level": *logLevel}).Info()
-	log.WithFields(log.Fields{"host": *managerMBHost, "port": uint16(*managerMBPort)}).Info("Manager MQTT broker")
-	log.WithFields(log.Fields{"host": *distributedMBHost, "port": uint16(*distributedMBPort)}).Info("Distributed MQTT broker")
 
-	managerMB := gateway.BrokerInfo{Host: *managerMBHost, Port: uint16(*managerMBPort)}
-	distributedMB := gateway.BrokerInfo{Host: *distributedMBHost, Port: uint16(*distributedMBPort)}
-	dmb.DMB(managerMB, distributedMB, *distributedMBTopic, *baseRetransmissionIntervalMilliSeconds, *maxRetransmissionIntervalMilliSeconds)
+	scheme, err := topicscheme.Lookup(*topicScheme)
+	if err != nil {
+		log.WithFields(log.Fields{"topicScheme": *topicScheme, "error": err}).Fatal("Undefined topic scheme")
+	}
+	topicscheme.SetCurrent(scheme)
+	log.WithFields(log.Fields{"topicScheme": scheme.Name()}).Info()
+	if err := topicscheme.ValidateTopic(scheme, *distributedMBTopic); err != nil {
+		log.WithFields(log.Fields{"dmbTopic": *distributedMBTopic, "error": err}).Fatal("Invalid distributed MQTT broker topic")
+	}
+
+	if *distributedMBSpare && *distributedMBReplica {
+		log.Fatal("dmbSpare and dmbReplica cannot be set at the same time")
+	}
+
+	managerMB := gateway.BrokerInfo{Scheme: *managerMBScheme, Path: *managerMBPath, Host: *managerMBHost, Port: uint16(*managerMBPort), ProtocolVersion: uint8(*managerMBProtocolVersion)}
+	if err := managerMB.Validate(); err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Invalid manager MQTT broker")
+	}
+	distributedMB := gateway.BrokerInfo{Scheme: *distributedMBScheme, Path: *distributedMBPath, Host: *distributedMBHost, Port: uint16(*distributedMBPort), CredentialRef: *distributedMBCredentialRef, ProtocolVersion: uint8(*distributedMBProtocolVersion)}
+	if err := distributedMB.Validate(); err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Invalid distributed MQTT broker")
+	}
+
+	var credentials *credential.Store
+	if *credentialFile != "" {
+		credentials, err = credential.LoadStore(*credentialFile)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Fatal("Invalid credential file")
+		}
+		log.WithFields(log.Fields{"credentials": *credentialFile}).Info("Loaded credential file")
+	}
+	log.WithFields(log.Fields{"url": managerMB.URL(), "credential": credentials.Lookup(managerMB)}).Info("Manager MQTT broker")
+	log.WithFields(log.Fields{"url": distributedMB.URL(), "credentialRef": distributedMB.CredentialRef}).Info("Distributed MQTT broker")
+	if *metricsAddr != "" {
+		go func() {
+			if err := metrics.ListenAndServe(*metricsAddr, metrics.Default); err != nil {
+				log.WithFields(log.Fields{"error": err}).Fatal("Metrics server error")
+			}
+		}()
+	}
+
+	dmb.DMB(managerMB, distributedMB, *distributedMBTopic, *distributedMBReplica, *distributedMBSpare, *baseRetransmissionIntervalMilliSeconds, *maxRetransmissionIntervalMilliSeconds, credentials)
 }
@@ -3,7 +3,16 @@ package main
 import (
 	"flag"
 	"gamma/internal/apps/gateway"
+	"gamma/pkg/brokerpool"
+	"gamma/pkg/circuitbreaker"
+	"gamma/pkg/credential"
+	"gamma/pkg/metrics"
+	"gamma/pkg/outbox"
+	"gamma/pkg/subsctable"
+	"gamma/pkg/topicscheme"
+	"gamma/pkg/traffic"
 	"os"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -12,10 +21,39 @@ func main() {
 	environment := flag.String("env", "production", "実行環境 [\"production\", \"development\"]")
 	logLevel := flag.String("level", "warn", "ログレベル [\"trace\", \"debug\", \"info\", \"warn\", \"error\", \"fatal\", \"panic\"]")
 	setReportCaller := flag.Bool("caller", false, "ログに行番号を表示する")
+	managerMBScheme := flag.String("managerScheme", "tcp", "Manager MQTT broker scheme [\"tcp\", \"ssl\", \"ws\", \"wss\"]")
+	managerMBPath := flag.String("managerPath", "", "Manager MQTT broker path [ws, wss のみ] (例: \"/mqtt\")")
 	managerMBHost := flag.String("managerHost", "localhost", "Manager MQTT broker host")
 	managerMBPort := flag.Int("managerPort", 1883, "Manager MQTT broker port")
+	managerMBProtocolVersion := flag.Uint("managerProtocolVersion", 0, "Manager MQTT broker protocol version [0 (3.1.1), 3 (3.1), 4 (3.1.1), 5 (5.0)]")
+	gatewayMBScheme := flag.String("gatewayScheme", "tcp", "Gateway MQTT broker scheme [\"tcp\", \"ssl\", \"ws\", \"wss\"]")
+	gatewayMBPath := flag.String("gatewayPath", "", "Gateway MQTT broker path [ws, wss のみ] (例: \"/mqtt\")")
 	gatewayMBHost := flag.String("gatewayHost", "localhost", "Gateway MQTT broker host")
 	gatewayMBPort := flag.Int("gatewayPort", 1884, "Gateway MQTT broker port")
+	gatewayMBProtocolVersion := flag.Uint("gatewayProtocolVersion", 0, "Gateway MQTT broker protocol version [0 (3.1.1), 3 (3.1), 4 (3.1.1), 5 (5.0)]")
+	topicScheme := flag.String("topicScheme", "quadkey", "ルーティング用トピックの形式 [\"quadkey\", \"geohash\"]")
+	aggregationThreshold := flag.Float64("aggregationThreshold", 0, "子孫ノードのトピックを親ノードの \"#\" へ集約する被覆率 (0 の場合は集約しない)")
+	aggregationReleaseThreshold := flag.Float64("aggregationReleaseThreshold", 0.5, "集約を解除する被覆率 (aggregationThreshold 以下)")
+	aggregationMinTopics := flag.Uint("aggregationMinTopics", 2, "集約に必要な子孫ノードのトピック数")
+	replicaPublishQuorum := flag.Uint("replicaPublishQuorum", 0, "レプリカセットへの Publish 時に配送する必要があるレプリカの数 (0 の場合は全てのレプリカ)")
+	workerIndex := flag.Uint("workerIndex", 0, "ゲートウェイブローカを複数のプロセスで分担する場合の、このプロセスの番号 (0 〜 workerCount-1)")
+	workerCount := flag.Uint("workerCount", 1, "ゲートウェイブローカを分担するプロセスの数 (1 の場合は分担しない)")
+	workerPartitionDepth := flag.Uint("workerPartitionDepth", 3, "ゲートウェイブローカを分担する際に、トピックの先頭からこのレベルの数の接頭辞ごとに担当のプロセスを決める")
+	sharedGroup := flag.String("sharedGroup", "", "/forward/# を共有サブスクリプション ($share/<sharedGroup>//forward/#) で分担する場合のグループ名 (空の場合はトピックのハッシュ値で分担する)")
+	lazyConnect := flag.Bool("lazyConnect", false, "分散ブローカへ起動時に接続せず、最初に使用する際に接続する")
+	brokerIdleTimeoutSeconds := flag.Uint("brokerIdleTimeoutSeconds", 0, "Subscriber がおらず、最後の Publish からこの秒数が経過した分散ブローカとの接続を切断する (0 の場合は切断しない)")
+	maxBrokerConnections := flag.Uint("maxBrokerConnections", 0, "同時に接続する分散ブローカの最大数。超えた場合は最も長く使用されていない接続から切断する (0 の場合は無制限)")
+	outboxMaxMessages := flag.Uint("outboxMaxMessages", 0, "分散ブローカと接続できない間に Publish するメッセージを、分散ブローカごとにメモリ上に保持する最大数 (0 の場合は保持しない)")
+	outboxMaxAgeSeconds := flag.Uint("outboxMaxAgeSeconds", 0, "保持したメッセージを再送する期限の秒数 (0 の場合は無期限)")
+	outboxSpillDir := flag.String("outboxSpillDir", "", "メモリ上に保持できないメッセージを書き出すディレクトリ (空の場合は書き出さずに破棄する)")
+	outboxMaxSpillMessages := flag.Uint("outboxMaxSpillMessages", 0, "分散ブローカごとにディスクへ書き出すメッセージの最大数 (0 の場合は無制限)")
+	circuitFailureThreshold := flag.Uint("circuitFailureThreshold", 0, "分散ブローカへの Publish に連続してこの回数失敗した場合に、祖先ノードの分散ブローカへ転送する (0 の場合は転送しない)")
+	circuitOpenSeconds := flag.Uint("circuitOpenSeconds", 30, "祖先ノードの分散ブローカへ転送し始めてから、元の分散ブローカが回復したかどうかを試すまでの秒数")
+	publishTimeoutMilliseconds := flag.Uint("publishTimeoutMilliseconds", 0, "分散ブローカへの Publish の完了を待つ最大のミリ秒数。超えた場合は失敗として扱う (0 の場合は無制限に待つ)")
+	trafficDepth := flag.Uint("trafficDepth", 0, "トピックの先頭からこのレベルの数ごと（タイルごと）にメッセージの数を数え、マネージャへ通知する (0 の場合は数えない)")
+	trafficReportSeconds := flag.Uint("trafficReportSeconds", 60, "タイルごとのメッセージの数をマネージャへ通知する間隔の秒数")
+	credentialFile := flag.String("credentials", "", "MQTT ブローカへ接続する際の認証情報・TLS の設定を記述した JSON ファイル (空の場合は認証情報なし)")
+	metricsAddr := flag.String("metricsAddr", "", "メトリクスを Prometheus/OpenMetrics 形式で公開する HTTP サーバのアドレス (例: \":9100\"。空の場合は公開しない)")
 	flag.Parse()
 
 	// 標準エラー出力でなく標準出力とする
@@ -59,10 +97,99 @@ func main() {
 	}
 	log.WithFields(log.Fields{"environment": *environment}).Info()
 	log.WithFields(log.Fields{"level": *logLevel}).Info()
-	log.WithFields(log.Fields{"host": *managerMBHost, "port": uint16(*managerMBPort)}).Info("Manager MQTT broker")
-	log.WithFields(log.Fields{"host": *gatewayMBHost, "port": uint16(*gatewayMBPort)}).Info("Gateway MQTT broker")
 
-	managerMB := gateway.BrokerInfo{Host: *managerMBHost, Port: uint16(*managerMBPort)}
-	gatewayMB := gateway.BrokerInfo{Host: *gatewayMBHost, Port: uint16(*gatewayMBPort)}
-	gateway.Gateway(gatewayMB, managerMB)
+	scheme, err := topicscheme.Lookup(*topicScheme)
+	if err != nil {
+		log.WithFields(log.Fields{"topicScheme": *topicScheme, "error": err}).Fatal("Undefined topic scheme")
+	}
+	topicscheme.SetCurrent(scheme)
+	log.WithFields(log.Fields{"topicScheme": scheme.Name()}).Info()
+
+	managerMB := gateway.BrokerInfo{Scheme: *managerMBScheme, Path: *managerMBPath, Host: *managerMBHost, Port: uint16(*managerMBPort), ProtocolVersion: uint8(*managerMBProtocolVersion)}
+	if err := managerMB.Validate(); err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Invalid manager MQTT broker")
+	}
+	gatewayMB := gateway.BrokerInfo{Scheme: *gatewayMBScheme, Path: *gatewayMBPath, Host: *gatewayMBHost, Port: uint16(*gatewayMBPort), ProtocolVersion: uint8(*gatewayMBProtocolVersion)}
+	if err := gatewayMB.Validate(); err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Invalid gateway MQTT broker")
+	}
+
+	var credentials *credential.Store
+	if *credentialFile != "" {
+		credentials, err = credential.LoadStore(*credentialFile)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Fatal("Invalid credential file")
+		}
+		log.WithFields(log.Fields{"credentials": *credentialFile}).Info("Loaded credential file")
+	}
+	log.WithFields(log.Fields{"url": managerMB.URL(), "credential": credentials.Lookup(managerMB)}).Info("Manager MQTT broker")
+	log.WithFields(log.Fields{"url": gatewayMB.URL(), "credential": credentials.Lookup(gatewayMB)}).Info("Gateway MQTT broker")
+
+	aggregationPolicy := subsctable.AggregationPolicy{
+		Threshold:        *aggregationThreshold,
+		ReleaseThreshold: *aggregationReleaseThreshold,
+		MinTopics:        *aggregationMinTopics,
+	}
+	if err := aggregationPolicy.Validate(); err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Invalid aggregation policy")
+	}
+	log.WithFields(log.Fields{"threshold": aggregationPolicy.Threshold, "releaseThreshold": aggregationPolicy.ReleaseThreshold, "minTopics": aggregationPolicy.MinTopics}).Info("Aggregation policy")
+
+	log.WithFields(log.Fields{"replicaPublishQuorum": *replicaPublishQuorum}).Info()
+
+	worker := gateway.Worker{Index: *workerIndex, Count: *workerCount, SharedGroup: *sharedGroup, Depth: *workerPartitionDepth}
+	if err := worker.Validate(); err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Invalid worker")
+	}
+	log.WithFields(log.Fields{"worker": worker.String(), "forwardTopic": worker.ForwardTopic()}).Info("Gateway worker")
+
+	connectionPolicy := brokerpool.ConnectionPolicy{
+		Lazy:           *lazyConnect,
+		IdleTimeout:    time.Duration(*brokerIdleTimeoutSeconds) * time.Second,
+		MaxConnections: *maxBrokerConnections,
+	}
+	if err := connectionPolicy.Validate(); err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Invalid connection policy")
+	}
+	log.WithFields(log.Fields{"lazy": connectionPolicy.Lazy, "idleTimeout": connectionPolicy.IdleTimeout, "maxConnections": connectionPolicy.MaxConnections}).Info("Connection policy")
+
+	outboxPolicy := outbox.Policy{
+		MaxMessages:      *outboxMaxMessages,
+		MaxAge:           time.Duration(*outboxMaxAgeSeconds) * time.Second,
+		SpillDir:         *outboxSpillDir,
+		MaxSpillMessages: *outboxMaxSpillMessages,
+	}
+	if err := outboxPolicy.Validate(); err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Invalid outbox policy")
+	}
+	log.WithFields(log.Fields{"maxMessages": outboxPolicy.MaxMessages, "maxAge": outboxPolicy.MaxAge, "spillDir": outboxPolicy.SpillDir, "maxSpillMessages": outboxPolicy.MaxSpillMessages}).Info("Outbox policy")
+
+	circuitPolicy := circuitbreaker.Policy{
+		FailureThreshold: *circuitFailureThreshold,
+		OpenTimeout:      time.Duration(*circuitOpenSeconds) * time.Second,
+		PublishTimeout:   time.Duration(*publishTimeoutMilliseconds) * time.Millisecond,
+	}
+	if err := circuitPolicy.Validate(); err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Invalid circuit policy")
+	}
+	log.WithFields(log.Fields{"failureThreshold": circuitPolicy.FailureThreshold, "openTimeout": circuitPolicy.OpenTimeout, "publishTimeout": circuitPolicy.PublishTimeout}).Info("Circuit policy")
+
+	trafficPolicy := traffic.Policy{
+		Depth:          *trafficDepth,
+		ReportInterval: time.Duration(*trafficReportSeconds) * time.Second,
+	}
+	if err := trafficPolicy.Validate(); err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Invalid traffic policy")
+	}
+	log.WithFields(log.Fields{"depth": trafficPolicy.Depth, "reportInterval": trafficPolicy.ReportInterval}).Info("Traffic policy")
+
+	if *metricsAddr != "" {
+		go func() {
+			if err := metrics.ListenAndServe(*metricsAddr, metrics.Default); err != nil {
+				log.WithFields(log.Fields{"error": err}).Fatal("Metrics server error")
+			}
+		}()
+	}
+
+	gateway.Gateway(gatewayMB, managerMB, aggregationPolicy, *replicaPublishQuorum, credentials, worker, connectionPolicy, outboxPolicy, circuitPolicy, trafficPolicy)
 }
@@ -2,11 +2,16 @@ package main
 
 import (
 	"flag"
-	"fmt"
 	"gamma/internal/apps/manager"
+	"gamma/pkg/autoscale"
+	"gamma/pkg/credential"
+	"gamma/pkg/metrics"
+	"gamma/pkg/mqttv5"
+	"gamma/pkg/topicscheme"
 	"os"
+	"strings"
+	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -14,8 +19,21 @@ func main() {
 	environment := flag.String("env", "production", "実行環境 [\"production\", \"dev\"]")
 	logLevel := flag.String("level", "warn", "ログレベル [\"trace\", \"debug\", \"info\", \"warn\", \"error\", \"fatal\", \"panic\"]")
 	setReportCaller := flag.Bool("caller", false, "ログに行番号を表示する")
+	scheme := flag.String("scheme", "tcp", "Manager Broker のスキーム [\"tcp\", \"ssl\", \"ws\", \"wss\"]")
+	path := flag.String("path", "", "Manager Broker のパス [ws, wss のみ] (例: \"/mqtt\")")
 	host := flag.String("host", "127.0.0.1", "Manager Broker のホスト名")
 	port := flag.Uint("port", 1883, "Manager Broker のポート番号")
+	protocolVersion := flag.Uint("protocolVersion", 0, "Manager Broker へ接続する MQTT のプロトコルバージョン [0 (3.1.1), 3 (3.1), 4 (3.1.1), 5 (5.0)]")
+	topicScheme := flag.String("topicScheme", "quadkey", "ルーティング用トピックの形式 [\"quadkey\", \"geohash\"] (ヒートマップを GeoJSON で出力する際に使用する)")
+	splitThreshold := flag.Float64("splitThreshold", 0, "分散ブローカの負荷 (1 秒あたりのメッセージの数) がこの値を超えた場合に、最も負荷が高い子のサブツリーを予備の分散ブローカへ割り当てる (0 の場合は割り当てない)")
+	splitSustainSeconds := flag.Uint("splitSustainSeconds", 60, "分散ブローカの負荷が splitThreshold を超えた状態がこの秒数続いた場合に割り当てる")
+	consolidateThreshold := flag.Float64("consolidateThreshold", 0, "分散ブローカの負荷 (1 秒あたりのメッセージの数) がこの値を下回った場合に、担当範囲を親ノードの分散ブローカへ戻し、予備の分散ブローカとする (0 の場合は戻さない。splitThreshold より小さくすること)")
+	consolidateAfterSeconds := flag.Uint("consolidateAfterSeconds", 1800, "分散ブローカの負荷が consolidateThreshold を下回った状態がこの秒数続いた場合に戻す")
+	pinnedTopics := flag.String("pinnedTopics", "", "親ノードの分散ブローカへ戻さないサブツリーのトピック (カンマ区切り。例: \"/0/1,/2\")")
+	autoscaleCooldownSeconds := flag.Uint("autoscaleCooldownSeconds", 300, "負荷に応じて割り当てを変更してから、次に変更しない秒数")
+	topologyFile := flag.String("topology", "", "起動した分散ブローカの担当トピック・ゲートウェイの担当エリアを記述した JSON ファイル (空の場合は、登録・通知されたとおりに登録する)")
+	credentialFile := flag.String("credentials", "", "MQTT ブローカへ接続する際の認証情報・TLS の設定を記述した JSON ファイル (空の場合は認証情報なし)")
+	metricsAddr := flag.String("metricsAddr", "", "メトリクスを Prometheus/OpenMetrics 形式で公開する HTTP サーバのアドレス (例: \":9100\"。空の場合は公開しない)")
 	flag.Parse()
 
 	// 標準エラー出力でなく標準出力とする
@@ -60,18 +78,71 @@ func main() {
 	}
 	log.WithFields(log.Fields{"level": *logLevel}).Info()
 
+	routingScheme, err := topicscheme.Lookup(*topicScheme)
+	if err != nil {
+		log.WithFields(log.Fields{"topicScheme": *topicScheme, "error": err}).Fatal("Undefined topic scheme")
+	}
+	topicscheme.SetCurrent(routingScheme)
+	log.WithFields(log.Fields{"topicScheme": routingScheme.Name()}).Info()
+
+	autoscalePolicy := autoscale.Policy{
+		SplitThreshold:       *splitThreshold,
+		SplitSustain:         time.Duration(*splitSustainSeconds) * time.Second,
+		ConsolidateThreshold: *consolidateThreshold,
+		ConsolidateAfter:     time.Duration(*consolidateAfterSeconds) * time.Second,
+		Cooldown:             time.Duration(*autoscaleCooldownSeconds) * time.Second,
+	}
+	if *pinnedTopics != "" {
+		autoscalePolicy.Pinned = strings.Split(*pinnedTopics, ",")
+	}
+	if err := autoscalePolicy.Validate(); err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Invalid autoscale policy")
+	}
+	log.WithFields(log.Fields{"splitThreshold": autoscalePolicy.SplitThreshold, "splitSustain": autoscalePolicy.SplitSustain, "consolidateThreshold": autoscalePolicy.ConsolidateThreshold, "consolidateAfter": autoscalePolicy.ConsolidateAfter, "pinned": autoscalePolicy.Pinned, "cooldown": autoscalePolicy.Cooldown}).Info("Autoscale policy")
+
+	var topology *manager.Topology
+	if *topologyFile != "" {
+		topology, err = manager.LoadTopology(*topologyFile)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Fatal("Invalid topology file")
+		}
+		log.WithFields(log.Fields{"topology": *topologyFile, "distributedBrokers": len(topology.DistributedBrokers), "gateways": len(topology.Gateways)}).Info("Loaded topology file")
+	}
+
 	//////////////        APIブローカへ接続するための準備        //////////////
-	apiBroker := fmt.Sprintf("tcp://%v:%v", *host, *port)
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(apiBroker)
+	apiBroker := manager.BrokerInfo{Scheme: *scheme, Path: *path, Host: *host, Port: uint16(*port), ProtocolVersion: uint8(*protocolVersion)}
+	if err := apiBroker.Validate(); err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Invalid manager broker")
+	}
+	var credentials *credential.Store
+	if *credentialFile != "" {
+		var err error
+		credentials, err = credential.LoadStore(*credentialFile)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Fatal("Invalid credential file")
+		}
+		log.WithFields(log.Fields{"credentials": *credentialFile}).Info("Loaded credential file")
+	}
+	opts, err := credentials.NewClientOptions(apiBroker)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("MQTT client options error")
+	}
 
 	// APIブローカへ接続
-	apiClient := mqtt.NewClient(opts)
+	apiClient := mqttv5.NewClientFor(apiBroker, opts)
 	if token := apiClient.Connect(); token.Wait() && token.Error() != nil {
 		log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT connect error")
 	}
-	log.WithFields(log.Fields{"host": *host, "port": *port}).Info("MQTT connected broker")
+	log.WithFields(log.Fields{"url": apiBroker.URL()}).Info("MQTT connected broker")
 	defer apiClient.Disconnect(1000)
 
-	manager.Manager(apiClient)
+	if *metricsAddr != "" {
+		go func() {
+			if err := metrics.ListenAndServe(*metricsAddr, metrics.Default); err != nil {
+				log.WithFields(log.Fields{"error": err}).Fatal("Metrics server error")
+			}
+		}()
+	}
+
+	manager.Manager(apiClient, autoscalePolicy, topology)
 }
@@ -3,6 +3,8 @@ module gamma
 go 1.13
 
 require (
+	github.com/eclipse/paho.golang v0.11.0
 	github.com/eclipse/paho.mqtt.golang v1.3.1
+	github.com/gorilla/websocket v1.4.2
 	github.com/sirupsen/logrus v1.7.0
 )
@@ -2,8 +2,10 @@ package dmb
 
 import (
 	"encoding/json"
-	"fmt"
 	"gamma/internal/apps/gateway"
+	"gamma/pkg/credential"
+	"gamma/pkg/metrics"
+	"gamma/pkg/mqttv5"
 	"math"
 	"math/rand"
 	"os"
@@ -15,28 +17,42 @@ import (
 )
 
 // FIXME: 変数名、引数名、コメント等の単語・綴りの統一
-func DMB(managerMB gateway.BrokerInfo, distributedMB gateway.BrokerInfo, distributedMBTopic string, baseRetransmissionIntervalMilliSeconds int,
-	maxRetransmissionIntervalMilliSeconds int) {
+// isReplica が true の場合、distributedMBTopic を担当している既存の分散ブローカのレプリカとして登録する
+// isSpare が true の場合、担当トピックを持たない予備の分散ブローカとして登録する（マネージャが負荷に応じてトピックを割り当てる）
+// credentials は、Manager ブローカへ接続する際の認証情報（nil の場合は認証情報なし）
+func DMB(managerMB gateway.BrokerInfo, distributedMB gateway.BrokerInfo, distributedMBTopic string, isReplica bool, isSpare bool, baseRetransmissionIntervalMilliSeconds int,
+	maxRetransmissionIntervalMilliSeconds int, credentials *credential.Store) {
 	// プルグラムを強制終了させるためのチャンネル
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, os.Interrupt)
 
 	isRegisterd := false
+	role := ""
+	if isReplica {
+		role = gateway.RoleReplica
+	}
 	retransmissionCounter := 0
 	allDistributedBrokerList := gateway.AllDistributedBrokerInfo{Version: -1, DMBs: []gateway.DistributedBrokerInfo{}}
 
+	// /metrics で公開するメトリクス
+	registeredGauge := metrics.Default.NewGauge("gamma_dmb_registered", "Whether this distributed broker is registered to the manager (1) or not (0).")
+	registrationCounter := metrics.Default.NewCounter("gamma_dmb_registration_requests_total", "Number of registration requests sent to the manager.")
+	brokertableVersionGauge := metrics.Default.NewGauge("gamma_dmb_brokertable_version", "Version of the broker table last received from the manager.")
+	brokertableVersionGauge.Set(float64(allDistributedBrokerList.Version))
+
 	//////////////          Managerブローカへ接続する           //////////////
-	managerBroker := fmt.Sprintf("tcp://%v:%v", managerMB.Host, managerMB.Port)
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(managerBroker)
+	opts, err := credentials.NewClientOptions(managerMB)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("MQTT client options error")
+	}
 
 	// Managerブローカへ接続
-	managerClient := mqtt.NewClient(opts)
+	managerClient := mqttv5.NewClientFor(managerMB, opts)
 	if token := managerClient.Connect(); token.Wait() && token.Error() != nil {
 		log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT connect error")
 	}
 	defer managerClient.Disconnect(1000)
-	log.WithFields(log.Fields{"host": managerMB.Host, "port": managerMB.Port}).Info("Connected manager broker")
+	log.WithFields(log.Fields{"url": managerMB.URL()}).Info("Connected manager broker")
 
 	// 分散ブローカの追加リクエストを受取るチャンネル
 	brokertableInfoMsgCh := make(chan mqtt.Message, 10)
@@ -47,8 +63,27 @@ func DMB(managerMB gateway.BrokerInfo, distributedMB gateway.BrokerInfo, distrib
 		log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT subscribe error")
 	}
 
+	// 予備として登録したかどうかは、マネージャが通知する予備の一覧で確認する
+	spareBrokersMsgCh := make(chan mqtt.Message, 10)
+	if isSpare {
+		var spareBrokersMsgFunc mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+			spareBrokersMsgCh <- msg
+		}
+		if token := managerClient.Subscribe("/api/distributedbroker/spare/info", 1, spareBrokersMsgFunc); token.Wait() && token.Error() != nil {
+			log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT subscribe error")
+		}
+	}
+	register := func() {
+		if isSpare {
+			notifiSpareDMBToManager(managerClient, distributedMB)
+		} else {
+			notifiNewDMBToManager(managerClient, distributedMB, distributedMBTopic, role)
+		}
+	}
+
 	// Managerへ分散MQTT接続情報の通知
-	notifiNewDMBToManager(managerClient, distributedMB, distributedMBTopic)
+	register()
+	registrationCounter.Inc()
 	retransmissionTimer := time.NewTimer(time.Millisecond * time.Duration(baseRetransmissionIntervalMilliSeconds))
 
 	for {
@@ -60,10 +95,30 @@ func DMB(managerMB gateway.BrokerInfo, distributedMB gateway.BrokerInfo, distrib
 				log.WithFields(log.Fields{"err": err}).Fatal("add distributed broker (addDistributedBrokerMsgCh)")
 			}
 			log.WithFields(log.Fields{"allDistributedBrokerList": string(m.Payload())}).Info("Received distributed MQTT broker info")
+			brokertableVersionGauge.Set(float64(allDistributedBrokerList.Version))
 			for _, v := range allDistributedBrokerList.DMBs {
 				if v.BrokerInfo.Host == distributedMB.Host && v.BrokerInfo.Port == distributedMB.Port {
 					log.WithFields(log.Fields{"myDistributedBrokerHost": distributedMB.Host, "myDistributedBrokerPort": distributedMB.Port}).Info("My distributed broker was successfully registered to manager")
 					isRegisterd = true
+					registeredGauge.Set(1)
+					break
+				}
+			}
+			continue
+
+		// manager から予備の分散ブローカの一覧を受け取るチャンネル
+		// NOTE: トピックを割り当てられた場合は予備の一覧から除かれるが、ブローカテーブルに含まれるため登録済みのままとする
+		case m := <-spareBrokersMsgCh:
+			var spares []gateway.BrokerInfo
+			if err := json.Unmarshal(m.Payload(), &spares); err != nil {
+				log.WithFields(log.Fields{"error": err}).Error("Invalid spare broker list")
+				continue
+			}
+			for _, v := range spares {
+				if v.Host == distributedMB.Host && v.Port == distributedMB.Port {
+					log.WithFields(log.Fields{"myDistributedBrokerHost": distributedMB.Host, "myDistributedBrokerPort": distributedMB.Port}).Info("My distributed broker was successfully registered to manager as a spare")
+					isRegisterd = true
+					registeredGauge.Set(1)
 					break
 				}
 			}
@@ -79,7 +134,8 @@ func DMB(managerMB gateway.BrokerInfo, distributedMB gateway.BrokerInfo, distrib
 			}
 
 			// Managerへ分散MQTT接続情報の再通知
-			notifiNewDMBToManager(managerClient, distributedMB, distributedMBTopic)
+			register()
+			registrationCounter.Inc()
 			retransmissionCounter++
 
 			// 次に追加完了確認を行うまでの時間を決める乱数の範囲を、確認回数に応じて指数関数的に増やす
@@ -105,11 +161,32 @@ func DMB(managerMB gateway.BrokerInfo, distributedMB gateway.BrokerInfo, distrib
 	}
 }
 
-func notifiNewDMBToManager(managerCliet mqtt.Client, dmbInfo gateway.BrokerInfo, dmbTopic string) {
+func notifiNewDMBToManager(managerCliet mqtt.Client, dmbInfo gateway.BrokerInfo, dmbTopic string, role string) {
 	// mosquitto_pub -h localhost -p 1883 -t "/api/tool/distributedbroker/add" -m '{"topic":"/","broker_info":{"host":"localhost","port":1893}}'
-	msg := fmt.Sprintf(`{"broker_info":{"host":"%v","port":%v},"topic":"%v"}`, dmbInfo.Host, dmbInfo.Port, dmbTopic)
+	// レプリカとして登録する場合: -m '{"topic":"/","broker_info":{"host":"localhost","port":1894},"role":"replica"}'
+	// tcp 以外で接続する場合: -m '{"topic":"/","broker_info":{"scheme":"ws","host":"::1","port":9001}}'
+	// リバースプロキシ経由の WebSocket で接続する場合: -m '{"topic":"/","broker_info":{"scheme":"wss","host":"proxy.example.com","port":443,"path":"/mqtt"}}'
+	// NOTE: IPv6 アドレス等を含むため、文字列の埋め込みでなく JSON エンコードする
+	payload, err := json.Marshal(gateway.DistributedBrokerInfo{Topic: dmbTopic, BrokerInfo: dmbInfo, Role: role})
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Notify to manager")
+	}
+	msg := string(payload)
 	if token := managerCliet.Publish("/api/tool/distributedbroker/add", 1, false, msg); token.Wait() && token.Error() != nil {
 		log.WithFields(log.Fields{"error": token.Error()}).Fatal("Notify to manager")
 	}
 	log.WithFields(log.Fields{"msg": msg}).Info("Notified new distributed MQTT broker to manager")
 }
+
+func notifiSpareDMBToManager(managerCliet mqtt.Client, dmbInfo gateway.BrokerInfo) {
+	// mosquitto_pub -h localhost -p 1883 -t "/api/tool/distributedbroker/spare" -m '{"host":"localhost","port":1895}'
+	payload, err := json.Marshal(dmbInfo)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Notify to manager")
+	}
+	msg := string(payload)
+	if token := managerCliet.Publish("/api/tool/distributedbroker/spare", 1, false, msg); token.Wait() && token.Error() != nil {
+		log.WithFields(log.Fields{"error": token.Error()}).Fatal("Notify to manager")
+	}
+	log.WithFields(log.Fields{"msg": msg}).Info("Notified spare distributed MQTT broker to manager")
+}
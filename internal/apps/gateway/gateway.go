@@ -2,11 +2,18 @@ package gateway
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"gamma/pkg/brokerpool"
 	"gamma/pkg/brokertable"
+	"gamma/pkg/circuitbreaker"
+	"gamma/pkg/credential"
+	"gamma/pkg/endpoint"
 	"gamma/pkg/metrics"
-	"reflect"
+	"gamma/pkg/mqttv5"
+	"gamma/pkg/outbox"
+	"gamma/pkg/subsctable"
+	"gamma/pkg/traffic"
 	"time"
 
 	"os"
@@ -17,14 +24,18 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-type BrokerInfo struct {
-	Host string `json:"host"`
-	Port uint16 `json:"port"`
-}
+// BrokerInfo は、MQTT ブローカへの接続先（URL スキーム、ホスト、ポート、認証情報の参照名）
+// NOTE: "scheme" を省略した JSON は tcp として扱うため、従来の {"host":...,"port":...} 形式とも互換性がある
+type BrokerInfo = endpoint.Endpoint
+
+// RoleReplica は、分散ブローカが既存の分散ブローカのレプリカとして同じトピックを担当することを表す
+// Role が空の場合は、既存の分散ブローカが担当するトピックを分割して引き継ぐ
+const RoleReplica = "replica"
 
 type DistributedBrokerInfo struct {
 	Topic      string     `json:"topic"`
 	BrokerInfo BrokerInfo `json:"broker_info"`
+	Role       string     `json:"role,omitempty"`
 }
 
 type AllDistributedBrokerInfo struct {
@@ -32,33 +43,72 @@ type AllDistributedBrokerInfo struct {
 	DMBs    []DistributedBrokerInfo `json:"brokers"`
 }
 
-func Gateway(gatewayMB, managerMB BrokerInfo) {
+// GatewayBrokerStatus は、Manager へ通知するゲートウェイブローカの状態
+// NOTE: BrokerInfo は Manager からクライアントへ通知されるため、URL スキーム・パスも含める
+// 1 つのゲートウェイブローカを複数のワーカで分担している場合は、ワーカごとに通知する（Worker はワーカの番号、Workers はワーカの数）
+type GatewayBrokerStatus struct {
+	Status     string     `json:"status"`
+	Version    int        `json:"version"`
+	BrokerInfo BrokerInfo `json:"broker_info"`
+	Worker     uint       `json:"worker,omitempty"`
+	Workers    uint       `json:"workers,omitempty"`
+}
+
+// SubscriptionReport は、Manager へ定期的に通知する、トピックごとの Subscriber 数
+// NOTE: Manager が分散ブローカの追加・削除の影響（引き継ぐ Subscriber の数）を見積もるために使用する
+type SubscriptionReport struct {
+	BrokerInfo    BrokerInfo      `json:"broker_info"`
+	Worker        uint            `json:"worker,omitempty"`
+	Subscriptions map[string]uint `json:"subscriptions"`
+}
+
+// RegisterResult は、/api/register の要求に MQTT v5 の Response Topic が指定されている場合に応答する結果
+// NOTE: 応答には要求の Correlation Data を引き継ぐ
+type RegisterResult struct {
+	Topic      string `json:"topic"`
+	ReasonCode byte   `json:"reason_code"` // 0x00: 成功、0x80 以上: 失敗（分散ブローカが SUBACK で返した理由コード。不明な場合は 0x80）
+	Error      string `json:"error,omitempty"`
+}
+
+// registerReasonUnspecified は、SUBACK の理由コード以外の原因で Subscribe に失敗した場合の理由コード（Unspecified error）
+const registerReasonUnspecified = 0x80
+
+// aggregationPolicy は、分散ブローカへの Subscribe を親ノードのワイルドカードトピックへ集約する条件
+// publishQuorum は、レプリカセットへの Publish 時に配送する必要があるレプリカの数（0 の場合は全てのレプリカ）
+// credentials は、Manager ブローカ・ゲートウェイブローカ・分散ブローカへ接続する際の認証情報（nil の場合は認証情報なし）
+// worker は、1 つのゲートウェイブローカを複数のプロセスで分担する際の、このプロセスの担当
+// connectionPolicy は、分散ブローカとの接続の管理方法（遅延接続、使用されていない接続の切断、接続数の上限）
+// outboxPolicy は、分散ブローカと接続できない間に Publish するメッセージを保持する方法
+// circuitPolicy は、Publish に失敗し続けた分散ブローカを使用せず、祖先ノードの分散ブローカへ転送する条件
+func Gateway(gatewayMB, managerMB BrokerInfo, aggregationPolicy subsctable.AggregationPolicy, publishQuorum uint, credentials *credential.Store, worker Worker, connectionPolicy brokerpool.ConnectionPolicy, outboxPolicy outbox.Policy, circuitPolicy circuitbreaker.Policy, trafficPolicy traffic.Policy) {
 	startTimeUnix := time.Now().Unix()
 	//////////////          Managerブローカへ接続する           //////////////
-	managerBroker := fmt.Sprintf("tcp://%v:%v", managerMB.Host, managerMB.Port)
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(managerBroker)
+	opts, err := credentials.NewClientOptions(managerMB)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("MQTT client options error")
+	}
 
 	// Managerブローカへ接続
-	managerClient := mqtt.NewClient(opts)
+	managerClient := mqttv5.NewClientFor(managerMB, opts)
 	if token := managerClient.Connect(); token.Wait() && token.Error() != nil {
 		log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT connect error")
 	}
 	defer managerClient.Disconnect(1000)
-	log.WithFields(log.Fields{"host": managerMB.Host, "port": managerMB.Port}).Info("Connected manager broker")
+	log.WithFields(log.Fields{"url": managerMB.URL()}).Info("Connected manager broker")
 
 	//////////////        ゲートウェイブローカへ接続する         //////////////
-	gatewayBroker := fmt.Sprintf("tcp://%v:%v", gatewayMB.Host, gatewayMB.Port)
-	opts = mqtt.NewClientOptions()
-	opts.AddBroker(gatewayBroker)
+	opts, err = credentials.NewClientOptions(gatewayMB)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("MQTT client options error")
+	}
 
 	// ゲートウェイブローカへ接続
-	gatewayClient := mqtt.NewClient(opts)
+	gatewayClient := mqttv5.NewClientFor(gatewayMB, opts)
 	if token := gatewayClient.Connect(); token.Wait() && token.Error() != nil {
 		log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT connect error")
 	}
 	defer gatewayClient.Disconnect(1000)
-	log.WithFields(log.Fields{"host": gatewayMB.Host, "port": gatewayMB.Port}).Info("Connected gateway broker")
+	log.WithFields(log.Fields{"url": gatewayMB.URL()}).Info("Connected gateway broker")
 
 	//////////////        メッセージハンドラの作成・登録         //////////////
 
@@ -121,7 +171,8 @@ func Gateway(gatewayMB, managerMB BrokerInfo) {
 	var apiForwardMsgFunc mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
 		apiMsgForwardToDistributedBrokerCh <- msg
 	}
-	if token := gatewayClient.Subscribe("/forward/#", 0, apiForwardMsgFunc); token.Wait() && token.Error() != nil {
+	// NOTE: 複数のワーカで分担している場合は、共有サブスクリプション（$share）とする場合がある
+	if token := gatewayClient.Subscribe(worker.ForwardTopic(), 0, apiForwardMsgFunc); token.Wait() && token.Error() != nil {
 		log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT subscribe error")
 	}
 
@@ -135,34 +186,79 @@ func Gateway(gatewayMB, managerMB BrokerInfo) {
 	apiMsgForwardToGatewayBrokerCh := make(chan mqtt.Message, 100)
 	bp := brokerpool.NewBrokerPool(0, apiMsgForwardToGatewayBrokerCh)
 	defer bp.CloseAllBroker(100)
+	if err := bp.SetAggregationPolicy(aggregationPolicy); err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Invalid aggregation policy")
+	}
+	bp.SetPublishQuorum(publishQuorum)
+	bp.SetCredentialStore(credentials)
+	if err := bp.SetConnectionPolicy(connectionPolicy); err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Invalid connection policy")
+	}
+	if err := bp.SetOutboxPolicy(outboxPolicy); err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Invalid outbox policy")
+	}
+	if err := bp.SetCircuitPolicy(circuitPolicy); err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Invalid circuit policy")
+	}
 
-	// 分散ブローカ接続情報管理オブジェクト
-	rootNode := &brokertable.Node{}
+	// レプリカセットのフェイルオーバー・保持したメッセージの再送・使用されていない分散ブローカとの接続の切断を確認するためのタイマ
+	failoverTicker := time.NewTicker(time.Second)
 
-	// 統計データを格納する変数
-	apiRegisterMsgMetrics := metrics.NewMetrics("API_register_message")
-	apiUnregisterMsgMetrics := metrics.NewMetrics("API_unregister_message")
-	apiMsgForwardToGatewayBrokerMetrics := metrics.NewMetrics("Forward_to_gateway_broker")
-	apiMsgForwardToDistributedBrokerMetrics := metrics.NewMetrics("Forward_to_distributed_broker")
+	// 分散ブローカ接続情報管理オブジェクト
+	// NOTE: 参照時は table.Load() でスナップショットを取得し、更新時は table.Update() で差し替える
+	table := brokertable.NewTable()
+
+	// /metrics で公開するメトリクス
+	gm := newGatewayMetrics(metrics.Default, bp, table, map[string]chan mqtt.Message{
+		"brokertable_all_info":      brokertableAllInfoMsgCh,
+		"brokertable_update_status": brokertableUpdateStatusMsgCh,
+		"register":                  apiRegisterMsgCh,
+		"unregister":                apiUnregisterMsgCh,
+		"forward_to_gateway":        apiMsgForwardToGatewayBrokerCh,
+		"forward_to_distributed":    apiMsgForwardToDistributedBrokerCh,
+	})
+	// 統計データを格納する変数（/metrics で公開するカウンタを、ログに出力する名前で参照する）
+	apiRegisterMsgMetrics := metrics.NewMetricsFor("API_register_message", gm.apiRequests.With("register"))
+	apiUnregisterMsgMetrics := metrics.NewMetricsFor("API_unregister_message", gm.apiRequests.With("unregister"))
+	apiMsgForwardToGatewayBrokerMetrics := metrics.NewMetricsFor("Forward_to_gateway_broker", gm.forwards.With(directionToGateway))
+	apiMsgForwardToDistributedBrokerMetrics := metrics.NewMetricsFor("Forward_to_distributed_broker", gm.forwards.With(directionToDistributed))
+	apiMsgFallbackToAncestorBrokerMetrics := metrics.NewMetricsFor("Fallback_to_ancestor_broker", gm.fallbacks)
 	metricsTicker := time.NewTicker(time.Minute)
 	metricsList := []*metrics.Metrics{
 		apiRegisterMsgMetrics,
 		apiUnregisterMsgMetrics,
 		apiMsgForwardToGatewayBrokerMetrics,
 		apiMsgForwardToDistributedBrokerMetrics,
+		apiMsgFallbackToAncestorBrokerMetrics,
 	}
 
 	// brokertable 更新関連の変数
 	brokertableVersion := -1
 	var newDistributedBrokerInfo DistributedBrokerInfo
 	isUpdatedBrokerInfo := false
+	// ブローカテーブルから削除された分散ブローカ（担当範囲を親ノードへ戻す）
+	var removedDistributedBrokerInfo DistributedBrokerInfo
+	isRemovedBrokerInfo := false
+	// 最後に受け取ったブローカテーブル（削除された分散ブローカを調べるため）
+	var distributedBrokers []DistributedBrokerInfo
 	isStarted := false // 分散ブローカ情報の取得が完了したかどうか
+	// brokerpool へ追加済みの分散ブローカ（"host:port"）
+	// NOTE: 接続を管理している場合は、追加済みでも brokerpool に存在しない（接続していない）場合があるため、brokerpool とは別に記録する
+	knownBrokers := map[string]bool{}
+
+	// タイル（トピックの先頭 trafficPolicy.Depth レベル）ごとの統計を取り、定期的にマネージャへ通知する
+	trafficCounter := traffic.NewCounter(trafficPolicy.Depth)
+	var trafficReportCh <-chan time.Time // 統計を取らない場合は nil（受信しない）
+	if trafficPolicy.IsEnabled() {
+		trafficReportTicker := time.NewTicker(trafficPolicy.ReportInterval)
+		defer trafficReportTicker.Stop()
+		trafficReportCh = trafficReportTicker.C
+	}
+	lastTrafficReport := time.Now()
+
 	// Manager へ自分の情報を通知する
 	// TODO: 自分が死んだとき用のメッセージの設定をする(will)
-	msg := fmt.Sprintf(`{"broker_info":{"host":"%v","port":%v},"status":"%v", "version": %v}`, gatewayMB.Host, gatewayMB.Port, "up", brokertableVersion)
-	if token := managerClient.Publish("/api/notice/gatewaybroker", 1, false, msg); token.Wait() && token.Error() != nil {
-		log.WithFields(log.Fields{"error": token.Error()}).Fatal("Notify to manager")
-	}
+	noticeGatewayStatus(managerClient, gatewayMB, worker, "up", brokertableVersion)
 	for {
 		select {
 		// brokertable の全ての情報を受け取るチャンネル
@@ -174,32 +270,68 @@ func Gateway(gatewayMB, managerMB BrokerInfo) {
 			}
 			brokertableInfo := allDistributedBroker.DMBs
 			brokertableVersion = allDistributedBroker.Version
+			previousBrokers := distributedBrokers
+			distributedBrokers = brokertableInfo
+
+			// 分散ブローカへ接続する際の URL スキーム等を登録する
+			for _, info := range brokertableInfo {
+				if err := bp.RegisterEndpoint(info.BrokerInfo); err != nil {
+					log.WithFields(log.Fields{"topic": info.Topic, "broker_info": info.BrokerInfo, "error": err}).Error("Invalid distributed broker endpoint (brokertableAllInfoMsgCh)")
+				}
+			}
 
 			if isStarted {
+				// 分散ブローカの削除は、全てのゲートウェイが新しいブローカテーブルを受け取ってから行う
+				// NOTE: マネージャは 1 つのバージョンで 1 つの分散ブローカのみを追加・削除する
+				if removed, ok := findRemovedBroker(previousBrokers, brokertableInfo); ok {
+					removedDistributedBrokerInfo = removed
+					isRemovedBrokerInfo = true
+					noticeGatewayStatus(managerClient, gatewayMB, worker, "complete", brokertableVersion)
+					log.WithFields(log.Fields{"removedDistributedBrokerInfo": removed}).Info("Distributed broker will be removed (brokertableAllInfoMsgCh)")
+					continue
+				}
+				var newReplicaInfo *DistributedBrokerInfo
 				for _, info := range brokertableInfo {
-					_, err := bp.GetBroker(info.BrokerInfo.Host, info.BrokerInfo.Port)
-					if err != nil && reflect.ValueOf(err).Type() == reflect.ValueOf(brokerpool.NotFoundError{}).Type() {
+					if !knownBrokers[info.BrokerInfo.Address()] {
+						if info.Role == RoleReplica {
+							// レプリカとして追加済みかどうかを確認する
+							if _, err := bp.LookupReplica(info.BrokerInfo.Host, info.BrokerInfo.Port); err == nil {
+								continue
+							}
+							info := info
+							newReplicaInfo = &info
+							break
+						}
 						newDistributedBrokerInfo = info
 						isUpdatedBrokerInfo = true
 						break
-					} else if err != nil {
-						log.WithFields(log.Fields{"err": err}).Fatal("Init gateway (brokertableAllInfoMsgCh)")
 					}
 				}
+
+				// レプリカの追加は、担当するトピックが変わらないため brokertable の更新状態を待たずに完了する
+				if newReplicaInfo != nil {
+					if err := addReplica(bp, table, brokertableVersion, *newReplicaInfo); err != nil {
+						log.WithFields(log.Fields{"topic": newReplicaInfo.Topic, "error": err}).Fatal("Brokertable Update error (brokertableAllInfoMsgCh, AddReplica)")
+					}
+					noticeGatewayStatus(managerClient, gatewayMB, worker, "complete", brokertableVersion)
+					log.WithFields(log.Fields{
+						"brokertable":    fmt.Sprint(table.Load()),
+						"newReplicaInfo": *newReplicaInfo,
+					}).Info("Brokerpool Update complete (brokertableAllInfoMsgCh, AddReplica)")
+					continue
+				}
 				if !isUpdatedBrokerInfo {
 					continue
 				}
 				// Broker を追加・接続・Subscribe
-				err := bp.AddSubsetBroker(newDistributedBrokerInfo.BrokerInfo.Host, newDistributedBrokerInfo.BrokerInfo.Port, newDistributedBrokerInfo.Topic, rootNode)
+				err := bp.AddSubsetBroker(newDistributedBrokerInfo.BrokerInfo.Host, newDistributedBrokerInfo.BrokerInfo.Port, newDistributedBrokerInfo.Topic, table.Load().Root())
 				if err != nil {
 					log.WithFields(log.Fields{"topic": newDistributedBrokerInfo.Topic, "error": err}).Fatal("Brokertable Update error (brokertableUpdateInfoMsgCh, AddSubsetBroker)")
 				}
-				msg := fmt.Sprintf(`{"broker_info":{"host":"%v","port":%v},"status":"%v", "version": %v}`, gatewayMB.Host, gatewayMB.Port, "complete", brokertableVersion)
-				if token := managerClient.Publish("/api/notice/gatewaybroker", 1, false, msg); token.Wait() && token.Error() != nil {
-					log.WithFields(log.Fields{"error": token.Error()}).Fatal("Notify to manager")
-				}
+				knownBrokers[newDistributedBrokerInfo.BrokerInfo.Address()] = true
+				noticeGatewayStatus(managerClient, gatewayMB, worker, "complete", brokertableVersion)
 				log.WithFields(log.Fields{
-					"rootNode":                 fmt.Sprint(rootNode),
+					"brokertable":              fmt.Sprint(table.Load()),
 					"newDistributedBrokerInfo": newDistributedBrokerInfo,
 				}).Info("Brokerpool Update complete (brokertableUpdateInfoMsgCh)")
 				continue
@@ -211,46 +343,47 @@ func Gateway(gatewayMB, managerMB BrokerInfo) {
 				continue
 			}
 			info := brokertableInfo[0]
-			err := brokertable.UpdateHost(rootNode, info.Topic, info.BrokerInfo.Host, info.BrokerInfo.Port)
+			err := table.UpdateHost(brokertableVersion, info.Topic, info.BrokerInfo.Host, info.BrokerInfo.Port)
 			if err != nil {
 				log.WithFields(log.Fields{"topic": info.Topic, "error": err}).Fatal("Brokertable Update error (brokertableAllInfoMsgCh, Add root distributed broker)")
 			}
-			bp.ConnectBroker(info.BrokerInfo.Host, info.BrokerInfo.Port)
+			// NOTE: 遅延接続の場合は、最初に使用する際に接続する
+			if !connectionPolicy.Lazy {
+				bp.ConnectBroker(info.BrokerInfo.Host, info.BrokerInfo.Port)
+			}
+			knownBrokers[info.BrokerInfo.Address()] = true
 
 			// brokertable, brokerpool の更新作業を一度に行う
 			for _, info := range brokertableInfo[1:] {
+				if info.Role == RoleReplica {
+					if err := addReplica(bp, table, brokertableVersion, info); err != nil {
+						log.WithFields(log.Fields{"topic": info.Topic, "error": err}).Fatal("Brokertable Update error (brokertableAllInfoMsgCh, AddReplica)")
+					}
+					continue
+				}
 				// Broker を追加・接続・Subscribe
-				err := bp.AddSubsetBroker(info.BrokerInfo.Host, info.BrokerInfo.Port, info.Topic, rootNode)
+				err := bp.AddSubsetBroker(info.BrokerInfo.Host, info.BrokerInfo.Port, info.Topic, table.Load().Root())
 				if err != nil {
 					log.WithFields(log.Fields{"topic": info.Topic, "error": err}).Fatal("Brokertable Update error (brokertableAllInfoMsgCh, AddSubsetBroker)")
 				}
-				hosts, err := brokertable.LookupSubsetHosts(rootNode, info.Topic)
+				knownBrokers[info.BrokerInfo.Address()] = true
+				// Unsubscribe・Subscriber 数の引継ぎ
+				err = bp.UnsubscribeSubsetTopics(info.BrokerInfo.Host, info.BrokerInfo.Port, info.Topic, table.Load().Root())
 				if err != nil {
-					log.WithFields(log.Fields{"topic": info.Topic, "error": err}).Fatal("Brokertable Lookup error (brokertableAllInfoMsgCh, LookupSubsetHosts)")
-				}
-				// Unsubscribe
-				for _, h := range hosts {
-					b, err := bp.GetBroker(h.Host, h.Port)
-					if err != nil {
-						log.WithFields(log.Fields{"error": err}).Debug("brokerpool.GetBroker() error (brokertableAllInfoMsgCh)")
-						continue
-					}
-					b.UnsubscribeSubsetTopics(info.Topic)
+					log.WithFields(log.Fields{"topic": info.Topic, "error": err}).Error("Brokerpool Update error (brokertableAllInfoMsgCh, UnsubscribeSubsetTopics)")
 				}
-				// brokertable の更新
-				err = brokertable.UpdateHost(rootNode, info.Topic, info.BrokerInfo.Host, info.BrokerInfo.Port)
+				// brokertable の更新（より深いレベルの分散ブローカはそのまま残すため、更新の順序に依存しない）
+				changed, err := table.ReassignHost(brokertableVersion, info.Topic, info.BrokerInfo.Host, info.BrokerInfo.Port)
 				if err != nil {
 					log.WithFields(log.Fields{
-						"rootNode": fmt.Sprint(rootNode),
-						"info":     info,
-						"error":    err,
-					}).Fatal("Brokertable Update error (brokertableAllInfoMsgCh, UpdateHost)")
+						"brokertable": fmt.Sprint(table.Load()),
+						"info":        info,
+						"error":       err,
+					}).Fatal("Brokertable Update error (brokertableAllInfoMsgCh, ReassignHost)")
 				}
+				log.WithFields(log.Fields{"info": info, "changed": changed}).Debug("Reassigned topics (brokertableAllInfoMsgCh)")
 			}
-			msg := fmt.Sprintf(`{"broker_info":{"host":"%v","port":%v},"status":"%v", "version": %v}`, gatewayMB.Host, gatewayMB.Port, "complete", brokertableVersion)
-			if token := managerClient.Publish("/api/notice/gatewaybroker", 1, false, msg); token.Wait() && token.Error() != nil {
-				log.WithFields(log.Fields{"error": token.Error()}).Fatal("Notify to manager")
-			}
+			noticeGatewayStatus(managerClient, gatewayMB, worker, "complete", brokertableVersion)
 			isStarted = true
 			log.Info("Gateway started!!!!")
 
@@ -261,43 +394,60 @@ func Gateway(gatewayMB, managerMB BrokerInfo) {
 				log.WithFields(log.Fields{"payload": string(m.Payload())}).Info("Ignored this message (not complete start sequence)")
 				continue
 			}
-			if !isUpdatedBrokerInfo {
+			// NOTE: マネージャは、全てのゲートウェイ（ワーカ）が更新状態を処理したこと（"applied"）を確認してから次のバージョンを通知する
+			// 新しいブローカテーブルと更新状態は別々のチャンネルで受け取るため、処理する前に次のバージョンを受け取らないようにする
+			if !isUpdatedBrokerInfo && !isRemovedBrokerInfo {
 				log.WithFields(log.Fields{"isUpdatedBrokerInfo": isUpdatedBrokerInfo, "message": string(m.Payload())}).Info("There is no updating info...")
+				noticeGatewayStatus(managerClient, gatewayMB, worker, "applied", brokertableVersion)
 				continue
 			}
 			if string(m.Payload()) != "complete" {
-				log.WithFields(log.Fields{"isUpdatedBrokerInfo": isUpdatedBrokerInfo, "message": string(m.Payload())}).Error("Brokertable Update error (brokertableUpdateStatusMsgCh)")
+				log.WithFields(log.Fields{"isUpdatedBrokerInfo": isUpdatedBrokerInfo, "isRemovedBrokerInfo": isRemovedBrokerInfo, "message": string(m.Payload())}).Error("Brokertable Update error (brokertableUpdateStatusMsgCh)")
 				continue
 			}
-			hosts, err := brokertable.LookupSubsetHosts(rootNode, newDistributedBrokerInfo.Topic)
-			if err != nil {
-				log.WithFields(log.Fields{"topic": newDistributedBrokerInfo.Topic, "error": err}).Fatal("Brokertable Lookup error (brokertableUpdateStatusMsgCh, LookupSubsetHosts)")
-			}
-
-			// Unsubscribe
-			for _, h := range hosts {
-				b, err := bp.GetBroker(h.Host, h.Port)
+			if isRemovedBrokerInfo {
+				// Subscriber の引継ぎ・brokertable の更新・切断
+				changed, err := removeDistributedBroker(bp, table, brokertableVersion, removedDistributedBrokerInfo)
 				if err != nil {
-					log.WithFields(log.Fields{"error": err}).Debug("brokerpool.GetBroker() error (brokertableUpdateStatusMsgCh)")
-					continue
+					log.WithFields(log.Fields{
+						"brokertable":                  fmt.Sprint(table.Load()),
+						"removedDistributedBrokerInfo": removedDistributedBrokerInfo,
+						"error":                        err,
+					}).Fatal("Brokertable Update error (brokertableUpdateStatusMsgCh, RemoveNode)")
 				}
-				b.UnsubscribeSubsetTopics(newDistributedBrokerInfo.Topic)
+				delete(knownBrokers, removedDistributedBrokerInfo.BrokerInfo.Address())
+				isRemovedBrokerInfo = false
+				log.WithFields(log.Fields{
+					"brokertable":                  fmt.Sprint(table.Load()),
+					"changed":                      changed,
+					"removedDistributedBrokerInfo": removedDistributedBrokerInfo,
+				}).Info("Brokertable Update complete (brokertableUpdateStatusMsgCh, RemoveNode)")
+				// Subscriber の引継ぎ・切断が完了したため、マネージャは削除した分散ブローカを予備へ戻すことができる
+				noticeGatewayStatus(managerClient, gatewayMB, worker, "applied", brokertableVersion)
+				continue
+			}
+			// Unsubscribe・Subscriber 数の引継ぎ
+			err := bp.UnsubscribeSubsetTopics(newDistributedBrokerInfo.BrokerInfo.Host, newDistributedBrokerInfo.BrokerInfo.Port, newDistributedBrokerInfo.Topic, table.Load().Root())
+			if err != nil {
+				log.WithFields(log.Fields{"topic": newDistributedBrokerInfo.Topic, "error": err}).Error("Brokerpool Update error (brokertableUpdateStatusMsgCh, UnsubscribeSubsetTopics)")
 			}
 
-			// brokertable の更新
-			err = brokertable.UpdateHost(rootNode, newDistributedBrokerInfo.Topic, newDistributedBrokerInfo.BrokerInfo.Host, newDistributedBrokerInfo.BrokerInfo.Port)
+			// brokertable の更新（より深いレベルの分散ブローカはそのまま残す）
+			changed, err := table.ReassignHost(brokertableVersion, newDistributedBrokerInfo.Topic, newDistributedBrokerInfo.BrokerInfo.Host, newDistributedBrokerInfo.BrokerInfo.Port)
 			if err != nil {
 				log.WithFields(log.Fields{
-					"rootNode":                 fmt.Sprint(rootNode),
+					"brokertable":              fmt.Sprint(table.Load()),
 					"newDistributedBrokerInfo": newDistributedBrokerInfo,
 					"error":                    err,
-				}).Fatal("Brokertable Update error (brokertableUpdateStatusMsgCh, UpdateHost)")
+				}).Fatal("Brokertable Update error (brokertableUpdateStatusMsgCh, ReassignHost)")
 			}
 			isUpdatedBrokerInfo = false
 			log.WithFields(log.Fields{
-				"rootNode":                 fmt.Sprint(rootNode),
+				"brokertable":              fmt.Sprint(table.Load()),
+				"changed":                  changed,
 				"newDistributedBrokerInfo": newDistributedBrokerInfo,
 			}).Info("Brokertable Update complete (brokertableUpdateStatusMsgCh)")
+			noticeGatewayStatus(managerClient, gatewayMB, worker, "applied", brokertableVersion)
 
 		// // Gateway の担当エリア情報を受け取る
 		// case m := <-gatewayAreaInfoMsgCh:
@@ -305,25 +455,46 @@ func Gateway(gatewayMB, managerMB BrokerInfo) {
 
 		// Client からの Subscribe リクエストを処理する
 		case m := <-apiRegisterMsgCh:
-			apiRegisterMsgMetrics.Countup()
 			if !isStarted {
 				log.WithFields(log.Fields{"payload": string(m.Payload())}).Info("Ignored this message (not complete start sequence)")
 				continue
 			}
 			topic := string(m.Payload())
-			editedTopic := strings.Replace(topic, "/#", "", 1)
-			log.WithFields(log.Fields{"topic": editedTopic}).Trace("apiRegisterMsgCh")
-			host, port, err := brokertable.LookupHost(rootNode, editedTopic)
-			if err != nil {
-				log.WithFields(log.Fields{"topic": topic, "error": err}).Error("Brokertable LookupHost error")
+			// 他のワーカが担当するトピックは処理しない
+			if !worker.Owns(topic) {
 				continue
 			}
-			b, err := bp.GetBroker(host, port)
+			if log.IsLevelEnabled(log.TraceLevel) {
+				log.WithFields(log.Fields{"topic": topic}).Trace("apiRegisterMsgCh")
+			}
+			apiRegisterMsgMetrics.Countup()
+			snapshot := table.Load()
+			hosts, err := lookupRegisterHosts(snapshot, topic)
 			if err != nil {
-				log.WithFields(log.Fields{"host": host, "port": port, "error": err, "broker_table": fmt.Sprint(rootNode)}).Error("Brokerpool GetBroker error")
+				log.WithFields(log.Fields{"topic": topic, "error": err}).Error("Brokertable LookupHost error")
+				if worker.Responds(topic) {
+					respondRegisterResult(gatewayClient, m, topic, err)
+				}
 				continue
 			}
-			b.Subscribe(topic)
+			var registerErr error
+			for _, h := range hosts {
+				b, err := bp.GetOrConnectBroker(h.Host, h.Port)
+				if err != nil {
+					log.WithFields(log.Fields{"host": h.Host, "port": h.Port, "error": err, "broker_table": fmt.Sprint(snapshot)}).Error("Brokerpool GetOrConnectBroker error")
+					registerErr = err
+					continue
+				}
+				// NOTE: MQTT v5 で接続している分散ブローカが Subscribe を拒否した場合は、mqttv5.SubscribeError（理由コード付き）が返される
+				if err := b.Subscribe(topic); err != nil {
+					log.WithFields(log.Fields{"host": h.Host, "port": h.Port, "topic": topic, "error": err}).Error("Broker Subscribe error")
+					registerErr = err
+				}
+			}
+			// 複数のパーティションにまたがるトピックは全てのワーカが処理するため、1 つのワーカのみが応答する
+			if worker.Responds(topic) {
+				respondRegisterResult(gatewayClient, m, topic, registerErr)
+			}
 
 		// Client からの Unsubscribe リクエストを処理する
 		case m := <-apiUnregisterMsgCh:
@@ -332,20 +503,30 @@ func Gateway(gatewayMB, managerMB BrokerInfo) {
 				log.WithFields(log.Fields{"payload": string(m.Payload())}).Info("Ignored this message (not complete start sequence)")
 				continue
 			}
-			editedTopic := strings.Replace(topic, "/#", "", 1)
-			log.WithFields(log.Fields{"topic": editedTopic}).Trace("apiUnregisterMsgCh")
+			// 他のワーカが担当するトピックは処理しない
+			if !worker.Owns(topic) {
+				continue
+			}
+			if log.IsLevelEnabled(log.TraceLevel) {
+				log.WithFields(log.Fields{"topic": topic}).Trace("apiUnregisterMsgCh")
+			}
 			apiUnregisterMsgMetrics.Countup()
-			host, port, err := brokertable.LookupHost(rootNode, editedTopic)
+			snapshot := table.Load()
+			hosts, err := lookupRegisterHosts(snapshot, topic)
 			if err != nil {
 				log.WithFields(log.Fields{"topic": topic, "error": err}).Error("Brokertable LookupHost error")
 				continue
 			}
-			b, err := bp.GetOrConnectBroker(host, port)
-			if err != nil {
-				log.WithFields(log.Fields{"host": host, "port": port, "error": err, "broker_table": fmt.Sprint(rootNode)}).Error("Brokerpool GetOrConnectBroker error")
-				continue
+			for _, h := range hosts {
+				b, err := bp.GetOrConnectBroker(h.Host, h.Port)
+				if err != nil {
+					log.WithFields(log.Fields{"host": h.Host, "port": h.Port, "error": err, "broker_table": fmt.Sprint(snapshot)}).Error("Brokerpool GetOrConnectBroker error")
+					continue
+				}
+				if err := b.Unsubscribe(topic); err != nil {
+					log.WithFields(log.Fields{"host": h.Host, "port": h.Port, "topic": topic, "error": err}).Error("Broker Unsubscribe error")
+				}
 			}
-			b.Unsubscribe(topic)
 
 		// 分散ブローカ ==> このプログラム ==> ゲートウェイブローカへ転送する
 		case m := <-apiMsgForwardToGatewayBrokerCh:
@@ -354,10 +535,20 @@ func Gateway(gatewayMB, managerMB BrokerInfo) {
 				log.WithFields(log.Fields{"payload": string(m.Payload())}).Info("Ignored this message (not complete start sequence)")
 				continue
 			}
-			log.WithFields(log.Fields{"topic": m.Topic(), "payload": string(m.Payload())}).Trace("apiMsgForwardToGatewayBrokerCh")
-			if token := gatewayClient.Publish(m.Topic(), 0, false, m.Payload()); token.Wait() && token.Error() != nil {
+			// 複数のパーティションにまたがるトピックは全てのワーカが Subscribe しているため、他のワーカが担当するメッセージは転送しない
+			if !worker.Owns(m.Topic()) {
+				continue
+			}
+			if log.IsLevelEnabled(log.TraceLevel) {
+				log.WithFields(log.Fields{"topic": m.Topic(), "payload": string(m.Payload())}).Trace("apiMsgForwardToGatewayBrokerCh")
+			}
+			trafficCounter.CountDelivery(m.Topic())
+			start := time.Now()
+			// MQTT v5 のプロパティ（ユーザプロパティ、Message Expiry など）を引き継ぐ
+			if token := gatewayClient.Publish(m.Topic(), 0, false, mqttv5.PayloadFor(gatewayClient, mqttv5.NewPublication(m))); token.Wait() && token.Error() != nil {
 				log.WithFields(log.Fields{"topic": m.Topic(), "error": token.Error()}).Error("apiMsgForwardToGatewayBrokerCh")
 			}
+			gm.publishDuration.With(directionToGateway).ObserveSince(start)
 
 		// ゲートウェイブローカ ==> このプログラム ==> 当該分散ブローカへ転送する
 		case m := <-apiMsgForwardToDistributedBrokerCh:
@@ -366,43 +557,61 @@ func Gateway(gatewayMB, managerMB BrokerInfo) {
 				log.WithFields(log.Fields{"payload": string(m.Payload())}).Info("Ignored this message (not complete start sequence)")
 				continue
 			}
-			log.WithFields(log.Fields{"topic": m.Topic(), "payload": string(m.Payload())}).Trace("apiMsgForwardToDistributedBrokerCh")
-			topic := strings.Replace(m.Topic(), "/forward", "", 1)
-			host, port, err := brokertable.LookupHost(rootNode, topic)
-			if err != nil {
-				log.WithFields(log.Fields{"topic": topic, "error": err}).Error("Brokertable LookupHost error")
+			if log.IsLevelEnabled(log.TraceLevel) {
+				log.WithFields(log.Fields{"topic": m.Topic(), "payload": string(m.Payload())}).Trace("apiMsgForwardToDistributedBrokerCh")
+			}
+			topic := strings.TrimPrefix(m.Topic(), "/forward")
+			// 他のワーカが転送するメッセージは転送しない
+			if !worker.OwnsForward(topic) {
 				continue
 			}
-			b, err := bp.GetBroker(host, port)
+			trafficCounter.CountPublish(topic)
+			snapshot := table.Load()
+			// 担当している分散ブローカのサーキットブレーカが開いている場合は、祖先ノードの分散ブローカへ転送する
+			b, fallback, err := bp.LookupPublishBroker(snapshot, topic)
 			if err != nil {
-				log.WithFields(log.Fields{"host": host, "port": port, "error": err, "broker_table": fmt.Sprint(rootNode)}).Error("Brokerpool GetBroker error")
+				log.WithFields(log.Fields{"topic": topic, "error": err, "broker_table": fmt.Sprint(snapshot)}).Error("Brokerpool LookupPublishBroker error")
 				continue
 			}
-			b.Publish(topic, false, m.Payload())
+			if fallback {
+				apiMsgFallbackToAncestorBrokerMetrics.Countup()
+			}
+			start := time.Now()
+			// MQTT v5 のプロパティ（ユーザプロパティ、Message Expiry など）を引き継ぐ
+			b.Publish(topic, false, mqttv5.NewPublication(m))
+			gm.publishDuration.With(directionToDistributed).ObserveSince(start)
 
 			// brokertable の更新作業中の場合は、新たな分散ブローカへも転送する
 			if isUpdatedBrokerInfo {
-				if len(topic) >= len(newDistributedBrokerInfo.Topic) {
-					isMatched := true
-					for i, s := range newDistributedBrokerInfo.Topic {
-						if string(topic[i]) != string(s) {
-							isMatched = false
-							break
-						}
-					}
-					if !isMatched {
-						continue
-					}
+				if len(topic) >= len(newDistributedBrokerInfo.Topic) && !strings.HasPrefix(topic, newDistributedBrokerInfo.Topic) {
+					continue
 				}
 				b, err := bp.GetBroker(newDistributedBrokerInfo.BrokerInfo.Host, newDistributedBrokerInfo.BrokerInfo.Port)
 				if err != nil {
-					log.WithFields(log.Fields{"host": host, "port": port, "error": err, "broker_table": fmt.Sprint(rootNode)}).Info("Brokerpool GetBroker error")
+					log.WithFields(log.Fields{"host": newDistributedBrokerInfo.BrokerInfo.Host, "port": newDistributedBrokerInfo.BrokerInfo.Port, "error": err, "broker_table": fmt.Sprint(snapshot)}).Info("Brokerpool GetBroker error")
 					continue
 				}
-				b.Publish(topic, false, m.Payload())
+				b.Publish(topic, false, mqttv5.NewPublication(m))
+			}
+
+		// Subscribe に使用している分散ブローカとの接続が切れたレプリカセットをフェイルオーバーする
+		case <-failoverTicker.C:
+			if !isStarted {
+				continue
 			}
+			bp.FailoverReplicas()
+			bp.ReplayOutboxes()
+			bp.ReapIdleBrokers(100)
+
+		// タイルごとの統計をマネージャへ通知する
+		case now := <-trafficReportCh:
+			reportTraffic(managerClient, gatewayMB, worker, trafficCounter, now.Sub(lastTrafficReport))
+			lastTrafficReport = now
 
 		case <-metricsTicker.C:
+			if isStarted {
+				reportSubscriptions(managerClient, gatewayMB, worker, bp.GetSubscriptions())
+			}
 			passedTimeSecTotal := time.Now().Unix() - startTimeUnix
 			passedTimeHour := passedTimeSecTotal / 3600
 			passedTimeMinutes := (passedTimeSecTotal / 60) % 60
@@ -414,13 +623,30 @@ func Gateway(gatewayMB, managerMB BrokerInfo) {
 				"seconds_total": passedTimeSecTotal,
 			}).Info("Total run time")
 			for _, m := range metricsList {
-				ok, rate, name := m.GetRate()
-				if ok {
-					log.WithFields(log.Fields{"rate": rate, "name": name}).Info("Metrics")
-				} else {
-					log.WithFields(log.Fields{"rate": nil, "name": name}).Debug("Metrics cannot get")
-				}
+				rates := m.Rates()
+				log.WithFields(log.Fields{
+					"name":    m.Name(),
+					"count":   m.Count(),
+					"rate_1s": rates.OneSecond,
+					"rate_1m": rates.OneMinute,
+					"rate_5m": rates.FiveMinutes,
+				}).Info("Metrics")
 			}
+			stats := bp.GetConnectionStats()
+			log.WithFields(log.Fields{
+				"open":      stats.Open,
+				"connects":  stats.Connects,
+				"evictions": stats.Evictions,
+				"reaped":    stats.Reaped,
+			}).Info("Distributed broker connections")
+			outboxStats := bp.GetOutboxStats()
+			log.WithFields(log.Fields{
+				"pending":  outboxStats.Pending,
+				"buffered": outboxStats.Buffered,
+				"replayed": outboxStats.Replayed,
+				"expired":  outboxStats.Expired,
+				"dropped":  outboxStats.Dropped,
+			}).Info("Distributed broker outbox")
 
 		case <-signalCh:
 			log.Info("Interrupt detected.\n")
@@ -428,3 +654,149 @@ func Gateway(gatewayMB, managerMB BrokerInfo) {
 		}
 	}
 }
+
+// lookupRegisterHosts 関数は、Subscribe (Unsubscribe) リクエストのトピックを担当している分散ブローカを返す
+// ワイルドカード ("+", "#") を含むトピックの場合は、マッチし得るトピックを担当している全ての分散ブローカを返す
+func lookupRegisterHosts(snapshot *brokertable.Snapshot, topic string) ([]brokertable.Host, error) {
+	if strings.Contains(topic, "+") || strings.HasSuffix(topic, "#") {
+		return snapshot.LookupMatchingHosts(topic)
+	}
+	host, port, err := snapshot.LookupHost(topic)
+	if err != nil {
+		return nil, err
+	}
+	return []brokertable.Host{{Host: host, Port: port}}, nil
+}
+
+// addReplica 関数は、info.Topic を担当している分散ブローカのレプリカセットへ、info の分散ブローカを追加する
+func addReplica(bp brokerpool.Brokerpool, table *brokertable.Table, version int, info DistributedBrokerInfo) error {
+	host, port, err := table.Load().LookupHost(info.Topic)
+	if err != nil {
+		return err
+	}
+	if err := bp.AddReplica(host, port, info.BrokerInfo.Host, info.BrokerInfo.Port); err != nil {
+		return err
+	}
+	return table.AddReplica(version, info.Topic, info.BrokerInfo.Host, info.BrokerInfo.Port)
+}
+
+// findRemovedBroker 関数は、previous に含まれ、current に含まれない分散ブローカ（レプリカを除く）を返す
+func findRemovedBroker(previous []DistributedBrokerInfo, current []DistributedBrokerInfo) (DistributedBrokerInfo, bool) {
+	exists := map[string]bool{}
+	for _, info := range current {
+		exists[info.Topic+" "+info.BrokerInfo.Address()] = true
+	}
+	for _, info := range previous {
+		if info.Role != RoleReplica && !exists[info.Topic+" "+info.BrokerInfo.Address()] {
+			return info, true
+		}
+	}
+	return DistributedBrokerInfo{}, false
+}
+
+// removeDistributedBroker 関数は、ブローカテーブルから削除された分散ブローカ info の担当範囲を親ノードの分散ブローカへ戻す
+// Subscriber を親ノードの分散ブローカへ引き継いでから brokertable を更新し、info との接続を切断する
+func removeDistributedBroker(bp brokerpool.Brokerpool, table *brokertable.Table, version int, info DistributedBrokerInfo) ([]string, error) {
+	parentHost, parentPort, err := table.Load().LookupHost(parentTopic(info.Topic))
+	if err != nil {
+		return nil, err
+	}
+	if err := bp.MergeSubsetBroker(info.BrokerInfo.Host, info.BrokerInfo.Port, parentHost, parentPort, info.Topic); err != nil {
+		return nil, err
+	}
+	changed, err := table.RemoveNode(version, info.Topic)
+	if err != nil {
+		return nil, err
+	}
+	// NOTE: Subscriber を引き継いだため、Subscriber の有無や最後の Publish からの経過時間によらず切断する
+	// （切断しないと、複製したワイルドカードトピックのメッセージを親ノードの分散ブローカと重複して転送する）
+	bp.DisconnectBroker(info.BrokerInfo.Host, info.BrokerInfo.Port, 100)
+	return changed, nil
+}
+
+// parentTopic 関数は、topic の親ノードのトピックを返す（例: "/0/1" => "/0", "/0" => "/"）
+func parentTopic(topic string) string {
+	i := strings.LastIndex(topic, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return topic[:i]
+}
+
+// noticeGatewayStatus 関数は、Manager へゲートウェイブローカの状態を通知する
+func noticeGatewayStatus(managerClient mqtt.Client, gatewayMB BrokerInfo, worker Worker, status string, version int) {
+	gatewayStatus := GatewayBrokerStatus{Status: status, Version: version, BrokerInfo: gatewayMB}
+	if worker.IsPartitioned() {
+		gatewayStatus.Worker = worker.Index
+		gatewayStatus.Workers = worker.Count
+	}
+	msg, err := json.Marshal(gatewayStatus)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Notify to manager")
+	}
+	if token := managerClient.Publish("/api/notice/gatewaybroker", 1, false, msg); token.Wait() && token.Error() != nil {
+		log.WithFields(log.Fields{"error": token.Error()}).Fatal("Notify to manager")
+	}
+}
+
+// reportTraffic 関数は、前回の通知から interval の間に数えたタイルごとの統計をマネージャへ通知する
+func reportTraffic(managerClient mqtt.Client, gatewayMB BrokerInfo, worker Worker, counter *traffic.Counter, interval time.Duration) {
+	report := traffic.Report{BrokerInfo: gatewayMB, Depth: counter.Depth(), IntervalSeconds: interval.Seconds(), Tiles: counter.Flush()}
+	if worker.IsPartitioned() {
+		report.Worker = worker.Index
+	}
+	msg, err := json.Marshal(report)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Traffic report error")
+		return
+	}
+	// NOTE: 次の通知で最新の統計に置き換わるため、QoS 0 とする
+	if token := managerClient.Publish(traffic.ReportTopic, 0, false, msg); token.Wait() && token.Error() != nil {
+		log.WithFields(log.Fields{"error": token.Error()}).Error("Traffic report error")
+	}
+	log.WithFields(log.Fields{"tiles": len(report.Tiles), "interval": interval}).Debug("Reported traffic to manager")
+}
+
+// reportSubscriptions 関数は、トピックごとの Subscriber 数をマネージャへ通知する
+func reportSubscriptions(managerClient mqtt.Client, gatewayMB BrokerInfo, worker Worker, subscriptions map[string]uint) {
+	report := SubscriptionReport{BrokerInfo: gatewayMB, Subscriptions: subscriptions}
+	if worker.IsPartitioned() {
+		report.Worker = worker.Index
+	}
+	msg, err := json.Marshal(report)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Subscription report error")
+		return
+	}
+	// NOTE: 次の通知で最新の状態に置き換わるため、QoS 0 とする
+	if token := managerClient.Publish("/api/notice/gatewaybroker/subscriptions", 0, false, msg); token.Wait() && token.Error() != nil {
+		log.WithFields(log.Fields{"error": token.Error()}).Error("Subscription report error")
+	}
+	log.WithFields(log.Fields{"topics": len(subscriptions)}).Debug("Reported subscriptions to manager")
+}
+
+// respondRegisterResult 関数は、/api/register の要求 m に MQTT v5 の Response Topic が指定されている場合に、Subscribe の結果を応答する
+func respondRegisterResult(gatewayClient mqtt.Client, m mqtt.Message, topic string, err error) {
+	props := mqttv5.PropertiesOf(m)
+	if props.ResponseTopic == "" {
+		return
+	}
+	result := RegisterResult{Topic: topic}
+	if err != nil {
+		result.ReasonCode = registerReasonUnspecified
+		var se mqttv5.SubscribeError
+		if errors.As(err, &se) && se.ReasonCode >= registerReasonUnspecified {
+			result.ReasonCode = se.ReasonCode
+		}
+		result.Error = err.Error()
+	}
+	msg, err := json.Marshal(result)
+	if err != nil {
+		log.WithFields(log.Fields{"topic": topic, "error": err}).Error("Register result error")
+		return
+	}
+	payload := mqttv5.Publication{Payload: msg, Properties: mqttv5.Properties{ContentType: "application/json", CorrelationData: props.CorrelationData}}
+	if token := gatewayClient.Publish(props.ResponseTopic, 1, false, mqttv5.PayloadFor(gatewayClient, payload)); token.Wait() && token.Error() != nil {
+		log.WithFields(log.Fields{"topic": topic, "response_topic": props.ResponseTopic, "error": token.Error()}).Error("Register result error")
+	}
+}
@@ -7,3 +7,46 @@ import (
 func TestGateway(t *testing.T) {
 	t.Skip("skip gateway...")
 }
+
+func TestFindRemovedBroker(t *testing.T) {
+	root := DistributedBrokerInfo{Topic: "/", BrokerInfo: BrokerInfo{Host: "localhost", Port: 1893}}
+	zero := DistributedBrokerInfo{Topic: "/0", BrokerInfo: BrokerInfo{Host: "localhost", Port: 1894}}
+	replica := DistributedBrokerInfo{Topic: "/0", BrokerInfo: BrokerInfo{Host: "localhost", Port: 1895}, Role: RoleReplica}
+
+	tests := []struct {
+		name     string
+		previous []DistributedBrokerInfo
+		current  []DistributedBrokerInfo
+		want     DistributedBrokerInfo
+		wantOK   bool
+	}{
+		{name: "Normal scenario 01 (removed)", previous: []DistributedBrokerInfo{root, zero}, current: []DistributedBrokerInfo{root}, want: zero, wantOK: true},
+		{name: "Normal scenario 02 (added)", previous: []DistributedBrokerInfo{root}, current: []DistributedBrokerInfo{root, zero}},
+		{name: "Normal scenario 03 (replica is ignored)", previous: []DistributedBrokerInfo{root, zero, replica}, current: []DistributedBrokerInfo{root, zero}},
+		{name: "Normal scenario 04 (first brokertable)", previous: nil, current: []DistributedBrokerInfo{root}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := findRemovedBroker(tt.previous, tt.current)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("findRemovedBroker() = %v, %v, expected %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestParentTopic(t *testing.T) {
+	tests := []struct {
+		topic string
+		want  string
+	}{
+		{topic: "/0/1/2", want: "/0/1"},
+		{topic: "/0", want: "/"},
+		{topic: "/", want: "/"},
+	}
+	for _, tt := range tests {
+		if got := parentTopic(tt.topic); got != tt.want {
+			t.Errorf("parentTopic(%v) = %v, expected %v", tt.topic, got, tt.want)
+		}
+	}
+}
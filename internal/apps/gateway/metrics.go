@@ -0,0 +1,88 @@
+package gateway
+
+import (
+	"gamma/pkg/brokerpool"
+	"gamma/pkg/brokertable"
+	"gamma/pkg/endpoint"
+	"gamma/pkg/metrics"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+//////////////        以下、Metrics 関連             //////////////
+
+// 転送の方向（forwards_total 等の direction ラベルの値）
+const (
+	directionToGateway     = "to_gateway"     // 分散ブローカ ==> ゲートウェイブローカ
+	directionToDistributed = "to_distributed" // ゲートウェイブローカ ==> 分散ブローカ
+)
+
+// gatewayMetrics 構造体は、/metrics で公開するゲートウェイのメトリクス
+type gatewayMetrics struct {
+	apiRequests     *metrics.CounterVec   // api: "register", "unregister"
+	forwards        *metrics.CounterVec   // direction
+	fallbacks       *metrics.Counter      // 祖先ノードの分散ブローカへ代替した数
+	publishDuration *metrics.HistogramVec // direction
+}
+
+// newGatewayMetrics 関数は、ゲートウェイのメトリクスを r へ登録する
+// 分散ブローカとの接続・Subscriber 数・保持しているメッセージ・チャンネルの滞留数は、参照時に bp, table, queues から取得する
+func newGatewayMetrics(r *metrics.Registry, bp brokerpool.Brokerpool, table *brokertable.Table, queues map[string]chan mqtt.Message) *gatewayMetrics {
+	m := &gatewayMetrics{
+		apiRequests:     r.NewCounterVec("gamma_gateway_api_requests_total", "Number of API requests received from clients.", "api"),
+		forwards:        r.NewCounterVec("gamma_gateway_forwards_total", "Number of forwarded messages.", "direction"),
+		fallbacks:       r.NewCounter("gamma_gateway_ancestor_fallbacks_total", "Number of messages forwarded to an ancestor distributed broker because the circuit was open."),
+		publishDuration: r.NewHistogramVec("gamma_gateway_publish_duration_seconds", "Time taken to publish a forwarded message.", nil, "direction"),
+	}
+
+	r.NewGaugeFunc("gamma_gateway_brokertable_version", "Version of the broker table.", nil, func(emit func(float64, ...string)) {
+		emit(float64(table.Load().Version()))
+	})
+	r.NewGaugeFunc("gamma_gateway_queue_depth", "Number of messages waiting in the internal queue.", []string{"queue"}, func(emit func(float64, ...string)) {
+		for name, ch := range queues {
+			emit(float64(len(ch)), name)
+		}
+	})
+
+	r.NewGaugeFunc("gamma_gateway_distributed_brokers_connected", "Number of connected distributed brokers.", nil, func(emit func(float64, ...string)) {
+		emit(float64(bp.GetConnectionStats().Open))
+	})
+	r.NewCounterFunc("gamma_gateway_distributed_broker_disconnects_total", "Number of distributed broker connections closed by the connection policy.", []string{"reason"}, func(emit func(float64, ...string)) {
+		stats := bp.GetConnectionStats()
+		emit(float64(stats.Evictions), "evicted")
+		emit(float64(stats.Reaped), "idle")
+	})
+	r.NewCounterFunc("gamma_gateway_distributed_broker_connects_total", "Number of connections made to distributed brokers.", nil, func(emit func(float64, ...string)) {
+		emit(float64(bp.GetConnectionStats().Connects))
+	})
+	r.NewGaugeFunc("gamma_gateway_subscribers", "Number of subscribers registered on each distributed broker.", []string{"broker"}, func(emit func(float64, ...string)) {
+		for _, s := range bp.GetBrokerStats() {
+			emit(float64(s.Subscribers), brokerLabel(s))
+		}
+	})
+	r.NewGaugeFunc("gamma_gateway_outbox_pending", "Number of messages buffered for each distributed broker.", []string{"broker"}, func(emit func(float64, ...string)) {
+		for _, s := range bp.GetBrokerStats() {
+			emit(float64(s.Pending), brokerLabel(s))
+		}
+	})
+	// NOTE: 切断した分散ブローカの統計は含まないため、切断時に減少する（リセットとして扱われる）
+	r.NewCounterFunc("gamma_gateway_outbox_messages_total", "Number of buffered messages by result.", []string{"result"}, func(emit func(float64, ...string)) {
+		stats := bp.GetOutboxStats()
+		emit(float64(stats.Buffered), "buffered")
+		emit(float64(stats.Replayed), "replayed")
+		emit(float64(stats.Expired), "expired")
+		emit(float64(stats.Dropped), "dropped")
+	})
+	r.NewGaugeFunc("gamma_gateway_circuit_state", "State of the circuit of each distributed broker (0: closed, 1: open, 2: half-open).", []string{"broker"}, func(emit func(float64, ...string)) {
+		for _, s := range bp.GetBrokerStats() {
+			emit(float64(s.Circuit), brokerLabel(s))
+		}
+	})
+	return m
+}
+
+func brokerLabel(s brokerpool.BrokerStats) string {
+	return endpoint.Endpoint{Host: s.Host, Port: s.Port}.Address()
+}
+
+//////////////        以上、Metrics 関連             //////////////
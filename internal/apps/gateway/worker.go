@@ -0,0 +1,149 @@
+package gateway
+
+import (
+	"fmt"
+	"gamma/pkg/topicscheme"
+	"hash/fnv"
+	"strings"
+)
+
+//////////////        以下、Worker 関連              //////////////
+
+// forwardTopic は、ゲートウェイブローカ ==> 分散ブローカへメッセージを転送するためのトピック
+const forwardTopic = "/forward/#"
+
+// defaultPartitionDepth は、Worker.Depth が指定されていない場合に分担に使用するトピックの先頭のレベルの数
+const defaultPartitionDepth = 3
+
+// Worker 構造体は、1 つのゲートウェイブローカを複数のゲートウェイプロセス（ワーカ）で分担する際の、このプロセスの担当を表す
+// トピックの先頭から Depth 個のレベル（ルーティング用トピックの接頭辞）のハッシュ値で担当のワーカを決める（パーティション）
+// ワイルドカードを含むトピック（例: "/0/1/2/#"）と、それにカバーされるトピックは同じ接頭辞を持つため、同じワーカが担当する
+// /api/register, /api/unregister は全てのワーカが受信し、担当となったワーカのみが処理する
+// （分散ブローカへの Subscribe の状態をワーカ間で分割し、分散ブローカからのメッセージを 1 つのワーカのみが転送するため）
+// 接頭辞にワイルドカードを含むトピック（例: "/0/+/2", "/0/#"）は複数のパーティションにまたがるため、全てのワーカが処理し、
+// 分散ブローカから受信したメッセージのうち自身のパーティションのもののみを転送する
+// /forward/# は、SharedGroup が指定されている場合は共有サブスクリプション（$share）で 1 つのワーカにのみ配送させ、
+// 指定されていない場合は全てのワーカが受信し、転送先のトピックの担当となったワーカのみが転送する
+// NOTE: ワーカの数・Depth を変更した場合は、Subscribe の担当が変わるため、全てのワーカを再起動してクライアントに再登録させる必要がある
+type Worker struct {
+	Index       uint   // このワーカの番号（0 〜 Count-1）
+	Count       uint   // ワーカの数（0, 1 の場合は分担しない）
+	SharedGroup string // /forward/# の共有サブスクリプションのグループ名（空の場合はトピックで分担する）
+	Depth       uint   // 分担に使用するトピックの先頭のレベルの数（0 の場合は defaultPartitionDepth）
+}
+
+// IsPartitioned 関数は、複数のワーカで分担しているかどうかを返す
+func (w Worker) IsPartitioned() bool {
+	return w.Count > 1
+}
+
+// Validate 関数は、ワーカの設定が正しいかどうかを検証する
+func (w Worker) Validate() error {
+	if w.Count > 1 && w.Index >= w.Count {
+		return WorkerError{Msg: fmt.Sprintf("Invalid worker index (%v). Index must be less than the number of workers (%v).", w.Index, w.Count)}
+	}
+	if w.Count <= 1 && w.Index != 0 {
+		return WorkerError{Msg: fmt.Sprintf("Invalid worker index (%v). Index must be 0 when the number of workers is %v.", w.Index, w.Count)}
+	}
+	if w.SharedGroup != "" && strings.ContainsAny(w.SharedGroup, "/+#") {
+		return WorkerError{Msg: fmt.Sprintf("Invalid shared subscription group (%v). '/', '+' and '#' are not allowed.", w.SharedGroup)}
+	}
+	return nil
+}
+
+// Owns 関数は、このワーカが topic を担当するかどうか（/api/register, /api/unregister を処理するかどうか、
+// 分散ブローカから受信したメッセージを転送するかどうか）を返す
+// 複数のパーティションにまたがるトピックは、全てのワーカが担当する
+// NOTE: メッセージのトピックはワイルドカードを含まないため、ちょうど 1 つのワーカが担当する
+func (w Worker) Owns(topic string) bool {
+	if !w.IsPartitioned() {
+		return true
+	}
+	key, spanning := partitionKey(topic, w.depth())
+	return spanning || partitionOf(key, w.Count) == w.Index
+}
+
+// Responds 関数は、このワーカが topic の /api/register の結果を応答するかどうかを返す
+// 複数のパーティションにまたがるトピックは全てのワーカが処理するため、ワイルドカードの直前までの接頭辞を担当するワーカのみが応答する
+func (w Worker) Responds(topic string) bool {
+	if !w.IsPartitioned() {
+		return true
+	}
+	key, _ := partitionKey(topic, w.depth())
+	return partitionOf(key, w.Count) == w.Index
+}
+
+// ForwardTopic 関数は、ゲートウェイブローカから転送するメッセージを受信するために Subscribe するトピックを返す
+// NOTE: 共有サブスクリプションは "$share/<グループ名>/<トピックフィルタ>" の形式のため、"/forward/#" の先頭の "/" もそのまま残す
+// （例: "$share/gamma-gateway//forward/#"）
+func (w Worker) ForwardTopic() string {
+	if w.IsPartitioned() && w.SharedGroup != "" {
+		return fmt.Sprintf("$share/%v/%v", w.SharedGroup, forwardTopic)
+	}
+	return forwardTopic
+}
+
+// OwnsForward 関数は、転送先が topic のメッセージをこのワーカが転送するかどうかを返す
+// NOTE: 共有サブスクリプションの場合は、ゲートウェイブローカが 1 つのワーカにのみ配送するため、常に true を返す
+func (w Worker) OwnsForward(topic string) bool {
+	if w.SharedGroup != "" {
+		return true
+	}
+	return w.Owns(topic)
+}
+
+func (w Worker) String() string {
+	if !w.IsPartitioned() {
+		return "single"
+	}
+	return fmt.Sprintf("%v/%v", w.Index, w.Count)
+}
+
+func (w Worker) depth() uint {
+	if w.Depth == 0 {
+		return defaultPartitionDepth
+	}
+	return w.Depth
+}
+
+// partitionKey 関数は、topic の先頭から depth 個のレベル（パーティションの接頭辞）を返す
+// 接頭辞にワイルドカード（"+", "#"）を含む場合は、ワイルドカードの直前までを返し、複数のパーティションにまたがることを表す true を返す
+func partitionKey(topic string, depth uint) (string, bool) {
+	if !strings.HasPrefix(topic, "/") {
+		return topic, false
+	}
+	i := 1
+	for d := uint(0); d < depth && i <= len(topic); d++ {
+		level, next := topicscheme.NextLevel(topic, i)
+		if level == "+" || level == "#" {
+			return topic[:i-1], true
+		}
+		i = next
+	}
+	if i > len(topic) {
+		return topic, false
+	}
+	return topic[:i-1], false
+}
+
+// partitionOf 関数は、接頭辞 key のパーティションを担当するワーカの番号を返す（FNV-1a ハッシュ値の剰余）
+func partitionOf(key string, count uint) uint {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return uint(h.Sum32()) % count
+}
+
+//////////////        以上、Worker 関連              //////////////
+//////////////        以下、エラー 関連              //////////////
+
+// WorkerError 構造体
+// ワーカの設定が不正な場合に返される
+type WorkerError struct {
+	Msg string
+}
+
+func (e WorkerError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+//////////////        以上、エラー 関連              //////////////
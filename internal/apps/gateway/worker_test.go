@@ -0,0 +1,177 @@
+package gateway_test
+
+import (
+	"fmt"
+	"gamma/internal/apps/gateway"
+	"reflect"
+	"testing"
+)
+
+func TestWorkerValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		w    gateway.Worker
+		want error
+	}{
+		{
+			name: "Normal scenario 01 (single worker)",
+			w:    gateway.Worker{},
+			want: nil,
+		},
+		{
+			name: "Normal scenario 02 (shared subscription)",
+			w:    gateway.Worker{Index: 2, Count: 3, SharedGroup: "gamma-gateway"},
+			want: nil,
+		},
+		{
+			name: "Error scenario 01 (index out of range)",
+			w:    gateway.Worker{Index: 3, Count: 3},
+			want: gateway.WorkerError{},
+		},
+		{
+			name: "Error scenario 02 (index without workers)",
+			w:    gateway.Worker{Index: 1, Count: 1},
+			want: gateway.WorkerError{},
+		},
+		{
+			name: "Error scenario 03 (shared group)",
+			w:    gateway.Worker{Index: 0, Count: 2, SharedGroup: "gamma/gateway"},
+			want: gateway.WorkerError{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.w.Validate()
+			if tt.want == nil {
+				if got != nil {
+					t.Errorf("Validate() = %v (Type: %T), expected nil", got, got)
+				}
+			} else if got == nil || reflect.TypeOf(got) != reflect.TypeOf(tt.want) {
+				t.Errorf("Validate() = %v (Type: %T), expected Type: %T", got, got, tt.want)
+			}
+		})
+	}
+}
+
+// 全てのトピックを、ちょうど 1 つのワーカが担当する
+func TestWorkerOwns(t *testing.T) {
+	const count = 4
+	owned := make([]int, count)
+	for i := 0; i < 1000; i++ {
+		topic := fmt.Sprintf("/%v/1/%v/%v", i, i%4, i)
+		owners := 0
+		for index := uint(0); index < count; index++ {
+			if (gateway.Worker{Index: index, Count: count}).Owns(topic) {
+				owners++
+				owned[index]++
+			}
+		}
+		if owners != 1 {
+			t.Fatalf("Owns(%v) is true for %v workers, expected 1", topic, owners)
+		}
+	}
+	for index, n := range owned {
+		if n == 0 {
+			t.Errorf("worker %v owns no topic (owned = %v)", index, owned)
+		}
+	}
+
+	if !(gateway.Worker{}).Owns("/0/1") {
+		t.Errorf("Owns() = false for single worker, expected true")
+	}
+}
+
+// ワイルドカードを含むトピックと、それにカバーされるトピックは同じワーカが担当する
+// 複数のパーティションにまたがるトピックは全てのワーカが担当し、1 つのワーカのみが応答する
+func TestWorkerPartition(t *testing.T) {
+	const count = 4
+	tests := []struct {
+		name     string
+		depth    uint
+		topic    string
+		covered  []string
+		spanning bool
+	}{
+		{name: "Normal scenario 01 (multi level wildcard)", topic: "/0/1/2/#", covered: []string{"/0/1/2", "/0/1/2/3", "/0/1/2/3/0"}},
+		{name: "Normal scenario 02 (single level wildcard)", topic: "/0/1/2/+/1", covered: []string{"/0/1/2/0/1", "/0/1/2/3/1"}},
+		{name: "Normal scenario 03 (trailing word)", topic: "/0/1/2/3/data", covered: []string{"/0/1/2/3/data"}},
+		{name: "Normal scenario 04 (depth)", depth: 2, topic: "/0/1/#", covered: []string{"/0/1/2", "/0/1/3/0"}},
+		{name: "Normal scenario 05 (spanning, single level wildcard)", topic: "/0/+/2", spanning: true},
+		{name: "Normal scenario 06 (spanning, multi level wildcard)", topic: "/0/1/#", spanning: true},
+		{name: "Normal scenario 07 (spanning, root)", topic: "/#", spanning: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			owners, responders := 0, 0
+			for index := uint(0); index < count; index++ {
+				w := gateway.Worker{Index: index, Count: count, Depth: tt.depth}
+				if !w.Owns(tt.topic) {
+					continue
+				}
+				owners++
+				if w.Responds(tt.topic) {
+					responders++
+				}
+				for _, topic := range tt.covered {
+					if !w.Owns(topic) {
+						t.Errorf("Owns(%v) = false for the worker which owns %v", topic, tt.topic)
+					}
+				}
+			}
+			want := 1
+			if tt.spanning {
+				want = count
+			}
+			if owners != want {
+				t.Errorf("Owns(%v) is true for %v workers, expected %v", tt.topic, owners, want)
+			}
+			if responders != 1 {
+				t.Errorf("Responds(%v) is true for %v workers, expected 1", tt.topic, responders)
+			}
+		})
+	}
+}
+
+func TestWorkerForwardTopic(t *testing.T) {
+	tests := []struct {
+		name      string
+		w         gateway.Worker
+		want      string
+		wantOwned bool // 他のワーカが担当するトピックも転送するかどうか
+	}{
+		{
+			name:      "Normal scenario 01 (single worker)",
+			w:         gateway.Worker{SharedGroup: "gamma-gateway"},
+			want:      "/forward/#",
+			wantOwned: true,
+		},
+		{
+			name:      "Normal scenario 02 (shared subscription)",
+			w:         gateway.Worker{Index: 0, Count: 2, SharedGroup: "gamma-gateway"},
+			want:      "$share/gamma-gateway//forward/#",
+			wantOwned: true,
+		},
+		{
+			name:      "Normal scenario 03 (topic hash)",
+			w:         gateway.Worker{Index: 0, Count: 2},
+			want:      "/forward/#",
+			wantOwned: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.w.ForwardTopic(); got != tt.want {
+				t.Errorf("ForwardTopic() = %v, expected %v", got, tt.want)
+			}
+			all := true
+			for i := 0; i < 100; i++ {
+				if !tt.w.OwnsForward(fmt.Sprintf("/0/%v", i)) {
+					all = false
+				}
+			}
+			if all != tt.wantOwned {
+				t.Errorf("OwnsForward() for all topics = %v, expected %v", all, tt.wantOwned)
+			}
+		})
+	}
+}
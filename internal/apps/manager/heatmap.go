@@ -0,0 +1,39 @@
+package manager
+
+import (
+	"gamma/pkg/topicscheme"
+	"gamma/pkg/traffic"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// heatmapTopicPrefix は、Response Topic が指定されていない場合にヒートマップを出力するトピック（末尾に出力形式を付ける）
+const heatmapTopicPrefix = "/api/heatmap/"
+
+// exportHeatmap 関数は、/api/tool/heatmap/export の要求 m に応じて、タイルごとの統計を出力する
+// ペイロードは出力形式（"json", "geojson"。空の場合は "json"）とする
+// MQTT v5 の Response Topic が指定されている場合はそのトピックへ、指定されていない場合は /api/heatmap/<出力形式> へ Publish する
+func exportHeatmap(client mqtt.Client, m mqtt.Message, tiles []traffic.TileRate) {
+	format := strings.TrimSpace(string(m.Payload()))
+	if format == "" {
+		format = traffic.FormatJSON
+	}
+	msg, err := traffic.Export(tiles, format, topicscheme.Current())
+	if err != nil {
+		log.WithFields(log.Fields{"format": format, "error": err}).Error("Heatmap export error")
+		return
+	}
+	contentType := "application/json"
+	if format == traffic.FormatGeoJSON {
+		contentType = "application/geo+json"
+	}
+
+	topic, err := respond(client, m, heatmapTopicPrefix+format, contentType, msg)
+	if err != nil {
+		log.WithFields(log.Fields{"topic": topic, "error": err}).Error("Heatmap export error")
+		return
+	}
+	log.WithFields(log.Fields{"topic": topic, "format": format, "tiles": len(tiles)}).Info("Exported heatmap")
+}
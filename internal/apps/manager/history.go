@@ -0,0 +1,175 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"gamma/pkg/mqttv5"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// 変更の履歴の種類
+const (
+	HistoryKindBrokertable = "brokertable" // ブローカテーブルの更新（バージョンごと）
+	HistoryKindCoverArea   = "cover_area"  // ゲートウェイの担当エリアの変更
+)
+
+// historyLimit は、History 構造体が保持する履歴の最大数（超えた場合は古い履歴から削除する）
+const historyLimit = 1000
+
+// historyClientProperty は、要求の送信元クライアントを表す MQTT v5 のユーザプロパティのキー
+// NOTE: MQTT では Publish した側のクライアント ID を受け取れないため、要求する側で指定する
+const historyClientProperty = "client"
+
+// Origin は、変更の発端となった要求
+// Request は要求を受け取ったトピック（負荷に応じた分割・統合の場合は "autoscale"）、Client は送信元クライアント（不明な場合は空）
+type Origin struct {
+	Request string          `json:"request"`
+	Client  string          `json:"client,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// HistoryEntry は、ブローカテーブルまたはゲートウェイの担当エリアの変更の履歴（変更後の状態を記録する）
+type HistoryEntry struct {
+	Sequence int       `json:"sequence"`
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	Origin
+	Brokertable *AllDistributedBrokerInfo `json:"brokertable,omitempty"`
+	CoverArea   *GatewayBrokerInfo        `json:"cover_area,omitempty"`
+}
+
+// HistoryQuery は、/api/tool/history で取得する履歴の条件（Since より大きい Sequence の履歴、Kind が空の場合は全ての種類）
+// NOTE: 保持する履歴は最新の historyLimit 件のみのため、古い履歴は取得できない（Sequence は削除後も続きから振る）
+type HistoryQuery struct {
+	Since int    `json:"since"`
+	Kind  string `json:"kind,omitempty"`
+}
+
+// History 構造体は、マネージャが行った変更の履歴を最新の limit 件まで記録する
+type History struct {
+	entries  []HistoryEntry
+	sequence int // 最後に記録した履歴の Sequence
+	limit    int
+}
+
+// NewHistory 関数は、空の History 構造体を生成する
+func NewHistory() *History {
+	return &History{entries: []HistoryEntry{}, limit: historyLimit}
+}
+
+// RecordBrokertable 関数は、バージョン list.Version のブローカテーブルを履歴に記録する
+func (h *History) RecordBrokertable(now time.Time, origin Origin, list AllDistributedBrokerInfo) HistoryEntry {
+	snapshot := AllDistributedBrokerInfo{Version: list.Version, DMBs: append([]DistributedBrokerInfo{}, list.DMBs...)}
+	return h.record(HistoryEntry{Time: now, Kind: HistoryKindBrokertable, Origin: origin, Brokertable: &snapshot})
+}
+
+// RecordCoverArea 関数は、変更後のゲートウェイの担当エリアを履歴に記録する
+func (h *History) RecordCoverArea(now time.Time, origin Origin, area GatewayBrokerInfo) HistoryEntry {
+	area.Topics = append([]string{}, area.Topics...)
+	return h.record(HistoryEntry{Time: now, Kind: HistoryKindCoverArea, Origin: origin, CoverArea: &area})
+}
+
+func (h *History) record(e HistoryEntry) HistoryEntry {
+	h.sequence++
+	e.Sequence = h.sequence
+	h.entries = append(h.entries, e)
+	if len(h.entries) > h.limit {
+		n := copy(h.entries, h.entries[len(h.entries)-h.limit:])
+		h.entries = h.entries[:n]
+	}
+	return e
+}
+
+// Entries 関数は、q に一致する履歴を古い順に返す
+func (h *History) Entries(q HistoryQuery) []HistoryEntry {
+	entries := []HistoryEntry{}
+	for _, e := range h.entries {
+		if e.Sequence > q.Since && (q.Kind == "" || e.Kind == q.Kind) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Brokertable 関数は、バージョン version のブローカテーブルを返す（削除された古い履歴の場合は false）
+func (h *History) Brokertable(version int) (AllDistributedBrokerInfo, bool) {
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		if e := h.entries[i]; e.Brokertable != nil && e.Brokertable.Version == version {
+			return *e.Brokertable, true
+		}
+	}
+	return AllDistributedBrokerInfo{}, false
+}
+
+// originOf 関数は、要求 m を変更の発端として返す
+// NOTE: JSON でないペイロードは文字列として記録する
+func originOf(m mqtt.Message) Origin {
+	payload := m.Payload()
+	if !json.Valid(payload) {
+		payload, _ = json.Marshal(string(payload))
+	}
+	return Origin{Request: m.Topic(), Client: mqttv5.PropertiesOf(m).Get(historyClientProperty), Payload: payload}
+}
+
+// autoscaleOrigin 関数は、負荷に応じた分割・統合を変更の発端として返す（Payload は判断の根拠）
+func autoscaleOrigin(reason interface{}) Origin {
+	payload, _ := json.Marshal(reason)
+	return Origin{Request: "autoscale", Payload: payload}
+}
+
+//////////////        以下、ロールバック 関連             //////////////
+
+// RollbackRequest は、/api/tool/rollback で戻すブローカテーブルのバージョン
+type RollbackRequest struct {
+	Version int `json:"version"`
+}
+
+// RollbackResult は、/api/tool/rollback の要求に応答する結果（Steps は 1 バージョンずつ適用する変更）
+type RollbackResult struct {
+	Version int           `json:"version"`
+	Steps   []PlanRequest `json:"steps"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// planRollback 関数は、ブローカテーブルを current から target と同じ分散ブローカの構成へ戻すための変更を、適用する順に返す
+// ゲートウェイは 1 つのバージョンで 1 つの分散ブローカのみを追加・削除するため、変更は 1 つずつ通常の更新手順で適用すること
+// 深いトピックの分散ブローカから削除し、その後 target の順に追加する
+// NOTE: 途中の変更が適用できない場合（レプリカの削除など）はエラーを返す
+func planRollback(current AllDistributedBrokerInfo, target AllDistributedBrokerInfo) ([]PlanRequest, error) {
+	inCurrent := map[string]bool{}
+	for _, info := range current.DMBs {
+		inCurrent[distributedBrokerKey(info)] = true
+	}
+	inTarget := map[string]bool{}
+	for _, info := range target.DMBs {
+		inTarget[distributedBrokerKey(info)] = true
+	}
+
+	steps := []PlanRequest{}
+	// NOTE: current.DMBs はトピックの長さの昇順のため、逆順に削除する
+	for i := len(current.DMBs) - 1; i >= 0; i-- {
+		if info := current.DMBs[i]; !inTarget[distributedBrokerKey(info)] {
+			steps = append(steps, PlanRequest{Action: PlanActionRemove, Broker: info})
+		}
+	}
+	for _, info := range target.DMBs {
+		if !inCurrent[distributedBrokerKey(info)] {
+			steps = append(steps, PlanRequest{Action: PlanActionAdd, Broker: info})
+		}
+	}
+
+	// 全ての変更を適用できることを確認する
+	list := current
+	for _, step := range steps {
+		plan, err := planChange(list, step, nil, nil)
+		if err != nil {
+			return nil, PlanError{Msg: fmt.Sprintf("Could not %v %v (%v): %v", step.Action, step.Broker.BrokerInfo.Address(), step.Broker.Topic, err)}
+		}
+		list = plan.Brokertable
+	}
+	return steps, nil
+}
+
+//////////////        以上、ロールバック 関連             //////////////
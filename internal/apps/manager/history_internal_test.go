@@ -0,0 +1,151 @@
+package manager
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	root := DistributedBrokerInfo{Topic: "/", BrokerInfo: BrokerInfo{Host: "localhost", Port: 1893}}
+	zero := DistributedBrokerInfo{Topic: "/0", BrokerInfo: BrokerInfo{Host: "localhost", Port: 1894}}
+	now := time.Unix(1000000, 0)
+	origin := Origin{Request: "/api/tool/distributedbroker/add", Client: "operator"}
+
+	h := NewHistory()
+	list := AllDistributedBrokerInfo{Version: 0, DMBs: []DistributedBrokerInfo{root}}
+	h.RecordBrokertable(now, origin, list)
+	area := GatewayBrokerInfo{Topics: []string{"/0"}, BrokerInfo: BrokerInfo{Host: "localhost", Port: 1883}}
+	h.RecordCoverArea(now.Add(time.Second), Origin{Request: "/api/tool/gatewaybroker/set"}, area)
+	list.Version++
+	list.DMBs = append(list.DMBs, zero)
+	h.RecordBrokertable(now.Add(2*time.Second), origin, list)
+	// 記録後の変更は履歴に影響しない
+	list.DMBs[0] = zero
+	area.Topics[0] = "/1"
+
+	if got, ok := h.Brokertable(0); !ok || !reflect.DeepEqual(got.DMBs, []DistributedBrokerInfo{root}) {
+		t.Errorf("Brokertable(0) = %+v, %v", got, ok)
+	}
+	if got, ok := h.Brokertable(1); !ok || !reflect.DeepEqual(got.DMBs, []DistributedBrokerInfo{root, zero}) {
+		t.Errorf("Brokertable(1) = %+v, %v", got, ok)
+	}
+	if _, ok := h.Brokertable(2); ok {
+		t.Errorf("Brokertable(2) = true, expected false")
+	}
+
+	tests := []struct {
+		name  string
+		query HistoryQuery
+		want  []int
+	}{
+		{name: "Normal scenario 01 (all)", query: HistoryQuery{}, want: []int{1, 2, 3}},
+		{name: "Normal scenario 02 (since)", query: HistoryQuery{Since: 1}, want: []int{2, 3}},
+		{name: "Normal scenario 03 (kind)", query: HistoryQuery{Kind: HistoryKindCoverArea}, want: []int{2}},
+		{name: "Normal scenario 04 (no entries)", query: HistoryQuery{Since: 3}, want: []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []int{}
+			for _, e := range h.Entries(tt.query) {
+				got = append(got, e.Sequence)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Entries() = %v, expected %v", got, tt.want)
+			}
+		})
+	}
+	if e := h.Entries(HistoryQuery{Kind: HistoryKindCoverArea})[0]; e.CoverArea.Topics[0] != "/0" || !e.Time.Equal(now.Add(time.Second)) {
+		t.Errorf("Entries() = %+v, expected cover area /0", e)
+	}
+}
+
+// 最新の limit 件を超えた履歴は、古いものから削除される
+func TestHistoryLimit(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	h := NewHistory()
+	h.limit = 3
+	for version := 0; version < 5; version++ {
+		h.RecordBrokertable(now.Add(time.Duration(version)*time.Second), Origin{Request: "autoscale"}, AllDistributedBrokerInfo{Version: version})
+	}
+
+	got := []int{}
+	for _, e := range h.Entries(HistoryQuery{}) {
+		got = append(got, e.Sequence)
+	}
+	if want := []int{3, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Entries() = %v, expected %v", got, want)
+	}
+	if _, ok := h.Brokertable(1); ok {
+		t.Errorf("Brokertable(1) = true, expected false (dropped)")
+	}
+	if got, ok := h.Brokertable(4); !ok || got.Version != 4 {
+		t.Errorf("Brokertable(4) = %+v, %v", got, ok)
+	}
+}
+
+func TestPlanRollback(t *testing.T) {
+	root := DistributedBrokerInfo{Topic: "/", BrokerInfo: BrokerInfo{Host: "localhost", Port: 1893}}
+	zero := DistributedBrokerInfo{Topic: "/0", BrokerInfo: BrokerInfo{Host: "localhost", Port: 1894}}
+	zeroOne := DistributedBrokerInfo{Topic: "/0/1", BrokerInfo: BrokerInfo{Host: "localhost", Port: 1895}}
+	moved := DistributedBrokerInfo{Topic: "/2", BrokerInfo: BrokerInfo{Host: "localhost", Port: 1895}}
+	replica := DistributedBrokerInfo{Topic: "/0", BrokerInfo: BrokerInfo{Host: "localhost", Port: 1896}, Role: RoleReplica}
+
+	tests := []struct {
+		name    string
+		current []DistributedBrokerInfo
+		target  []DistributedBrokerInfo
+		want    []PlanRequest
+		wantErr bool
+	}{
+		{
+			name:    "Normal scenario 01 (remove deeper brokers first)",
+			current: []DistributedBrokerInfo{root, zero, zeroOne},
+			target:  []DistributedBrokerInfo{root},
+			want:    []PlanRequest{{Action: PlanActionRemove, Broker: zeroOne}, {Action: PlanActionRemove, Broker: zero}},
+		},
+		{
+			name:    "Normal scenario 02 (add in target order)",
+			current: []DistributedBrokerInfo{root},
+			target:  []DistributedBrokerInfo{root, zero, zeroOne, replica},
+			want:    []PlanRequest{{Action: PlanActionAdd, Broker: zero}, {Action: PlanActionAdd, Broker: zeroOne}, {Action: PlanActionAdd, Broker: replica}},
+		},
+		{
+			name:    "Normal scenario 03 (same broker with another topic)",
+			current: []DistributedBrokerInfo{root, moved},
+			target:  []DistributedBrokerInfo{root, zeroOne},
+			want:    []PlanRequest{{Action: PlanActionRemove, Broker: moved}, {Action: PlanActionAdd, Broker: zeroOne}},
+		},
+		{
+			name:    "Normal scenario 04 (no change)",
+			current: []DistributedBrokerInfo{root, zero},
+			target:  []DistributedBrokerInfo{root, zero},
+			want:    []PlanRequest{},
+		},
+		{
+			name:    "Error scenario 01 (remove replica)",
+			current: []DistributedBrokerInfo{root, zero, replica},
+			target:  []DistributedBrokerInfo{root, zero},
+			wantErr: true,
+		},
+		{
+			name:    "Error scenario 02 (change root)",
+			current: []DistributedBrokerInfo{root},
+			target:  []DistributedBrokerInfo{zero},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current := AllDistributedBrokerInfo{Version: 5, DMBs: tt.current}
+			target := AllDistributedBrokerInfo{Version: 2, DMBs: tt.target}
+			got, err := planRollback(current, target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("planRollback() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("planRollback() = %+v, expected %+v", got, tt.want)
+			}
+		})
+	}
+}
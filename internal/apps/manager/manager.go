@@ -1,25 +1,43 @@
 package manager
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"gamma/pkg/autoscale"
+	"gamma/pkg/endpoint"
+	"gamma/pkg/metrics"
+	"gamma/pkg/mqttv5"
+	"gamma/pkg/traffic"
 	"os"
 	"os/signal"
-	"sort"
+	"strings"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	log "github.com/sirupsen/logrus"
 )
 
-type BrokerInfo struct {
-	Host string `json:"host"`
-	Port uint16 `json:"port"`
-}
+// BrokerInfo は、MQTT ブローカへの接続先（URL スキーム、ホスト、ポート、認証情報の参照名）
+type BrokerInfo = endpoint.Endpoint
+
+// RoleReplica は、分散ブローカが既存の分散ブローカのレプリカとして同じトピックを担当することを表す
+// Role が空の場合は、既存の分散ブローカが担当するトピックを分割して引き継ぐ
+const RoleReplica = "replica"
+
+// 予備の分散ブローカ（担当トピックを割り当てていない分散ブローカ）の登録と、登録済みの予備の一覧を通知するトピック
+const (
+	SpareBrokerAddTopic  = "/api/tool/distributedbroker/spare"
+	SpareBrokerInfoTopic = "/api/distributedbroker/spare/info"
+)
+
+// autoscaleInterval は、負荷に応じて担当トピックを分割・統合するかどうかを判断する間隔
+const autoscaleInterval = 10 * time.Second
 
 type DistributedBrokerInfo struct {
 	Topic      string     `json:"topic"`
 	BrokerInfo BrokerInfo `json:"broker_info"`
+	Role       string     `json:"role,omitempty"`
 }
 
 type AllDistributedBrokerInfo struct {
@@ -36,13 +54,27 @@ type GatewayBrokerInfo struct {
 	BrokerInfo BrokerInfo `json:"broker_info"`
 }
 
+// GatewayBrokerStatus は、ゲートウェイから通知される状態
+// NOTE: 1 つのゲートウェイブローカを複数のワーカで分担している場合は、ワーカごとに通知される（Worker はワーカの番号、Workers はワーカの数）
+// NOTE: Status は "up"（起動）・"complete"（ブローカテーブルの更新完了）・"applied"（更新状態の処理完了。統合した分散ブローカとの切断を含む）のいずれか
 type GatewayBrokerStatus struct {
 	Status     string     `json:"status"`
 	Version    int        `json:"version"`
 	BrokerInfo BrokerInfo `json:"broker_info"`
+	Worker     uint       `json:"worker,omitempty"`
+	Workers    uint       `json:"workers,omitempty"`
+}
+
+// releasingBroker は、統合した分散ブローカと、まだ切断の完了を通知していないゲートウェイ（ワーカ）
+// NOTE: Pending のキーは、"<host>-<port>-<worker>" とする
+type releasingBroker struct {
+	BrokerInfo BrokerInfo
+	Pending    map[string]bool
 }
 
-func Manager(client mqtt.Client) {
+// autoscalePolicy は、予備の分散ブローカへ担当トピックを分割・統合する条件（分割・統合しない場合は IsEnabled() が false）
+// topology は、起動した分散ブローカ・ゲートウェイを登録する際の構成（nil の場合は、登録・通知されたとおりに登録する）
+func Manager(client mqtt.Client, autoscalePolicy autoscale.Policy, topology *Topology) {
 	startTimeUnix := time.Now().Unix()
 
 	// プルグラムを強制通知を受け取るためのチャンネル
@@ -88,17 +120,249 @@ func Manager(client mqtt.Client) {
 		log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT subscribe error")
 	}
 
+	// 予備の分散ブローカの登録リクエストを受取るチャンネル
+	addSpareBrokerMsgCh := make(chan mqtt.Message, 10)
+	var addSpareBrokerMsgFunc mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+		addSpareBrokerMsgCh <- msg
+	}
+	if token := client.Subscribe(SpareBrokerAddTopic, 1, addSpareBrokerMsgFunc); token.Wait() && token.Error() != nil {
+		log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT subscribe error")
+	}
+
+	// ユーザによる統合しないサブツリーの設定・解除リクエストを受取るチャンネル
+	pinMsgCh := make(chan mqtt.Message, 10)
+	var pinMsgFunc mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+		pinMsgCh <- msg
+	}
+	if token := client.Subscribe("/api/tool/distributedbroker/pin", 1, pinMsgFunc); token.Wait() && token.Error() != nil {
+		log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT subscribe error")
+	}
+	unpinMsgCh := make(chan mqtt.Message, 10)
+	var unpinMsgFunc mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+		unpinMsgCh <- msg
+	}
+	if token := client.Subscribe("/api/tool/distributedbroker/unpin", 1, unpinMsgFunc); token.Wait() && token.Error() != nil {
+		log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT subscribe error")
+	}
+
+	// ゲートウェイからタイルごとの統計の通知を受取るチャンネル
+	trafficReportMsgCh := make(chan mqtt.Message, 100)
+	var trafficReportMsgFunc mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+		trafficReportMsgCh <- msg
+	}
+	if token := client.Subscribe(traffic.ReportTopic, 0, trafficReportMsgFunc); token.Wait() && token.Error() != nil {
+		log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT subscribe error")
+	}
+
+	// ユーザによるヒートマップの出力リクエストを受取るチャンネル
+	exportHeatmapMsgCh := make(chan mqtt.Message, 10)
+	var exportHeatmapMsgFunc mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+		exportHeatmapMsgCh <- msg
+	}
+	if token := client.Subscribe("/api/tool/heatmap/export", 1, exportHeatmapMsgFunc); token.Wait() && token.Error() != nil {
+		log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT subscribe error")
+	}
+
+	// ゲートウェイからトピックごとの Subscriber 数の通知を受取るチャンネル
+	subscriptionReportMsgCh := make(chan mqtt.Message, 100)
+	var subscriptionReportMsgFunc mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+		subscriptionReportMsgCh <- msg
+	}
+	if token := client.Subscribe("/api/notice/gatewaybroker/subscriptions", 0, subscriptionReportMsgFunc); token.Wait() && token.Error() != nil {
+		log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT subscribe error")
+	}
+
+	// ユーザによる分散ブローカの変更案の評価リクエストを受取るチャンネル
+	planMsgCh := make(chan mqtt.Message, 10)
+	var planMsgFunc mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+		planMsgCh <- msg
+	}
+	if token := client.Subscribe("/api/tool/plan", 1, planMsgFunc); token.Wait() && token.Error() != nil {
+		log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT subscribe error")
+	}
+
+	// ユーザによる変更の履歴の取得・ロールバックのリクエストを受取るチャンネル
+	historyMsgCh := make(chan mqtt.Message, 10)
+	var historyMsgFunc mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+		historyMsgCh <- msg
+	}
+	if token := client.Subscribe("/api/tool/history", 1, historyMsgFunc); token.Wait() && token.Error() != nil {
+		log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT subscribe error")
+	}
+	rollbackMsgCh := make(chan mqtt.Message, 10)
+	var rollbackMsgFunc mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+		rollbackMsgCh <- msg
+	}
+	if token := client.Subscribe("/api/tool/rollback", 1, rollbackMsgFunc); token.Wait() && token.Error() != nil {
+		log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT subscribe error")
+	}
+
 	// 分散ブローカ情報更新の際に使用する
 	gatewayCoverAreaInfo := map[string]*GatewayBrokerInfo{}
 	gatewayStatusMap := map[string]GatewayBrokerStatus{}
 	allDistributedBrokerList := AllDistributedBrokerInfo{Version: -1, DMBs: []DistributedBrokerInfo{}}
 	isUpdatingDistributedBrokerList := false
+	// ゲートウェイ（ワーカ）ごとのトピックごとの Subscriber 数（キーは gatewayStatusMap と同じ）
+	subscriptionReports := map[string]SubscriptionReport{}
+	// 担当トピックを割り当てていない予備の分散ブローカ（登録順）
+	spareBrokers := []BrokerInfo{}
+	// 統合した分散ブローカ（キーは統合したブローカテーブルのバージョン）
+	releasingBrokers := map[int]*releasingBroker{}
+	// acknowledgeRemoval 関数は、ゲートウェイ（ワーカ）key が version で統合した分散ブローカとの切断を完了したものとし、
+	// 全てのゲートウェイが完了した分散ブローカを予備へ戻す
+	acknowledgeRemoval := func(key string, version int) {
+		r, ok := releasingBrokers[version]
+		if !ok {
+			return
+		}
+		delete(r.Pending, key)
+		if len(r.Pending) > 0 {
+			return
+		}
+		delete(releasingBrokers, version)
+		// NOTE: 切断を待つ間にロールバック・トポロジファイルにより再び登録された場合は、担当トピックがあるため予備へ戻さない
+		if containsDistributedBroker(allDistributedBrokerList.DMBs, r.BrokerInfo) {
+			log.WithFields(log.Fields{
+				"Host":    r.BrokerInfo.Host,
+				"Port":    r.BrokerInfo.Port,
+				"version": version,
+			}).Info("Consolidated distributed broker was registered again")
+			return
+		}
+		spareBrokers = append(spareBrokers, r.BrokerInfo)
+		publishSpareBrokers(client, spareBrokers)
+		log.WithFields(log.Fields{
+			"Host":    r.BrokerInfo.Host,
+			"Port":    r.BrokerInfo.Port,
+			"version": version,
+			"spares":  len(spareBrokers),
+		}).Info("Returned consolidated distributed broker to spares")
+	}
+	// ブローカテーブル・ゲートウェイの担当エリアの変更の履歴
+	history := NewHistory()
+	// ロールバックの残りの変更（全てのゲートウェイの更新が完了するたびに 1 つずつ適用する）
+	var rollbackSteps []PlanRequest
+	var rollbackOrigin Origin
+	// 更新状態（"complete"）をまだ処理していないゲートウェイ（ワーカ）（キーは gatewayStatusMap と同じ）
+	awaitingApplied := map[string]bool{}
+	// applyStep 関数は、変更 step をブローカテーブルに適用し、新しいバージョンを通知する
+	applyStep := func(step PlanRequest, origin Origin) error {
+		// 切断を待っている分散ブローカは、全てのゲートウェイが切断するまで登録しない
+		if step.Action == PlanActionAdd && isReleasing(releasingBrokers, step.Broker.BrokerInfo) {
+			return PlanError{Msg: fmt.Sprintf("This broker (%v) is being released.", step.Broker.BrokerInfo.Address())}
+		}
+		if err := applyPlan(client, &allDistributedBrokerList, step); err != nil {
+			return err
+		}
+		isUpdatingDistributedBrokerList = true
+		// 分散ブローカの登録・統合と同様に、予備の分散ブローカの一覧を更新する
+		switch {
+		case step.Action == PlanActionRemove:
+			// NOTE: 切断する前に予備へ戻すと、他のトピックへ割り当てた後も古いトピックのメッセージが転送されるため、
+			// 現在の全てのゲートウェイ（ワーカ）が切断を通知するまで待つ
+			pending := map[string]bool{}
+			for key := range gatewayStatusMap {
+				pending[key] = true
+			}
+			version := allDistributedBrokerList.Version
+			releasingBrokers[version] = &releasingBroker{BrokerInfo: step.Broker.BrokerInfo, Pending: pending}
+			if len(pending) == 0 {
+				acknowledgeRemoval("", version)
+			}
+		case containsBroker(spareBrokers, step.Broker.BrokerInfo):
+			spareBrokers = removeBroker(spareBrokers, step.Broker.BrokerInfo)
+			publishSpareBrokers(client, spareBrokers)
+		}
+		history.RecordBrokertable(time.Now(), origin, allDistributedBrokerList)
+		return nil
+	}
+	// applyRollbackStep 関数は、ロールバックの次の変更を適用する（適用できない場合は、ロールバックを中止する）
+	applyRollbackStep := func() {
+		step := rollbackSteps[0]
+		rollbackSteps = rollbackSteps[1:]
+		if err := applyStep(step, rollbackOrigin); err != nil {
+			rollbackSteps = nil
+			log.WithFields(log.Fields{"step": step, "error": err}).Error("Rollback aborted")
+			return
+		}
+		log.WithFields(log.Fields{"step": step, "version": allDistributedBrokerList.Version, "remaining": len(rollbackSteps)}).Info("Applied rollback step")
+	}
+	// トポロジファイルに記述された分散ブローカのうち、登録・通知してきたもの（"host:port"）
+	availableBrokers := map[string]bool{}
+	var lastTopologyStatus []byte
+	// reconcileTopology 関数は、起動しているトポロジファイルの分散ブローカを 1 つずつ登録し、まだ揃っていない分散ブローカ・ゲートウェイを通知する
+	reconcileTopology := func() {
+		if topology == nil {
+			return
+		}
+		if !isUpdatingDistributedBrokerList && len(rollbackSteps) == 0 {
+			if step, ok := topology.NextStep(allDistributedBrokerList, availableBrokers); ok {
+				payload, _ := json.Marshal(step.Broker)
+				if err := applyStep(step, Origin{Request: "topology", Payload: payload}); err != nil {
+					log.WithFields(log.Fields{"step": step, "error": err}).Error("Could not add distributed broker in topology")
+				} else {
+					log.WithFields(log.Fields{"topic": step.Broker.Topic, "Host": step.Broker.BrokerInfo.Host, "Port": step.Broker.BrokerInfo.Port, "version": allDistributedBrokerList.Version}).Info("Added distributed broker in topology")
+				}
+			}
+		}
+		// NOTE: 状態が変わった場合のみ通知する
+		status := topology.Status(allDistributedBrokerList, gatewayCoverAreaInfo)
+		msg, err := json.Marshal(status)
+		if err != nil || bytes.Equal(msg, lastTopologyStatus) {
+			return
+		}
+		lastTopologyStatus = msg
+		if token := client.Publish(topologyStatusTopic, 1, true, msg); token.Wait() && token.Error() != nil {
+			log.WithFields(log.Fields{"error": token.Error()}).Error("Notify topology status")
+		}
+		log.WithFields(log.Fields{
+			"missing_distributed_brokers": len(status.MissingDistributedBrokers),
+			"missing_gateways":            len(status.MissingGateways),
+			"complete":                    status.Complete,
+		}).Info("Topology status")
+	}
+	// acknowledgeApplied 関数は、ゲートウェイ（ワーカ）key が version の更新状態を処理したものとし、
+	// 全てのゲートウェイが処理した場合は更新を完了して、ロールバックの次の変更、またはトポロジファイルの次の分散ブローカを適用する
+	// NOTE: ゲートウェイは新しいブローカテーブルと更新状態を別々に受け取るため、更新状態を処理する前に次のバージョンを通知すると、
+	// 処理中の分散ブローカの追加・削除が失われる
+	acknowledgeApplied := func(key string, version int) {
+		if version != allDistributedBrokerList.Version {
+			return
+		}
+		delete(awaitingApplied, key)
+		if len(awaitingApplied) > 0 {
+			return
+		}
+		isUpdatingDistributedBrokerList = false
+		log.WithFields(log.Fields{"version": version}).Info("Distributed broker`s info applied by all gateways")
+		if len(rollbackSteps) > 0 {
+			applyRollbackStep()
+		} else {
+			reconcileTopology()
+		}
+	}
 	metricsTrigger := make(chan bool, 10)
+	// /metrics で公開するメトリクス
+	mm := newManagerMetrics(metrics.Default)
+	mm.update(allDistributedBrokerList, isUpdatingDistributedBrokerList, gatewayCoverAreaInfo, gatewayStatusMap, spareBrokers)
+	// 全てのゲートウェイから通知されたタイルごとの統計
+	heatmap := traffic.NewHeatmap()
+	// 負荷に応じて担当トピックを分割・統合する（分割・統合しない場合は scaler が nil、autoscaleCh は受信しない）
+	scaler := autoscale.NewScaler(autoscalePolicy)
+	var autoscaleCh <-chan time.Time
+	if scaler != nil {
+		autoscaleTicker := time.NewTicker(autoscaleInterval)
+		defer autoscaleTicker.Stop()
+		autoscaleCh = autoscaleTicker.C
+	}
+	publishPinnedTopics(client, scaler.Pinned())
+	reconcileTopology()
 	for {
 		select {
 		// Gatewayの状態通知を受取るチャンネル
 		case m := <-gatewayNotifyMsgCh:
 			metricsTrigger <- true
+			mm.apiRequests.With("notice_gateway").Inc()
 			log.WithFields(log.Fields{"payload": string(m.Payload())}).Trace("gatewayNotifyMsgCh")
 			// JSONデコード
 			var gatewayStatus GatewayBrokerStatus
@@ -106,15 +370,37 @@ func Manager(client mqtt.Client) {
 				log.WithFields(log.Fields{"err": err}).Fatal("add gateway broker (gatewayNotifyMsgCh)")
 			}
 			key := fmt.Sprintf("%v-%v", gatewayStatus.BrokerInfo.Host, gatewayStatus.BrokerInfo.Port)
+			workerKey := fmt.Sprintf("%v-%v", key, gatewayStatus.Worker)
+			// 更新状態の処理の完了通知（統合した分散ブローカとの切断の完了を含む）
+			if gatewayStatus.Status == "applied" {
+				acknowledgeRemoval(workerKey, gatewayStatus.Version)
+				acknowledgeApplied(workerKey, gatewayStatus.Version)
+				continue
+			}
 			if _, ok := gatewayCoverAreaInfo[key]; !ok {
-				gatewayCoverAreaInfo[key] = &GatewayBrokerInfo{Topics: []string{"/"}, BrokerInfo: gatewayStatus.BrokerInfo}
+				// トポロジファイルに記述されたゲートウェイは、記述された担当エリアとする
+				origin := originOf(m)
+				coverArea := GatewayBrokerInfo{Topics: []string{"/"}, BrokerInfo: gatewayStatus.BrokerInfo}
+				if declared, ok := topology.Gateway(gatewayStatus.BrokerInfo); ok {
+					payload, _ := json.Marshal(declared)
+					origin = Origin{Request: "topology", Payload: payload}
+					coverArea.Topics = append([]string{}, declared.Topics...)
+				}
+				gatewayCoverAreaInfo[key] = &coverArea
+				history.RecordCoverArea(time.Now(), origin, coverArea)
+				reconcileTopology()
 			}
-			gatewayStatusMap[key] = gatewayStatus
+			// NOTE: 全てのワーカの更新が完了するまで待つため、状態はワーカごとに管理する
+			gatewayStatusMap[workerKey] = gatewayStatus
 			if gatewayStatus.Status == "up" {
+				// 起動し直したゲートウェイ（ワーカ）は、統合した分散ブローカと接続していない
+				for version := range releasingBrokers {
+					acknowledgeRemoval(workerKey, version)
+				}
 				var payload []GatewayBrokerInfoSingleTopic
 				for _, v := range gatewayCoverAreaInfo {
 					for _, t := range v.Topics {
-						var gatewayCoverArea = GatewayBrokerInfoSingleTopic{Topic: t, BrokerInfo: BrokerInfo{Host: v.BrokerInfo.Host, Port: v.BrokerInfo.Port}}
+						var gatewayCoverArea = GatewayBrokerInfoSingleTopic{Topic: t, BrokerInfo: v.BrokerInfo}
 						payload = append(payload, gatewayCoverArea)
 					}
 				}
@@ -128,23 +414,32 @@ func Manager(client mqtt.Client) {
 			}
 
 			// 全ての Gateway の状態が completeかどうかを確かめる
+			isComplete := true
 			for _, info := range gatewayStatusMap {
-				isUpdatingDistributedBrokerList = false
 				if info.Version != allDistributedBrokerList.Version {
-					isUpdatingDistributedBrokerList = true
+					isComplete = false
 					break
 				}
 			}
-			if !isUpdatingDistributedBrokerList {
-				if token := client.Publish("/api/brokertable/update/status", 2, false, "complete"); token.Wait() && token.Error() != nil {
-					log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT publish error")
-				}
-				log.Info("Distributed broker`s info update complete by gateway")
+			if !isComplete {
+				isUpdatingDistributedBrokerList = true
+				continue
+			}
+			if token := client.Publish("/api/brokertable/update/status", 2, false, "complete"); token.Wait() && token.Error() != nil {
+				log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT publish error")
 			}
+			log.Info("Distributed broker`s info update complete by gateway")
+			// 全てのゲートウェイが更新状態を処理してから、ロールバックの次の変更、またはトポロジファイルの次の分散ブローカを適用する
+			awaitingApplied = map[string]bool{}
+			for key := range gatewayStatusMap {
+				awaitingApplied[key] = true
+			}
+			acknowledgeApplied("", allDistributedBrokerList.Version)
 
 		// ユーザによるゲートウェイ担当エリアの設定
 		case m := <-setGatewayBrokerMsgCh:
 			metricsTrigger <- true
+			mm.apiRequests.With("set_gateway").Inc()
 			log.WithFields(log.Fields{"payload": string(m.Payload())}).Trace("setGatewayBrokerMsgCh")
 			// JSONデコード
 			var gatewayCoverArea GatewayBrokerInfo
@@ -160,11 +455,12 @@ func Manager(client mqtt.Client) {
 				continue
 			}
 			gatewayCoverAreaInfo[key] = &gatewayCoverArea
+			history.RecordCoverArea(time.Now(), originOf(m), gatewayCoverArea)
 
 			var payload []GatewayBrokerInfoSingleTopic
 			for _, v := range gatewayCoverAreaInfo {
 				for _, t := range v.Topics {
-					tmpGatewayCoverArea := GatewayBrokerInfoSingleTopic{Topic: t, BrokerInfo: BrokerInfo{Host: v.BrokerInfo.Host, Port: v.BrokerInfo.Port}}
+					tmpGatewayCoverArea := GatewayBrokerInfoSingleTopic{Topic: t, BrokerInfo: v.BrokerInfo}
 					payload = append(payload, tmpGatewayCoverArea)
 				}
 			}
@@ -183,53 +479,274 @@ func Manager(client mqtt.Client) {
 		// ユーザによる分散ブローカの登録（「出来なかったらやり直せばいいでしょ」の方針）
 		case m := <-addDistributedBrokerMsgCh:
 			metricsTrigger <- true
+			mm.apiRequests.With("add_distributed_broker").Inc()
 			log.WithFields(log.Fields{"payload": string(m.Payload())}).Trace("addDistributedBrokerMsgCh")
-			if isUpdatingDistributedBrokerList {
+			// JSONデコード
+			var newDistributedBrokerInfo DistributedBrokerInfo
+			if err := json.Unmarshal(m.Payload(), &newDistributedBrokerInfo); err != nil {
+				log.WithFields(log.Fields{"err": err}).Fatal("add distributed broker (addDistributedBrokerMsgCh)")
+			}
+			// トポロジファイルに記述された分散ブローカは、記述された順・トピックで登録する
+			if declared, ok := topology.DistributedBroker(newDistributedBrokerInfo.BrokerInfo); ok {
+				availableBrokers[declared.BrokerInfo.Address()] = true
+				if declared.Topic != newDistributedBrokerInfo.Topic || declared.Role != newDistributedBrokerInfo.Role {
+					log.WithFields(log.Fields{"requested": newDistributedBrokerInfo, "declared": declared}).Warn("Distributed broker will be added as declared in topology (addDistributedBrokerMsgCh)")
+				}
+				reconcileTopology()
+				continue
+			}
+			if isUpdatingDistributedBrokerList || len(rollbackSteps) > 0 {
 				log.WithFields(log.Fields{
 					"isUpdatingDistributedBrokerList": isUpdatingDistributedBrokerList,
+					"rollbackSteps":                   len(rollbackSteps),
 					"gatewayStatusMap":                gatewayStatusMap,
 				}).Error("Could not add distributed broker...")
 				continue
 			}
 
-			isUpdatingDistributedBrokerList = true
-			allDistributedBrokerList.Version++
-			// JSONデコード
-			var newDistributedBrokerInfo DistributedBrokerInfo
-			if err := json.Unmarshal(m.Payload(), &newDistributedBrokerInfo); err != nil {
-				log.WithFields(log.Fields{"err": err}).Fatal("add distributed broker (addDistributedBrokerMsgCh)")
+			// バリデーション（/api/tool/plan と同じ）に失敗した場合は、バージョンを進めない
+			// NOTE: 予備として登録されていた分散ブローカは、予備の一覧から除かれる
+			step := PlanRequest{Action: PlanActionAdd, Broker: newDistributedBrokerInfo}
+			if err := applyStep(step, originOf(m)); err != nil {
+				log.WithFields(log.Fields{
+					"Host":  newDistributedBrokerInfo.BrokerInfo.Host,
+					"Port":  newDistributedBrokerInfo.BrokerInfo.Port,
+					"Topic": newDistributedBrokerInfo.Topic,
+					"error": err,
+				}).Error("Could not add distributed broker (addDistributedBrokerMsgCh)")
+				continue
+			}
+
+		// 予備の分散ブローカの登録
+		case m := <-addSpareBrokerMsgCh:
+			metricsTrigger <- true
+			mm.apiRequests.With("add_spare_broker").Inc()
+			log.WithFields(log.Fields{"payload": string(m.Payload())}).Trace("addSpareBrokerMsgCh")
+			var spare BrokerInfo
+			if err := json.Unmarshal(m.Payload(), &spare); err != nil {
+				log.WithFields(log.Fields{"error": err}).Error("Invalid spare broker (addSpareBrokerMsgCh)")
+				continue
+			}
+			if err := spare.Validate(); err != nil {
+				log.WithFields(log.Fields{"BrokerInfo": spare, "error": err}).Error("Invalid spare broker (addSpareBrokerMsgCh)")
+				continue
+			}
+			// トポロジファイルに記述された分散ブローカは、予備とせずに記述されたトピックで登録する
+			// NOTE: 予備の一覧には含めないため、ブローカテーブルに登録されるまで登録リクエストが再送される
+			if _, ok := topology.DistributedBroker(spare); ok {
+				availableBrokers[spare.Address()] = true
+				reconcileTopology()
+				continue
+			}
+			// NOTE: 登録済みの場合も、再送された登録リクエストに応えるため一覧を通知し直す
+			if !containsBroker(spareBrokers, spare) && !containsDistributedBroker(allDistributedBrokerList.DMBs, spare) {
+				spareBrokers = append(spareBrokers, spare)
+				log.WithFields(log.Fields{"Host": spare.Host, "Port": spare.Port, "spares": len(spareBrokers)}).Info("Added spare distributed broker")
 			}
-			// バリデーションを行う
-			for _, info := range allDistributedBrokerList.DMBs {
-				if info.BrokerInfo.Host == newDistributedBrokerInfo.BrokerInfo.Host && info.BrokerInfo.Port == newDistributedBrokerInfo.BrokerInfo.Port {
-					isUpdatingDistributedBrokerList = false
+			publishSpareBrokers(client, spareBrokers)
+
+		// 負荷に応じた担当トピックの分割・統合
+		case now := <-autoscaleCh:
+			if isUpdatingDistributedBrokerList || len(rollbackSteps) > 0 {
+				continue
+			}
+			tiles := heatmap.Tiles(now)
+			brokers := primaryBrokers(allDistributedBrokerList.DMBs)
+			if split, ok := scaler.Evaluate(now, brokers, tiles); ok {
+				// NOTE: 分割すべき負荷のため、予備の分散ブローカが無い場合も同じ周期で統合は行わない
+				if len(spareBrokers) == 0 {
 					log.WithFields(log.Fields{
-						"Host": newDistributedBrokerInfo.BrokerInfo.Host,
-						"Port": newDistributedBrokerInfo.BrokerInfo.Port,
-					}).Error("This broker is already exists (addDistributedBrokerMsgCh)")
-					break
+						"from":       split.From.Address,
+						"from_topic": split.From.Topic,
+						"from_rate":  split.FromRate,
+						"topic":      split.Topic,
+						"topic_rate": split.TopicRate,
+					}).Warn("No spare distributed broker to split onto")
+					continue
 				}
+				// ユーザによる分散ブローカの登録と同様に、検証してからブローカテーブルを更新する
+				spare := spareBrokers[0]
+				step := PlanRequest{Action: PlanActionAdd, Broker: DistributedBrokerInfo{Topic: split.Topic, BrokerInfo: spare}}
+				if err := applyStep(step, autoscaleOrigin(split)); err != nil {
+					log.WithFields(log.Fields{"step": step, "error": err}).Error("Could not split distributed broker onto spare")
+					continue
+				}
+				scaler.Changed(now)
+				mm.autoscaleSplits.Inc()
+				metricsTrigger <- true
+				log.WithFields(log.Fields{
+					"from":       split.From.Address,
+					"from_topic": split.From.Topic,
+					"from_rate":  split.FromRate,
+					"topic":      split.Topic,
+					"topic_rate": split.TopicRate,
+					"Host":       spare.Host,
+					"Port":       spare.Port,
+					"version":    allDistributedBrokerList.Version,
+				}).Info("Split distributed broker onto spare")
+				continue
 			}
-			if !isUpdatingDistributedBrokerList {
+
+			// NOTE: レプリカを持つ分散ブローカ・トポロジファイルに記述された分散ブローカは統合しない
+			excluded := replicatedTopics(allDistributedBrokerList.DMBs)
+			for topic := range topology.DeclaredTopics() {
+				excluded[topic] = true
+			}
+			c, ok := scaler.EvaluateConsolidation(now, brokers, excluded, tiles)
+			if !ok {
+				continue
+			}
+			removed, ok := findDistributedBroker(allDistributedBrokerList.DMBs, c.Broker)
+			if !ok {
 				continue
 			}
+			// 全てのゲートウェイが Subscriber を親ノードの分散ブローカへ引き継ぎ、切断を通知してから予備へ戻す
+			step := PlanRequest{Action: PlanActionRemove, Broker: removed}
+			if err := applyStep(step, autoscaleOrigin(c)); err != nil {
+				log.WithFields(log.Fields{"step": step, "error": err}).Error("Could not consolidate distributed broker into parent")
+				continue
+			}
+			scaler.Changed(now)
+			mm.autoscaleConsolidations.Inc()
+			metricsTrigger <- true
+			log.WithFields(log.Fields{
+				"topic":       c.Broker.Topic,
+				"rate":        c.Rate,
+				"parent":      c.Parent.Address,
+				"parent_rate": c.ParentRate,
+				"Host":        removed.BrokerInfo.Host,
+				"Port":        removed.BrokerInfo.Port,
+				"version":     allDistributedBrokerList.Version,
+			}).Info("Consolidated distributed broker into parent")
 
-			allDistributedBrokerList.DMBs = append(allDistributedBrokerList.DMBs, newDistributedBrokerInfo)
-			// 非安定ソート
-			sort.Slice(allDistributedBrokerList.DMBs, func(i, j int) bool {
-				return len(allDistributedBrokerList.DMBs[i].Topic) < len(allDistributedBrokerList.DMBs[j].Topic)
-			})
+		// ユーザによる統合しないサブツリーの設定・解除
+		case m := <-pinMsgCh:
+			mm.apiRequests.With("pin").Inc()
+			topic := string(m.Payload())
+			if !strings.HasPrefix(topic, "/") {
+				log.WithFields(log.Fields{"topic": topic}).Error("Invalid pinned topic (pinMsgCh)")
+				continue
+			}
+			if scaler == nil {
+				log.WithFields(log.Fields{"topic": topic}).Warn("Autoscale is disabled (pinMsgCh)")
+			}
+			scaler.Pin(topic)
+			publishPinnedTopics(client, scaler.Pinned())
+			log.WithFields(log.Fields{"topic": topic}).Info("Pinned subtree")
+
+		case m := <-unpinMsgCh:
+			mm.apiRequests.With("unpin").Inc()
+			topic := string(m.Payload())
+			if !strings.HasPrefix(topic, "/") {
+				log.WithFields(log.Fields{"topic": topic}).Error("Invalid pinned topic (unpinMsgCh)")
+				continue
+			}
+			scaler.Unpin(topic)
+			publishPinnedTopics(client, scaler.Pinned())
+			log.WithFields(log.Fields{"topic": topic}).Info("Unpinned subtree")
 
-			// JSONエンコード
-			msg, err := json.Marshal(allDistributedBrokerList)
+		// ゲートウェイからのタイルごとの統計の通知
+		case m := <-trafficReportMsgCh:
+			mm.apiRequests.With("notice_traffic").Inc()
+			log.WithFields(log.Fields{"payload": string(m.Payload())}).Trace("trafficReportMsgCh")
+			var report traffic.Report
+			if err := json.Unmarshal(m.Payload(), &report); err != nil {
+				log.WithFields(log.Fields{"error": err}).Error("Invalid traffic report (trafficReportMsgCh)")
+				continue
+			}
+			if err := heatmap.Add(report, time.Now()); err != nil {
+				log.WithFields(log.Fields{"BrokerInfo": report.BrokerInfo, "error": err}).Error("Invalid traffic report (trafficReportMsgCh)")
+			}
+
+		// ユーザによるヒートマップの出力
+		case m := <-exportHeatmapMsgCh:
+			mm.apiRequests.With("export_heatmap").Inc()
+			log.WithFields(log.Fields{"payload": string(m.Payload())}).Trace("exportHeatmapMsgCh")
+			exportHeatmap(client, m, heatmap.Tiles(time.Now()))
+
+		// ゲートウェイからのトピックごとの Subscriber 数の通知
+		case m := <-subscriptionReportMsgCh:
+			mm.apiRequests.With("notice_subscriptions").Inc()
+			log.WithFields(log.Fields{"payload": string(m.Payload())}).Trace("subscriptionReportMsgCh")
+			var report SubscriptionReport
+			if err := json.Unmarshal(m.Payload(), &report); err != nil {
+				log.WithFields(log.Fields{"error": err}).Error("Invalid subscription report (subscriptionReportMsgCh)")
+				continue
+			}
+			subscriptionReports[fmt.Sprintf("%v-%v-%v", report.BrokerInfo.Host, report.BrokerInfo.Port, report.Worker)] = report
+
+		// ユーザによる分散ブローカの変更案の評価（ブローカテーブルは変更しない）
+		case m := <-planMsgCh:
+			mm.apiRequests.With("plan").Inc()
+			log.WithFields(log.Fields{"payload": string(m.Payload())}).Trace("planMsgCh")
+			var req PlanRequest
+			if err := json.Unmarshal(m.Payload(), &req); err != nil {
+				respondPlan(client, m, Plan{Error: err.Error()})
+				continue
+			}
+			plan, err := planChange(allDistributedBrokerList, req, gatewayStatusMap, subscriptionReports)
 			if err != nil {
-				log.WithFields(log.Fields{"err": err}).Fatal("add gateway broker (gatewayNotifyMsgCh)")
+				plan.Error = err.Error()
 			}
-			if token := client.Publish("/api/brokertable/all/info", 2, true, msg); token.Wait() && token.Error() != nil {
-				log.WithFields(log.Fields{"error": token.Error()}).Fatal("Notify to manager")
+			plan.Pending = isUpdatingDistributedBrokerList
+			respondPlan(client, m, plan)
+
+		// ユーザによる変更の履歴の取得（ペイロードは HistoryQuery。空の場合は全ての履歴）
+		case m := <-historyMsgCh:
+			mm.apiRequests.With("history").Inc()
+			log.WithFields(log.Fields{"payload": string(m.Payload())}).Trace("historyMsgCh")
+			var q HistoryQuery
+			if len(m.Payload()) > 0 {
+				if err := json.Unmarshal(m.Payload(), &q); err != nil {
+					log.WithFields(log.Fields{"error": err}).Error("Invalid history query (historyMsgCh)")
+					continue
+				}
+			}
+			entries := history.Entries(q)
+			if topic, err := respondJSON(client, m, "/api/history/result", entries); err != nil {
+				log.WithFields(log.Fields{"topic": topic, "error": err}).Error("History error")
+			}
+
+		// ユーザによるブローカテーブルのロールバック（通常の更新手順で、1 バージョンずつ指定したバージョンの構成へ戻す）
+		case m := <-rollbackMsgCh:
+			metricsTrigger <- true
+			mm.apiRequests.With("rollback").Inc()
+			log.WithFields(log.Fields{"payload": string(m.Payload())}).Trace("rollbackMsgCh")
+			var req RollbackRequest
+			result, err := func() (RollbackResult, error) {
+				if err := json.Unmarshal(m.Payload(), &req); err != nil {
+					return RollbackResult{}, err
+				}
+				result := RollbackResult{Version: req.Version, Steps: []PlanRequest{}}
+				if isUpdatingDistributedBrokerList || len(rollbackSteps) > 0 {
+					return result, PlanError{Msg: "The brokertable is being updated."}
+				}
+				target, ok := history.Brokertable(req.Version)
+				if !ok {
+					return result, PlanError{Msg: fmt.Sprintf("Version %v is not found in the history (only the latest %v entries are kept).", req.Version, historyLimit)}
+				}
+				steps, err := planRollback(allDistributedBrokerList, target)
+				result.Steps = steps
+				return result, err
+			}()
+			if err != nil {
+				result.Error = err.Error()
+				log.WithFields(log.Fields{"version": req.Version, "error": err}).Error("Could not rollback brokertable (rollbackMsgCh)")
+			}
+			if topic, err := respondJSON(client, m, "/api/rollback/result", result); err != nil {
+				log.WithFields(log.Fields{"topic": topic, "error": err}).Error("Rollback error")
 			}
+			if len(result.Steps) == 0 {
+				continue
+			}
+			// 最初の変更を適用し、残りは全てのゲートウェイの更新が完了するたびに適用する
+			log.WithFields(log.Fields{"version": req.Version, "steps": len(result.Steps)}).Info("Started brokertable rollback")
+			rollbackSteps = result.Steps
+			rollbackOrigin = originOf(m)
+			applyRollbackStep()
 
 		case <-metricsTrigger:
+			mm.update(allDistributedBrokerList, isUpdatingDistributedBrokerList, gatewayCoverAreaInfo, gatewayStatusMap, spareBrokers)
 			passedTimeSecTotal := time.Now().Unix() - startTimeUnix
 			passedTimeHour := passedTimeSecTotal / 3600
 			passedTimeMinutes := (passedTimeSecTotal / 60) % 60
@@ -257,3 +774,169 @@ func Manager(client mqtt.Client) {
 		}
 	}
 }
+
+// publishAllDistributedBrokerInfo 関数は、ブローカテーブルをゲートウェイ・分散ブローカへ通知する
+func publishAllDistributedBrokerInfo(client mqtt.Client, list AllDistributedBrokerInfo) {
+	// JSONエンコード
+	msg, err := json.Marshal(list)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Fatal("add gateway broker (gatewayNotifyMsgCh)")
+	}
+	if token := client.Publish("/api/brokertable/all/info", 2, true, msg); token.Wait() && token.Error() != nil {
+		log.WithFields(log.Fields{"error": token.Error()}).Fatal("Notify to manager")
+	}
+}
+
+// applyPlan 関数は、変更 req をブローカテーブル list に適用し、新しいバージョンのブローカテーブルを通知する
+func applyPlan(client mqtt.Client, list *AllDistributedBrokerInfo, req PlanRequest) error {
+	plan, err := planChange(*list, req, nil, nil)
+	if err != nil {
+		return err
+	}
+	*list = plan.Brokertable
+	publishAllDistributedBrokerInfo(client, *list)
+	return nil
+}
+
+// respond 関数は、要求 m に MQTT v5 の Response Topic が指定されている場合はそのトピックへ、指定されていない場合は topic へ msg を応答する
+// 応答したトピックを返す
+// NOTE: 応答には要求の Correlation Data を引き継ぐ
+func respond(client mqtt.Client, m mqtt.Message, topic string, contentType string, msg []byte) (string, error) {
+	props := mqttv5.PropertiesOf(m)
+	if props.ResponseTopic != "" {
+		topic = props.ResponseTopic
+	}
+	payload := mqttv5.Publication{Payload: msg, Properties: mqttv5.Properties{ContentType: contentType, CorrelationData: props.CorrelationData}}
+	if token := client.Publish(topic, 1, false, mqttv5.PayloadFor(client, payload)); token.Wait() && token.Error() != nil {
+		return topic, token.Error()
+	}
+	return topic, nil
+}
+
+// respondJSON 関数は、v を JSON エンコードして要求 m に応答する（respond 関数を参照）
+func respondJSON(client mqtt.Client, m mqtt.Message, topic string, v interface{}) (string, error) {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return topic, err
+	}
+	return respond(client, m, topic, "application/json", msg)
+}
+
+// publishSpareBrokers 関数は、予備の分散ブローカの一覧を通知する（予備の分散ブローカが登録されたことを確認するため）
+func publishSpareBrokers(client mqtt.Client, spares []BrokerInfo) {
+	msg, err := json.Marshal(spares)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Notify spare brokers")
+	}
+	if token := client.Publish(SpareBrokerInfoTopic, 1, true, msg); token.Wait() && token.Error() != nil {
+		log.WithFields(log.Fields{"error": token.Error()}).Fatal("Notify spare brokers")
+	}
+}
+
+// publishPinnedTopics 関数は、統合しないサブツリーの一覧を通知する
+func publishPinnedTopics(client mqtt.Client, topics []string) {
+	if topics == nil {
+		topics = []string{}
+	}
+	msg, err := json.Marshal(topics)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Notify pinned topics")
+	}
+	if token := client.Publish("/api/distributedbroker/pinned/info", 1, true, msg); token.Wait() && token.Error() != nil {
+		log.WithFields(log.Fields{"error": token.Error()}).Fatal("Notify pinned topics")
+	}
+}
+
+// removeDistributedBroker 関数は、b と同じトピック・分散ブローカの登録（レプリカを除く）を list から削除し、削除したものを返す
+func removeDistributedBroker(list *AllDistributedBrokerInfo, b autoscale.Broker) (DistributedBrokerInfo, bool) {
+	for i, info := range list.DMBs {
+		if info.Role != RoleReplica && info.Topic == b.Topic && info.BrokerInfo.Address() == b.Address {
+			list.DMBs = append(list.DMBs[:i:i], list.DMBs[i+1:]...)
+			return info, true
+		}
+	}
+	return DistributedBrokerInfo{}, false
+}
+
+// findDistributedBroker 関数は、b と同じトピック・分散ブローカの登録（レプリカを除く）を返す
+func findDistributedBroker(dmbs []DistributedBrokerInfo, b autoscale.Broker) (DistributedBrokerInfo, bool) {
+	for _, info := range dmbs {
+		if info.Role != RoleReplica && info.Topic == b.Topic && info.BrokerInfo.Address() == b.Address {
+			return info, true
+		}
+	}
+	return DistributedBrokerInfo{}, false
+}
+
+// replicatedTopics 関数は、レプリカが登録されているトピックを返す
+func replicatedTopics(dmbs []DistributedBrokerInfo) map[string]bool {
+	topics := map[string]bool{}
+	for _, info := range dmbs {
+		if info.Role == RoleReplica {
+			topics[info.Topic] = true
+		}
+	}
+	return topics
+}
+
+// primaryBrokers 関数は、トピックを担当している分散ブローカ（レプリカを除く）を返す
+func primaryBrokers(dmbs []DistributedBrokerInfo) []autoscale.Broker {
+	brokers := []autoscale.Broker{}
+	for _, info := range dmbs {
+		if info.Role != RoleReplica {
+			brokers = append(brokers, autoscale.Broker{Topic: info.Topic, Address: info.BrokerInfo.Address()})
+		}
+	}
+	return brokers
+}
+
+// containsBroker 関数は、brokers に b と同じホスト・ポートの MQTT ブローカが含まれるかどうかを返す
+func containsBroker(brokers []BrokerInfo, b BrokerInfo) bool {
+	for _, info := range brokers {
+		if info.Host == b.Host && info.Port == b.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// removeBroker 関数は、brokers から b と同じホスト・ポートの MQTT ブローカを除いたものを返す
+func removeBroker(brokers []BrokerInfo, b BrokerInfo) []BrokerInfo {
+	result := []BrokerInfo{}
+	for _, info := range brokers {
+		if info.Host != b.Host || info.Port != b.Port {
+			result = append(result, info)
+		}
+	}
+	return result
+}
+
+// isReleasing 関数は、releasing に b と同じホスト・ポートの分散ブローカが含まれるかどうかを返す
+func isReleasing(releasing map[int]*releasingBroker, b BrokerInfo) bool {
+	for _, r := range releasing {
+		if r.BrokerInfo.Host == b.Host && r.BrokerInfo.Port == b.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// containsDistributedBroker 関数は、dmbs に b と同じホスト・ポートの分散ブローカが含まれるかどうかを返す
+func containsDistributedBroker(dmbs []DistributedBrokerInfo, b BrokerInfo) bool {
+	for _, info := range dmbs {
+		if info.BrokerInfo.Host == b.Host && info.BrokerInfo.Port == b.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPrimary 関数は、トピックを担当している分散ブローカ（レプリカを除く）が登録されているかどうかを返す
+func hasPrimary(dmbs []DistributedBrokerInfo, topic string) bool {
+	for _, info := range dmbs {
+		if info.Topic == topic && info.Role != RoleReplica {
+			return true
+		}
+	}
+	return false
+}
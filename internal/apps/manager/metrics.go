@@ -0,0 +1,72 @@
+package manager
+
+import (
+	"gamma/pkg/metrics"
+)
+
+//////////////        以下、Metrics 関連             //////////////
+
+// managerMetrics 構造体は、/metrics で公開するマネージャのメトリクス
+type managerMetrics struct {
+	apiRequests             *metrics.CounterVec // api: "notice_gateway", "set_gateway", "add_distributed_broker", "add_spare_broker", ...
+	brokertableVersion      *metrics.Gauge
+	brokertableUpdating     *metrics.Gauge
+	distributedBrokers      *metrics.GaugeVec // role: "primary", "replica"
+	gateways                *metrics.Gauge
+	gatewayWorkers          *metrics.Gauge
+	outdatedWorkers         *metrics.Gauge
+	spareBrokers            *metrics.Gauge
+	autoscaleSplits         *metrics.Counter
+	autoscaleConsolidations *metrics.Counter
+}
+
+// newManagerMetrics 関数は、マネージャのメトリクスを r へ登録する
+func newManagerMetrics(r *metrics.Registry) *managerMetrics {
+	return &managerMetrics{
+		apiRequests:             r.NewCounterVec("gamma_manager_api_requests_total", "Number of API requests received.", "api"),
+		brokertableVersion:      r.NewGauge("gamma_manager_brokertable_version", "Version of the broker table."),
+		brokertableUpdating:     r.NewGauge("gamma_manager_brokertable_updating", "Whether gateways are updating the broker table (1) or not (0)."),
+		distributedBrokers:      r.NewGaugeVec("gamma_manager_distributed_brokers", "Number of registered distributed brokers.", "role"),
+		gateways:                r.NewGauge("gamma_manager_gateway_brokers", "Number of known gateway brokers."),
+		gatewayWorkers:          r.NewGauge("gamma_manager_gateway_workers", "Number of gateway workers that have notified their status."),
+		outdatedWorkers:         r.NewGauge("gamma_manager_gateway_workers_outdated", "Number of gateway workers whose broker table version is not the latest."),
+		spareBrokers:            r.NewGauge("gamma_manager_spare_brokers", "Number of spare distributed brokers without assigned topics."),
+		autoscaleSplits:         r.NewCounter("gamma_manager_autoscale_splits_total", "Number of subtrees split onto spare distributed brokers."),
+		autoscaleConsolidations: r.NewCounter("gamma_manager_autoscale_consolidations_total", "Number of distributed brokers consolidated into their parent and returned to spares."),
+	}
+}
+
+// update 関数は、マネージャの状態からゲージを更新する
+// NOTE: マネージャの状態はメインループのみが参照するため、メインループから呼び出すこと
+func (m *managerMetrics) update(list AllDistributedBrokerInfo, updating bool, gateways map[string]*GatewayBrokerInfo, statuses map[string]GatewayBrokerStatus, spares []BrokerInfo) {
+	m.brokertableVersion.Set(float64(list.Version))
+	if updating {
+		m.brokertableUpdating.Set(1)
+	} else {
+		m.brokertableUpdating.Set(0)
+	}
+
+	primaries, replicas := 0, 0
+	for _, info := range list.DMBs {
+		if info.Role == RoleReplica {
+			replicas++
+		} else {
+			primaries++
+		}
+	}
+	m.distributedBrokers.With("primary").Set(float64(primaries))
+	m.distributedBrokers.With("replica").Set(float64(replicas))
+
+	m.gateways.Set(float64(len(gateways)))
+	m.gatewayWorkers.Set(float64(len(statuses)))
+	outdated := 0
+	for _, s := range statuses {
+		if s.Version != list.Version {
+			outdated++
+		}
+	}
+	m.outdatedWorkers.Set(float64(outdated))
+	m.spareBrokers.Set(float64(len(spares)))
+}
+
+//////////////        以上、Metrics 関連             //////////////
@@ -0,0 +1,235 @@
+package manager
+
+import (
+	"fmt"
+	"gamma/pkg/autoscale"
+	"gamma/pkg/brokertable"
+	"sort"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// 変更案の種類
+const (
+	PlanActionAdd    = "add"    // 分散ブローカの追加（/api/tool/distributedbroker/add と同じ）
+	PlanActionRemove = "remove" // 分散ブローカの削除（担当範囲を親ノードの分散ブローカへ戻す）
+)
+
+// planResultTopic は、Response Topic が指定されていない場合に変更案の評価結果を Publish するトピック
+const planResultTopic = "/api/plan/result"
+
+// PlanRequest は、/api/tool/plan で評価する分散ブローカの変更案
+type PlanRequest struct {
+	Action string                `json:"action"`
+	Broker DistributedBrokerInfo `json:"broker"`
+}
+
+// OwnerChange は、担当する分散ブローカ（"host:port"）が変わるトピック
+// NOTE: トピックは、そのノード以下のうち、より深いノードが担当していないトピックを表す
+type OwnerChange struct {
+	Topic string `json:"topic"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// PlanGateway は、新しいバージョンのブローカテーブルの更新完了を通知する必要があるゲートウェイ（ワーカごと）
+// MovedSubscriptions は、担当する分散ブローカが変わるトピックの Subscriber 数（Reported が false の場合は不明）
+type PlanGateway struct {
+	BrokerInfo         BrokerInfo `json:"broker_info"`
+	Worker             uint       `json:"worker,omitempty"`
+	Reported           bool       `json:"reported"`
+	MovedSubscriptions uint       `json:"moved_subscriptions"`
+}
+
+// Plan は、変更案を適用した場合の結果（適用はしない）
+// Pending は、他の更新が完了していないため、現時点では変更を適用できないことを表す
+type Plan struct {
+	Request      PlanRequest              `json:"request"`
+	Brokertable  AllDistributedBrokerInfo `json:"brokertable"`
+	OwnerChanges []OwnerChange            `json:"owner_changes"`
+	Gateways     []PlanGateway            `json:"gateways"`
+	Pending      bool                     `json:"pending"`
+	Error        string                   `json:"error,omitempty"`
+}
+
+// SubscriptionReport は、ゲートウェイから定期的に通知される、トピックごとの Subscriber 数
+type SubscriptionReport struct {
+	BrokerInfo    BrokerInfo      `json:"broker_info"`
+	Worker        uint            `json:"worker,omitempty"`
+	Subscriptions map[string]uint `json:"subscriptions"`
+}
+
+// planChange 関数は、現在のブローカテーブル list に変更案 req を適用した場合の結果を返す
+// gateways, reports は、ゲートウェイ（ワーカ）ごとの状態と Subscriber 数（キーは "host-port-worker"）
+// NOTE: list, gateways, reports は変更しない
+func planChange(list AllDistributedBrokerInfo, req PlanRequest, gateways map[string]GatewayBrokerStatus, reports map[string]SubscriptionReport) (Plan, error) {
+	plan := Plan{Request: req, OwnerChanges: []OwnerChange{}, Gateways: []PlanGateway{}}
+	current, err := buildBrokertable(list.DMBs)
+	if err != nil {
+		return plan, err
+	}
+	next := current.Clone()
+	info := req.Broker
+	dmbs := append([]DistributedBrokerInfo{}, list.DMBs...)
+	var changed []string
+	switch req.Action {
+	case PlanActionAdd:
+		if err := validateNewDistributedBroker(dmbs, info); err != nil {
+			return plan, err
+		}
+		dmbs = append(dmbs, info)
+		sort.SliceStable(dmbs, func(i, j int) bool {
+			return len(dmbs[i].Topic) < len(dmbs[j].Topic)
+		})
+		// NOTE: レプリカの追加では、担当する分散ブローカは変わらない
+		if info.Role == RoleReplica {
+			err = brokertable.AddReplica(next, info.Topic, info.BrokerInfo.Host, info.BrokerInfo.Port)
+		} else {
+			changed, err = brokertable.ReassignHost(next, info.Topic, info.BrokerInfo.Host, info.BrokerInfo.Port)
+		}
+	case PlanActionRemove:
+		// NOTE: 自動的な統合と同様に、ルートノード・レプリカを持つ分散ブローカ・レプリカは削除しない
+		if info.Role == RoleReplica {
+			return plan, PlanError{Msg: "Removing a replica is not supported."}
+		}
+		if replicatedTopics(dmbs)[info.Topic] {
+			return plan, PlanError{Msg: fmt.Sprintf("The distributed broker of %v has replicas.", info.Topic)}
+		}
+		list := AllDistributedBrokerInfo{DMBs: dmbs}
+		if _, ok := removeDistributedBroker(&list, autoscale.Broker{Topic: info.Topic, Address: info.BrokerInfo.Address()}); !ok {
+			return plan, PlanError{Msg: fmt.Sprintf("The distributed broker (%v, %v) is not exists.", info.Topic, info.BrokerInfo.Address())}
+		}
+		dmbs = list.DMBs
+		changed, err = brokertable.RemoveNode(next, info.Topic)
+	default:
+		return plan, PlanError{Msg: fmt.Sprintf("Unknown action (%v).", req.Action)}
+	}
+	if err != nil {
+		return plan, err
+	}
+	plan.Brokertable = AllDistributedBrokerInfo{Version: list.Version + 1, DMBs: dmbs}
+
+	for _, topic := range changed {
+		plan.OwnerChanges = append(plan.OwnerChanges, OwnerChange{Topic: topic, From: lookupAddress(current, topic), To: lookupAddress(next, topic)})
+	}
+
+	keys := make([]string, 0, len(gateways))
+	for key := range gateways {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		status := gateways[key]
+		g := PlanGateway{BrokerInfo: status.BrokerInfo, Worker: status.Worker}
+		if report, ok := reports[key]; ok {
+			g.Reported = true
+			g.MovedSubscriptions = movedSubscriptions(current, next, report.Subscriptions)
+		}
+		plan.Gateways = append(plan.Gateways, g)
+	}
+	return plan, nil
+}
+
+// buildBrokertable 関数は、ゲートウェイと同じ手順で、分散ブローカの一覧からブローカテーブルを構築する
+// 分散ブローカが登録されていない場合は、どのトピックも担当していない空のノードを返す
+// NOTE: 先頭はルートノードを担当する分散ブローカであること
+func buildBrokertable(dmbs []DistributedBrokerInfo) (*brokertable.Node, error) {
+	root := &brokertable.Node{}
+	if len(dmbs) == 0 {
+		return root, nil
+	}
+	if err := brokertable.UpdateHost(root, dmbs[0].Topic, dmbs[0].BrokerInfo.Host, dmbs[0].BrokerInfo.Port); err != nil {
+		return nil, err
+	}
+	for _, info := range dmbs[1:] {
+		if info.Role == RoleReplica {
+			if err := brokertable.AddReplica(root, info.Topic, info.BrokerInfo.Host, info.BrokerInfo.Port); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if _, err := brokertable.ReassignHost(root, info.Topic, info.BrokerInfo.Host, info.BrokerInfo.Port); err != nil {
+			return nil, err
+		}
+	}
+	return root, nil
+}
+
+// movedSubscriptions 関数は、current から next へ更新した場合に、担当する分散ブローカが変わるトピックの Subscriber 数を返す
+// NOTE: ワイルドカードを含むトピックは、引き継がずに新しい分散ブローカへ追加で Subscribe するため数えない
+func movedSubscriptions(current *brokertable.Node, next *brokertable.Node, subscriptions map[string]uint) uint {
+	var moved uint
+	for topic, count := range subscriptions {
+		if strings.ContainsAny(topic, "+#") {
+			continue
+		}
+		if from := lookupAddress(current, topic); from != "" && from != lookupAddress(next, topic) {
+			moved += count
+		}
+	}
+	return moved
+}
+
+// lookupAddress 関数は、トピックを担当している分散ブローカ（"host:port"）を返す（担当していない・不正なトピックの場合は空文字列）
+func lookupAddress(root *brokertable.Node, topic string) string {
+	host, port, err := brokertable.LookupHost(root, topic)
+	if err != nil || host == "" {
+		return ""
+	}
+	return fmt.Sprintf("%v:%v", host, port)
+}
+
+// distributedBrokerKey 関数は、分散ブローカの登録（トピック・ホスト・ポート・役割）を識別する文字列を返す
+func distributedBrokerKey(info DistributedBrokerInfo) string {
+	return fmt.Sprintf("%v %v %v", info.Topic, info.BrokerInfo.Address(), info.Role)
+}
+
+// validateNewDistributedBroker 関数は、分散ブローカ info を dmbs へ追加できるかどうかを確認する
+func validateNewDistributedBroker(dmbs []DistributedBrokerInfo, info DistributedBrokerInfo) error {
+	if err := info.BrokerInfo.Validate(); err != nil {
+		return err
+	}
+	if containsDistributedBroker(dmbs, info.BrokerInfo) {
+		return PlanError{Msg: fmt.Sprintf("This broker (%v) is already exists.", info.BrokerInfo.Address())}
+	}
+	// NOTE: ゲートウェイは最初の分散ブローカをルートノードの担当として扱うため、ルートノードから登録する
+	if len(dmbs) == 0 && (info.Topic != "/" || info.Role == RoleReplica) {
+		return PlanError{Msg: fmt.Sprintf("The first distributed broker must be the root (%v).", info.Topic)}
+	}
+	// レプリカの場合は、同じトピックを担当している分散ブローカが存在することを確認する
+	if info.Role == RoleReplica && !hasPrimary(dmbs, info.Topic) {
+		return PlanError{Msg: fmt.Sprintf("There is no distributed broker to replicate (%v).", info.Topic)}
+	}
+	return nil
+}
+
+// respondPlan 関数は、/api/tool/plan の要求 m に評価結果を応答する
+// MQTT v5 の Response Topic が指定されている場合はそのトピックへ、指定されていない場合は /api/plan/result へ Publish する
+func respondPlan(client mqtt.Client, m mqtt.Message, plan Plan) {
+	topic, err := respondJSON(client, m, planResultTopic, plan)
+	if err != nil {
+		log.WithFields(log.Fields{"topic": topic, "error": err}).Error("Plan error")
+		return
+	}
+	log.WithFields(log.Fields{
+		"topic":         topic,
+		"action":        plan.Request.Action,
+		"owner_changes": len(plan.OwnerChanges),
+		"error":         plan.Error,
+	}).Info("Responded plan")
+}
+
+//////////////             以下、エラー 関連              //////////////
+
+// PlanError は、変更案を適用できない場合のエラー
+type PlanError struct {
+	Msg string
+}
+
+func (e PlanError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+//////////////             以上、エラー 関連              //////////////
@@ -0,0 +1,103 @@
+package manager
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanChange(t *testing.T) {
+	root := DistributedBrokerInfo{Topic: "/", BrokerInfo: BrokerInfo{Host: "localhost", Port: 1893}}
+	zero := DistributedBrokerInfo{Topic: "/0", BrokerInfo: BrokerInfo{Host: "localhost", Port: 1894}}
+	one := DistributedBrokerInfo{Topic: "/1", BrokerInfo: BrokerInfo{Host: "localhost", Port: 1895}}
+	replica := DistributedBrokerInfo{Topic: "/0", BrokerInfo: BrokerInfo{Host: "localhost", Port: 1896}, Role: RoleReplica}
+	list := AllDistributedBrokerInfo{Version: 3, DMBs: []DistributedBrokerInfo{root, zero}}
+
+	gatewayA := BrokerInfo{Host: "localhost", Port: 1883}
+	gatewayB := BrokerInfo{Host: "localhost", Port: 1884}
+	gateways := map[string]GatewayBrokerStatus{
+		"localhost-1883-0": {Status: "complete", Version: 3, BrokerInfo: gatewayA},
+		"localhost-1884-0": {Status: "complete", Version: 3, BrokerInfo: gatewayB},
+	}
+	reports := map[string]SubscriptionReport{
+		"localhost-1883-0": {BrokerInfo: gatewayA, Subscriptions: map[string]uint{"/0/1": 2, "/1/2": 3, "/1/+": 4, "/2/0": 1}},
+	}
+
+	tests := []struct {
+		name    string
+		req     PlanRequest
+		want    Plan
+		wantErr bool
+	}{
+		{
+			name: "Normal scenario 01 (add)",
+			req:  PlanRequest{Action: PlanActionAdd, Broker: one},
+			want: Plan{
+				Brokertable:  AllDistributedBrokerInfo{Version: 4, DMBs: []DistributedBrokerInfo{root, zero, one}},
+				OwnerChanges: []OwnerChange{{Topic: "/1", From: "localhost:1893", To: "localhost:1895"}},
+				Gateways: []PlanGateway{
+					{BrokerInfo: gatewayA, Reported: true, MovedSubscriptions: 3},
+					{BrokerInfo: gatewayB},
+				},
+			},
+		},
+		{
+			name: "Normal scenario 02 (remove)",
+			req:  PlanRequest{Action: PlanActionRemove, Broker: zero},
+			want: Plan{
+				Brokertable:  AllDistributedBrokerInfo{Version: 4, DMBs: []DistributedBrokerInfo{root}},
+				OwnerChanges: []OwnerChange{{Topic: "/0", From: "localhost:1894", To: "localhost:1893"}},
+				Gateways: []PlanGateway{
+					{BrokerInfo: gatewayA, Reported: true, MovedSubscriptions: 2},
+					{BrokerInfo: gatewayB},
+				},
+			},
+		},
+		{
+			name: "Normal scenario 03 (add replica)",
+			req:  PlanRequest{Action: PlanActionAdd, Broker: replica},
+			want: Plan{
+				Brokertable:  AllDistributedBrokerInfo{Version: 4, DMBs: []DistributedBrokerInfo{root, zero, replica}},
+				OwnerChanges: []OwnerChange{},
+				Gateways: []PlanGateway{
+					{BrokerInfo: gatewayA, Reported: true},
+					{BrokerInfo: gatewayB},
+				},
+			},
+		},
+		{name: "Error scenario 01 (duplicate broker)", req: PlanRequest{Action: PlanActionAdd, Broker: DistributedBrokerInfo{Topic: "/1", BrokerInfo: zero.BrokerInfo}}, wantErr: true},
+		{name: "Error scenario 02 (replica without primary)", req: PlanRequest{Action: PlanActionAdd, Broker: DistributedBrokerInfo{Topic: "/1", BrokerInfo: replica.BrokerInfo, Role: RoleReplica}}, wantErr: true},
+		{name: "Error scenario 03 (remove root)", req: PlanRequest{Action: PlanActionRemove, Broker: root}, wantErr: true},
+		{name: "Error scenario 04 (remove unknown broker)", req: PlanRequest{Action: PlanActionRemove, Broker: one}, wantErr: true},
+		{name: "Error scenario 05 (unknown action)", req: PlanRequest{Action: "move", Broker: one}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := planChange(list, tt.req, gateways, reports)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("planChange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			tt.want.Request = tt.req
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("planChange() = %+v, expected %+v", got, tt.want)
+			}
+		})
+	}
+
+	// 分散ブローカが登録されていない場合は、ルートノードの分散ブローカのみ登録できる
+	empty := AllDistributedBrokerInfo{Version: -1, DMBs: []DistributedBrokerInfo{}}
+	got, err := planChange(empty, PlanRequest{Action: PlanActionAdd, Broker: root}, nil, nil)
+	if want := []OwnerChange{{Topic: "/", From: "", To: "localhost:1893"}}; err != nil || got.Brokertable.Version != 0 || !reflect.DeepEqual(got.OwnerChanges, want) {
+		t.Errorf("planChange() = %+v, %v, expected owner changes %+v", got, err, want)
+	}
+	if _, err := planChange(empty, PlanRequest{Action: PlanActionAdd, Broker: zero}, nil, nil); err == nil {
+		t.Errorf("planChange() error = nil, expected error")
+	}
+
+	// 変更案は適用しない
+	if want := []DistributedBrokerInfo{root, zero}; list.Version != 3 || !reflect.DeepEqual(list.DMBs, want) {
+		t.Errorf("planChange() modified list = %+v", list)
+	}
+}
@@ -0,0 +1,177 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// topologyStatusTopic は、トポロジファイルに記述された構成のうち、まだ揃っていない分散ブローカ・ゲートウェイを通知するトピック
+const topologyStatusTopic = "/api/topology/status"
+
+// Topology は、マネージャの起動時に読み込む宣言的な構成（分散ブローカの担当トピックと、ゲートウェイの担当エリア）
+// NOTE: マネージャは分散ブローカ・ゲートウェイのプロセスを起動しない。起動して登録・通知してきたものを、記述された構成で登録する
+type Topology struct {
+	DistributedBrokers []DistributedBrokerInfo `json:"distributed_brokers"`
+	Gateways           []GatewayBrokerInfo     `json:"gateways"`
+}
+
+// TopologyStatus は、Topology の構成のうち、ブローカテーブルに登録されていない分散ブローカと、起動していないゲートウェイ
+type TopologyStatus struct {
+	MissingDistributedBrokers []DistributedBrokerInfo `json:"missing_distributed_brokers"`
+	MissingGateways           []GatewayBrokerInfo     `json:"missing_gateways"`
+	Complete                  bool                    `json:"complete"`
+}
+
+// LoadTopology 関数は、JSON ファイルから Topology 構造体を生成する
+// 例: {"distributed_brokers":[{"topic":"/","broker_info":{"host":"localhost","port":1893}},{"topic":"/0","broker_info":{"host":"localhost","port":1894}}],
+// "gateways":[{"topics":["/0"],"broker_info":{"host":"localhost","port":1884}}]}
+func LoadTopology(path string) (*Topology, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, TopologyError{Msg: fmt.Sprintf("Could not read topology file (%v): %v", path, err)}
+	}
+	t := &Topology{}
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, TopologyError{Msg: fmt.Sprintf("Could not parse topology file (%v): %v", path, err)}
+	}
+	// NOTE: ブローカテーブルと同様に、レプリカセット内の優先度（記述順）を保つため、安定ソートとする
+	sort.SliceStable(t.DistributedBrokers, func(i, j int) bool {
+		return len(t.DistributedBrokers[i].Topic) < len(t.DistributedBrokers[j].Topic)
+	})
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Validate 関数は、記述された順に全ての分散ブローカを登録できること、ゲートウェイの担当エリアが正しいことを検証する
+func (t *Topology) Validate() error {
+	list := AllDistributedBrokerInfo{Version: -1, DMBs: []DistributedBrokerInfo{}}
+	for _, info := range t.DistributedBrokers {
+		plan, err := planChange(list, PlanRequest{Action: PlanActionAdd, Broker: info}, nil, nil)
+		if err != nil {
+			return TopologyError{Msg: fmt.Sprintf("Invalid distributed broker (%v, %v): %v", info.Topic, info.BrokerInfo.Address(), err)}
+		}
+		list = plan.Brokertable
+	}
+	gateways := map[string]bool{}
+	for _, g := range t.Gateways {
+		if err := g.BrokerInfo.Validate(); err != nil {
+			return TopologyError{Msg: fmt.Sprintf("Invalid gateway (%v): %v", g.BrokerInfo.Address(), err)}
+		}
+		if gateways[g.BrokerInfo.Address()] {
+			return TopologyError{Msg: fmt.Sprintf("Duplicate gateway (%v).", g.BrokerInfo.Address())}
+		}
+		gateways[g.BrokerInfo.Address()] = true
+		if len(g.Topics) == 0 {
+			return TopologyError{Msg: fmt.Sprintf("Gateway (%v) has no cover area.", g.BrokerInfo.Address())}
+		}
+		for _, topic := range g.Topics {
+			if !strings.HasPrefix(topic, "/") {
+				return TopologyError{Msg: fmt.Sprintf("Invalid cover area of gateway (%v): %v", g.BrokerInfo.Address(), topic)}
+			}
+		}
+	}
+	return nil
+}
+
+// DistributedBroker 関数は、b と同じホスト・ポートの分散ブローカの記述を返す
+// NOTE: nil の場合は、記述されていないものとして扱う
+func (t *Topology) DistributedBroker(b BrokerInfo) (DistributedBrokerInfo, bool) {
+	if t == nil {
+		return DistributedBrokerInfo{}, false
+	}
+	for _, info := range t.DistributedBrokers {
+		if info.BrokerInfo.Host == b.Host && info.BrokerInfo.Port == b.Port {
+			return info, true
+		}
+	}
+	return DistributedBrokerInfo{}, false
+}
+
+// Gateway 関数は、b と同じホスト・ポートのゲートウェイの記述を返す
+// NOTE: nil の場合は、記述されていないものとして扱う
+func (t *Topology) Gateway(b BrokerInfo) (GatewayBrokerInfo, bool) {
+	if t == nil {
+		return GatewayBrokerInfo{}, false
+	}
+	for _, g := range t.Gateways {
+		if g.BrokerInfo.Host == b.Host && g.BrokerInfo.Port == b.Port {
+			return g, true
+		}
+	}
+	return GatewayBrokerInfo{}, false
+}
+
+// DeclaredTopics 関数は、記述された分散ブローカ（レプリカを除く）が担当するトピックを返す
+// NOTE: 統合しても NextStep 関数で再び登録されるため、負荷に応じて統合しない
+func (t *Topology) DeclaredTopics() map[string]bool {
+	topics := map[string]bool{}
+	if t == nil {
+		return topics
+	}
+	for _, info := range t.DistributedBrokers {
+		if info.Role != RoleReplica {
+			topics[info.Topic] = true
+		}
+	}
+	return topics
+}
+
+// NextStep 関数は、ブローカテーブル list に登録されていない分散ブローカのうち、起動している（available に "host:port" が含まれる）
+// 最初のものを追加する変更を返す
+// NOTE: 他の分散ブローカが同じホスト・ポートで別のトピックを担当している場合など、追加できないものは飛ばす
+func (t *Topology) NextStep(list AllDistributedBrokerInfo, available map[string]bool) (PlanRequest, bool) {
+	for _, info := range t.missingDistributedBrokers(list) {
+		if !available[info.BrokerInfo.Address()] {
+			continue
+		}
+		step := PlanRequest{Action: PlanActionAdd, Broker: info}
+		if _, err := planChange(list, step, nil, nil); err == nil {
+			return step, true
+		}
+	}
+	return PlanRequest{}, false
+}
+
+// Status 関数は、ブローカテーブル list に登録されていない分散ブローカと、gateways（キーは "host-port"）に含まれないゲートウェイを返す
+func (t *Topology) Status(list AllDistributedBrokerInfo, gateways map[string]*GatewayBrokerInfo) TopologyStatus {
+	status := TopologyStatus{MissingDistributedBrokers: t.missingDistributedBrokers(list), MissingGateways: []GatewayBrokerInfo{}}
+	for _, g := range t.Gateways {
+		if _, ok := gateways[fmt.Sprintf("%v-%v", g.BrokerInfo.Host, g.BrokerInfo.Port)]; !ok {
+			status.MissingGateways = append(status.MissingGateways, g)
+		}
+	}
+	status.Complete = len(status.MissingDistributedBrokers) == 0 && len(status.MissingGateways) == 0
+	return status
+}
+
+func (t *Topology) missingDistributedBrokers(list AllDistributedBrokerInfo) []DistributedBrokerInfo {
+	registered := map[string]bool{}
+	for _, info := range list.DMBs {
+		registered[distributedBrokerKey(info)] = true
+	}
+	missing := []DistributedBrokerInfo{}
+	for _, info := range t.DistributedBrokers {
+		if !registered[distributedBrokerKey(info)] {
+			missing = append(missing, info)
+		}
+	}
+	return missing
+}
+
+//////////////             以下、エラー 関連              //////////////
+
+// TopologyError は、トポロジファイルが不正な場合のエラー
+type TopologyError struct {
+	Msg string
+}
+
+func (e TopologyError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+//////////////             以上、エラー 関連              //////////////
@@ -0,0 +1,143 @@
+package manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadTopology(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topology")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{
+			name: "Normal scenario 01",
+			content: `{"distributed_brokers":[{"topic":"/0","broker_info":{"host":"localhost","port":1894}},{"topic":"/","broker_info":{"host":"localhost","port":1893}}],
+				"gateways":[{"topics":["/0"],"broker_info":{"host":"localhost","port":1884}}]}`,
+		},
+		{name: "Error scenario 01 (invalid json)", content: `{"distributed_brokers":`, wantErr: true},
+		{name: "Error scenario 02 (no root)", content: `{"distributed_brokers":[{"topic":"/0","broker_info":{"host":"localhost","port":1894}}]}`, wantErr: true},
+		{
+			name:    "Error scenario 03 (duplicate distributed broker)",
+			content: `{"distributed_brokers":[{"topic":"/","broker_info":{"host":"localhost","port":1893}},{"topic":"/0","broker_info":{"host":"localhost","port":1893}}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "Error scenario 04 (replica without primary)",
+			content: `{"distributed_brokers":[{"topic":"/","broker_info":{"host":"localhost","port":1893}},{"topic":"/0","broker_info":{"host":"localhost","port":1894},"role":"replica"}]}`,
+			wantErr: true,
+		},
+		{name: "Error scenario 05 (no cover area)", content: `{"gateways":[{"topics":[],"broker_info":{"host":"localhost","port":1884}}]}`, wantErr: true},
+		{
+			name:    "Error scenario 06 (duplicate gateway)",
+			content: `{"gateways":[{"topics":["/"],"broker_info":{"host":"localhost","port":1884}},{"topics":["/0"],"broker_info":{"host":"localhost","port":1884}}]}`,
+			wantErr: true,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, filepath.Base(t.Name())+".json")
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("ioutil.WriteFile() error = %v", err)
+			}
+			got, err := LoadTopology(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadTopology() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			// ルートノードの分散ブローカから登録する
+			if i == 0 && got.DistributedBrokers[0].Topic != "/" {
+				t.Errorf("LoadTopology() = %+v, expected the root first", got.DistributedBrokers)
+			}
+		})
+	}
+
+	if _, err := LoadTopology(filepath.Join(dir, "not_exists.json")); err == nil {
+		t.Errorf("LoadTopology() error = nil, expected error")
+	}
+}
+
+func TestTopologyReconcile(t *testing.T) {
+	root := DistributedBrokerInfo{Topic: "/", BrokerInfo: BrokerInfo{Host: "localhost", Port: 1893}}
+	zero := DistributedBrokerInfo{Topic: "/0", BrokerInfo: BrokerInfo{Host: "localhost", Port: 1894}}
+	one := DistributedBrokerInfo{Topic: "/1", BrokerInfo: BrokerInfo{Host: "localhost", Port: 1895}}
+	gateway := GatewayBrokerInfo{Topics: []string{"/0"}, BrokerInfo: BrokerInfo{Host: "localhost", Port: 1884}}
+	topology := &Topology{DistributedBrokers: []DistributedBrokerInfo{root, zero, one}, Gateways: []GatewayBrokerInfo{gateway}}
+	if err := topology.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		list      []DistributedBrokerInfo
+		available []DistributedBrokerInfo
+		want      PlanRequest
+		wantOK    bool
+	}{
+		{name: "Normal scenario 01 (nothing is available)", list: []DistributedBrokerInfo{}},
+		{name: "Normal scenario 02 (wait for the root)", list: []DistributedBrokerInfo{}, available: []DistributedBrokerInfo{one}},
+		{
+			name:      "Normal scenario 03 (root)",
+			list:      []DistributedBrokerInfo{},
+			available: []DistributedBrokerInfo{root, one},
+			want:      PlanRequest{Action: PlanActionAdd, Broker: root},
+			wantOK:    true,
+		},
+		{
+			name:      "Normal scenario 04 (skip unavailable brokers)",
+			list:      []DistributedBrokerInfo{root},
+			available: []DistributedBrokerInfo{root, one},
+			want:      PlanRequest{Action: PlanActionAdd, Broker: one},
+			wantOK:    true,
+		},
+		{name: "Normal scenario 05 (all registered)", list: []DistributedBrokerInfo{root, zero, one}, available: []DistributedBrokerInfo{root, zero, one}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			available := map[string]bool{}
+			for _, info := range tt.available {
+				available[info.BrokerInfo.Address()] = true
+			}
+			got, ok := topology.NextStep(AllDistributedBrokerInfo{DMBs: tt.list}, available)
+			if ok != tt.wantOK || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NextStep() = %+v, %v, expected %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	want := TopologyStatus{MissingDistributedBrokers: []DistributedBrokerInfo{one}, MissingGateways: []GatewayBrokerInfo{gateway}}
+	if got := topology.Status(AllDistributedBrokerInfo{DMBs: []DistributedBrokerInfo{root, zero}}, map[string]*GatewayBrokerInfo{}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Status() = %+v, expected %+v", got, want)
+	}
+	gateways := map[string]*GatewayBrokerInfo{"localhost-1884": &gateway}
+	want = TopologyStatus{MissingDistributedBrokers: []DistributedBrokerInfo{}, MissingGateways: []GatewayBrokerInfo{}, Complete: true}
+	if got := topology.Status(AllDistributedBrokerInfo{DMBs: []DistributedBrokerInfo{root, zero, one}}, gateways); !reflect.DeepEqual(got, want) {
+		t.Errorf("Status() = %+v, expected %+v", got, want)
+	}
+
+	wantTopics := map[string]bool{"/": true, "/0": true, "/1": true}
+	if got := topology.DeclaredTopics(); !reflect.DeepEqual(got, wantTopics) {
+		t.Errorf("DeclaredTopics() = %v, expected %v", got, wantTopics)
+	}
+
+	// nil の場合は、記述されていないものとして扱う
+	var empty *Topology
+	if got := empty.DeclaredTopics(); len(got) != 0 {
+		t.Errorf("DeclaredTopics() = %v, expected no topics", got)
+	}
+	if _, ok := empty.DistributedBroker(root.BrokerInfo); ok {
+		t.Errorf("DistributedBroker() = true, expected false")
+	}
+	if _, ok := empty.Gateway(gateway.BrokerInfo); ok {
+		t.Errorf("Gateway() = true, expected false")
+	}
+}
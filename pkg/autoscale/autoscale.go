@@ -0,0 +1,372 @@
+package autoscale
+
+import (
+	"fmt"
+	"gamma/pkg/traffic"
+	"sort"
+	"strings"
+	"time"
+)
+
+//////////////        以下、Policy 関連              //////////////
+
+// Policy 構造体は、マネージャが分散ブローカの負荷に応じて担当トピックを分割・統合する条件を表す
+type Policy struct {
+	SplitThreshold       float64       // 分散ブローカの負荷（1 秒あたりのメッセージの数）がこの値を超えた場合に分割する（0 の場合は分割しない）
+	SplitSustain         time.Duration // 負荷が SplitThreshold を超えた状態がこの期間続いた場合に分割する
+	ConsolidateThreshold float64       // 分散ブローカの負荷がこの値を下回った場合に、親ノードの分散ブローカへ統合する（0 の場合は統合しない）
+	ConsolidateAfter     time.Duration // 負荷が ConsolidateThreshold を下回った状態がこの期間続いた場合に統合する
+	Cooldown             time.Duration // 構成を変更してから、次に変更しない期間（ゲートウェイの統計が新しい構成を反映するまで待つ）
+	Pinned               []string      // 統合しないサブツリー（このトピック以下を担当する分散ブローカは統合しない）
+}
+
+// IsEnabled 関数は、負荷に応じて分割・統合するかどうかを返す
+func (p Policy) IsEnabled() bool {
+	return p.SplitThreshold > 0 || p.ConsolidateThreshold > 0
+}
+
+// Validate 関数は、条件が正しいかどうかを検証する
+func (p Policy) Validate() error {
+	if p.SplitThreshold < 0 {
+		return PolicyError{Msg: fmt.Sprintf("Invalid split threshold (%v). Split threshold must not be negative.", p.SplitThreshold)}
+	}
+	if p.SplitSustain < 0 {
+		return PolicyError{Msg: fmt.Sprintf("Invalid split sustain (%v). Split sustain must not be negative.", p.SplitSustain)}
+	}
+	if p.ConsolidateThreshold < 0 {
+		return PolicyError{Msg: fmt.Sprintf("Invalid consolidate threshold (%v). Consolidate threshold must not be negative.", p.ConsolidateThreshold)}
+	}
+	if p.ConsolidateThreshold > 0 && p.ConsolidateAfter <= 0 {
+		return PolicyError{Msg: fmt.Sprintf("Invalid consolidate period (%v). Consolidate period must be greater than 0 when consolidate threshold is set.", p.ConsolidateAfter)}
+	}
+	// NOTE: 統合した直後に分割しないように、統合する負荷は分割する負荷より小さくする
+	if p.SplitThreshold > 0 && p.ConsolidateThreshold >= p.SplitThreshold {
+		return PolicyError{Msg: fmt.Sprintf("Consolidate threshold (%v) must be less than split threshold (%v).", p.ConsolidateThreshold, p.SplitThreshold)}
+	}
+	for _, t := range p.Pinned {
+		if !strings.HasPrefix(t, "/") {
+			return PolicyError{Msg: fmt.Sprintf("Invalid pinned topic (%v).", t)}
+		}
+	}
+	if p.Cooldown < 0 {
+		return PolicyError{Msg: fmt.Sprintf("Invalid cooldown (%v). Cooldown must not be negative.", p.Cooldown)}
+	}
+	return nil
+}
+
+//////////////        以上、Policy 関連              //////////////
+//////////////        以下、Load 関連                //////////////
+
+// Broker 構造体は、トピックを担当している分散ブローカ（レプリカを除く）
+type Broker struct {
+	Topic   string // 担当しているトピック
+	Address string // 分散ブローカを識別する文字列（endpoint.Endpoint.Address()）
+}
+
+// BrokerLoad 構造体は、分散ブローカの負荷
+type BrokerLoad struct {
+	Broker
+	Rate float64 // 担当しているタイルの 1 秒あたりのメッセージの数の合計
+}
+
+// Owner 関数は、tile を担当している分散ブローカ（トピックが最も長く一致するもの）を返す
+// NOTE: tile が分散ブローカのトピックより浅い場合は、tile の先頭を担当している分散ブローカとする
+func Owner(brokers []Broker, tile string) (Broker, bool) {
+	var owner Broker
+	found := false
+	for _, b := range brokers {
+		if !covers(b.Topic, tile) {
+			continue
+		}
+		if !found || len(b.Topic) > len(owner.Topic) {
+			owner = b
+			found = true
+		}
+	}
+	return owner, found
+}
+
+// covers 関数は、トピック topic の分散ブローカが tile を担当するかどうかを返す
+func covers(topic string, tile string) bool {
+	return topic == "/" || tile == topic || strings.HasPrefix(tile, topic+"/")
+}
+
+// depth 関数は、topic のレベルの数を返す（"/" の場合は 0）
+func depth(topic string) int {
+	if topic == "/" {
+		return 0
+	}
+	return strings.Count(topic, "/")
+}
+
+// Loads 関数は、タイルごとの負荷を担当している分散ブローカごとに合計し、brokers の順に返す
+func Loads(brokers []Broker, tiles []traffic.TileRate) []BrokerLoad {
+	rates := map[Broker]float64{}
+	for _, t := range tiles {
+		if owner, ok := Owner(brokers, t.Topic); ok {
+			rates[owner] += t.Rate
+		}
+	}
+	loads := make([]BrokerLoad, 0, len(brokers))
+	for _, b := range brokers {
+		loads = append(loads, BrokerLoad{Broker: b, Rate: rates[b]})
+	}
+	return loads
+}
+
+// ChildLoads 関数は、分散ブローカ b が担当しているタイルの負荷を、b のトピックの 1 つ下のレベル（子のサブツリー）ごとに合計する
+// 他の分散ブローカが担当しているタイル、b のトピックより深くないタイルは含めない
+func ChildLoads(b Broker, brokers []Broker, tiles []traffic.TileRate) map[string]float64 {
+	children := map[string]float64{}
+	d := depth(b.Topic)
+	for _, t := range tiles {
+		if owner, ok := Owner(brokers, t.Topic); !ok || owner != b || depth(t.Topic) <= d {
+			continue
+		}
+		children[traffic.Prefix(t.Topic, d+1)] += t.Rate
+	}
+	return children
+}
+
+//////////////        以上、Load 関連                //////////////
+//////////////        以下、Scaler 関連              //////////////
+
+// Split 構造体は、分散ブローカ From が担当しているサブツリー Topic を、予備の分散ブローカへ割り当てる変更
+type Split struct {
+	From      Broker
+	FromRate  float64 // From の負荷
+	Topic     string  // 割り当てるサブツリー
+	TopicRate float64 // Topic の負荷
+}
+
+// Consolidation 構造体は、分散ブローカ Broker の担当範囲を親ノードの分散ブローカへ戻す変更
+type Consolidation struct {
+	Broker     Broker
+	Rate       float64 // Broker の負荷
+	Parent     Broker  // 担当範囲を引き継ぐ分散ブローカ
+	ParentRate float64 // Parent の負荷
+}
+
+// Scaler 構造体は、分散ブローカの負荷を監視し、担当トピックの分割・統合を判断する
+// NOTE: 短時間の負荷の変動で構成を変更し続けないように、以下のヒステリシスを設ける
+//   - 負荷が閾値を超えた状態が SplitSustain 続くまで分割しない
+//   - 負荷が閾値を下回った状態が ConsolidateAfter 続くまで統合しない
+//   - 統合すると親ノードの分散ブローカが分割する閾値を超える場合は統合しない
+//   - 構成を変更してから Cooldown の間は分割・統合しない
+type Scaler struct {
+	policy     Policy
+	overSince  map[Broker]time.Time // 負荷が閾値を超え始めた時刻
+	underSince map[Broker]time.Time // 負荷が閾値を下回り始めた時刻
+	pinned     map[string]bool
+	lastChange time.Time
+}
+
+// NewScaler 関数は、policy の条件で判断する Scaler を生成する（分割・統合しない場合は nil）
+func NewScaler(policy Policy) *Scaler {
+	if !policy.IsEnabled() {
+		return nil
+	}
+	s := &Scaler{policy: policy, overSince: map[Broker]time.Time{}, underSince: map[Broker]time.Time{}, pinned: map[string]bool{}}
+	for _, t := range policy.Pinned {
+		s.Pin(t)
+	}
+	return s
+}
+
+// Pin 関数は、topic 以下を担当する分散ブローカを統合しないようにする
+func (s *Scaler) Pin(topic string) {
+	if s == nil {
+		return
+	}
+	s.pinned[topic] = true
+}
+
+// Unpin 関数は、Pin 関数で統合しないようにしたサブツリーを、再び統合できるようにする
+func (s *Scaler) Unpin(topic string) {
+	if s == nil {
+		return
+	}
+	delete(s.pinned, topic)
+}
+
+// Pinned 関数は、統合しないサブツリーをトピックの順に返す
+func (s *Scaler) Pinned() []string {
+	if s == nil {
+		return nil
+	}
+	topics := make([]string, 0, len(s.pinned))
+	for t := range s.pinned {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// IsPinned 関数は、topic がいずれかの統合しないサブツリーに含まれるかどうかを返す
+func (s *Scaler) IsPinned(topic string) bool {
+	if s == nil {
+		return false
+	}
+	for t := range s.pinned {
+		if covers(t, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate 関数は、時刻 now の時点の負荷から、分割するべきサブツリーを返す（分割しない場合は false）
+// 閾値を超えた状態が最も長く続いている分散ブローカについて、最も負荷が高い子のサブツリーを選ぶ
+func (s *Scaler) Evaluate(now time.Time, brokers []Broker, tiles []traffic.TileRate) (Split, bool) {
+	if s == nil || s.policy.SplitThreshold <= 0 {
+		return Split{}, false
+	}
+	loads := Loads(brokers, tiles)
+	over := map[Broker]bool{}
+	for _, l := range loads {
+		if l.Rate <= s.policy.SplitThreshold {
+			continue
+		}
+		over[l.Broker] = true
+		if _, ok := s.overSince[l.Broker]; !ok {
+			s.overSince[l.Broker] = now
+		}
+	}
+	for b := range s.overSince {
+		if !over[b] {
+			delete(s.overSince, b)
+		}
+	}
+	if now.Sub(s.lastChange) < s.policy.Cooldown {
+		return Split{}, false
+	}
+
+	// 閾値を超えた状態が長く続いている順に試す
+	sort.SliceStable(loads, func(i, j int) bool {
+		return s.overSinceOf(loads[i].Broker, now).Before(s.overSinceOf(loads[j].Broker, now))
+	})
+	for _, l := range loads {
+		since, ok := s.overSince[l.Broker]
+		if !ok || now.Sub(since) < s.policy.SplitSustain {
+			continue
+		}
+		children := ChildLoads(l.Broker, brokers, tiles)
+		topic, rate := hottest(children)
+		if topic == "" {
+			// タイルが分散ブローカのトピックより深くない場合は、分割できない
+			continue
+		}
+		return Split{From: l.Broker, FromRate: l.Rate, Topic: topic, TopicRate: rate}, true
+	}
+	return Split{}, false
+}
+
+// EvaluateConsolidation 関数は、時刻 now の時点の負荷から、親ノードの分散ブローカへ統合するべき分散ブローカを返す（統合しない場合は false）
+// 閾値を下回った状態が最も長く続いている分散ブローカを選ぶ
+// NOTE: ルートノード、統合しないサブツリー、excluded のトピックを担当する分散ブローカ（レプリカを持つものなど）は統合しない
+func (s *Scaler) EvaluateConsolidation(now time.Time, brokers []Broker, excluded map[string]bool, tiles []traffic.TileRate) (Consolidation, bool) {
+	if s == nil || s.policy.ConsolidateThreshold <= 0 {
+		return Consolidation{}, false
+	}
+	loads := Loads(brokers, tiles)
+	rates := map[Broker]float64{}
+	under := map[Broker]bool{}
+	for _, l := range loads {
+		rates[l.Broker] = l.Rate
+		if l.Topic == "/" || l.Rate >= s.policy.ConsolidateThreshold {
+			continue
+		}
+		under[l.Broker] = true
+		if _, ok := s.underSince[l.Broker]; !ok {
+			s.underSince[l.Broker] = now
+		}
+	}
+	for b := range s.underSince {
+		if !under[b] {
+			delete(s.underSince, b)
+		}
+	}
+	if now.Sub(s.lastChange) < s.policy.Cooldown {
+		return Consolidation{}, false
+	}
+
+	candidates := []Consolidation{}
+	for _, l := range loads {
+		since, ok := s.underSince[l.Broker]
+		if !ok || now.Sub(since) < s.policy.ConsolidateAfter || s.IsPinned(l.Topic) || excluded[l.Topic] {
+			continue
+		}
+		parent, ok := Owner(brokers, parentTopic(l.Topic))
+		if !ok {
+			continue
+		}
+		// 統合した結果、親ノードの分散ブローカを分割することにならないようにする
+		if s.policy.SplitThreshold > 0 && rates[parent]+l.Rate > s.policy.SplitThreshold {
+			continue
+		}
+		candidates = append(candidates, Consolidation{Broker: l.Broker, Rate: l.Rate, Parent: parent, ParentRate: rates[parent]})
+	}
+	if len(candidates) == 0 {
+		return Consolidation{}, false
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return s.underSince[candidates[i].Broker].Before(s.underSince[candidates[j].Broker])
+	})
+	return candidates[0], true
+}
+
+// parentTopic 関数は、topic の親ノードのトピックを返す（例: "/0/1" => "/0", "/0" => "/"）
+func parentTopic(topic string) string {
+	i := strings.LastIndex(topic, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return topic[:i]
+}
+
+// overSinceOf 関数は、負荷が閾値を超え始めた時刻を返す（超えていない場合は now）
+func (s *Scaler) overSinceOf(b Broker, now time.Time) time.Time {
+	if since, ok := s.overSince[b]; ok {
+		return since
+	}
+	return now
+}
+
+// Changed 関数は、時刻 now に構成を変更したことを記録する（Cooldown の起点とする）
+func (s *Scaler) Changed(now time.Time) {
+	if s == nil {
+		return
+	}
+	s.lastChange = now
+	s.overSince = map[Broker]time.Time{}
+	s.underSince = map[Broker]time.Time{}
+}
+
+// hottest 関数は、最も負荷が高いサブツリーを返す（負荷が等しい場合はトピックの順で先のもの）
+func hottest(children map[string]float64) (string, float64) {
+	topic, rate := "", 0.0
+	for t, r := range children {
+		if r <= 0 {
+			continue
+		}
+		if topic == "" || r > rate || (r == rate && t < topic) {
+			topic, rate = t, r
+		}
+	}
+	return topic, rate
+}
+
+//////////////        以上、Scaler 関連              //////////////
+//////////////        以下、エラー 関連              //////////////
+
+// PolicyError 構造体
+// 条件が不正な場合に返される
+type PolicyError struct {
+	Msg string
+}
+
+func (e PolicyError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+//////////////        以上、エラー 関連              //////////////
@@ -0,0 +1,176 @@
+package autoscale_test
+
+import (
+	"gamma/pkg/autoscale"
+	"gamma/pkg/traffic"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	root = autoscale.Broker{Topic: "/", Address: "localhost:1893"}
+	zero = autoscale.Broker{Topic: "/0", Address: "localhost:1894"}
+)
+
+func TestLoads(t *testing.T) {
+	brokers := []autoscale.Broker{root, zero}
+	tiles := []traffic.TileRate{
+		{Topic: "/0/1", Rate: 3},
+		{Topic: "/0/2", Rate: 2},
+		{Topic: "/1/0", Rate: 4},
+		{Topic: "/1/1", Rate: 1},
+	}
+	want := []autoscale.BrokerLoad{{Broker: root, Rate: 5}, {Broker: zero, Rate: 5}}
+	if got := autoscale.Loads(brokers, tiles); !reflect.DeepEqual(got, want) {
+		t.Errorf("Loads() = %+v, expected %+v", got, want)
+	}
+	wantChildren := map[string]float64{"/1": 5}
+	if got := autoscale.ChildLoads(root, brokers, tiles); !reflect.DeepEqual(got, wantChildren) {
+		t.Errorf("ChildLoads() = %+v, expected %+v", got, wantChildren)
+	}
+	wantChildren = map[string]float64{"/0/1": 3, "/0/2": 2}
+	if got := autoscale.ChildLoads(zero, brokers, tiles); !reflect.DeepEqual(got, wantChildren) {
+		t.Errorf("ChildLoads() = %+v, expected %+v", got, wantChildren)
+	}
+}
+
+func TestScalerEvaluate(t *testing.T) {
+	start := time.Unix(1000000, 0)
+	brokers := []autoscale.Broker{root, zero}
+	hot := []traffic.TileRate{
+		{Topic: "/0/1", Rate: 30},
+		{Topic: "/0/2", Rate: 20},
+		{Topic: "/1/0", Rate: 4},
+	}
+	cold := []traffic.TileRate{{Topic: "/0/1", Rate: 3}}
+	s := autoscale.NewScaler(autoscale.Policy{SplitThreshold: 40, SplitSustain: time.Minute, Cooldown: 5 * time.Minute})
+
+	tests := []struct {
+		name   string
+		now    time.Time
+		tiles  []traffic.TileRate
+		want   autoscale.Split
+		wantOK bool
+	}{
+		{name: "Normal scenario 01 (not sustained yet)", now: start, tiles: hot},
+		{name: "Normal scenario 02 (load dropped, reset)", now: start.Add(30 * time.Second), tiles: cold},
+		{name: "Normal scenario 03 (over threshold again)", now: start.Add(40 * time.Second), tiles: hot},
+		{name: "Normal scenario 04 (not sustained since reset)", now: start.Add(90 * time.Second), tiles: hot},
+		{
+			name:   "Normal scenario 05 (sustained)",
+			now:    start.Add(100 * time.Second),
+			tiles:  hot,
+			want:   autoscale.Split{From: zero, FromRate: 50, Topic: "/0/1", TopicRate: 30},
+			wantOK: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := s.Evaluate(tt.now, brokers, tt.tiles)
+			if ok != tt.wantOK || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Evaluate() = %+v, %v, expected %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	// 構成を変更してから Cooldown の間は分割しない
+	s.Changed(start.Add(100 * time.Second))
+	if _, ok := s.Evaluate(start.Add(5*time.Minute), brokers, hot); ok {
+		t.Errorf("Evaluate() = true during cooldown, expected false")
+	}
+	if _, ok := s.Evaluate(start.Add(7*time.Minute), brokers, hot); !ok {
+		t.Errorf("Evaluate() = false after cooldown, expected true")
+	}
+
+	// 分割しない場合は nil
+	if s := autoscale.NewScaler(autoscale.Policy{}); s != nil {
+		t.Errorf("NewScaler() = %v, expected nil", s)
+	}
+}
+
+func TestScalerEvaluateConsolidation(t *testing.T) {
+	start := time.Unix(1000000, 0)
+	one := autoscale.Broker{Topic: "/1", Address: "localhost:1895"}
+	pinned := autoscale.Broker{Topic: "/2/3", Address: "localhost:1896"}
+	replicated := autoscale.Broker{Topic: "/3", Address: "localhost:1897"}
+	brokers := []autoscale.Broker{root, zero, one, pinned, replicated}
+	busy := []traffic.TileRate{{Topic: "/0/1", Rate: 5}, {Topic: "/1/0", Rate: 1}, {Topic: "/4/0", Rate: 10}}
+	idle := []traffic.TileRate{{Topic: "/0/1", Rate: 1}, {Topic: "/1/0", Rate: 1}, {Topic: "/4/0", Rate: 10}}
+	s := autoscale.NewScaler(autoscale.Policy{
+		SplitThreshold:       40,
+		SplitSustain:         time.Minute,
+		ConsolidateThreshold: 2,
+		ConsolidateAfter:     10 * time.Minute,
+		Pinned:               []string{"/2"},
+	})
+
+	tests := []struct {
+		name   string
+		now    time.Time
+		tiles  []traffic.TileRate
+		want   autoscale.Consolidation
+		wantOK bool
+	}{
+		// /0 は負荷が閾値以上、/1, /2/3, /3 は負荷が閾値を下回り始める
+		{name: "Normal scenario 01 (not idle long enough)", now: start, tiles: busy},
+		// /0 が閾値を下回り始める
+		{name: "Normal scenario 02 (idle)", now: start.Add(time.Minute), tiles: idle},
+		{
+			// /1 が最も長く閾値を下回っている（/2/3 は統合しない、/3 はレプリカを持つ）
+			name:   "Normal scenario 03 (idle long enough)",
+			now:    start.Add(10 * time.Minute),
+			tiles:  idle,
+			want:   autoscale.Consolidation{Broker: one, Rate: 1, Parent: root, ParentRate: 10},
+			wantOK: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := s.EvaluateConsolidation(tt.now, brokers, map[string]bool{"/3": true}, tt.tiles)
+			if ok != tt.wantOK || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("EvaluateConsolidation() = %+v, %v, expected %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	// 統合すると親ノードの分散ブローカが分割する閾値を超える場合は統合しない
+	s.Changed(start.Add(10 * time.Minute))
+	hotParent := []traffic.TileRate{{Topic: "/0/1", Rate: 1}, {Topic: "/1/0", Rate: 1}, {Topic: "/4/0", Rate: 39.5}}
+	replicatedTopics := map[string]bool{"/3": true}
+	s.EvaluateConsolidation(start.Add(11*time.Minute), brokers, replicatedTopics, hotParent)
+	if got, ok := s.EvaluateConsolidation(start.Add(30*time.Minute), brokers, replicatedTopics, hotParent); ok {
+		t.Errorf("EvaluateConsolidation() = %+v, true, expected false", got)
+	}
+
+	// Unpin した場合は統合する（負荷が 0 のため、親ノードの分散ブローカは閾値を超えない）
+	s.Unpin("/2")
+	if s.IsPinned("/2/3") {
+		t.Errorf("IsPinned(/2/3) = true, expected false")
+	}
+	want := autoscale.Consolidation{Broker: pinned, Rate: 0, Parent: root, ParentRate: 39.5}
+	if got, ok := s.EvaluateConsolidation(start.Add(31*time.Minute), brokers, replicatedTopics, hotParent); !ok || got != want {
+		t.Errorf("EvaluateConsolidation() = %+v, %v, expected %+v", got, ok, want)
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  autoscale.Policy
+		wantErr bool
+	}{
+		{name: "Normal scenario 01 (disabled)", policy: autoscale.Policy{}},
+		{name: "Normal scenario 02 (split and consolidate)", policy: autoscale.Policy{SplitThreshold: 10, ConsolidateThreshold: 1, ConsolidateAfter: time.Minute}},
+		{name: "Error scenario 01 (consolidate threshold is not less than split threshold)", policy: autoscale.Policy{SplitThreshold: 10, ConsolidateThreshold: 10, ConsolidateAfter: time.Minute}, wantErr: true},
+		{name: "Error scenario 02 (no consolidate period)", policy: autoscale.Policy{ConsolidateThreshold: 1}, wantErr: true},
+		{name: "Error scenario 03 (invalid pinned topic)", policy: autoscale.Policy{SplitThreshold: 10, Pinned: []string{"0"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
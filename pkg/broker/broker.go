@@ -2,6 +2,11 @@ package broker
 
 import (
 	"fmt"
+	"gamma/pkg/circuitbreaker"
+	"gamma/pkg/credential"
+	"gamma/pkg/endpoint"
+	"gamma/pkg/mqttv5"
+	"gamma/pkg/outbox"
 	"gamma/pkg/subsctable"
 	"sync"
 	"time"
@@ -21,31 +26,56 @@ type Broker interface {
 	IncreaseSubCnt() error
 	DecreaseSubCnt() error
 	GetSubCnt() uint
+	GetSubCntByTopic() map[string]uint
 	UpdateLastPub()
 	GetLastPub() time.Time
-	CreateSubsetBroker(host string, port uint16, qos byte, ch chan<- mqtt.Message, topic string) (Broker, error)
+	CreateSubsetBroker(e endpoint.Endpoint, cred credential.Credential, qos byte, ch chan<- mqtt.Message, topic string) (Broker, error)
 	SubscribeAll()
-	UnsubscribeSubsetTopics(topic string) error
+	UnsubscribeSubsetTopics(topic string) (uint, error)
+	UnsubscribeAll() (uint, error)
+	MergeSubsetBroker(child Broker, topic string) error
+	RecountSubCnt()
+	CheckSubCnt() error
+	SetAggregationPolicy(policy subsctable.AggregationPolicy) error
+	AddReplica(e endpoint.Endpoint, cred credential.Credential) error
+	SetPublishQuorum(quorum uint)
+	Failover() (bool, error)
+	SetOutbox(o *outbox.Outbox)
+	ReplayOutbox() int
+	GetOutboxStats() outbox.Stats
+	SetCircuitPolicy(policy circuitbreaker.Policy, name string)
+	Available() bool
+	GetCircuitState() circuitbreaker.State
+	getSubsctable() subsctable.Subsctable
 }
 
 // 分散ブローカに関するデータを管理する構造体
 type broker struct {
-	Client    mqtt.Client
-	SubCntMu  sync.RWMutex
-	SubCnt    uint // 接続先分散ブローカーへ Subscribe 要求している MQTT クライアントの数
-	LastPubMu sync.RWMutex
-	LastPub   time.Time // 接続先分散ブローカーへ MQTT クライアントが最後に Publish 要求をした時刻
-	subTb     subsctable.Subsctable
-	qos       byte
+	Client     mqtt.Client // Subscribe に使用するクライアント（Replicas のうちの 1 つ）
+	SubCntMu   sync.RWMutex
+	SubCnt     uint // 接続先分散ブローカーへ Subscribe 要求している MQTT クライアントの数
+	LastPubMu  sync.RWMutex
+	LastPub    time.Time // 接続先分散ブローカーへ MQTT クライアントが最後に Publish 要求をした時刻
+	ReplicasMu sync.RWMutex
+	Replicas   []mqtt.Client // 同じトピックを担当する分散ブローカ（レプリカセット）へのクライアント（優先度の高い順）
+	subTb      subsctable.Subsctable
+	qos        byte
+	quorum     uint // Publish 時に配送する必要があるレプリカの数（0 の場合は全てのレプリカ）
+	outboxMu   sync.RWMutex
+	outbox     *outbox.Outbox // 接続できない間に Publish するメッセージを保持する（nil の場合は保持しない）
+	circuitMu  sync.RWMutex
+	circuit    *circuitbreaker.Breaker // Publish に失敗し続けた場合に、この分散ブローカを使用しないようにする（nil の場合は常に使用する）
+	timeout    time.Duration           // Publish の完了を待つ最大の時間（0 の場合は無制限に待つ）
 }
 
 func NewBroker(c mqtt.Client, qos byte, ch chan<- mqtt.Message) Broker {
 	return &broker{
-		Client:  c,
-		SubCnt:  0,
-		LastPub: time.Now(),
-		qos:     qos,
-		subTb:   subsctable.NewSubsctable(c, qos, ch),
+		Client:   c,
+		SubCnt:   0,
+		LastPub:  time.Now(),
+		Replicas: []mqtt.Client{c},
+		qos:      qos,
+		subTb:    subsctable.NewSubsctable(c, qos, ch),
 	}
 
 }
@@ -54,23 +84,35 @@ func (b *broker) getQos() byte {
 	return b.qos
 }
 
-func (b *broker) CreateSubsetBroker(host string, port uint16, qos byte, ch chan<- mqtt.Message, topic string) (Broker, error) {
-	c, err := connectBroker(host, port, ch)
+func (b *broker) getSubsctable() subsctable.Subsctable {
+	return b.subTb
+}
+
+func (b *broker) CreateSubsetBroker(e endpoint.Endpoint, cred credential.Credential, qos byte, ch chan<- mqtt.Message, topic string) (Broker, error) {
+	c, err := connectBroker(e, cred, ch)
 	if err != nil {
 		return nil, err
 	}
+	return b.createSubsetBroker(c, qos, ch, topic)
+}
 
+// createSubsetBroker 関数は、与えられたトピック以下を担当する broker 構造体を生成する
+// SubCnt は、引き継いだトピックの Subscriber 数の合計とする
+// NOTE: 新たな分散ブローカは、元の分散ブローカのレプリカを引き継がない
+func (b *broker) createSubsetBroker(c mqtt.Client, qos byte, ch chan<- mqtt.Message, topic string) (Broker, error) {
 	subTb, err := b.subTb.GetSubsetSubsctable(c, qos, ch, topic)
 	if err != nil {
 		return nil, err
 	}
 
 	return &broker{
-		Client:  c,
-		SubCnt:  0,
-		LastPub: time.Now(),
-		qos:     qos,
-		subTb:   subTb,
+		Client:   c,
+		SubCnt:   subTb.CountSubscribers(),
+		LastPub:  time.Now(),
+		Replicas: []mqtt.Client{c},
+		qos:      qos,
+		subTb:    subTb,
+		quorum:   b.getPublishQuorum(),
 	}, nil
 }
 
@@ -78,14 +120,181 @@ func (b *broker) SubscribeAll() {
 	b.subTb.SubscribeAll()
 }
 
-func (b *broker) UnsubscribeSubsetTopics(topic string) error {
-	return b.subTb.UnsubscribeSubsetTopics(topic)
+// UnsubscribeSubsetTopics 関数は、与えられたトピック以下のトピックを Unsubscribe し、
+// 新たな分散ブローカへ引き継いだ Subscriber 数を SubCnt から差し引く
+func (b *broker) UnsubscribeSubsetTopics(topic string) (uint, error) {
+	b.SubCntMu.Lock()
+	defer b.SubCntMu.Unlock()
+
+	movedCnt, err := b.subTb.UnsubscribeSubsetTopics(topic)
+	if err != nil {
+		return 0, err
+	}
+	if movedCnt > b.SubCnt {
+		b.SubCnt = 0
+		return movedCnt, SubCntMismatchError{Msg: fmt.Sprintf("Moved SubCnt (%v) is greater than SubCnt", movedCnt)}
+	}
+	b.SubCnt -= movedCnt
+	return movedCnt, nil
 }
 
-func connectBroker(host string, port uint16, ch chan<- mqtt.Message) (mqtt.Client, error) {
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%v:%v", host, port))
-	c := mqtt.NewClient(opts)
+// UnsubscribeAll 関数は、全てのトピックを Unsubscribe し、切り離した Subscriber 数を SubCnt から差し引く
+func (b *broker) UnsubscribeAll() (uint, error) {
+	b.SubCntMu.Lock()
+	defer b.SubCntMu.Unlock()
+
+	removedCnt, err := b.subTb.UnsubscribeAll()
+	if err != nil {
+		return 0, err
+	}
+	if removedCnt > b.SubCnt {
+		b.SubCnt = 0
+		return removedCnt, SubCntMismatchError{Msg: fmt.Sprintf("Removed SubCnt (%v) is greater than SubCnt", removedCnt)}
+	}
+	b.SubCnt -= removedCnt
+	return removedCnt, nil
+}
+
+// MergeSubsetBroker 関数は、CreateSubsetBroker 関数の逆の操作として、与えられたトピック以下を担当していた
+// 分散ブローカ child の Subscriber を引き継ぐ
+// 統合後の child は Subscribe しているトピックを持たないため、Subscriber の有無によらず切断できる
+func (b *broker) MergeSubsetBroker(child Broker, topic string) error {
+	b.SubCntMu.Lock()
+	mergedCnt, err := b.subTb.MergeSubsctable(child.getSubsctable(), topic)
+	b.SubCnt += mergedCnt
+	b.SubCntMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// NOTE: 統合したノードは両方の Subsctable で共有されるため、child から切り離す
+	if _, err := child.UnsubscribeSubsetTopics(topic); err != nil {
+		return err
+	}
+	// child に残るのは複製したワイルドカードトピック（例: "/0/+/2"）のみで、自身が引き続き受信するため切り離す
+	_, err = child.UnsubscribeAll()
+	return err
+}
+
+// RecountSubCnt 関数は、SubCnt を Subsctable に登録されている Subscriber 数の合計に合わせる
+// 分散ブローカの追加後、元の分散ブローカが担当していた間に増減した Subscriber 数を引き継ぐ際に使用する
+func (b *broker) RecountSubCnt() {
+	b.SubCntMu.Lock()
+	defer b.SubCntMu.Unlock()
+	b.SubCnt = b.subTb.CountSubscribers()
+}
+
+// CheckSubCnt 関数は、SubCnt と Subsctable に登録されている Subscriber 数の合計が一致するかどうかを検証する
+func (b *broker) CheckSubCnt() error {
+	b.SubCntMu.RLock()
+	defer b.SubCntMu.RUnlock()
+	if cnt := b.subTb.CountSubscribers(); cnt != b.SubCnt {
+		return SubCntMismatchError{Msg: fmt.Sprintf("SubCnt (%v) does not match the number of subscribers in subsctable (%v)", b.SubCnt, cnt)}
+	}
+	return nil
+}
+
+// SetAggregationPolicy 関数は、Subscribe するトピックを親ノードのワイルドカードトピックへ集約する条件を設定する
+func (b *broker) SetAggregationPolicy(policy subsctable.AggregationPolicy) error {
+	return b.subTb.SetAggregationPolicy(policy)
+}
+
+// AddReplica 関数は、同じトピックを担当する分散ブローカへ接続し、レプリカセットの末尾（最も優先度が低い）に追加する
+// 追加したレプリカは Publish にのみ使用し、Subscribe はフェイルオーバー時まで行わない
+func (b *broker) AddReplica(e endpoint.Endpoint, cred credential.Credential) error {
+	c, err := connectBroker(e, cred, nil)
+	if err != nil {
+		return err
+	}
+	b.addReplica(c)
+	return nil
+}
+
+func (b *broker) addReplica(c mqtt.Client) {
+	b.ReplicasMu.Lock()
+	defer b.ReplicasMu.Unlock()
+	if len(b.Replicas) == 0 {
+		b.Replicas = []mqtt.Client{b.Client}
+	}
+	b.Replicas = append(b.Replicas, c)
+}
+
+// getReplicas 関数は、レプリカセットへのクライアントを返す
+func (b *broker) getReplicas() []mqtt.Client {
+	b.ReplicasMu.RLock()
+	defer b.ReplicasMu.RUnlock()
+	if len(b.Replicas) == 0 {
+		return []mqtt.Client{b.Client}
+	}
+	return b.Replicas
+}
+
+// getPublishOrder 関数は、Publish 時にレプリカへ配送する順序を返す（Subscribe に使用しているクライアントが先頭）
+func (b *broker) getPublishOrder() []mqtt.Client {
+	b.ReplicasMu.RLock()
+	defer b.ReplicasMu.RUnlock()
+	if len(b.Replicas) <= 1 {
+		return []mqtt.Client{b.Client}
+	}
+	order := make([]mqtt.Client, 0, len(b.Replicas))
+	order = append(order, b.Client)
+	for _, c := range b.Replicas {
+		if c != b.Client {
+			order = append(order, c)
+		}
+	}
+	return order
+}
+
+// SetPublishQuorum 関数は、Publish 時に配送する必要があるレプリカの数を設定する（0 の場合は全てのレプリカ）
+func (b *broker) SetPublishQuorum(quorum uint) {
+	b.ReplicasMu.Lock()
+	defer b.ReplicasMu.Unlock()
+	b.quorum = quorum
+}
+
+func (b *broker) getPublishQuorum() uint {
+	b.ReplicasMu.RLock()
+	defer b.ReplicasMu.RUnlock()
+	return b.quorum
+}
+
+// Failover 関数は、Subscribe に使用している分散ブローカとの接続が切れている場合、
+// 接続中のレプリカのうち最も優先度の高いものへ Subscribe 中のトピックを全て移す
+// 戻り値は、フェイルオーバーを行ったかどうか
+// NOTE: 元の分散ブローカとの接続が回復してもフェイルバックは行わない（切り替えが頻発するのを避けるため）
+func (b *broker) Failover() (bool, error) {
+	b.ReplicasMu.Lock()
+	defer b.ReplicasMu.Unlock()
+
+	// レプリカが存在しない場合は、フェイルオーバー先が無いため何もしない
+	if len(b.Replicas) <= 1 || b.Client.IsConnectionOpen() {
+		return false, nil
+	}
+	for _, c := range b.Replicas {
+		if c == b.Client || !c.IsConnectionOpen() {
+			continue
+		}
+		// MQTT v5 のクライアントは再接続時に Subscribe し直すため、移したトピックを元のクライアントから削除する
+		if old, ok := b.Client.(*mqttv5.Client); ok {
+			old.ForgetSubscriptions()
+		}
+		b.Client = c
+		b.subTb.ReplaceClient(c)
+		opt := c.OptionsReader()
+		log.WithFields(log.Fields{"servers": opt.Servers()}).Info("Failed over to replica")
+		return true, nil
+	}
+	return false, NoHealthyReplicaError{Msg: fmt.Sprintf("There is no connected replica (replicas = %v)", len(b.Replicas))}
+}
+
+// connectBroker 関数は、e の URL スキーム（tcp, ssl, ws, wss）で、cred の認証情報・TLS の設定を用いて分散ブローカへ接続する
+func connectBroker(e endpoint.Endpoint, cred credential.Credential, ch chan<- mqtt.Message) (mqtt.Client, error) {
+	opts, err := credential.NewClientOptions(e, cred)
+	if err != nil {
+		return nil, err
+	}
+	c := mqttv5.NewClientFor(e, opts)
 	if token := c.Connect(); token.Wait() && token.Error() != nil {
 		log.WithFields(log.Fields{"func": "ConnectBroker", "error": token.Error()}).Debug("Connect error")
 		return nil, token.Error()
@@ -93,8 +302,8 @@ func connectBroker(host string, port uint16, ch chan<- mqtt.Message) (mqtt.Clien
 	return c, nil
 }
 
-func ConnectBroker(host string, port uint16, qos byte, ch chan<- mqtt.Message) (Broker, error) {
-	c, err := connectBroker(host, port, ch)
+func ConnectBroker(e endpoint.Endpoint, cred credential.Credential, qos byte, ch chan<- mqtt.Message) (Broker, error) {
+	c, err := connectBroker(e, cred, ch)
 	if err != nil {
 		return nil, err
 	}
@@ -102,23 +311,179 @@ func ConnectBroker(host string, port uint16, qos byte, ch chan<- mqtt.Message) (
 	return b, nil
 }
 
+// Publish 関数は、レプリカセットのうち接続中のレプリカへ quorum 個まで Publish する
+// NOTE: Subscribe に使用しているレプリカへ最初に配送し、以降は優先度の高い順に配送する
+// （quorum が全てのレプリカより少ない場合でも、このプログラムが Subscribe しているレプリカには必ず配送するため）
+// Outbox が設定されている場合、どのレプリカへも配送できなかったメッセージは Outbox に保持し、ReplayOutbox 関数で再送する
+// （一部のレプリカへ配送できた場合は、重複して配送しないよう保持しない）
 func (b *broker) Publish(topic string, retained bool, payload interface{}) {
-	token := b.Client.Publish(topic, b.qos, retained, payload)
-	token.Wait()
-	if token.Error() != nil {
-		log.WithFields(log.Fields{"error": token.Error()}).Error("MQTT publish error")
+	defer b.UpdateLastPub()
+	o := b.getOutbox()
+	// 保持しているメッセージがある場合は、Publish した順に配送するため先に再送する
+	if o.Len() > 0 {
+		if b.replayOutbox(); o.Len() > 0 {
+			if !o.Enqueue(topic, retained, payload) {
+				log.WithFields(log.Fields{"topic": topic}).Error("Outbox is full, dropped message")
+			}
+			return
+		}
 	}
-	b.UpdateLastPub()
+
+	delivered, quorum := b.publish(topic, retained, payload)
+	if delivered == 0 {
+		b.getCircuit().Failure()
+	} else {
+		b.getCircuit().Success()
+	}
+	if delivered == 0 && o != nil {
+		if o.Enqueue(topic, retained, payload) {
+			log.WithFields(log.Fields{"topic": topic}).Debug("Buffered message (distributed broker is unreachable)")
+		} else {
+			log.WithFields(log.Fields{"topic": topic}).Error("Outbox is full, dropped message")
+		}
+		return
+	}
+	if delivered < quorum {
+		log.WithFields(log.Fields{"topic": topic, "delivered": delivered, "quorum": quorum}).Error("MQTT publish quorum is not satisfied")
+	}
+}
+
+// publish 関数は、接続中のレプリカへ quorum 個まで Publish し、配送できたレプリカの数と quorum を返す
+func (b *broker) publish(topic string, retained bool, payload interface{}) (int, int) {
+	replicas := b.getPublishOrder()
+	quorum := int(b.getPublishQuorum())
+	if quorum == 0 || quorum > len(replicas) {
+		quorum = len(replicas)
+	}
+	timeout := b.getPublishTimeout()
+
+	delivered := 0
+	for _, c := range replicas {
+		if delivered >= quorum {
+			break
+		}
+		if !c.IsConnectionOpen() {
+			continue
+		}
+		// MQTT v5 のプロパティ（mqttv5.Publication）は、MQTT 3.1.1 で接続しているレプリカへは引き継がない
+		token := c.Publish(topic, b.qos, retained, mqttv5.PayloadFor(c, payload))
+		if !waitToken(token, timeout) {
+			log.WithFields(log.Fields{"topic": topic, "timeout": timeout}).Error("MQTT publish timeout")
+			continue
+		}
+		if token.Error() != nil {
+			log.WithFields(log.Fields{"error": token.Error()}).Error("MQTT publish error")
+			continue
+		}
+		delivered++
+	}
+	return delivered, quorum
+}
+
+// waitToken 関数は、timeout まで token の完了を待ち、完了したかどうかを返す（timeout が 0 の場合は完了するまで待つ）
+func waitToken(token mqtt.Token, timeout time.Duration) bool {
+	if timeout == 0 {
+		return token.Wait()
+	}
+	return token.WaitTimeout(timeout)
+}
+
+// SetOutbox 関数は、接続できない間に Publish するメッセージを保持する Outbox を設定する（nil の場合は保持しない）
+func (b *broker) SetOutbox(o *outbox.Outbox) {
+	b.outboxMu.Lock()
+	defer b.outboxMu.Unlock()
+	b.outbox = o
+}
+
+func (b *broker) getOutbox() *outbox.Outbox {
+	b.outboxMu.RLock()
+	defer b.outboxMu.RUnlock()
+	return b.outbox
+}
+
+// ReplayOutbox 関数は、Outbox に保持しているメッセージを保持した順に再送し、再送した数を返す
+// どのレプリカへも配送できなかった場合は、そのメッセージ以降を保持したまま終了する
+// NOTE: 分散ブローカとの再接続後に再送するため、定期的に呼び出すこと
+// サーキットブレーカが開いている間は再送しない（半開の場合は、再送の結果で回復したかどうかを判定する）
+func (b *broker) ReplayOutbox() int {
+	if b.getOutbox().Len() == 0 || !b.Available() {
+		return 0
+	}
+	return b.replayOutbox()
+}
+
+// replayOutbox 関数は、サーキットブレーカの状態を確認せずに、Outbox に保持しているメッセージを再送する
+func (b *broker) replayOutbox() int {
+	o := b.getOutbox()
+	if o.Len() == 0 {
+		return 0
+	}
+	replayed := o.Replay(func(e outbox.Entry) bool {
+		delivered, _ := b.publish(e.Topic, e.Retained, e.PublishPayload(time.Now()))
+		return delivered > 0
+	})
+	if replayed > 0 || o.Len() == 0 {
+		b.getCircuit().Success()
+	} else {
+		b.getCircuit().Failure()
+	}
+	if replayed > 0 {
+		opt := b.Client.OptionsReader()
+		log.WithFields(log.Fields{"servers": opt.Servers(), "replayed": replayed, "pending": o.Len()}).Info("Replayed buffered messages")
+	}
+	return replayed
+}
+
+// SetCircuitPolicy 関数は、Publish に失敗し続けた場合にこの分散ブローカを使用しないようにする条件と、Publish の完了を待つ最大の時間を設定する
+// name は、ログに出力する分散ブローカの名前
+func (b *broker) SetCircuitPolicy(policy circuitbreaker.Policy, name string) {
+	b.circuitMu.Lock()
+	defer b.circuitMu.Unlock()
+	b.circuit = circuitbreaker.New(policy, name)
+	b.timeout = policy.PublishTimeout
+}
+
+func (b *broker) getCircuit() *circuitbreaker.Breaker {
+	b.circuitMu.RLock()
+	defer b.circuitMu.RUnlock()
+	return b.circuit
+}
+
+func (b *broker) getPublishTimeout() time.Duration {
+	b.circuitMu.RLock()
+	defer b.circuitMu.RUnlock()
+	return b.timeout
+}
+
+// Available 関数は、この分散ブローカへ Publish してよいかどうか（サーキットブレーカが開いていないかどうか）を返す
+// NOTE: 半開の場合は 1 回だけ true を返すため、true の場合は必ず Publish すること
+func (b *broker) Available() bool {
+	return b.getCircuit().Allow()
 }
 
+// GetCircuitState 関数は、サーキットブレーカの状態を返す
+func (b *broker) GetCircuitState() circuitbreaker.State {
+	return b.getCircuit().State()
+}
+
+// GetOutboxStats 関数は、Outbox に保持しているメッセージに関する統計を返す
+func (b *broker) GetOutboxStats() outbox.Stats {
+	return b.getOutbox().Stats()
+}
+
+// NOTE: SubCnt は Subsctable への登録に成功した場合のみ増減させる（SubCnt と Subsctable の Subscriber 数を一致させるため）
 func (b *broker) Subscribe(topic string) error {
-	b.IncreaseSubCnt()
-	return b.subTb.IncreaseSubscriber(topic)
+	if err := b.subTb.IncreaseSubscriber(topic); err != nil {
+		return err
+	}
+	return b.IncreaseSubCnt()
 }
 
 func (b *broker) Unsubscribe(topic string) error {
-	b.DecreaseSubCnt()
-	return b.subTb.DecreaseSubscriber(topic)
+	if err := b.subTb.DecreaseSubscriber(topic); err != nil {
+		return err
+	}
+	return b.DecreaseSubCnt()
 }
 
 func (b *broker) TryDisconnect(expirationFromLastPub time.Duration, quiesce uint) bool {
@@ -131,19 +496,38 @@ func (b *broker) TryDisconnect(expirationFromLastPub time.Duration, quiesce uint
 		log.WithFields(log.Fields{"servers": opt.Servers()}).Debug("TryDisconnect()")
 		return false
 	}
+	// 再送していないメッセージがある場合は切断しない
+	if b.getOutbox().Len() != 0 {
+		log.WithFields(log.Fields{"servers": opt.Servers()}).Debug("TryDisconnect()")
+		return false
+	}
 	log.WithFields(log.Fields{"servers": opt.Servers()}).Debug("TryDisconnect()")
-	b.Client.Disconnect(quiesce)
+	for _, c := range b.getReplicas() {
+		c.Disconnect(quiesce)
+	}
+	b.closeOutbox()
 	return true
 }
 
 func (b *broker) Disconnect(quiesce uint) {
 	opt := b.Client.OptionsReader()
 	log.WithFields(log.Fields{"servers": opt.Servers()}).Debug("Disconnect()")
-	b.Client.Disconnect(quiesce)
+	for _, c := range b.getReplicas() {
+		c.Disconnect(quiesce)
+	}
+	b.closeOutbox()
 	b.SubCnt = 0
 	b.LastPub = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC) // Unix time の基準日
 }
 
+// closeOutbox 関数は、Outbox を閉じる（ディスクへ書き出している場合は、保持しているメッセージを次回の接続時に引き継ぐ）
+func (b *broker) closeOutbox() {
+	if err := b.getOutbox().Close(); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Outbox close error")
+	}
+	b.SetOutbox(nil)
+}
+
 func (b *broker) IncreaseSubCnt() error {
 	var maxSubCnt uint = 0xffffffff
 	b.SubCntMu.Lock()
@@ -173,6 +557,13 @@ func (b *broker) GetSubCnt() uint {
 	return b.SubCnt
 }
 
+// GetSubCntByTopic 関数は、Subscriber が存在するトピックごとの Subscriber 数を返す
+func (b *broker) GetSubCntByTopic() map[string]uint {
+	b.SubCntMu.RLock()
+	defer b.SubCntMu.RUnlock()
+	return b.subTb.CountSubscribersByTopic()
+}
+
 func (b *broker) UpdateLastPub() {
 	b.LastPubMu.Lock()
 	defer b.LastPubMu.Unlock()
@@ -208,4 +599,24 @@ func (e ZeroSubCntError) Error() string {
 	return fmt.Sprintf("Error: %v", e.Msg)
 }
 
+// SubCntMismatchError 構造体
+// 当該ブローカの SubCnt と Subsctable の Subscriber 数の合計が一致しない際に返される
+type SubCntMismatchError struct {
+	Msg string
+}
+
+func (e SubCntMismatchError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+// NoHealthyReplicaError 構造体
+// フェイルオーバー先となる接続中のレプリカが存在しない際に返される
+type NoHealthyReplicaError struct {
+	Msg string
+}
+
+func (e NoHealthyReplicaError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
 //////////////        以上 Error 構造体関連       //////////////
@@ -1,10 +1,80 @@
 package broker
 
 import (
+	"bytes"
+	"gamma/pkg/circuitbreaker"
+	"gamma/pkg/credential"
+	"gamma/pkg/endpoint"
+	"gamma/pkg/outbox"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"sort"
 	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/gorilla/websocket"
 )
 
+// fakeClient 構造体は、何もしない mqtt.Client
+type fakeClient struct{}
+
+func (c *fakeClient) IsConnected() bool      { return true }
+func (c *fakeClient) IsConnectionOpen() bool { return true }
+func (c *fakeClient) Connect() mqtt.Token    { return &fakeToken{} }
+func (c *fakeClient) Disconnect(uint)        {}
+func (c *fakeClient) Publish(string, byte, bool, interface{}) mqtt.Token {
+	return &fakeToken{}
+}
+func (c *fakeClient) Subscribe(string, byte, mqtt.MessageHandler) mqtt.Token {
+	return &fakeToken{}
+}
+func (c *fakeClient) SubscribeMultiple(map[string]byte, mqtt.MessageHandler) mqtt.Token {
+	return &fakeToken{}
+}
+func (c *fakeClient) Unsubscribe(...string) mqtt.Token     { return &fakeToken{} }
+func (c *fakeClient) AddRoute(string, mqtt.MessageHandler) {}
+func (c *fakeClient) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.NewClient(mqtt.NewClientOptions()).OptionsReader()
+}
+
+// replicaClient 構造体は、接続状態を切り替えることができ、Publish・Subscribe・Unsubscribe したトピックを記録する mqtt.Client
+type replicaClient struct {
+	fakeClient
+	closed       bool
+	published    []string
+	subscribed   []string
+	unsubscribed []string
+}
+
+func (c *replicaClient) IsConnectionOpen() bool { return !c.closed }
+func (c *replicaClient) Publish(topic string, _ byte, _ bool, _ interface{}) mqtt.Token {
+	c.published = append(c.published, topic)
+	return &fakeToken{}
+}
+func (c *replicaClient) Subscribe(topic string, _ byte, _ mqtt.MessageHandler) mqtt.Token {
+	c.subscribed = append(c.subscribed, topic)
+	return &fakeToken{}
+}
+func (c *replicaClient) Unsubscribe(topics ...string) mqtt.Token {
+	c.unsubscribed = append(c.unsubscribed, topics...)
+	return &fakeToken{}
+}
+
+type fakeToken struct{}
+
+func (t *fakeToken) Wait() bool                     { return true }
+func (t *fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (t *fakeToken) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+func (t *fakeToken) Error() error { return nil }
+
 // テストケース分類
 //   正常系
 //   準正常系（使用に無いテストケースなど?）
@@ -197,3 +267,430 @@ func TestUpdateLastPub(t *testing.T) {
 		})
 	}
 }
+
+// 分散ブローカの追加時に、SubCnt が過不足なく新たなブローカへ引き継がれることを確認する
+func TestSubCntHandover(t *testing.T) {
+	ch := make(chan mqtt.Message)
+	oldBroker := NewBroker(&fakeClient{}, 0, ch)
+	for _, topic := range []string{"/0/1/2", "/0/1/2", "/0/1/3", "/0/2/0", "/0/+/2"} {
+		if err := oldBroker.Subscribe(topic); err != nil {
+			t.Fatalf("Subscribe() error = %v", err)
+		}
+	}
+	// 不正なトピックは SubCnt に含まれない
+	if err := oldBroker.Subscribe("/0/hoge/fuga"); err == nil {
+		t.Errorf("Subscribe() error = nil, expected error")
+	}
+	if err := oldBroker.Unsubscribe("/0/3"); err == nil {
+		t.Errorf("Unsubscribe() error = nil, expected error")
+	}
+	if got := oldBroker.GetSubCnt(); got != 5 {
+		t.Fatalf("GetSubCnt() = %v, expected %v", got, 5)
+	}
+
+	newBroker, err := oldBroker.(*broker).createSubsetBroker(&fakeClient{}, 0, ch, "/0/1")
+	if err != nil {
+		t.Fatalf("createSubsetBroker() error = %v", err)
+	}
+	// "/0/1/2" x2, "/0/1/3", "/0/+/2"
+	if got := newBroker.GetSubCnt(); got != 4 {
+		t.Errorf("GetSubCnt() of new broker = %v, expected %v", got, 4)
+	}
+
+	// brokertable の更新前は、元のブローカが Subscribe 要求を受け付ける
+	if err := oldBroker.Subscribe("/0/1/0"); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	if err := oldBroker.Unsubscribe("/0/1/3"); err != nil {
+		t.Fatalf("Unsubscribe() error = %v", err)
+	}
+
+	moved, err := oldBroker.UnsubscribeSubsetTopics("/0/1")
+	if err != nil {
+		t.Fatalf("UnsubscribeSubsetTopics() error = %v", err)
+	}
+	newBroker.RecountSubCnt()
+
+	type want struct {
+		subCnt uint
+	}
+	tests := []struct {
+		name string
+		b    Broker
+		want want
+	}{
+		{name: "Normal scenario 01 (old broker)", b: oldBroker, want: want{subCnt: 2}},
+		{name: "Normal scenario 02 (new broker)", b: newBroker, want: want{subCnt: 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.b.GetSubCnt(); got != tt.want.subCnt {
+				t.Errorf("GetSubCnt() = %v, expected %v", got, tt.want.subCnt)
+			}
+			if err := tt.b.CheckSubCnt(); err != nil {
+				t.Errorf("CheckSubCnt() = %v, expected nil", err)
+			}
+		})
+	}
+	if moved != 3 {
+		t.Errorf("UnsubscribeSubsetTopics() = %v, expected %v", moved, 3)
+	}
+}
+
+func TestCheckSubCnt(t *testing.T) {
+	b := NewBroker(&fakeClient{}, 0, make(chan mqtt.Message))
+	if err := b.Subscribe("/0/1"); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	if err := b.IncreaseSubCnt(); err != nil {
+		t.Fatalf("IncreaseSubCnt() error = %v", err)
+	}
+	if err := b.CheckSubCnt(); err == nil || reflect.ValueOf(err).Type() != reflect.ValueOf(SubCntMismatchError{}).Type() {
+		t.Errorf("CheckSubCnt() = %v, expected %T", err, SubCntMismatchError{})
+	}
+}
+
+// 分散ブローカの削除時に、SubCnt が過不足なく親のブローカへ引き継がれることを確認する
+func TestMergeSubsetBroker(t *testing.T) {
+	ch := make(chan mqtt.Message)
+	parentBroker := NewBroker(&fakeClient{}, 0, ch)
+	for _, topic := range []string{"/0/1/2", "/0/1/3", "/0/2/0", "/0/+/2"} {
+		if err := parentBroker.Subscribe(topic); err != nil {
+			t.Fatalf("Subscribe() error = %v", err)
+		}
+	}
+	childBroker, err := parentBroker.(*broker).createSubsetBroker(&fakeClient{}, 0, ch, "/0/1")
+	if err != nil {
+		t.Fatalf("createSubsetBroker() error = %v", err)
+	}
+	if _, err := parentBroker.UnsubscribeSubsetTopics("/0/1"); err != nil {
+		t.Fatalf("UnsubscribeSubsetTopics() error = %v", err)
+	}
+	if err := childBroker.Subscribe("/0/1/0"); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+
+	if err := parentBroker.MergeSubsetBroker(childBroker, "/0/1"); err != nil {
+		t.Fatalf("MergeSubsetBroker() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		b      Broker
+		subCnt uint
+	}{
+		{name: "Normal scenario 01 (parent broker)", b: parentBroker, subCnt: 5},
+		{name: "Normal scenario 02 (child broker, copied wildcard topic is detached)", b: childBroker, subCnt: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.b.GetSubCnt(); got != tt.subCnt {
+				t.Errorf("GetSubCnt() = %v, expected %v", got, tt.subCnt)
+			}
+			if err := tt.b.CheckSubCnt(); err != nil {
+				t.Errorf("CheckSubCnt() = %v, expected nil", err)
+			}
+		})
+	}
+}
+
+// 親のブローカから複製した "+" を含むトピックも統合時に child から Unsubscribe され、child を切断できることを確認する
+func TestMergeSubsetBrokerWithCopiedWildcard(t *testing.T) {
+	ch := make(chan mqtt.Message)
+	parentBroker := NewBroker(&fakeClient{}, 0, ch)
+	for _, topic := range []string{"/0/1/2", "/+/1"} {
+		if err := parentBroker.Subscribe(topic); err != nil {
+			t.Fatalf("Subscribe() error = %v", err)
+		}
+	}
+	childClient := &replicaClient{}
+	childBroker, err := parentBroker.(*broker).createSubsetBroker(childClient, 0, ch, "/0/1")
+	if err != nil {
+		t.Fatalf("createSubsetBroker() error = %v", err)
+	}
+	childBroker.SubscribeAll()
+	if _, err := parentBroker.UnsubscribeSubsetTopics("/0/1"); err != nil {
+		t.Fatalf("UnsubscribeSubsetTopics() error = %v", err)
+	}
+	if got := childBroker.GetSubCnt(); got != 2 {
+		t.Fatalf("GetSubCnt() = %v, expected %v (before merge)", got, 2)
+	}
+
+	if err := parentBroker.MergeSubsetBroker(childBroker, "/0/1"); err != nil {
+		t.Fatalf("MergeSubsetBroker() error = %v", err)
+	}
+
+	if got := parentBroker.GetSubCnt(); got != 2 {
+		t.Errorf("GetSubCnt() = %v, expected %v (parent broker)", got, 2)
+	}
+	if got := childBroker.GetSubCnt(); got != 0 {
+		t.Errorf("GetSubCnt() = %v, expected %v (child broker)", got, 0)
+	}
+	if got := childBroker.GetSubCntByTopic(); len(got) != 0 {
+		t.Errorf("GetSubCntByTopic() = %v, expected no topics (child broker)", got)
+	}
+	if !reflect.DeepEqual(childClient.unsubscribed, []string{"/0/1/2", "/+/1"}) {
+		t.Errorf("unsubscribed = %v, expected %v", childClient.unsubscribed, []string{"/0/1/2", "/+/1"})
+	}
+	for _, b := range []Broker{parentBroker, childBroker} {
+		if err := b.CheckSubCnt(); err != nil {
+			t.Errorf("CheckSubCnt() = %v, expected nil", err)
+		}
+	}
+	if !childBroker.TryDisconnect(0, 0) {
+		t.Errorf("TryDisconnect() = false, expected true (child broker)")
+	}
+}
+
+// Subscribe に使用している分散ブローカとの接続が切れた際に、レプリカへ Subscribe し直すことを確認する
+func TestFailover(t *testing.T) {
+	primary, replica1, replica2 := &replicaClient{}, &replicaClient{}, &replicaClient{}
+	b := NewBroker(primary, 0, make(chan mqtt.Message))
+	for _, topic := range []string{"/0/1", "/0/2"} {
+		if err := b.Subscribe(topic); err != nil {
+			t.Fatalf("Subscribe() error = %v", err)
+		}
+	}
+
+	// レプリカが存在しない場合は何もしない
+	primary.closed = true
+	if ok, err := b.Failover(); ok || err != nil {
+		t.Fatalf("Failover() = %v, %v, expected false, nil", ok, err)
+	}
+
+	b.(*broker).addReplica(replica1)
+	b.(*broker).addReplica(replica2)
+	primary.closed = false
+	if ok, err := b.Failover(); ok || err != nil {
+		t.Fatalf("Failover() = %v, %v, expected false, nil", ok, err)
+	}
+
+	// 接続中のレプリカのうち、優先度の高いものへ Subscribe し直す
+	primary.closed = true
+	replica1.closed = true
+	if ok, err := b.Failover(); !ok || err != nil {
+		t.Fatalf("Failover() = %v, %v, expected true, nil", ok, err)
+	}
+	// NOTE: SubscribeAll の Subscribe 順は不定のため、ソートして比較する
+	sort.Strings(replica2.subscribed)
+	if want := []string{"/0/1", "/0/2"}; !reflect.DeepEqual(replica2.subscribed, want) || len(replica1.subscribed) != 0 {
+		t.Errorf("subscribed = %v, %v, expected %v", replica1.subscribed, replica2.subscribed, want)
+	}
+	if err := b.Subscribe("/0/3"); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	if got := replica2.subscribed[len(replica2.subscribed)-1]; got != "/0/3" {
+		t.Errorf("subscribed = %v, expected %v", got, "/0/3")
+	}
+	if err := b.CheckSubCnt(); err != nil {
+		t.Errorf("CheckSubCnt() error = %v", err)
+	}
+
+	// 接続中のレプリカが存在しない場合
+	replica2.closed = true
+	if ok, err := b.Failover(); ok || err == nil || reflect.ValueOf(err).Type() != reflect.ValueOf(NoHealthyReplicaError{}).Type() {
+		t.Errorf("Failover() = %v, %v, expected false, %T", ok, err, NoHealthyReplicaError{})
+	}
+}
+
+func TestPublishQuorum(t *testing.T) {
+	tests := []struct {
+		name   string
+		quorum uint
+		closed []bool // primary, replica1, replica2
+		want   []int  // 各レプリカへ Publish された回数
+	}{
+		{name: "Normal scenario 01 (all replicas)", quorum: 0, closed: []bool{false, false, false}, want: []int{1, 1, 1}},
+		{name: "Normal scenario 02 (quorum)", quorum: 2, closed: []bool{false, false, false}, want: []int{1, 1, 0}},
+		{name: "Normal scenario 03 (skip closed replica)", quorum: 2, closed: []bool{false, true, false}, want: []int{1, 0, 1}},
+		{name: "Normal scenario 04 (quorum is greater than replicas)", quorum: 5, closed: []bool{false, false, false}, want: []int{1, 1, 1}},
+		{name: "Error scenario 01 (quorum is not satisfied)", quorum: 0, closed: []bool{false, true, true}, want: []int{1, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clients := []*replicaClient{{}, {}, {}}
+			b := NewBroker(clients[0], 0, make(chan mqtt.Message))
+			b.(*broker).addReplica(clients[1])
+			b.(*broker).addReplica(clients[2])
+			b.SetPublishQuorum(tt.quorum)
+			for i, c := range clients {
+				c.closed = tt.closed[i]
+			}
+
+			b.Publish("/0/1", false, "payload")
+			for i, c := range clients {
+				if len(c.published) != tt.want[i] {
+					t.Errorf("published[%v] = %v, expected %v", i, len(c.published), tt.want[i])
+				}
+			}
+		})
+	}
+
+	// フェイルオーバー後は、Subscribe に使用しているレプリカへ最初に配送する
+	clients := []*replicaClient{{}, {}, {}}
+	b := NewBroker(clients[0], 0, make(chan mqtt.Message))
+	b.(*broker).addReplica(clients[1])
+	b.(*broker).addReplica(clients[2])
+	b.SetPublishQuorum(1)
+	clients[0].closed = true
+	clients[1].closed = true
+	if ok, err := b.Failover(); !ok || err != nil {
+		t.Fatalf("Failover() = %v, %v, expected true, nil", ok, err)
+	}
+	clients[1].closed = false
+	b.Publish("/0/1", false, "payload")
+	if len(clients[1].published) != 0 || len(clients[2].published) != 1 {
+		t.Errorf("published = %v, %v, expected 0, 1", len(clients[1].published), len(clients[2].published))
+	}
+}
+
+// 分散ブローカと接続できない間に Publish したメッセージを保持し、再接続後に Publish した順に再送することを確認する
+func TestPublishOutbox(t *testing.T) {
+	c := &replicaClient{}
+	b := NewBroker(c, 0, make(chan mqtt.Message))
+	o, err := outbox.New(outbox.Policy{MaxMessages: 10}, "localhost:1883")
+	if err != nil {
+		t.Fatalf("outbox.New() error = %v", err)
+	}
+	b.SetOutbox(o)
+
+	c.closed = true
+	b.Publish("/0/1", false, "payload")
+	b.Publish("/0/2", false, "payload")
+	if len(c.published) != 0 || b.GetOutboxStats().Pending != 2 {
+		t.Fatalf("published = %v, pending = %v, expected 0, 2", c.published, b.GetOutboxStats().Pending)
+	}
+	// 再送していないメッセージがある間は切断しない
+	if b.TryDisconnect(0, 0) {
+		t.Errorf("TryDisconnect() = true, expected false")
+	}
+
+	// 再接続後の Publish では、保持しているメッセージを先に再送する
+	c.closed = false
+	b.Publish("/0/3", false, "payload")
+	if want := []string{"/0/1", "/0/2", "/0/3"}; !reflect.DeepEqual(c.published, want) {
+		t.Errorf("published = %v, expected %v", c.published, want)
+	}
+
+	c.closed = true
+	b.Publish("/0/4", false, "payload")
+	c.closed = false
+	if got := b.ReplayOutbox(); got != 1 {
+		t.Errorf("ReplayOutbox() = %v, expected %v", got, 1)
+	}
+	want := outbox.Stats{Buffered: 3, Replayed: 3}
+	if got := b.GetOutboxStats(); got != want {
+		t.Errorf("GetOutboxStats() = %+v, expected %+v", got, want)
+	}
+}
+
+// hangingClient 構造体は、Publish が完了しない mqtt.Client（応答しなくなった分散ブローカ）
+type hangingClient struct {
+	fakeClient
+}
+
+func (c *hangingClient) Publish(string, byte, bool, interface{}) mqtt.Token {
+	return &hangingToken{}
+}
+
+type hangingToken struct {
+	fakeToken
+}
+
+func (t *hangingToken) WaitTimeout(d time.Duration) bool {
+	time.Sleep(d)
+	return false
+}
+
+// Publish が PublishTimeout 内に完了しない場合は失敗として扱い、サーキットブレーカを開く
+func TestPublishTimeout(t *testing.T) {
+	b := NewBroker(&hangingClient{}, 0, make(chan mqtt.Message))
+	b.SetCircuitPolicy(circuitbreaker.Policy{FailureThreshold: 2, OpenTimeout: time.Minute, PublishTimeout: time.Millisecond}, "localhost:1883")
+
+	for i := 0; i < 2; i++ {
+		if !b.Available() {
+			t.Fatalf("Available() = false, expected true (publish %v)", i)
+		}
+		b.Publish("/0/1", false, "payload")
+	}
+	if b.Available() || b.GetCircuitState() != circuitbreaker.Open {
+		t.Errorf("GetCircuitState() = %v, expected %v", b.GetCircuitState(), circuitbreaker.Open)
+	}
+}
+
+// newWebsocketBroker 関数は、path で WebSocket 接続を受け付け、CONNECT に CONNACK を返すだけの MQTT ブローカを起動する
+func newWebsocketBroker(t *testing.T, path string) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{Subprotocols: []string{"mqtt"}}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			p, err := packets.ReadPacket(bytes.NewReader(msg))
+			if err != nil {
+				return
+			}
+			if _, ok := p.(*packets.ConnectPacket); !ok {
+				continue
+			}
+			var buf bytes.Buffer
+			packets.NewControlPacket(packets.Connack).Write(&buf)
+			if err := conn.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
+				return
+			}
+		}
+	})
+	return httptest.NewServer(mux)
+}
+
+// リバースプロキシ経由の分散ブローカのように、パス付きの ws:// で接続できることを確認する
+func TestConnectBrokerWebsocket(t *testing.T) {
+	server := newWebsocketBroker(t, "/mqtt")
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{
+			name: "Normal scenario 01",
+			path: "/mqtt",
+		},
+		{
+			name:    "Error scenario 01 (path not found)",
+			path:    "/not-found",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := endpoint.Endpoint{Scheme: endpoint.SchemeWS, Host: "127.0.0.1", Port: uint16(addr.Port), Path: tt.path}
+			c, err := connectBroker(e, credential.Credential{}, nil)
+			if tt.wantErr {
+				if err == nil {
+					c.Disconnect(0)
+					t.Errorf("connectBroker() error = nil, expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("connectBroker() error = %v", err)
+			}
+			defer c.Disconnect(0)
+			opt := c.OptionsReader()
+			if servers := opt.Servers(); len(servers) != 1 || servers[0].String() != e.URL() {
+				t.Errorf("servers = %v, expected %v", servers, e.URL())
+			}
+		})
+	}
+}
@@ -1,10 +1,16 @@
 package brokerpool
 
 import (
+	"container/list"
 	"fmt"
 	"gamma/pkg/broker"
 	"gamma/pkg/brokertable"
-	"reflect"
+	"gamma/pkg/circuitbreaker"
+	"gamma/pkg/credential"
+	"gamma/pkg/endpoint"
+	"gamma/pkg/outbox"
+	"gamma/pkg/subsctable"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,27 +25,73 @@ type Brokerpool interface {
 	GetBroker(host string, port uint16) (broker.Broker, error)
 	ConnectBroker(host string, port uint16) error
 	AddSubsetBroker(newHost string, newPort uint16, topic string, rootNode *brokertable.Node) error
+	UnsubscribeSubsetTopics(newHost string, newPort uint16, topic string, rootNode *brokertable.Node) error
+	MergeSubsetBroker(host string, port uint16, parentHost string, parentPort uint16, topic string) error
 	GetOrConnectBroker(host string, port uint16) (broker.Broker, error)
 	TryDisconnectBroker(host string, port uint16, expirationFromLastPub time.Duration, quiesce uint) bool
+	DisconnectBroker(host string, port uint16, quiesce uint) bool
 	IncreaseSubCnt(host string, port uint16) error
 	DecreaseSubCnt(host string, port uint16) error
 	GetSubCnt(host string, port uint16) (uint, error)
 	GetLastPub(host string, port uint16) (time.Time, error)
 	UpdateLastPub(host string, port uint16) error
 	CloseAllBroker(quiesce uint)
+	SetAggregationPolicy(policy subsctable.AggregationPolicy) error
+	AddReplica(host string, port uint16, replicaHost string, replicaPort uint16) error
+	LookupReplica(replicaHost string, replicaPort uint16) (broker.Broker, error)
+	SetPublishQuorum(quorum uint)
+	FailoverReplicas()
+	RegisterEndpoint(e endpoint.Endpoint) error
+	LookupEndpoint(host string, port uint16) endpoint.Endpoint
+	SetCredentialStore(s *credential.Store)
+	SetConnectionPolicy(policy ConnectionPolicy) error
+	ReapIdleBrokers(quiesce uint) int
+	GetConnectionStats() ConnectionStats
+	GetBrokerStats() []BrokerStats
+	GetSubscriptions() map[string]uint
+	SetOutboxPolicy(policy outbox.Policy) error
+	ReplayOutboxes()
+	GetOutboxStats() outbox.Stats
+	SetCircuitPolicy(policy circuitbreaker.Policy) error
+	LookupPublishBroker(snapshot *brokertable.Snapshot, topic string) (broker.Broker, bool, error)
 }
 
 type brokerpool struct {
-	bt  BrokersTableByHost
-	qos byte
-	ch  chan<- mqtt.Message
+	bt       BrokersTableByHost
+	replicas BrokersTableByHost // レプリカの接続情報から、レプリカセットを管理する broker.Broker インターフェースを引く
+	qos      byte
+	ch       chan<- mqtt.Message
+	policy   subsctable.AggregationPolicy // 新たに接続するブローカにも適用する Subscribe の集約条件
+	quorum   uint                         // 新たに接続するブローカにも適用する、Publish 時に配送する必要があるレプリカの数
+
+	endpointsMu sync.RWMutex
+	endpoints   map[string]endpoint.Endpoint // "host:port" から、接続に使用する URL スキーム等を引く
+	credentials *credential.Store            // 分散ブローカへ接続する際の認証情報（nil の場合は認証情報なし）
+
+	connMu     sync.Mutex
+	connPolicy ConnectionPolicy
+	lru        *list.List               // 接続中の分散ブローカ（lruEntry）を最近使用した順に並べたもの（先頭が最も新しい）
+	lruElems   map[string]*list.Element // "host:port" から lru の要素を引く
+	connStats  ConnectionStats
+
+	outboxPolicy  outbox.Policy         // 分散ブローカと接続できない間に Publish するメッセージを保持する方法
+	circuitPolicy circuitbreaker.Policy // Publish に失敗し続けた分散ブローカを使用しないようにする条件
 }
 
 // NewBrokerPool は blokerpool 構造体を生成し、Brokerpool interface を返す
 func NewBrokerPool(qos byte, ch chan<- mqtt.Message) Brokerpool {
-	return &brokerpool{bt: BrokersTableByHost{}, qos: qos, ch: ch}
+	return &brokerpool{
+		bt:        BrokersTableByHost{},
+		replicas:  BrokersTableByHost{},
+		qos:       qos,
+		ch:        ch,
+		endpoints: map[string]endpoint.Endpoint{},
+		lru:       list.New(),
+		lruElems:  map[string]*list.Element{},
+	}
 }
 
+// GetBroker 関数は、接続済みの分散ブローカを返す（最近使用したものとして記録する）
 func (p *brokerpool) GetBroker(host string, port uint16) (broker.Broker, error) {
 	bt, err := p.bt.Load(host)
 	if err != nil {
@@ -47,6 +99,9 @@ func (p *brokerpool) GetBroker(host string, port uint16) (broker.Broker, error)
 	}
 
 	b, err := bt.Load(port)
+	if err == nil {
+		p.touch(host, port)
+	}
 	return b, err
 }
 
@@ -56,12 +111,11 @@ func (p *brokerpool) AddSubsetBroker(newHost string, newPort uint16, topic strin
 
 	// 重複を防ぐための確認
 	if err == nil {
-		return AlreadyConnectedError{Msg: fmt.Sprintf("This broker is already connected (tcp://%v:%v).", newHost, newPort)}
+		return AlreadyConnectedError{Msg: fmt.Sprintf("This broker is already connected (%v).", p.LookupEndpoint(newHost, newPort))}
 	}
 
 	// エラーが NotFoundError であることを確認する
-	typeNotFoundErr := reflect.ValueOf(NotFoundError{}).Type()
-	if reflect.ValueOf(err).Type() != typeNotFoundErr {
+	if _, ok := err.(NotFoundError); !ok {
 		return err
 	}
 
@@ -71,22 +125,23 @@ func (p *brokerpool) AddSubsetBroker(newHost string, newPort uint16, topic strin
 	}
 
 	b, err = p.GetBroker(oldHost, oldPort)
+	if _, ok := err.(NotFoundError); ok && p.getConnectionPolicy().IsManaged() {
+		// 元の分散ブローカと接続していない（引き継ぐ Subscriber がいない）ため、最初に使用する際に接続する
+		log.WithFields(log.Fields{"topic": topic, "host": newHost, "port": newPort}).Debug("Skipped connecting subset broker (lazy connection)")
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
-	subsetBroker, err := b.CreateSubsetBroker(newHost, newPort, p.qos, p.ch, topic)
+	e := p.LookupEndpoint(newHost, newPort)
+	subsetBroker, err := b.CreateSubsetBroker(e, p.credentials.Lookup(e), p.qos, p.ch, topic)
 	if err != nil {
 		return err
 	}
 
 	// brokerpool へ broker.Broker インターフェースを登録する
-	bt, err := p.bt.Load(newHost)
-	if err != nil && reflect.ValueOf(err).Type() == typeNotFoundErr {
-		bt = &BrokerTableByPort{}
-		p.bt.Store(newHost, bt)
-	}
-	bt.Store(newPort, subsetBroker)
+	p.storeBroker(newHost, newPort, subsetBroker)
 
 	// Subscribe する
 	subsetBroker.SubscribeAll()
@@ -94,34 +149,136 @@ func (p *brokerpool) AddSubsetBroker(newHost string, newPort uint16, topic strin
 	return nil
 }
 
+// UnsubscribeSubsetTopics 関数は、AddSubsetBroker 関数で追加した分散ブローカが担当するトピックを元の分散ブローカから Unsubscribe し、
+// Subscriber 数（broker.SubCnt）を新たな分散ブローカへ引き継ぐ
+// NOTE: この関数を呼び出した後に brokertable の更新（brokertable.ReassignHost 関数）を行うこと
+// 与えられたトピック以下で他の分散ブローカが担当しているトピックは、引き続きその分散ブローカが担当するため引き継がない
+// 接続を管理している場合（ConnectionPolicy.IsManaged）、新たな分散ブローカと接続していなければ、元の分散ブローカと接続している場合のみ
+// AddSubsetBroker 関数で接続してから引き継ぐ（元の分散ブローカとも接続していない場合は、引き継ぐ Subscriber がいないため何もしない）
+func (p *brokerpool) UnsubscribeSubsetTopics(newHost string, newPort uint16, topic string, rootNode *brokertable.Node) error {
+	oldHost, oldPort, err := brokertable.LookupHost(rootNode, topic)
+	if err != nil {
+		return err
+	}
+
+	newBroker, err := p.GetBroker(newHost, newPort)
+	if _, ok := err.(NotFoundError); ok && p.getConnectionPolicy().IsManaged() {
+		if _, err := p.GetBroker(oldHost, oldPort); err != nil {
+			return nil
+		}
+		if err := p.AddSubsetBroker(newHost, newPort, topic, rootNode); err != nil {
+			return err
+		}
+		newBroker, err = p.GetBroker(newHost, newPort)
+	}
+	if err != nil {
+		return err
+	}
+
+	var movedCnt uint = 0
+	brokers := []broker.Broker{newBroker}
+	if oldHost != newHost || oldPort != newPort {
+		b, err := p.GetBroker(oldHost, oldPort)
+		if err != nil {
+			return err
+		}
+		movedCnt, err = b.UnsubscribeSubsetTopics(topic)
+		if err != nil {
+			return err
+		}
+		brokers = append(brokers, b)
+	}
+
+	// 元の分散ブローカが担当していた間に増減した Subscriber 数も含めて引き継ぐ
+	newBroker.RecountSubCnt()
+	log.WithFields(log.Fields{
+		"topic":      topic,
+		"host":       newHost,
+		"port":       newPort,
+		"moved_cnt":  movedCnt,
+		"new_subcnt": newBroker.GetSubCnt(),
+	}).Info("Moved subscribers to new broker")
+
+	// broker.SubCnt と Subsctable の Subscriber 数の合計が一致することを確認する
+	for _, b := range brokers {
+		if err := b.CheckSubCnt(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MergeSubsetBroker 関数は、与えられたトピック以下を担当していた分散ブローカの Subscriber を、親の分散ブローカへ引き継ぐ
+// 分散ブローカを削除・統合する際に使用する
+// NOTE: この関数を呼び出した後に brokertable の更新を行うこと
+// また、引き継ぎ元の分散ブローカとの接続は DisconnectBroker 関数で切断すること
+// 接続を管理している場合（ConnectionPolicy.IsManaged）、引き継ぎ元の分散ブローカと接続していなければ何もしない
+func (p *brokerpool) MergeSubsetBroker(host string, port uint16, parentHost string, parentPort uint16, topic string) error {
+	managed := p.getConnectionPolicy().IsManaged()
+	child, err := p.GetBroker(host, port)
+	if _, ok := err.(NotFoundError); ok && managed {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var parent broker.Broker
+	if managed {
+		parent, err = p.GetOrConnectBroker(parentHost, parentPort)
+	} else {
+		parent, err = p.GetBroker(parentHost, parentPort)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := parent.MergeSubsetBroker(child, topic); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"topic":         topic,
+		"host":          host,
+		"port":          port,
+		"parent_host":   parentHost,
+		"parent_port":   parentPort,
+		"parent_subcnt": parent.GetSubCnt(),
+	}).Info("Merged subscribers to parent broker")
+
+	// broker.SubCnt と Subsctable の Subscriber 数の合計が一致することを確認する
+	for _, b := range []broker.Broker{parent, child} {
+		if err := b.CheckSubCnt(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (p *brokerpool) ConnectBroker(host string, port uint16) error {
 	b, err := p.GetBroker(host, port)
 
 	// 重複接続を防ぐための確認
 	if err == nil {
-		return AlreadyConnectedError{Msg: fmt.Sprintf("This broker is already connected (tcp://%v:%v).", host, port)}
+		return AlreadyConnectedError{Msg: fmt.Sprintf("This broker is already connected (%v).", p.LookupEndpoint(host, port))}
 	}
 
 	// エラーが NotFoundError であることを確認する
-	typeNotFoundErr := reflect.ValueOf(NotFoundError{}).Type()
-	if reflect.ValueOf(err).Type() != typeNotFoundErr {
+	if _, ok := err.(NotFoundError); !ok {
 		return err
 	}
 
 	// ブローカへの接続を試みる
-	b, err = broker.ConnectBroker(host, port, p.qos, p.ch)
+	e := p.LookupEndpoint(host, port)
+	b, err = broker.ConnectBroker(e, p.credentials.Lookup(e), p.qos, p.ch)
 	if err != nil {
 		return err
 	}
-
-	// brokerpool へ broker.Broker インターフェースを登録する
-	bt, err := p.bt.Load(host)
-	if err != nil && reflect.ValueOf(err).Type() == typeNotFoundErr {
-		bt = &BrokerTableByPort{}
-		p.bt.Store(host, bt)
+	if err := b.SetAggregationPolicy(p.policy); err != nil {
+		return err
 	}
+	b.SetPublishQuorum(p.quorum)
 
-	bt.Store(port, b)
+	// brokerpool へ broker.Broker インターフェースを登録する
+	p.storeBroker(host, port, b)
 
 	return nil
 }
@@ -140,16 +297,157 @@ func (p *brokerpool) GetOrConnectBroker(host string, port uint16) (broker.Broker
 	return p.GetBroker(host, port)
 }
 
+// TryDisconnectBroker 関数は、Subscriber がおらず、最後の Publish から expirationFromLastPub 以上経過した分散ブローカとの接続を切断し、
+// brokerpool から削除する
+// NOTE: レプリカセットの分散ブローカは切断しない（レプリカの情報が失われるため）
 func (p *brokerpool) TryDisconnectBroker(host string, port uint16, expirationFromLastPub time.Duration, quiesce uint) bool {
-	b, err := p.GetBroker(host, port)
+	b, err := p.lookupBroker(host, port)
+	if err != nil {
+		return false
+	}
+	if p.hasReplicas(b) {
+		return false
+	}
+	if !b.TryDisconnect(expirationFromLastPub, quiesce) {
+		return false
+	}
+	p.deleteBroker(host, port)
+	return true
+}
+
+// DisconnectBroker 関数は、Subscriber の有無や最後の Publish からの経過時間によらず分散ブローカとの接続を切断し、
+// brokerpool から削除する
+// MergeSubsetBroker 関数で親の分散ブローカへ統合した分散ブローカを切断する際に使用する
+// 戻り値は、接続していた分散ブローカを切断したかどうか
+func (p *brokerpool) DisconnectBroker(host string, port uint16, quiesce uint) bool {
+	b, err := p.lookupBroker(host, port)
 	if err != nil {
 		return false
 	}
-	return b.TryDisconnect(expirationFromLastPub, quiesce)
+	b.Disconnect(quiesce)
+	p.deleteBroker(host, port)
+	return true
 }
 
 func (p *brokerpool) CloseAllBroker(quiesce uint) {
 	p.bt.closeAllBroker(quiesce)
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	p.lru.Init()
+	p.lruElems = map[string]*list.Element{}
+}
+
+// SetAggregationPolicy 関数は、接続済みの全てのブローカと、今後接続するブローカに Subscribe の集約条件を設定する
+func (p *brokerpool) SetAggregationPolicy(policy subsctable.AggregationPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	p.policy = policy
+	return p.bt.forEachBroker(func(b broker.Broker) error {
+		return b.SetAggregationPolicy(policy)
+	})
+}
+
+// AddReplica 関数は、host, port の分散ブローカと同じトピックを担当する分散ブローカへ接続し、レプリカセットへ追加する
+// NOTE: brokertable の更新（brokertable.AddReplica 関数）は、この関数を呼び出した後に行うこと
+func (p *brokerpool) AddReplica(host string, port uint16, replicaHost string, replicaPort uint16) error {
+	if _, err := p.GetBroker(replicaHost, replicaPort); err == nil {
+		return AlreadyConnectedError{Msg: fmt.Sprintf("This broker is already connected (%v).", p.LookupEndpoint(replicaHost, replicaPort))}
+	}
+	if _, err := p.LookupReplica(replicaHost, replicaPort); err == nil {
+		return AlreadyConnectedError{Msg: fmt.Sprintf("This broker is already connected as a replica (%v).", p.LookupEndpoint(replicaHost, replicaPort))}
+	}
+
+	// NOTE: 接続を管理している場合は、レプリカセットの分散ブローカと接続していない場合がある
+	var b broker.Broker
+	var err error
+	if p.getConnectionPolicy().IsManaged() {
+		b, err = p.GetOrConnectBroker(host, port)
+	} else {
+		b, err = p.GetBroker(host, port)
+	}
+	if err != nil {
+		return err
+	}
+	e := p.LookupEndpoint(replicaHost, replicaPort)
+	if err := b.AddReplica(e, p.credentials.Lookup(e)); err != nil {
+		return err
+	}
+
+	bt, err := p.replicas.Load(replicaHost)
+	if _, ok := err.(NotFoundError); ok {
+		bt = &BrokerTableByPort{}
+		p.replicas.Store(replicaHost, bt)
+	}
+	bt.Store(replicaPort, b)
+
+	log.WithFields(log.Fields{
+		"host":         host,
+		"port":         port,
+		"replica_host": replicaHost,
+		"replica_port": replicaPort,
+	}).Info("Added replica")
+	return nil
+}
+
+// LookupReplica 関数は、レプリカとして追加した分散ブローカが属するレプリカセットの broker.Broker インターフェースを返す
+func (p *brokerpool) LookupReplica(replicaHost string, replicaPort uint16) (broker.Broker, error) {
+	bt, err := p.replicas.Load(replicaHost)
+	if err != nil {
+		return nil, err
+	}
+	return bt.Load(replicaPort)
+}
+
+// SetPublishQuorum 関数は、接続済みの全てのブローカと、今後接続するブローカに Publish 時に配送する必要があるレプリカの数を設定する
+// 0 の場合は、全てのレプリカへ配送する
+func (p *brokerpool) SetPublishQuorum(quorum uint) {
+	p.quorum = quorum
+	p.bt.forEachBroker(func(b broker.Broker) error {
+		b.SetPublishQuorum(quorum)
+		return nil
+	})
+}
+
+// FailoverReplicas 関数は、Subscribe に使用している分散ブローカとの接続が切れているレプリカセットを、
+// 接続中のレプリカへフェイルオーバーする
+// NOTE: 定期的に呼び出すこと
+func (p *brokerpool) FailoverReplicas() {
+	p.bt.forEachBroker(func(b broker.Broker) error {
+		if _, err := b.Failover(); err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Failover error")
+		}
+		return nil
+	})
+}
+
+// RegisterEndpoint 関数は、分散ブローカへ接続する際の URL スキームや認証情報の参照名を登録する
+// NOTE: 登録されていない分散ブローカへは tcp で接続する
+func (p *brokerpool) RegisterEndpoint(e endpoint.Endpoint) error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+	p.endpointsMu.Lock()
+	defer p.endpointsMu.Unlock()
+	p.endpoints[e.Address()] = e
+	return nil
+}
+
+// LookupEndpoint 関数は、host, port の分散ブローカへ接続する際の接続先を返す
+func (p *brokerpool) LookupEndpoint(host string, port uint16) endpoint.Endpoint {
+	e := endpoint.Endpoint{Host: host, Port: port}
+	p.endpointsMu.RLock()
+	defer p.endpointsMu.RUnlock()
+	if registered, ok := p.endpoints[e.Address()]; ok {
+		return registered
+	}
+	return e
+}
+
+// SetCredentialStore 関数は、今後接続する分散ブローカへの認証情報・TLS の設定を設定する
+// NOTE: Endpoint.CredentialRef または "host:port" ごとに設定を上書きできる（credential.Store 構造体を参照）
+func (p *brokerpool) SetCredentialStore(s *credential.Store) {
+	p.credentials = s
 }
 
 func (p *brokerpool) IncreaseSubCnt(host string, port uint16) error {
@@ -198,6 +496,352 @@ func (p *brokerpool) UpdateLastPub(host string, port uint16) error {
 }
 
 //////////////      以上 brokerpool 構造体関連      //////////////
+//////////////        以下 接続管理 関連            //////////////
+
+// evictionQuiesce は、接続数の上限を超えた際に分散ブローカとの接続を切断する際の待ち時間（ミリ秒）
+const evictionQuiesce uint = 100
+
+// ConnectionPolicy 構造体は、分散ブローカとの接続の管理方法を表す
+// NOTE: Subscriber がいる分散ブローカと、レプリカセットの分散ブローカとの接続は切断しない
+type ConnectionPolicy struct {
+	Lazy           bool          // true の場合は、起動時や分散ブローカの追加時に接続せず、最初に使用する際に接続する
+	IdleTimeout    time.Duration // Subscriber がおらず、最後の Publish からこの時間が経過した接続を ReapIdleBrokers 関数で切断する（0 の場合は切断しない）
+	MaxConnections uint          // 同時に接続する分散ブローカの最大数（0 の場合は無制限）。超えた場合は最も長く使用されていない接続から切断する
+}
+
+// Validate 関数は、接続の管理方法が正しいかどうかを検証する
+func (c ConnectionPolicy) Validate() error {
+	if c.IdleTimeout < 0 {
+		return ConnectionPolicyError{Msg: fmt.Sprintf("Invalid idle timeout (%v). Idle timeout must not be negative.", c.IdleTimeout)}
+	}
+	return nil
+}
+
+// IsManaged 関数は、分散ブローカとの接続を切断する（または接続しない）場合があるかどうかを返す
+// true の場合は、brokertable に登録されている分散ブローカであっても、brokerpool に存在しない場合がある
+func (c ConnectionPolicy) IsManaged() bool {
+	return c.Lazy || c.IdleTimeout > 0 || c.MaxConnections > 0
+}
+
+// ConnectionStats 構造体は、分散ブローカとの接続に関する統計
+type ConnectionStats struct {
+	Open      int    // 接続中の分散ブローカの数
+	Connects  uint64 // 接続した回数
+	Evictions uint64 // 接続数の上限を超えたため切断した回数
+	Reaped    uint64 // 使用されていないため切断した回数
+}
+
+// BrokerStats 構造体は、接続中の分散ブローカごとの統計
+type BrokerStats struct {
+	Host        string
+	Port        uint16
+	Subscribers uint                 // Subscriber の数
+	Pending     int                  // 再送していないメッセージの数
+	Circuit     circuitbreaker.State // サーキットブレーカの状態
+}
+
+// lruEntry 構造体は、lru の要素
+type lruEntry struct {
+	host string
+	port uint16
+}
+
+// SetConnectionPolicy 関数は、分散ブローカとの接続の管理方法を設定する
+// NOTE: 起動時の接続より前に設定すること
+func (p *brokerpool) SetConnectionPolicy(policy ConnectionPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	p.connMu.Lock()
+	p.connPolicy = policy
+	p.connMu.Unlock()
+	p.evict("")
+	return nil
+}
+
+func (p *brokerpool) getConnectionPolicy() ConnectionPolicy {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	return p.connPolicy
+}
+
+// GetConnectionStats 関数は、分散ブローカとの接続に関する統計を返す
+func (p *brokerpool) GetConnectionStats() ConnectionStats {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	stats := p.connStats
+	stats.Open = p.lru.Len()
+	return stats
+}
+
+// GetBrokerStats 関数は、接続中の分散ブローカごとの統計を返す
+func (p *brokerpool) GetBrokerStats() []BrokerStats {
+	entries := p.lruEntries()
+	stats := make([]BrokerStats, 0, len(entries))
+	for _, e := range entries {
+		b, err := p.lookupBroker(e.host, e.port)
+		if err != nil {
+			continue
+		}
+		stats = append(stats, BrokerStats{
+			Host:        e.host,
+			Port:        e.port,
+			Subscribers: b.GetSubCnt(),
+			Pending:     b.GetOutboxStats().Pending,
+			Circuit:     b.GetCircuitState(),
+		})
+	}
+	return stats
+}
+
+// GetSubscriptions 関数は、全ての分散ブローカの Subsctable に登録されている、トピックごとの Subscriber 数を返す
+// NOTE: ワイルドカードを含むトピックは、分散ブローカの追加時に複製され複数の Subsctable に同じ数が登録されるため、合計せず最大値とする
+func (p *brokerpool) GetSubscriptions() map[string]uint {
+	counts := map[string]uint{}
+	p.bt.forEachBroker(func(b broker.Broker) error {
+		for topic, cnt := range b.GetSubCntByTopic() {
+			if !strings.ContainsAny(topic, "+#") {
+				counts[topic] += cnt
+			} else if cnt > counts[topic] {
+				counts[topic] = cnt
+			}
+		}
+		return nil
+	})
+	return counts
+}
+
+// ReapIdleBrokers 関数は、Subscriber がおらず、最後の Publish から ConnectionPolicy.IdleTimeout 以上経過した分散ブローカとの接続を切断し、
+// 切断した数を返す
+// NOTE: 定期的に呼び出すこと
+func (p *brokerpool) ReapIdleBrokers(quiesce uint) int {
+	policy := p.getConnectionPolicy()
+	if policy.IdleTimeout <= 0 {
+		return 0
+	}
+	reaped := 0
+	for _, e := range p.lruEntries() {
+		if p.TryDisconnectBroker(e.host, e.port, policy.IdleTimeout, quiesce) {
+			reaped++
+			log.WithFields(log.Fields{"host": e.host, "port": e.port}).Info("Disconnected idle broker")
+		}
+	}
+	p.connMu.Lock()
+	p.connStats.Reaped += uint64(reaped)
+	p.connMu.Unlock()
+	return reaped
+}
+
+// storeBroker 関数は、接続した分散ブローカを brokerpool へ登録し、接続数の上限を超えた場合は最も長く使用されていない接続を切断する
+func (p *brokerpool) storeBroker(host string, port uint16, b broker.Broker) {
+	b.SetOutbox(p.newOutbox(host, port))
+	b.SetCircuitPolicy(p.circuitPolicy, lruKey(host, port))
+	bt, err := p.bt.Load(host)
+	if _, ok := err.(NotFoundError); ok {
+		bt = &BrokerTableByPort{}
+		p.bt.Store(host, bt)
+	}
+	bt.Store(port, b)
+
+	p.connMu.Lock()
+	p.connStats.Connects++
+	p.connMu.Unlock()
+	p.touch(host, port)
+	p.evict(lruKey(host, port))
+}
+
+// newOutbox 関数は、host, port の分散ブローカへ Publish するメッセージを保持する Outbox を生成する（保持しない場合は nil）
+func (p *brokerpool) newOutbox(host string, port uint16) *outbox.Outbox {
+	o, err := outbox.New(p.outboxPolicy, lruKey(host, port))
+	if err != nil {
+		log.WithFields(log.Fields{"host": host, "port": port, "error": err}).Error("Outbox create error")
+		return nil
+	}
+	return o
+}
+
+// deleteBroker 関数は、切断した分散ブローカを brokerpool から削除する
+func (p *brokerpool) deleteBroker(host string, port uint16) {
+	if bt, err := p.bt.Load(host); err == nil {
+		bt.Delete(port)
+	}
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	key := lruKey(host, port)
+	if elem, ok := p.lruElems[key]; ok {
+		p.lru.Remove(elem)
+		delete(p.lruElems, key)
+	}
+}
+
+// lookupBroker 関数は、最近使用したものとして記録せずに、接続済みの分散ブローカを返す
+func (p *brokerpool) lookupBroker(host string, port uint16) (broker.Broker, error) {
+	bt, err := p.bt.Load(host)
+	if err != nil {
+		return nil, err
+	}
+	return bt.Load(port)
+}
+
+// touch 関数は、分散ブローカを最近使用したものとして記録する
+func (p *brokerpool) touch(host string, port uint16) {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	key := lruKey(host, port)
+	if elem, ok := p.lruElems[key]; ok {
+		p.lru.MoveToFront(elem)
+		return
+	}
+	p.lruElems[key] = p.lru.PushFront(lruEntry{host: host, port: port})
+}
+
+// lruEntries 関数は、接続中の分散ブローカを最も長く使用されていない順に返す
+func (p *brokerpool) lruEntries() []lruEntry {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	entries := make([]lruEntry, 0, p.lru.Len())
+	for elem := p.lru.Back(); elem != nil; elem = elem.Prev() {
+		entries = append(entries, elem.Value.(lruEntry))
+	}
+	return entries
+}
+
+// evict 関数は、接続数が上限を超えている間、最も長く使用されていない接続から切断する（except の接続は切断しない）
+// NOTE: Subscriber がいる分散ブローカ、レプリカセットの分散ブローカ、再送していないメッセージがある分散ブローカは切断できないため、
+// 上限を超えたままとなる場合がある
+func (p *brokerpool) evict(except string) {
+	max := int(p.getConnectionPolicy().MaxConnections)
+	if max == 0 || p.openConnections() <= max {
+		return
+	}
+	for _, e := range p.lruEntries() {
+		if p.openConnections() <= max {
+			return
+		}
+		if lruKey(e.host, e.port) == except {
+			continue
+		}
+		b, err := p.lookupBroker(e.host, e.port)
+		if err != nil {
+			p.deleteBroker(e.host, e.port)
+			continue
+		}
+		if b.GetSubCnt() != 0 || p.hasReplicas(b) || b.GetOutboxStats().Pending != 0 {
+			continue
+		}
+		b.Disconnect(evictionQuiesce)
+		p.deleteBroker(e.host, e.port)
+		p.connMu.Lock()
+		p.connStats.Evictions++
+		p.connMu.Unlock()
+		log.WithFields(log.Fields{"host": e.host, "port": e.port, "max_connections": max}).Info("Evicted least recently used broker")
+	}
+	// NOTE: 最後の分散ブローカを切断して上限に収まった場合は、警告しない
+	if open := p.openConnections(); open > max {
+		log.WithFields(log.Fields{"open": open, "max_connections": max}).Warn("Could not evict brokers (all brokers have subscribers, replicas or buffered messages)")
+	}
+}
+
+// openConnections 関数は、接続中の分散ブローカの数を返す
+func (p *brokerpool) openConnections() int {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	return p.lru.Len()
+}
+
+// hasReplicas 関数は、b がレプリカを含むレプリカセットかどうかを返す
+func (p *brokerpool) hasReplicas(b broker.Broker) bool {
+	found := false
+	p.replicas.forEachBroker(func(r broker.Broker) error {
+		if r == b {
+			found = true
+		}
+		return nil
+	})
+	return found
+}
+
+func lruKey(host string, port uint16) string {
+	return endpoint.Endpoint{Host: host, Port: port}.Address()
+}
+
+// SetOutboxPolicy 関数は、分散ブローカと接続できない間に Publish するメッセージを保持する方法を設定する
+// NOTE: 分散ブローカへの接続より前に設定すること（設定後に接続した分散ブローカから適用する）
+func (p *brokerpool) SetOutboxPolicy(policy outbox.Policy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	p.outboxPolicy = policy
+	return nil
+}
+
+// ReplayOutboxes 関数は、全ての分散ブローカについて、保持しているメッセージを再送する
+// NOTE: 分散ブローカとの再接続後に再送するため、定期的に呼び出すこと
+func (p *brokerpool) ReplayOutboxes() {
+	p.bt.forEachBroker(func(b broker.Broker) error {
+		b.ReplayOutbox()
+		return nil
+	})
+}
+
+// GetOutboxStats 関数は、全ての分散ブローカについて、保持しているメッセージに関する統計の合計を返す
+// NOTE: 切断した分散ブローカの統計は含まない
+func (p *brokerpool) GetOutboxStats() outbox.Stats {
+	var stats outbox.Stats
+	p.bt.forEachBroker(func(b broker.Broker) error {
+		stats = stats.Add(b.GetOutboxStats())
+		return nil
+	})
+	return stats
+}
+
+// SetCircuitPolicy 関数は、Publish に失敗し続けた分散ブローカを使用しないようにする条件を設定する
+// NOTE: 分散ブローカへの接続より前に設定すること（設定後に接続した分散ブローカから適用する）
+func (p *brokerpool) SetCircuitPolicy(policy circuitbreaker.Policy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	p.circuitPolicy = policy
+	return nil
+}
+
+// LookupPublishBroker 関数は、topic のメッセージを Publish する分散ブローカを返す
+// 担当している分散ブローカのサーキットブレーカが開いている（または接続できない）場合は、祖先ノードを担当している分散ブローカのうち
+// 最も近く、使用できるものを返す（戻り値の bool は、祖先ノードの分散ブローカへ代替したかどうか）
+// NOTE: 代替先の分散ブローカでは、親ノードのワイルドカードトピックの Subscriber のみが受信する
+// 返された分散ブローカには必ず Publish すること（半開のサーキットブレーカは、その結果で回復したかどうかを判定するため）
+func (p *brokerpool) LookupPublishBroker(snapshot *brokertable.Snapshot, topic string) (broker.Broker, bool, error) {
+	host, port, err := snapshot.LookupHost(topic)
+	if err != nil {
+		return nil, false, err
+	}
+	b, err := p.GetOrConnectBroker(host, port)
+	if !p.circuitPolicy.IsEnabled() {
+		return b, false, err
+	}
+	if err == nil && b.Available() {
+		return b, false, nil
+	}
+
+	ancestors, lookupErr := snapshot.LookupAncestorHosts(topic)
+	if lookupErr != nil {
+		return nil, false, lookupErr
+	}
+	for _, h := range ancestors {
+		ancestor, err := p.GetOrConnectBroker(h.Host, h.Port)
+		if err != nil || !ancestor.Available() {
+			continue
+		}
+		log.WithFields(log.Fields{"topic": topic, "host": host, "port": port, "fallback_host": h.Host, "fallback_port": h.Port}).Debug("Fallback to ancestor broker")
+		return ancestor, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return nil, false, CircuitOpenError{Msg: fmt.Sprintf("There is no available broker for this topic (topic = %v, broker = %v).", topic, p.LookupEndpoint(host, port))}
+}
+
+//////////////        以上 接続管理 関連            //////////////
 //////////////  以下 BrokersTableByHost 構造体関連  //////////////
 
 // BrokersTableByHost 構造体を管理する構造体 (map)
@@ -222,6 +866,22 @@ func (t *BrokersTableByHost) closeAllBroker(quiesce uint) {
 	})
 }
 
+// forEachBroker 関数は、全てのブローカに対して f を実行する（f がエラーを返した場合は中断する）
+func (t *BrokersTableByHost) forEachBroker(f func(b broker.Broker) error) error {
+	var err error
+	t.t.Range(func(_, v interface{}) bool {
+		t, ok := v.(*BrokerTableByPort)
+		if !ok {
+			log.WithFields(log.Fields{
+				"error": StoredTypeIsInvalidError{Msg: fmt.Sprintf("Stored type is invalid (expected = %T, result = %T)", BrokerTableByPort{}, v)},
+			}).Fatal("Stored data type is invalid")
+		}
+		err = t.forEachBroker(f)
+		return err == nil
+	})
+	return err
+}
+
 // Store 関数
 func (s *BrokersTableByHost) Store(key string, value *BrokerTableByPort) {
 	s.t.Store(key, value)
@@ -268,11 +928,32 @@ func (t *BrokerTableByPort) closeAllBroker(quiesce uint) {
 	})
 }
 
+// forEachBroker 関数は、全てのブローカに対して f を実行する（f がエラーを返した場合は中断する）
+func (t *BrokerTableByPort) forEachBroker(f func(b broker.Broker) error) error {
+	var err error
+	t.t.Range(func(_, v interface{}) bool {
+		b, ok := v.(broker.Broker)
+		if !ok {
+			log.WithFields(log.Fields{
+				"error": StoredTypeIsInvalidError{Msg: fmt.Sprintf("Stored type is invalid (expected = %T, result = %T)", BrokerTableByPort{}, v)},
+			}).Fatal("Stored data type is invalid")
+		}
+		err = f(b)
+		return err == nil
+	})
+	return err
+}
+
 // Store 関数
 func (s *BrokerTableByPort) Store(key uint16, value broker.Broker) {
 	s.t.Store(key, value)
 }
 
+// Delete 関数
+func (s *BrokerTableByPort) Delete(key uint16) {
+	s.t.Delete(key)
+}
+
 // Load 関数
 func (s *BrokerTableByPort) Load(key uint16) (broker.Broker, error) {
 	v, ok := s.t.Load(key)
@@ -321,4 +1002,24 @@ func (e StoredTypeIsInvalidError) Error() string {
 	return fmt.Sprintf("Error: %v", e.Msg)
 }
 
+// ConnectionPolicyError 構造体
+// 分散ブローカとの接続の管理方法が不正な場合に返される
+type ConnectionPolicyError struct {
+	Msg string
+}
+
+func (e ConnectionPolicyError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+// CircuitOpenError 構造体
+// トピックを担当している分散ブローカと、その祖先ノードを担当している分散ブローカのサーキットブレーカが全て開いている場合に返される
+type CircuitOpenError struct {
+	Msg string
+}
+
+func (e CircuitOpenError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
 //////////////        以上 Error 構造体関連       //////////////
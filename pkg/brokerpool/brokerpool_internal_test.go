@@ -1,9 +1,355 @@
 package brokerpool
 
 import (
+	"gamma/pkg/broker"
+	"gamma/pkg/brokertable"
+	"gamma/pkg/circuitbreaker"
+	"reflect"
 	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 )
 
 func TestHoge(t *testing.T) {
 	t.Skip("skip test...")
 }
+
+// fakeClient 構造体は、何もしない mqtt.Client（Disconnect 関数が呼ばれたかどうかを記録する）
+type fakeClient struct {
+	disconnected bool
+}
+
+func (c *fakeClient) IsConnected() bool      { return !c.disconnected }
+func (c *fakeClient) IsConnectionOpen() bool { return !c.disconnected }
+func (c *fakeClient) Connect() mqtt.Token    { return &fakeToken{} }
+func (c *fakeClient) Disconnect(uint)        { c.disconnected = true }
+func (c *fakeClient) Publish(string, byte, bool, interface{}) mqtt.Token {
+	return &fakeToken{}
+}
+func (c *fakeClient) Subscribe(string, byte, mqtt.MessageHandler) mqtt.Token {
+	return &fakeToken{}
+}
+func (c *fakeClient) SubscribeMultiple(map[string]byte, mqtt.MessageHandler) mqtt.Token {
+	return &fakeToken{}
+}
+func (c *fakeClient) Unsubscribe(...string) mqtt.Token     { return &fakeToken{} }
+func (c *fakeClient) AddRoute(string, mqtt.MessageHandler) {}
+func (c *fakeClient) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.NewClient(mqtt.NewClientOptions()).OptionsReader()
+}
+
+type fakeToken struct{}
+
+func (t *fakeToken) Wait() bool                     { return true }
+func (t *fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (t *fakeToken) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+func (t *fakeToken) Error() error { return nil }
+
+// storeFakeBroker 関数は、fakeClient を使用する分散ブローカを brokerpool へ登録する
+func storeFakeBroker(p *brokerpool, port uint16) *fakeClient {
+	c := &fakeClient{}
+	p.storeBroker("localhost", port, broker.NewBroker(c, 0, make(chan mqtt.Message)))
+	return c
+}
+
+// 接続数の上限を超えた場合は、Subscriber がいない分散ブローカのうち最も長く使用されていないものから切断する
+func TestEvictLeastRecentlyUsed(t *testing.T) {
+	p := NewBrokerPool(0, make(chan mqtt.Message)).(*brokerpool)
+	if err := p.SetConnectionPolicy(ConnectionPolicy{Lazy: true, MaxConnections: 2}); err != nil {
+		t.Fatalf("SetConnectionPolicy() error = %v", err)
+	}
+
+	c1 := storeFakeBroker(p, 1883)
+	c2 := storeFakeBroker(p, 1884)
+	if err := p.IncreaseSubCnt("localhost", 1883); err != nil {
+		t.Fatalf("IncreaseSubCnt() error = %v", err)
+	}
+	c3 := storeFakeBroker(p, 1885)
+
+	// 1883 は Subscriber がいるため、次に古い 1884 が切断される
+	tests := []struct {
+		name             string
+		port             uint16
+		c                *fakeClient
+		wantDisconnected bool
+	}{
+		{name: "Normal scenario 01 (subscribed)", port: 1883, c: c1, wantDisconnected: false},
+		{name: "Normal scenario 02 (least recently used)", port: 1884, c: c2, wantDisconnected: true},
+		{name: "Normal scenario 03 (just connected)", port: 1885, c: c3, wantDisconnected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.c.disconnected != tt.wantDisconnected {
+				t.Errorf("disconnected = %v, expected %v", tt.c.disconnected, tt.wantDisconnected)
+			}
+			_, err := p.lookupBroker("localhost", tt.port)
+			if (err != nil) != tt.wantDisconnected {
+				t.Errorf("lookupBroker() error = %v, expected removed = %v", err, tt.wantDisconnected)
+			}
+		})
+	}
+
+	want := ConnectionStats{Open: 2, Connects: 3, Evictions: 1}
+	if got := p.GetConnectionStats(); got != want {
+		t.Errorf("GetConnectionStats() = %+v, expected %+v", got, want)
+	}
+}
+
+// 切断できる分散ブローカが無く、接続数の上限を超えたままの場合のみ警告する
+func TestEvictWarning(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	warnings := func() int {
+		n := 0
+		for _, e := range hook.AllEntries() {
+			if e.Level == log.WarnLevel {
+				n++
+			}
+		}
+		return n
+	}
+
+	p := NewBrokerPool(0, make(chan mqtt.Message)).(*brokerpool)
+	if err := p.SetConnectionPolicy(ConnectionPolicy{MaxConnections: 1}); err != nil {
+		t.Fatalf("SetConnectionPolicy() error = %v", err)
+	}
+	if got := warnings(); got != 0 {
+		t.Errorf("warnings = %v, expected 0 (no brokers)", got)
+	}
+
+	storeFakeBroker(p, 1883)
+	storeFakeBroker(p, 1884)
+	if got := warnings(); got != 0 {
+		t.Errorf("warnings = %v, expected 0 (evicted down to the cap)", got)
+	}
+
+	if err := p.IncreaseSubCnt("localhost", 1884); err != nil {
+		t.Fatalf("IncreaseSubCnt() error = %v", err)
+	}
+	storeFakeBroker(p, 1885)
+	if got := warnings(); got != 1 {
+		t.Errorf("warnings = %v, expected 1 (over the cap)", got)
+	}
+}
+
+// GetBroker 関数で使用した分散ブローカは、最近使用したものとして扱われる
+func TestEvictAfterTouch(t *testing.T) {
+	p := NewBrokerPool(0, make(chan mqtt.Message)).(*brokerpool)
+	if err := p.SetConnectionPolicy(ConnectionPolicy{MaxConnections: 2}); err != nil {
+		t.Fatalf("SetConnectionPolicy() error = %v", err)
+	}
+
+	c1 := storeFakeBroker(p, 1883)
+	c2 := storeFakeBroker(p, 1884)
+	if _, err := p.GetBroker("localhost", 1883); err != nil {
+		t.Fatalf("GetBroker() error = %v", err)
+	}
+	storeFakeBroker(p, 1885)
+
+	if c1.disconnected {
+		t.Errorf("recently used broker was disconnected")
+	}
+	if !c2.disconnected {
+		t.Errorf("least recently used broker was not disconnected")
+	}
+}
+
+// Subscriber がおらず、最後の Publish から IdleTimeout 以上経過した分散ブローカを切断する
+func TestReapIdleBrokers(t *testing.T) {
+	p := NewBrokerPool(0, make(chan mqtt.Message)).(*brokerpool)
+	if err := p.SetConnectionPolicy(ConnectionPolicy{Lazy: true, IdleTimeout: time.Millisecond}); err != nil {
+		t.Fatalf("SetConnectionPolicy() error = %v", err)
+	}
+
+	idle := storeFakeBroker(p, 1883)
+	subscribed := storeFakeBroker(p, 1884)
+	if err := p.IncreaseSubCnt("localhost", 1884); err != nil {
+		t.Fatalf("IncreaseSubCnt() error = %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if got := p.ReapIdleBrokers(0); got != 1 {
+		t.Errorf("ReapIdleBrokers() = %v, expected %v", got, 1)
+	}
+	if !idle.disconnected || subscribed.disconnected {
+		t.Errorf("disconnected = (idle: %v, subscribed: %v), expected (true, false)", idle.disconnected, subscribed.disconnected)
+	}
+	if _, err := p.GetBroker("localhost", 1883); err == nil {
+		t.Errorf("GetBroker() error = nil, expected reaped broker to be removed")
+	}
+
+	want := ConnectionStats{Open: 1, Connects: 2, Reaped: 1}
+	if got := p.GetConnectionStats(); got != want {
+		t.Errorf("GetConnectionStats() = %+v, expected %+v", got, want)
+	}
+}
+
+// 統合した分散ブローカは、Subscriber の有無によらず切断して brokerpool から削除する
+func TestDisconnectBroker(t *testing.T) {
+	p := NewBrokerPool(0, make(chan mqtt.Message)).(*brokerpool)
+	c := storeFakeBroker(p, 1883)
+	if err := p.IncreaseSubCnt("localhost", 1883); err != nil {
+		t.Fatalf("IncreaseSubCnt() error = %v", err)
+	}
+
+	if p.TryDisconnectBroker("localhost", 1883, 0, 0) {
+		t.Fatalf("TryDisconnectBroker() = true, expected false (subscribed)")
+	}
+	if !p.DisconnectBroker("localhost", 1883, 0) {
+		t.Errorf("DisconnectBroker() = false, expected true")
+	}
+	if !c.disconnected {
+		t.Errorf("disconnected = false, expected true")
+	}
+	if _, err := p.lookupBroker("localhost", 1883); err == nil {
+		t.Errorf("lookupBroker() error = nil, expected disconnected broker to be removed")
+	}
+	if p.DisconnectBroker("localhost", 1883, 0) {
+		t.Errorf("DisconnectBroker() = true, expected false (already removed)")
+	}
+}
+
+func TestGetBrokerStats(t *testing.T) {
+	p := NewBrokerPool(0, make(chan mqtt.Message)).(*brokerpool)
+	storeFakeBroker(p, 1883)
+	storeFakeBroker(p, 1884)
+	if err := p.IncreaseSubCnt("localhost", 1884); err != nil {
+		t.Fatalf("IncreaseSubCnt() error = %v", err)
+	}
+
+	// 最も長く使用されていない順に返す
+	want := []BrokerStats{
+		{Host: "localhost", Port: 1883, Subscribers: 0, Circuit: circuitbreaker.Closed},
+		{Host: "localhost", Port: 1884, Subscribers: 1, Circuit: circuitbreaker.Closed},
+	}
+	if got := p.GetBrokerStats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetBrokerStats() = %+v, expected %+v", got, want)
+	}
+}
+
+// ワイルドカードを含むトピックは複数の分散ブローカに複製されるため、合計しない
+func TestGetSubscriptions(t *testing.T) {
+	p := NewBrokerPool(0, make(chan mqtt.Message)).(*brokerpool)
+	storeFakeBroker(p, 1883)
+	storeFakeBroker(p, 1884)
+	subscriptions := []struct {
+		port  uint16
+		topic string
+	}{
+		{port: 1883, topic: "/0/1"},
+		{port: 1883, topic: "/0/+/2"},
+		{port: 1884, topic: "/0/1"},
+		{port: 1884, topic: "/1/2"},
+		{port: 1884, topic: "/0/+/2"},
+	}
+	for _, s := range subscriptions {
+		b, err := p.GetBroker("localhost", s.port)
+		if err != nil {
+			t.Fatalf("GetBroker() error = %v", err)
+		}
+		if err := b.Subscribe(s.topic); err != nil {
+			t.Fatalf("Subscribe() error = %v", err)
+		}
+	}
+
+	want := map[string]uint{"/0/1": 2, "/1/2": 1, "/0/+/2": 1}
+	if got := p.GetSubscriptions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetSubscriptions() = %v, expected %v", got, want)
+	}
+}
+
+func TestSetConnectionPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  ConnectionPolicy
+		wantErr bool
+	}{
+		{name: "Normal scenario 01 (default)", policy: ConnectionPolicy{}},
+		{name: "Normal scenario 02 (managed)", policy: ConnectionPolicy{Lazy: true, IdleTimeout: time.Minute, MaxConnections: 10}},
+		{name: "Error scenario 01 (negative idle timeout)", policy: ConnectionPolicy{IdleTimeout: -time.Second}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewBrokerPool(0, make(chan mqtt.Message))
+			err := p.SetConnectionPolicy(tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SetConnectionPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// 担当している分散ブローカのサーキットブレーカが開いている場合は、最も近い祖先ノードの分散ブローカへ代替する
+func TestLookupPublishBroker(t *testing.T) {
+	p := NewBrokerPool(0, make(chan mqtt.Message)).(*brokerpool)
+	if err := p.SetCircuitPolicy(circuitbreaker.Policy{FailureThreshold: 1, OpenTimeout: time.Minute}); err != nil {
+		t.Fatalf("SetCircuitPolicy() error = %v", err)
+	}
+	root := storeFakeBroker(p, 1883)
+	parent := storeFakeBroker(p, 1884)
+	child := storeFakeBroker(p, 1885)
+
+	// "/" を 1883、"/0" を 1884、"/0/1" を 1885 が担当する
+	table := brokertable.NewTable()
+	for _, u := range []struct {
+		topic string
+		port  uint16
+	}{{"/", 1883}, {"/0", 1884}, {"/0/1", 1885}} {
+		if _, err := table.ReassignHost(0, u.topic, "localhost", u.port); err != nil {
+			t.Fatalf("ReassignHost() error = %v", err)
+		}
+	}
+	snapshot := table.Load()
+
+	lookup := func(topic string) (uint16, bool, error) {
+		b, fallback, err := p.LookupPublishBroker(snapshot, topic)
+		if err != nil {
+			return 0, fallback, err
+		}
+		for _, port := range []uint16{1883, 1884, 1885} {
+			if got, _ := p.lookupBroker("localhost", port); got == b {
+				return port, fallback, nil
+			}
+		}
+		t.Fatalf("LookupPublishBroker() returned unknown broker")
+		return 0, false, nil
+	}
+
+	// 接続が切れている分散ブローカへの Publish に失敗すると、サーキットブレーカが開く
+	child.disconnected = true
+	b, _ := p.lookupBroker("localhost", 1885)
+	b.Publish("/0/1/2", false, "payload")
+	if got := b.GetCircuitState(); got != circuitbreaker.Open {
+		t.Fatalf("GetCircuitState() = %v, expected %v", got, circuitbreaker.Open)
+	}
+	if port, fallback, err := lookup("/0/1/2"); port != 1884 || !fallback || err != nil {
+		t.Errorf("LookupPublishBroker() = %v, %v, %v, expected %v, true, nil", port, fallback, err, 1884)
+	}
+
+	parent.disconnected = true
+	b, _ = p.lookupBroker("localhost", 1884)
+	b.Publish("/0/2", false, "payload")
+	if port, fallback, err := lookup("/0/1/2"); port != 1883 || !fallback || err != nil {
+		t.Errorf("LookupPublishBroker() = %v, %v, %v, expected %v, true, nil", port, fallback, err, 1883)
+	}
+	// 担当している分散ブローカが使用できる場合は代替しない
+	if port, fallback, err := lookup("/1"); port != 1883 || fallback || err != nil {
+		t.Errorf("LookupPublishBroker() = %v, %v, %v, expected %v, false, nil", port, fallback, err, 1883)
+	}
+
+	root.disconnected = true
+	b, _ = p.lookupBroker("localhost", 1883)
+	b.Publish("/1", false, "payload")
+	if _, _, err := lookup("/0/1/2"); err == nil {
+		t.Errorf("LookupPublishBroker() error = nil, expected %T", CircuitOpenError{})
+	} else if _, ok := err.(CircuitOpenError); !ok {
+		t.Errorf("LookupPublishBroker() error = %v (Type: %T), expected Type: %T", err, err, CircuitOpenError{})
+	}
+}
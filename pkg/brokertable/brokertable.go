@@ -2,9 +2,12 @@ package brokertable
 
 import (
 	"fmt"
-	"regexp"
+	"gamma/pkg/endpoint"
+	"gamma/pkg/topicscheme"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 //////////////        以下、Brokertable 関連              //////////////
@@ -36,22 +39,75 @@ func lookupAllHosts(root *Node, flag map[string]bool) []Host {
 	return hosts
 }
 
+// LookupMatchingHosts 関数は、ワイルドカード ("+", "#") を含むトピックフィルタにマッチし得るトピックを
+// 担当している分散ブローカを全て返す
+// 例: "/0/+/2" の場合、"/0/0/2" 〜 "/0/3/2" のいずれかを担当する分散ブローカ
+func LookupMatchingHosts(root *Node, filter string) ([]Host, error) {
+	if err := validateTopicFilter(filter); err != nil {
+		return []Host{{Host: root.Host, Port: root.Port}}, err
+	}
+	levels := strings.Split(strings.TrimPrefix(filter, "/"), "/")
+	return lookupMatchingHosts(root, levels, 0, make(map[string]bool)), nil
+}
+
+func lookupMatchingHosts(currentNode *Node, levels []string, depth int, flag map[string]bool) []Host {
+	hosts := []Host{}
+	appendCurrentHost := func() {
+		key := fmt.Sprintf("%s:%d", currentNode.Host, currentNode.Port)
+		if !flag[key] {
+			flag[key] = true
+			hosts = append(hosts, Host{Host: currentNode.Host, Port: currentNode.Port})
+		}
+	}
+
+	if len(levels) == 0 {
+		appendCurrentHost()
+		return hosts
+	}
+
+	switch levels[0] {
+	case "#":
+		return lookupAllHosts(currentNode, flag)
+	case "+":
+		// 子ノードとして存在しないトピックは、現在のノードの担当となる
+		fanout := topicscheme.Current().Fanout(depth)
+		if fanout == 0 || len(currentNode.Children) < fanout {
+			appendCurrentHost()
+		}
+		childrenKey := keys(currentNode.Children)
+		sort.Strings(childrenKey)
+		for _, k := range childrenKey {
+			hosts = append(hosts, lookupMatchingHosts(currentNode.Children[k], levels[1:], depth+1, flag)...)
+		}
+	default:
+		n, ok := currentNode.Children[levels[0]]
+		if !ok {
+			appendCurrentHost()
+			return hosts
+		}
+		hosts = append(hosts, lookupMatchingHosts(n, levels[1:], depth+1, flag)...)
+	}
+	return hosts
+}
+
+// LookupNode 関数は、トピック名を担当している（トピック名に最も深くまで一致する）ノードを返す
+// NOTE: メッセージの転送ごとに呼び出されるため、メモリ割り当てを行わないこと（エラー時を除く）
 func LookupNode(root *Node, topic string) (*Node, error) {
 	if err := validateTopic(topic); err != nil {
 		return root, err
 	}
 	currentNode := root
-	if topic != "/" {
-		rep := regexp.MustCompile(`^/`)
-		topicSlice := strings.Split(rep.ReplaceAllString(topic, ""), "/")
-		for _, child := range topicSlice {
-
-			n, ok := currentNode.Children[child]
-			if !ok {
-				break
-			}
-			currentNode = n
+	if topic == "/" {
+		return currentNode, nil
+	}
+	for i := 1; i <= len(topic); {
+		var child string
+		child, i = topicscheme.NextLevel(topic, i)
+		n, ok := currentNode.Children[child]
+		if !ok {
+			break
 		}
+		currentNode = n
 	}
 	return currentNode, nil
 }
@@ -62,10 +118,45 @@ func LookupHost(root *Node, topic string) (string, uint16, error) {
 	return n.Host, n.Port, err
 }
 
-// FIXME: 動的な分散ブローカの追加、削除には未対応（Broker.SubCntの引継ぎを何も考えていない）
+// LookupAncestorHosts 関数は、トピック名を担当しているノードの祖先ノードを担当している分散ブローカを、近い順に返す
+// トピック名を担当している分散ブローカ自身と、重複する分散ブローカは含まない
+// NOTE: 担当している分散ブローカを使用できない場合に、親ノードのワイルドカードトピックの Subscriber へ配送するための転送先の候補
+func LookupAncestorHosts(root *Node, topic string) ([]Host, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	}
+	path := []*Node{root}
+	if topic != "/" {
+		for i := 1; i <= len(topic); {
+			var child string
+			child, i = topicscheme.NextLevel(topic, i)
+			n, ok := path[len(path)-1].Children[child]
+			if !ok {
+				break
+			}
+			path = append(path, n)
+		}
+	}
+
+	owner := path[len(path)-1]
+	flag := map[string]bool{fmt.Sprintf("%s:%d", owner.Host, owner.Port): true}
+	hosts := []Host{}
+	for i := len(path) - 2; i >= 0; i-- {
+		key := fmt.Sprintf("%s:%d", path[i].Host, path[i].Port)
+		if flag[key] {
+			continue
+		}
+		flag[key] = true
+		hosts = append(hosts, Host{Host: path[i].Host, Port: path[i].Port})
+	}
+	return hosts, nil
+}
+
 // UpdateHost 関数は、トピック名とそれに対応する分散ブローカへの接続情報を更新する
 // 更新の際、当該トピックより深いレベルの分散ブローカへの接続情報は削除される。
 // そのため、更新処理の順序に気を付けること
+// NOTE: 深いレベルの分散ブローカへの接続情報を残したまま更新する場合は ReassignHost 関数を使用すること
+// NOTE: 分散ブローカの追加時は、brokerpool.UnsubscribeSubsetTopics 関数で Broker.SubCnt を引き継いでから呼び出すこと
 func UpdateHost(root *Node, topic string, host string, port uint16) error {
 	if err := validateTopic(topic); err != nil {
 		return err
@@ -77,9 +168,9 @@ func UpdateHost(root *Node, topic string, host string, port uint16) error {
 
 	currentNode := root
 	if topic != "/" {
-		rep := regexp.MustCompile(`^/`)
-		topicSlice := strings.Split(rep.ReplaceAllString(topic, ""), "/")
-		for _, child := range topicSlice {
+		for i := 1; i <= len(topic); {
+			var child string
+			child, i = topicscheme.NextLevel(topic, i)
 			if currentNode.Host == "" {
 				currentNode.Host = host
 			}
@@ -99,43 +190,498 @@ func UpdateHost(root *Node, topic string, host string, port uint16) error {
 			}
 		}
 	}
-	// NOTE: 古い子ノードは削除する
+	// NOTE: 古い子ノードとレプリカは削除する
 	currentNode.Host = host
 	currentNode.Port = port
+	currentNode.Replicas = nil
 	currentNode.Children = map[string]*Node{}
 
 	return nil
 }
 
+// AddReplica 関数は、トピック名に対応するノードへ、同じトピックを担当する分散ブローカ（レプリカ）を追加する
+// UpdateHost 関数と異なり、当該トピックより深いレベルの分散ブローカへの接続情報は変更しない
+// NOTE: トピック名に完全に一致するノードが存在しない場合は NodeNotFoundError を返す
+func AddReplica(root *Node, topic string, host string, port uint16) error {
+	if err := validateTopic(topic); err != nil {
+		return err
+	}
+
+	if err := validateHost(host); err != nil {
+		return err
+	}
+
+	currentNode := root
+	if topic != "/" {
+		for i := 1; i <= len(topic); {
+			var child string
+			child, i = topicscheme.NextLevel(topic, i)
+			n, ok := currentNode.Children[child]
+			if !ok {
+				return NodeNotFoundError{Msg: fmt.Sprintf("Node not found (topic = %v).", topic)}
+			}
+			currentNode = n
+		}
+	}
+
+	for _, h := range currentNode.Hosts() {
+		if h.Host == host && h.Port == port {
+			return DuplicateHostError{Msg: fmt.Sprintf("This broker (%v:%v) is already assigned to the topic (%v).", host, port, topic)}
+		}
+	}
+	// NOTE: 同じ分散ブローカが担当している子孫ノードも同じレプリカセットとする
+	for _, t := range collectTerritory(currentNode, topic) {
+		t.n.Replicas = append(append([]Host{}, t.n.Replicas...), Host{Host: host, Port: port})
+	}
+	return nil
+}
+
+// LookupReplicaSet 関数は、トピック名を担当している分散ブローカのレプリカセットを返す
+// 先頭は LookupHost 関数で返される分散ブローカとなる
+func LookupReplicaSet(root *Node, topic string) ([]Host, error) {
+	n, err := LookupNode(root, topic)
+	return n.Hosts(), err
+}
+
+// NOTE: トピック名の形式は topicscheme.Current() で設定されたスキームに従う
 func validateTopic(topic string) error {
-	rTopic := regexp.MustCompile(`^((/)|(/([0-9]+(/[0-3])*)?))$`)
-	if rTopic.MatchString(topic) {
-		return nil
+	s := topicscheme.Current()
+	if err := topicscheme.ValidateTopic(s, topic); err != nil {
+		return TopicNameError{Msg: fmt.Sprintf("Invalid topic name(%v). Allowed topic name`s regular expressions is '%v' .", topic, s.Pattern())}
+	}
+	return nil
+}
+
+// validateTopicFilter 関数は、ワイルドカード ("+", "#") を含むトピックフィルタを検証する
+// NOTE: subsctable パッケージと同じく topicscheme.ValidateTopicFilter で検証するため、
+// ルーティング用のトピックの後の任意の単語（例: "/0/+/data"）も許可する
+func validateTopicFilter(filter string) error {
+	scheme := topicscheme.Current()
+	if err := topicscheme.ValidateTopicFilter(scheme, filter); err != nil {
+		return TopicNameError{Msg: fmt.Sprintf("Invalid topic filter(%v). Each level of topic filter must be '+' or matched with '%v', and last level can be '#' or any word .", filter, scheme.Pattern())}
 	}
-	return TopicNameError{Msg: fmt.Sprintf("Invalid topic name(%v). Allowed topic name`s regular expressions is '^/([0-9]+(/[0-3])*)?$' .", topic)}
+	return nil
 }
 
+// NOTE: ホスト名の検証は endpoint パッケージと共通にする（IPv6 アドレスや "mqtt-broker" のようなホスト名も許可する）
 func validateHost(host string) error {
-	rIpv4Address := regexp.MustCompile(`^(([0-9]|[1-9][0-9]|1[0-9][0-9]|2[0-4][0-9]|25[0-5])\.){3}([0-9]|[1-9][0-9]|1[0-9][0-9]|2[0-4][0-9]|25[0-5])$`)
-	rDomainName := regexp.MustCompile(`^([a-zA-Z0-9][a-zA-Z0-9-]{1,61}[a-zA-Z0-9]\.)+[a-zA-Z-]{2,}$`)
-	exceptionalName := []string{
-		"localhost",
+	if err := endpoint.ValidateHost(host); err != nil {
+		return HostError{Msg: fmt.Sprintf("Invalid host (%v). Allowed 'host' formats are IPv4 address, IPv6 address or host name.", host)}
 	}
+	return nil
+}
 
-	if rIpv4Address.MatchString(host) || rDomainName.MatchString(host) {
+//////////////        以上、Brokertable 関連              //////////////
+//////////////         以下、再割り当て 関連              //////////////
+
+// NOTE: 以下の関数では、ノードと、同じ分散ブローカが担当している子孫ノード（途中で他の分散ブローカのノードを挟まないもの）を
+// そのノードの「担当範囲」として扱う（UpdateHost 関数で途中のノードが生成された場合などに、同じ分散ブローカのノードが連なるため）
+// また、戻り値のトピック名は、担当する分散ブローカが変わったノードのトピック名（昇順）を表す
+// 各トピック名は、そのノード以下のうち、より深いノードが担当していないトピックを表す
+
+// ReassignHost 関数は、トピック名に対応するノードの担当範囲を、与えられた分散ブローカへ割り当て直す
+// UpdateHost 関数と異なり、他の分散ブローカが担当している子孫ノードはそのまま残す
+// ノードが存在しない場合は追加する（途中のノードは親ノードの分散ブローカが引き続き担当する）
+// NOTE: 分散ブローカの追加時は、brokerpool.UnsubscribeSubsetTopics 関数で Broker.SubCnt を引き継いでから呼び出すこと
+func ReassignHost(root *Node, topic string, host string, port uint16) ([]string, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	}
+	if err := validateHost(host); err != nil {
+		return nil, err
+	}
+
+	changed := []string{}
+	for _, t := range collectTerritory(loadOrCreateNode(root, topic), topic) {
+		if t.n.Host != host || t.n.Port != port {
+			changed = append(changed, t.topic)
+		}
+		t.n.Host = host
+		t.n.Port = port
+		t.n.Replicas = nil
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// RemoveNode 関数は、トピック名に対応するノードの担当範囲を、親ノードの分散ブローカへ戻す
+// 他の分散ブローカが担当している子孫ノードはそのまま残し、不要になったノードは削除する
+// NOTE: ルートノードは削除できない
+func RemoveNode(root *Node, topic string) ([]string, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	}
+	if topic == "/" {
+		return nil, RootNodeError{Msg: "The root node cannot be removed."}
+	}
+
+	parent, key, n, err := loadNodeWithParent(root, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := []string{}
+	for _, t := range collectTerritory(n, topic) {
+		if t.n.Host != parent.Host || t.n.Port != parent.Port {
+			changed = append(changed, t.topic)
+		}
+		t.n.Host = parent.Host
+		t.n.Port = parent.Port
+		t.n.Replicas = copyHosts(parent.Replicas)
+	}
+	pruneChild(parent, key)
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// MoveSubtree 関数は、トピック名に対応するノード以下の全てのトピックを、与えられた分散ブローカへ移す
+// UpdateHost 関数と同様に子孫ノードは削除されるが、担当する分散ブローカが変わったノードのトピック名を返す
+// ノードが存在しない場合は追加する（途中のノードは親ノードの分散ブローカが引き続き担当する）
+func MoveSubtree(root *Node, topic string, host string, port uint16) ([]string, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	}
+	if err := validateHost(host); err != nil {
+		return nil, err
+	}
+
+	n := loadOrCreateNode(root, topic)
+	changed := []string{}
+	n.walk(topic, func(d *Node, t string) {
+		if d.Host != host || d.Port != port {
+			changed = append(changed, t)
+		}
+	})
+	n.Host = host
+	n.Port = port
+	n.Replicas = nil
+	n.Children = map[string]*Node{}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// territoryNode 構造体は、担当範囲に含まれるノードとそのトピック名を表す
+type territoryNode struct {
+	n     *Node
+	topic string
+}
+
+// collectTerritory 関数は、ノードの担当範囲に含まれるノードを返す（先頭は n）
+func collectTerritory(n *Node, topic string) []territoryNode {
+	result := []territoryNode{{n: n, topic: topic}}
+	for i := 0; i < len(result); i++ {
+		current := result[i]
+		for k, child := range current.n.Children {
+			if child.Host == n.Host && child.Port == n.Port {
+				result = append(result, territoryNode{n: child, topic: childTopic(current.topic, k)})
+			}
+		}
+	}
+	return result
+}
+
+// walk 関数は、自身と全ての子孫ノードに対して f を実行する
+func (n *Node) walk(topic string, f func(n *Node, topic string)) {
+	f(n, topic)
+	for k, child := range n.Children {
+		child.walk(childTopic(topic, k), f)
+	}
+}
+
+// loadOrCreateNode 関数は、検証済みのトピック名に対応するノードを返す
+// ノードが存在しない場合は、親ノードと同じ分散ブローカが担当するノードを追加する
+func loadOrCreateNode(root *Node, topic string) *Node {
+	currentNode := root
+	if topic == "/" {
+		return currentNode
+	}
+	for i := 1; i <= len(topic); {
+		var child string
+		child, i = topicscheme.NextLevel(topic, i)
+		if currentNode.Children == nil {
+			currentNode.Children = map[string]*Node{}
+		}
+		n, ok := currentNode.Children[child]
+		if !ok {
+			n = &Node{Children: map[string]*Node{}, Host: currentNode.Host, Port: currentNode.Port, Replicas: copyHosts(currentNode.Replicas)}
+			currentNode.Children[child] = n
+		}
+		currentNode = n
+	}
+	return currentNode
+}
+
+// loadNodeWithParent 関数は、検証済みのトピック名（"/" を除く）に完全に一致するノードと、その親ノード・キーを返す
+func loadNodeWithParent(root *Node, topic string) (*Node, string, *Node, error) {
+	parent, currentNode, key := (*Node)(nil), root, ""
+	for i := 1; i <= len(topic); {
+		key, i = topicscheme.NextLevel(topic, i)
+		n, ok := currentNode.Children[key]
+		if !ok {
+			return nil, "", nil, NodeNotFoundError{Msg: fmt.Sprintf("Node not found (topic = %v).", topic)}
+		}
+		parent, currentNode = currentNode, n
+	}
+	return parent, key, currentNode, nil
+}
+
+// pruneChild 関数は、親ノードと同じ分散ブローカが担当しており、子ノードを持たないノードを再帰的に削除する
+// NOTE: 削除しても LookupHost 関数などの結果は変わらない
+func pruneChild(parent *Node, key string) {
+	n := parent.Children[key]
+	for k := range n.Children {
+		pruneChild(n, k)
+	}
+	if len(n.Children) == 0 && sameHosts(parent.Hosts(), n.Hosts()) {
+		delete(parent.Children, key)
+	}
+}
+
+func childTopic(topic string, key string) string {
+	if topic == "/" {
+		return "/" + key
+	}
+	return topic + "/" + key
+}
+
+func copyHosts(hosts []Host) []Host {
+	if hosts == nil {
 		return nil
 	}
+	return append([]Host{}, hosts...)
+}
 
-	for _, h := range exceptionalName {
-		if h == host {
-			return nil
+func sameHosts(a, b []Host) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
 		}
 	}
+	return true
+}
+
+//////////////         以上、再割り当て 関連              //////////////
+//////////////            以下、Table 関連                //////////////
 
-	return HostError{Msg: "Invalid host. Allowed 'host' formats are IPv4 address, domain name or 'localhost'."}
+// Table 構造体は、複数の goroutine から安全に参照・更新できる brokertable
+// 参照する側はロックを取らずに不変のスナップショットを取得し、
+// 更新する側は現在のスナップショットを複製・更新した新たなスナップショットへアトミックに差し替える
+type Table struct {
+	mu       sync.Mutex   // 更新する側の排他制御
+	snapshot atomic.Value // *Snapshot
 }
 
-//////////////        以上、Brokertable 関連              //////////////
+// Snapshot 構造体は、ある時点の brokertable を表す
+// NOTE: 複数の goroutine から参照されるため、Root() で取得したノードは変更しないこと
+type Snapshot struct {
+	version int // Manager が管理する brokertable のバージョン
+	root    *Node
+	trie    *compactTrie // LookupHost 用に root を詰め直したもの
+}
+
+// NewTable 関数は、空の Table 構造体を生成する（バージョンは -1）
+func NewTable() *Table {
+	t := &Table{}
+	root := &Node{}
+	t.snapshot.Store(&Snapshot{version: -1, root: root, trie: compileTrie(root)})
+	return t
+}
+
+// Load 関数は、現在のスナップショットを返す
+func (t *Table) Load() *Snapshot {
+	return t.snapshot.Load().(*Snapshot)
+}
+
+// Update 関数は、現在のスナップショットを複製して f で更新し、バージョン version のスナップショットとして差し替える
+// f がエラーを返した場合は差し替えない
+// また、現在のスナップショットより古いバージョンへの更新は VersionError を返す
+func (t *Table) Update(version int, f func(root *Node) error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	current := t.Load()
+	if version < current.version {
+		return VersionError{Msg: fmt.Sprintf("Version (%v) is older than current version (%v).", version, current.version)}
+	}
+
+	root := current.root.Clone()
+	if err := f(root); err != nil {
+		return err
+	}
+	t.snapshot.Store(&Snapshot{version: version, root: root, trie: compileTrie(root)})
+	return nil
+}
+
+// UpdateHost 関数は、UpdateHost 関数による更新を新たなスナップショットとして差し替える
+func (t *Table) UpdateHost(version int, topic string, host string, port uint16) error {
+	return t.Update(version, func(root *Node) error {
+		return UpdateHost(root, topic, host, port)
+	})
+}
+
+// AddReplica 関数は、AddReplica 関数による更新を新たなスナップショットとして差し替える
+func (t *Table) AddReplica(version int, topic string, host string, port uint16) error {
+	return t.Update(version, func(root *Node) error {
+		return AddReplica(root, topic, host, port)
+	})
+}
+
+// ReassignHost 関数は、ReassignHost 関数による更新を新たなスナップショットとして差し替え、担当する分散ブローカが変わったトピック名を返す
+func (t *Table) ReassignHost(version int, topic string, host string, port uint16) ([]string, error) {
+	var changed []string
+	err := t.Update(version, func(root *Node) (err error) {
+		changed, err = ReassignHost(root, topic, host, port)
+		return err
+	})
+	return changed, err
+}
+
+// RemoveNode 関数は、RemoveNode 関数による更新を新たなスナップショットとして差し替え、担当する分散ブローカが変わったトピック名を返す
+func (t *Table) RemoveNode(version int, topic string) ([]string, error) {
+	var changed []string
+	err := t.Update(version, func(root *Node) (err error) {
+		changed, err = RemoveNode(root, topic)
+		return err
+	})
+	return changed, err
+}
+
+// MoveSubtree 関数は、MoveSubtree 関数による更新を新たなスナップショットとして差し替え、担当する分散ブローカが変わったトピック名を返す
+func (t *Table) MoveSubtree(version int, topic string, host string, port uint16) ([]string, error) {
+	var changed []string
+	err := t.Update(version, func(root *Node) (err error) {
+		changed, err = MoveSubtree(root, topic, host, port)
+		return err
+	})
+	return changed, err
+}
+
+// Version 関数は、スナップショットのバージョンを返す
+func (s *Snapshot) Version() int {
+	return s.version
+}
+
+// Root 関数は、スナップショットのルートノードを返す
+func (s *Snapshot) Root() *Node {
+	return s.root
+}
+
+// LookupHost 関数は、LookupHost 関数と同じ結果を返す
+// NOTE: メッセージの転送ごとに呼び出されるため、メモリ割り当てを行わないこと（エラー時を除く）
+func (s *Snapshot) LookupHost(topic string) (string, uint16, error) {
+	if err := validateTopic(topic); err != nil {
+		return s.root.Host, s.root.Port, err
+	}
+	h := s.trie.lookup(topic)[0]
+	return h.Host, h.Port, nil
+}
+
+// LookupReplicaSet 関数は、LookupReplicaSet 関数と同じ結果を返す
+// NOTE: メッセージの転送ごとに呼び出されるため、メモリ割り当てを行わないこと（エラー時を除く）
+// 返されるスライスはスナップショットと共有されるため、変更しないこと
+func (s *Snapshot) LookupReplicaSet(topic string) ([]Host, error) {
+	if err := validateTopic(topic); err != nil {
+		return s.root.Hosts(), err
+	}
+	return s.trie.lookup(topic), nil
+}
+
+func (s *Snapshot) LookupAncestorHosts(topic string) ([]Host, error) {
+	return LookupAncestorHosts(s.root, topic)
+}
+
+func (s *Snapshot) LookupSubsetHosts(topic string) ([]Host, error) {
+	return LookupSubsetHosts(s.root, topic)
+}
+
+func (s *Snapshot) LookupMatchingHosts(filter string) ([]Host, error) {
+	return LookupMatchingHosts(s.root, filter)
+}
+
+func (s *Snapshot) String() string {
+	return fmt.Sprintf("{\"version\":%v,\"root\":%v}", s.version, s.root)
+}
+
+//////////////            以上、Table 関連                //////////////
+//////////////         以下、compactTrie 関連             //////////////
+
+// compactTrie 構造体は、Node の木構造を検索用に配列へ詰め直したもの
+// 各ノードの子ノードへの枝は、edges の連続した領域 [edgeStart, edgeEnd) にキーの昇順で格納し、二分探索で検索する
+// NOTE: map を辿るよりポインタの参照が少なく、キャッシュ効率が良い
+type compactTrie struct {
+	nodes []compactNode
+	edges []compactEdge
+}
+
+type compactNode struct {
+	hosts     []Host // レプリカセット（先頭は Node.Host, Node.Port）
+	edgeStart int32
+	edgeEnd   int32
+}
+
+type compactEdge struct {
+	key   string
+	child int32 // nodes のインデックス
+}
+
+// compileTrie 関数は、幅優先で Node を走査し、compactTrie 構造体を生成する
+func compileTrie(root *Node) *compactTrie {
+	t := &compactTrie{nodes: []compactNode{{hosts: root.Hosts()}}}
+	queue := []*Node{root}
+	for i := 0; i < len(queue); i++ {
+		n := queue[i]
+		childrenKey := keys(n.Children)
+		sort.Strings(childrenKey)
+		t.nodes[i].edgeStart = int32(len(t.edges))
+		for _, k := range childrenKey {
+			child := n.Children[k]
+			t.edges = append(t.edges, compactEdge{key: k, child: int32(len(t.nodes))})
+			t.nodes = append(t.nodes, compactNode{hosts: child.Hosts()})
+			queue = append(queue, child)
+		}
+		t.nodes[i].edgeEnd = int32(len(t.edges))
+	}
+	return t
+}
+
+// lookup 関数は、検証済みのトピック名を担当している分散ブローカのレプリカセットを返す
+func (t *compactTrie) lookup(topic string) []Host {
+	idx := int32(0)
+	if topic != "/" {
+		for i := 1; i <= len(topic); {
+			var level string
+			level, i = topicscheme.NextLevel(topic, i)
+			child, ok := t.child(idx, level)
+			if !ok {
+				break
+			}
+			idx = child
+		}
+	}
+	return t.nodes[idx].hosts
+}
+
+func (t *compactTrie) child(idx int32, key string) (int32, bool) {
+	n := &t.nodes[idx]
+	lo, hi := n.edgeStart, n.edgeEnd
+	for lo < hi {
+		mid := int32(uint32(lo+hi) >> 1)
+		if t.edges[mid].key < key {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo < n.edgeEnd && t.edges[lo].key == key {
+		return t.edges[lo].child, true
+	}
+	return 0, false
+}
+
+//////////////         以上、compactTrie 関連             //////////////
 //////////////            以下、Node 関連                 //////////////
 
 type Host struct {
@@ -147,12 +693,32 @@ type Node struct {
 	Children map[string]*Node
 	Host     string
 	Port     uint16
+	Replicas []Host // Host, Port と同じトピックを担当する分散ブローカ（優先度の高い順）
+}
+
+// Hosts 関数は、ノードを担当している分散ブローカのレプリカセットを返す（先頭は Host, Port）
+func (n *Node) Hosts() []Host {
+	hosts := make([]Host, 0, len(n.Replicas)+1)
+	hosts = append(hosts, Host{Host: n.Host, Port: n.Port})
+	return append(hosts, n.Replicas...)
 }
 
 // 再帰的に Node 構造体を JSON 形式の文字列に変換する
 func (n Node) String() string {
 	// HACK: 文字列生成処理の部分があまり効率の良くない実装になっている
-	result := fmt.Sprintf("{\"host\":\"%v\",\"port\":%v,\"children\":{", n.Host, n.Port)
+	result := fmt.Sprintf("{\"host\":\"%v\",\"port\":%v,", n.Host, n.Port)
+	// NOTE: レプリカが存在しない場合は、従来の形式のまま出力する
+	if len(n.Replicas) > 0 {
+		result += "\"replicas\":["
+		for i, h := range n.Replicas {
+			if i > 0 {
+				result += ","
+			}
+			result += fmt.Sprintf("{\"host\":\"%v\",\"port\":%v}", h.Host, h.Port)
+		}
+		result += "],"
+	}
+	result += "\"children\":{"
 	counter := 1
 
 	// NOTE: go の map は range でイテレーションすると、実行するたびに順序が入れ替わるためキーをソートしている
@@ -171,6 +737,21 @@ func (n Node) String() string {
 	return result
 }
 
+// Clone 関数は、子ノードを含めて Node 構造体を複製する
+func (n *Node) Clone() *Node {
+	clone := &Node{Host: n.Host, Port: n.Port}
+	if n.Replicas != nil {
+		clone.Replicas = append([]Host{}, n.Replicas...)
+	}
+	if n.Children != nil {
+		clone.Children = make(map[string]*Node, len(n.Children))
+		for k, child := range n.Children {
+			clone.Children[k] = child.Clone()
+		}
+	}
+	return clone
+}
+
 func keys(m map[string]*Node) []string {
 	ks := []string{}
 	for k, _ := range m {
@@ -198,4 +779,44 @@ func (e HostError) Error() string {
 	return fmt.Sprintf("Error: %v", e.Msg)
 }
 
+// VersionError 構造体
+// 現在のスナップショットより古いバージョンで Table を更新しようとした際に返される
+type VersionError struct {
+	Msg string
+}
+
+func (e VersionError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+// NodeNotFoundError 構造体
+// トピック名に完全に一致するノードが存在しない際に返される
+type NodeNotFoundError struct {
+	Msg string
+}
+
+func (e NodeNotFoundError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+// DuplicateHostError 構造体
+// 既にノードを担当している分散ブローカをレプリカとして追加しようとした際に返される
+type DuplicateHostError struct {
+	Msg string
+}
+
+func (e DuplicateHostError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+// RootNodeError 構造体
+// ルートノードを削除しようとした際に返される
+type RootNodeError struct {
+	Msg string
+}
+
+func (e RootNodeError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
 //////////////           以上、エラー 関連                 //////////////
@@ -2,6 +2,7 @@ package brokertable
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -169,7 +170,17 @@ func TestValidateHost(t *testing.T) {
 		},
 		{
 			name: "Invalid domain name 01 (format)",
-			args: args{host: "randomstringHOGHEODJSLFJDSLFELDFJDSL"},
+			args: args{host: "golang..org"},
+			want: HostError{},
+		},
+		{
+			name: "Invalid domain name 02 (leading hyphen)",
+			args: args{host: "-golang.org"},
+			want: HostError{},
+		},
+		{
+			name: "Invalid domain name 03 (boundary value, label length)",
+			args: args{host: strings.Repeat("a", 64) + ".org"},
 			want: HostError{},
 		},
 		{
@@ -177,6 +188,36 @@ func TestValidateHost(t *testing.T) {
 			args: args{host: "localhost"},
 			want: nil,
 		},
+		{
+			name: "Valid single-label host name 01",
+			args: args{host: "randomstringHOGHEODJSLFJDSLFELDFJDSL"},
+			want: nil,
+		},
+		{
+			name: "Valid single-label host name 02 (docker service name)",
+			args: args{host: "mqtt-broker"},
+			want: nil,
+		},
+		{
+			name: "Valid IPv6 address 01",
+			args: args{host: "::1"},
+			want: nil,
+		},
+		{
+			name: "Valid IPv6 address 02",
+			args: args{host: "2001:db8::8a2e:370:7334"},
+			want: nil,
+		},
+		{
+			name: "Invalid IPv6 address 01 (format)",
+			args: args{host: "2001:db8:::1"},
+			want: HostError{},
+		},
+		{
+			name: "Invalid IPv6 address 02 (brackets)",
+			args: args{host: "[::1]"},
+			want: HostError{},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
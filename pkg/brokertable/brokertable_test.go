@@ -3,6 +3,7 @@ package brokertable_test
 import (
 	"fmt"
 	"gamma/pkg/brokertable"
+	"gamma/pkg/topicscheme"
 	"reflect"
 	"testing"
 )
@@ -615,3 +616,818 @@ func TestString(t *testing.T) {
 		}
 	}
 }
+
+// geohash スキームで、長さの異なる geohash トピックへ分散ブローカを割り当てた場合のテスト
+func TestUpdateHostGeohash(t *testing.T) {
+	topicscheme.SetCurrent(topicscheme.Geohash)
+	defer topicscheme.SetCurrent(topicscheme.Quadkey)
+
+	type update struct {
+		topic string
+		host  string
+		port  uint16
+	}
+	type lookup struct {
+		topic string
+		host  string
+		port  uint16
+		err   error
+	}
+	tests := []struct {
+		name    string
+		updates []update
+		lookups []lookup
+	}{
+		{
+			name: "Split 1 character",
+			updates: []update{
+				{topic: "/", host: "mqtt00.example.com", port: 5000},
+				{topic: "/x", host: "mqtt01.example.com", port: 5001},
+			},
+			lookups: []lookup{
+				{topic: "/", host: "mqtt00.example.com", port: 5000},
+				{topic: "/w", host: "mqtt00.example.com", port: 5000},
+				{topic: "/x", host: "mqtt01.example.com", port: 5001},
+				{topic: "/x/n/7/6/u/r", host: "mqtt01.example.com", port: 5001},
+			},
+		},
+		{
+			name: "Split 2, 4 and 6 characters",
+			updates: []update{
+				{topic: "/", host: "mqtt00.example.com", port: 5000},
+				{topic: "/x/n", host: "mqtt01.example.com", port: 5001},
+				{topic: "/x/n/7/6", host: "mqtt02.example.com", port: 5002},
+				{topic: "/x/n/7/6/u/r", host: "mqtt03.example.com", port: 5003},
+			},
+			lookups: []lookup{
+				{topic: "/b/0", host: "mqtt00.example.com", port: 5000},
+				{topic: "/x/n/q", host: "mqtt01.example.com", port: 5001},
+				{topic: "/x/n/q/q/q", host: "mqtt01.example.com", port: 5001},
+				{topic: "/x/n/7/6", host: "mqtt02.example.com", port: 5002},
+				{topic: "/x/n/7/6/b/c", host: "mqtt02.example.com", port: 5002},
+				{topic: "/x/n/7/6/u/r/z/z/z/z/z/z", host: "mqtt03.example.com", port: 5003},
+			},
+		},
+		{
+			name: "Split siblings (32 children)",
+			updates: []update{
+				{topic: "/", host: "mqtt00.example.com", port: 5000},
+				{topic: "/0", host: "mqtt01.example.com", port: 5001},
+				{topic: "/z", host: "mqtt02.example.com", port: 5002},
+			},
+			lookups: []lookup{
+				{topic: "/0/0", host: "mqtt01.example.com", port: 5001},
+				{topic: "/b/0", host: "mqtt00.example.com", port: 5000},
+				{topic: "/z/z", host: "mqtt02.example.com", port: 5002},
+				{topic: "/a", host: "mqtt00.example.com", port: 5000, err: brokertable.TopicNameError{}},
+				{topic: "/0/1/2/3", host: "mqtt01.example.com", port: 5001},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := &brokertable.Node{}
+			for _, u := range tt.updates {
+				if err := brokertable.UpdateHost(root, u.topic, u.host, u.port); err != nil {
+					t.Fatalf("UpdateHost(%v) = %v, expected nil", u.topic, err)
+				}
+			}
+			for _, l := range tt.lookups {
+				host, port, err := brokertable.LookupHost(root, l.topic)
+				if l.err == nil && err != nil {
+					t.Errorf("LookupHost(%v) = %v, expected nil", l.topic, err)
+				}
+				if l.err != nil && (err == nil || reflect.ValueOf(err).Type() != reflect.ValueOf(l.err).Type()) {
+					t.Errorf("LookupHost(%v) = %v (Type: %T), expected %T", l.topic, err, err, l.err)
+				}
+				if host != l.host || port != l.port {
+					t.Errorf("LookupHost(%v) = %v:%v, expected %v:%v", l.topic, host, port, l.host, l.port)
+				}
+			}
+		})
+	}
+}
+
+func TestLookupAncestorHosts(t *testing.T) {
+	// "/" と "/0" 以下を mqtt00、"/0/1" 以下を mqtt01、"/0/1/2" 以下を mqtt02、"/0/1/2/3" 以下を mqtt01 が担当する
+	root := &brokertable.Node{
+		Children: map[string]*brokertable.Node{
+			"0": {
+				Children: map[string]*brokertable.Node{
+					"1": {
+						Children: map[string]*brokertable.Node{
+							"2": {
+								Children: map[string]*brokertable.Node{
+									"3": {Children: map[string]*brokertable.Node{}, Host: "mqtt01.example.com", Port: 5001},
+								},
+								Host: "mqtt02.example.com",
+								Port: 5002,
+							},
+						},
+						Host: "mqtt01.example.com",
+						Port: 5001,
+					},
+				},
+				Host: "mqtt00.example.com",
+				Port: 5000,
+			},
+		},
+		Host: "mqtt00.example.com",
+		Port: 5000,
+	}
+	type want struct {
+		hosts []brokertable.Host
+		err   error
+	}
+	tests := []struct {
+		name  string
+		topic string
+		want  want
+	}{
+		{
+			name:  "Normal scenario 01",
+			topic: "/0/1/2/0",
+			want: want{hosts: []brokertable.Host{
+				{Host: "mqtt01.example.com", Port: 5001},
+				{Host: "mqtt00.example.com", Port: 5000},
+			}},
+		},
+		{
+			name:  "Normal scenario 02 (owner appears in ancestors)",
+			topic: "/0/1/2/3",
+			want: want{hosts: []brokertable.Host{
+				{Host: "mqtt02.example.com", Port: 5002},
+				{Host: "mqtt00.example.com", Port: 5000},
+			}},
+		},
+		{
+			name:  "Normal scenario 03 (root)",
+			topic: "/0/2",
+			want:  want{hosts: []brokertable.Host{}},
+		},
+		{
+			name:  "Error scenario 01",
+			topic: "/0/hoge",
+			want:  want{hosts: nil, err: brokertable.TopicNameError{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := brokertable.LookupAncestorHosts(root, tt.topic)
+			if reflect.TypeOf(err) != reflect.TypeOf(tt.want.err) {
+				t.Errorf("LookupAncestorHosts() error = %v (Type: %T), expected Type: %T", err, err, tt.want.err)
+			}
+			if !reflect.DeepEqual(got, tt.want.hosts) {
+				t.Errorf("LookupAncestorHosts() = %v, expected %v", got, tt.want.hosts)
+			}
+		})
+	}
+}
+
+func TestLookupMatchingHosts(t *testing.T) {
+	// "/0" 以下を mqtt00、"/0/1" 以下を mqtt01、"/0/1/2" 以下を mqtt02、"/1" 以下を mqtt03 が担当する
+	newRootNode := func() *brokertable.Node {
+		return &brokertable.Node{
+			Children: map[string]*brokertable.Node{
+				"0": {
+					Children: map[string]*brokertable.Node{
+						"1": {
+							Children: map[string]*brokertable.Node{
+								"2": {Children: map[string]*brokertable.Node{}, Host: "mqtt02.example.com", Port: 5002},
+							},
+							Host: "mqtt01.example.com",
+							Port: 5001,
+						},
+					},
+					Host: "mqtt00.example.com",
+					Port: 5000,
+				},
+				"1": {Children: map[string]*brokertable.Node{}, Host: "mqtt03.example.com", Port: 5003},
+			},
+			Host: "mqtt00.example.com",
+			Port: 5000,
+		}
+	}
+	type want struct {
+		hosts []brokertable.Host
+		err   error
+	}
+	tests := []struct {
+		name   string
+		filter string
+		want   want
+	}{
+		{
+			name:   "Single level wildcard 01",
+			filter: "/0/+/2",
+			want: want{hosts: []brokertable.Host{
+				{Host: "mqtt00.example.com", Port: 5000},
+				{Host: "mqtt02.example.com", Port: 5002},
+			}},
+		},
+		{
+			name:   "Single level wildcard 02",
+			filter: "/0/+/3",
+			want: want{hosts: []brokertable.Host{
+				{Host: "mqtt00.example.com", Port: 5000},
+				{Host: "mqtt01.example.com", Port: 5001},
+			}},
+		},
+		{
+			name:   "Single level wildcard 03 (first level)",
+			filter: "/+",
+			want: want{hosts: []brokertable.Host{
+				{Host: "mqtt00.example.com", Port: 5000},
+				{Host: "mqtt03.example.com", Port: 5003},
+			}},
+		},
+		{
+			name:   "Single level wildcard 04 (same host)",
+			filter: "/1/+",
+			want: want{hosts: []brokertable.Host{
+				{Host: "mqtt03.example.com", Port: 5003},
+			}},
+		},
+		{
+			name:   "Multi level wildcard 01",
+			filter: "/0/1/#",
+			want: want{hosts: []brokertable.Host{
+				{Host: "mqtt01.example.com", Port: 5001},
+				{Host: "mqtt02.example.com", Port: 5002},
+			}},
+		},
+		{
+			name:   "Multi level wildcard 02 (with single level wildcard)",
+			filter: "/+/+/#",
+			want: want{hosts: []brokertable.Host{
+				{Host: "mqtt00.example.com", Port: 5000},
+				{Host: "mqtt01.example.com", Port: 5001},
+				{Host: "mqtt02.example.com", Port: 5002},
+				{Host: "mqtt03.example.com", Port: 5003},
+			}},
+		},
+		{
+			name:   "No wildcard",
+			filter: "/0/1/2/3",
+			want: want{hosts: []brokertable.Host{
+				{Host: "mqtt02.example.com", Port: 5002},
+			}},
+		},
+		{
+			name:   "Invalid topic filter 01",
+			filter: "/0/#/2",
+			want:   want{hosts: []brokertable.Host{{Host: "mqtt00.example.com", Port: 5000}}, err: brokertable.TopicNameError{}},
+		},
+		{
+			name:   "Trailing word 01",
+			filter: "/0/+/data",
+			want: want{hosts: []brokertable.Host{
+				{Host: "mqtt00.example.com", Port: 5000},
+				{Host: "mqtt01.example.com", Port: 5001},
+			}},
+		},
+		{
+			name:   "Trailing word 02 (not routing level)",
+			filter: "/0/1/2/4",
+			want: want{hosts: []brokertable.Host{
+				{Host: "mqtt02.example.com", Port: 5002},
+			}},
+		},
+		{
+			name:   "Invalid topic filter 02",
+			filter: "/0/+/4/5",
+			want:   want{hosts: []brokertable.Host{{Host: "mqtt00.example.com", Port: 5000}}, err: brokertable.TopicNameError{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts, err := brokertable.LookupMatchingHosts(newRootNode(), tt.filter)
+			if tt.want.err == nil {
+				if err != nil {
+					t.Errorf("LookupMatchingHosts() = %v (Type: %T), expected %v (Type: %T)", err, err, tt.want.err, tt.want.err)
+				}
+			} else {
+				if err == nil || reflect.ValueOf(err).Type() != reflect.ValueOf(tt.want.err).Type() {
+					t.Errorf("LookupMatchingHosts() = %v (Type: %T), expected %v (Type: %T)", err, err, tt.want.err, tt.want.err)
+				}
+			}
+			if !reflect.DeepEqual(hosts, tt.want.hosts) {
+				t.Errorf("LookupMatchingHosts(); hosts = %v, expected %v", hosts, tt.want.hosts)
+			}
+		})
+	}
+}
+
+func TestTableUpdate(t *testing.T) {
+	table := brokertable.NewTable()
+	if err := table.UpdateHost(0, "/", "127.0.0.1", 1883); err != nil {
+		t.Fatalf("UpdateHost() error = %v", err)
+	}
+	oldSnapshot := table.Load()
+
+	type want struct {
+		version int
+		host    string
+		port    uint16
+		err     error
+	}
+	tests := []struct {
+		name    string
+		version int
+		update  func(root *brokertable.Node) error
+		want    want
+	}{
+		{
+			name:    "Normal scenario 01",
+			version: 1,
+			update: func(root *brokertable.Node) error {
+				return brokertable.UpdateHost(root, "/0/1", "127.0.0.2", 1883)
+			},
+			want: want{version: 1, host: "127.0.0.2", port: 1883},
+		},
+		{
+			name:    "Normal scenario 02 (same version)",
+			version: 1,
+			update: func(root *brokertable.Node) error {
+				return brokertable.UpdateHost(root, "/0/1", "127.0.0.3", 1884)
+			},
+			want: want{version: 1, host: "127.0.0.3", port: 1884},
+		},
+		{
+			name:    "Error scenario 01 (old version)",
+			version: 0,
+			update: func(root *brokertable.Node) error {
+				return brokertable.UpdateHost(root, "/0/1", "127.0.0.4", 1883)
+			},
+			want: want{version: 1, host: "127.0.0.3", port: 1884, err: brokertable.VersionError{}},
+		},
+		{
+			name:    "Error scenario 02 (rollback)",
+			version: 2,
+			update: func(root *brokertable.Node) error {
+				if err := brokertable.UpdateHost(root, "/0/1", "127.0.0.5", 1883); err != nil {
+					return err
+				}
+				return brokertable.UpdateHost(root, "/0/1/2", "hoge..", 1883)
+			},
+			want: want{version: 1, host: "127.0.0.3", port: 1884, err: brokertable.HostError{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := table.Update(tt.version, tt.update)
+			if tt.want.err == nil {
+				if err != nil {
+					t.Fatalf("Update() error = %v", err)
+				}
+			} else if err == nil || reflect.ValueOf(err).Type() != reflect.ValueOf(tt.want.err).Type() {
+				t.Fatalf("Update() error = %v (Type: %T), expected %T", err, err, tt.want.err)
+			}
+
+			snapshot := table.Load()
+			if snapshot.Version() != tt.want.version {
+				t.Errorf("Version() = %v, expected %v", snapshot.Version(), tt.want.version)
+			}
+			host, port, err := snapshot.LookupHost("/0/1/2")
+			if err != nil || host != tt.want.host || port != tt.want.port {
+				t.Errorf("LookupHost() = %v, %v, %v, expected %v, %v", host, port, err, tt.want.host, tt.want.port)
+			}
+		})
+	}
+
+	// 古いスナップショットは変更されない
+	host, port, err := oldSnapshot.LookupHost("/0/1/2")
+	if err != nil || host != "127.0.0.1" || port != 1883 || oldSnapshot.Version() != 0 {
+		t.Errorf("old snapshot = %v, LookupHost() = %v, %v, %v", oldSnapshot, host, port, err)
+	}
+}
+
+// 参照と更新を並行に行ってもデータ競合が発生しないことを確認する（go test -race で実行する）
+func TestTableConcurrentAccess(t *testing.T) {
+	table := brokertable.NewTable()
+	if err := table.UpdateHost(0, "/", "127.0.0.1", 1883); err != nil {
+		t.Fatalf("UpdateHost() error = %v", err)
+	}
+
+	done := make(chan struct{})
+	errCh := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					errCh <- nil
+					return
+				default:
+				}
+				if _, _, err := table.Load().LookupHost("/0/1/2/3"); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}()
+	}
+	for version := 1; version <= 100; version++ {
+		topic := fmt.Sprintf("/%v/1", version%3)
+		if err := table.UpdateHost(version, topic, "127.0.0.2", uint16(1883+version)); err != nil {
+			t.Fatalf("UpdateHost() error = %v", err)
+		}
+	}
+	close(done)
+	for i := 0; i < 4; i++ {
+		if err := <-errCh; err != nil {
+			t.Errorf("LookupHost() error = %v", err)
+		}
+	}
+	if got := table.Load().Version(); got != 100 {
+		t.Errorf("Version() = %v, expected %v", got, 100)
+	}
+}
+
+func TestAddReplica(t *testing.T) {
+	newRoot := func() *brokertable.Node {
+		root := &brokertable.Node{}
+		if err := brokertable.UpdateHost(root, "/", "127.0.0.1", 1883); err != nil {
+			t.Fatalf("UpdateHost() error = %v", err)
+		}
+		if err := brokertable.UpdateHost(root, "/0/1", "127.0.0.2", 1883); err != nil {
+			t.Fatalf("UpdateHost() error = %v", err)
+		}
+		return root
+	}
+
+	type args struct {
+		topic string
+		host  string
+		port  uint16
+	}
+	type want struct {
+		hosts []brokertable.Host // "/0/1/2" のレプリカセット
+		err   error
+	}
+	tests := []struct {
+		name string
+		args []args
+		want want
+	}{
+		{
+			name: "Normal scenario 01",
+			args: []args{{topic: "/0/1", host: "127.0.0.3", port: 1883}},
+			want: want{hosts: []brokertable.Host{{Host: "127.0.0.2", Port: 1883}, {Host: "127.0.0.3", Port: 1883}}},
+		},
+		{
+			name: "Normal scenario 02 (priority order)",
+			args: []args{{topic: "/0/1", host: "127.0.0.4", port: 1883}, {topic: "/0/1", host: "127.0.0.3", port: 1883}},
+			want: want{hosts: []brokertable.Host{{Host: "127.0.0.2", Port: 1883}, {Host: "127.0.0.4", Port: 1883}, {Host: "127.0.0.3", Port: 1883}}},
+		},
+		{
+			name: "Normal scenario 03 (other topic)",
+			args: []args{{topic: "/", host: "127.0.0.3", port: 1883}},
+			want: want{hosts: []brokertable.Host{{Host: "127.0.0.2", Port: 1883}}},
+		},
+		{
+			name: "Error scenario 01 (node not found)",
+			args: []args{{topic: "/0/1/2", host: "127.0.0.3", port: 1883}},
+			want: want{hosts: []brokertable.Host{{Host: "127.0.0.2", Port: 1883}}, err: brokertable.NodeNotFoundError{}},
+		},
+		{
+			name: "Error scenario 02 (duplicate primary)",
+			args: []args{{topic: "/0/1", host: "127.0.0.2", port: 1883}},
+			want: want{hosts: []brokertable.Host{{Host: "127.0.0.2", Port: 1883}}, err: brokertable.DuplicateHostError{}},
+		},
+		{
+			name: "Error scenario 03 (duplicate replica)",
+			args: []args{{topic: "/0/1", host: "127.0.0.3", port: 1883}, {topic: "/0/1", host: "127.0.0.3", port: 1883}},
+			want: want{hosts: []brokertable.Host{{Host: "127.0.0.2", Port: 1883}, {Host: "127.0.0.3", Port: 1883}}, err: brokertable.DuplicateHostError{}},
+		},
+		{
+			name: "Error scenario 04 (invalid host)",
+			args: []args{{topic: "/0/1", host: "hoge..", port: 1883}},
+			want: want{hosts: []brokertable.Host{{Host: "127.0.0.2", Port: 1883}}, err: brokertable.HostError{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := newRoot()
+			var err error
+			for _, a := range tt.args {
+				if err = brokertable.AddReplica(root, a.topic, a.host, a.port); err != nil {
+					break
+				}
+			}
+			if tt.want.err == nil {
+				if err != nil {
+					t.Fatalf("AddReplica() error = %v", err)
+				}
+			} else if err == nil || reflect.ValueOf(err).Type() != reflect.ValueOf(tt.want.err).Type() {
+				t.Fatalf("AddReplica() error = %v (Type: %T), expected %T", err, err, tt.want.err)
+			}
+
+			hosts, err := brokertable.LookupReplicaSet(root, "/0/1/2")
+			if err != nil || !reflect.DeepEqual(hosts, tt.want.hosts) {
+				t.Errorf("LookupReplicaSet() = %v, %v, expected %v", hosts, err, tt.want.hosts)
+			}
+
+			// スナップショットでも同じレプリカセットを返す
+			table := brokertable.NewTable()
+			if err := table.Update(0, func(r *brokertable.Node) error {
+				*r = *root.Clone()
+				return nil
+			}); err != nil {
+				t.Fatalf("Update() error = %v", err)
+			}
+			hosts, err = table.Load().LookupReplicaSet("/0/1/2")
+			if err != nil || !reflect.DeepEqual(hosts, tt.want.hosts) {
+				t.Errorf("Snapshot.LookupReplicaSet() = %v, %v, expected %v", hosts, err, tt.want.hosts)
+			}
+			host, port, err := table.Load().LookupHost("/0/1/2")
+			if err != nil || host != tt.want.hosts[0].Host || port != tt.want.hosts[0].Port {
+				t.Errorf("Snapshot.LookupHost() = %v, %v, %v, expected %v", host, port, err, tt.want.hosts[0])
+			}
+		})
+	}
+
+	// UpdateHost でノードを引き継ぐとレプリカは削除される
+	root := newRoot()
+	if err := brokertable.AddReplica(root, "/0/1", "127.0.0.3", 1883); err != nil {
+		t.Fatalf("AddReplica() error = %v", err)
+	}
+	wantString := `{"host":"127.0.0.2","port":1883,"replicas":[{"host":"127.0.0.3","port":1883}],"children":{}}`
+	if got := fmt.Sprint(root.Children["0"].Children["1"]); got != wantString {
+		t.Errorf("String() = %v, expected %v", got, wantString)
+	}
+	if err := brokertable.UpdateHost(root, "/0/1", "127.0.0.4", 1883); err != nil {
+		t.Fatalf("UpdateHost() error = %v", err)
+	}
+	if hosts, _ := brokertable.LookupReplicaSet(root, "/0/1"); len(hosts) != 1 {
+		t.Errorf("LookupReplicaSet() = %v, expected only primary", hosts)
+	}
+}
+
+// 再割り当てのテストで使用する brokertable
+// "/"(A) ─ "/0"(A) ─ "/0/1"(B) ─ "/0/1/2"(C)
+//                 └ "/0/2"(A) ─ "/0/2/3"(A)
+func newReassignRoot(t *testing.T) *brokertable.Node {
+	root := &brokertable.Node{}
+	for _, u := range []struct {
+		topic string
+		host  string
+	}{
+		{topic: "/0/2/3", host: "127.0.0.1"},
+		{topic: "/0/1", host: "127.0.0.2"},
+		{topic: "/0/1/2", host: "127.0.0.3"},
+	} {
+		if err := brokertable.UpdateHost(root, u.topic, u.host, 1883); err != nil {
+			t.Fatalf("UpdateHost() error = %v", err)
+		}
+	}
+	return root
+}
+
+func TestReassign(t *testing.T) {
+	type want struct {
+		changed []string
+		hosts   map[string]string // トピック名 => LookupHost の結果
+		err     error
+	}
+	tests := []struct {
+		name   string
+		update func(root *brokertable.Node) ([]string, error)
+		want   want
+	}{
+		{
+			name: "Normal scenario 01 (ReassignHost keeps descendants)",
+			update: func(root *brokertable.Node) ([]string, error) {
+				return brokertable.ReassignHost(root, "/0/1", "127.0.0.4", 1883)
+			},
+			want: want{
+				changed: []string{"/0/1"},
+				hosts:   map[string]string{"/0/1": "127.0.0.4", "/0/1/3": "127.0.0.4", "/0/1/2": "127.0.0.3", "/0/2/3": "127.0.0.1"},
+			},
+		},
+		{
+			name: "Normal scenario 02 (ReassignHost moves inherited nodes)",
+			update: func(root *brokertable.Node) ([]string, error) {
+				return brokertable.ReassignHost(root, "/0", "127.0.0.4", 1883)
+			},
+			want: want{
+				changed: []string{"/0", "/0/2", "/0/2/3"},
+				hosts:   map[string]string{"/": "127.0.0.1", "/0/3": "127.0.0.4", "/0/2/3": "127.0.0.4", "/0/1": "127.0.0.2", "/0/1/2": "127.0.0.3"},
+			},
+		},
+		{
+			name: "Normal scenario 03 (ReassignHost adds node)",
+			update: func(root *brokertable.Node) ([]string, error) {
+				return brokertable.ReassignHost(root, "/1/2", "127.0.0.4", 1883)
+			},
+			want: want{
+				changed: []string{"/1/2"},
+				hosts:   map[string]string{"/1": "127.0.0.1", "/1/3": "127.0.0.1", "/1/2": "127.0.0.4", "/1/2/0": "127.0.0.4"},
+			},
+		},
+		{
+			name: "Normal scenario 04 (ReassignHost same host)",
+			update: func(root *brokertable.Node) ([]string, error) {
+				return brokertable.ReassignHost(root, "/0/1/2", "127.0.0.3", 1883)
+			},
+			want: want{
+				changed: []string{},
+				hosts:   map[string]string{"/0/1/2": "127.0.0.3"},
+			},
+		},
+		{
+			name: "Normal scenario 05 (RemoveNode keeps descendants)",
+			update: func(root *brokertable.Node) ([]string, error) {
+				return brokertable.RemoveNode(root, "/0/1")
+			},
+			want: want{
+				changed: []string{"/0/1"},
+				hosts:   map[string]string{"/0/1": "127.0.0.1", "/0/1/3": "127.0.0.1", "/0/1/2": "127.0.0.3"},
+			},
+		},
+		{
+			name: "Normal scenario 06 (RemoveNode leaf)",
+			update: func(root *brokertable.Node) ([]string, error) {
+				return brokertable.RemoveNode(root, "/0/1/2")
+			},
+			want: want{
+				changed: []string{"/0/1/2"},
+				hosts:   map[string]string{"/0/1": "127.0.0.2", "/0/1/2": "127.0.0.2"},
+			},
+		},
+		{
+			name: "Normal scenario 07 (MoveSubtree)",
+			update: func(root *brokertable.Node) ([]string, error) {
+				return brokertable.MoveSubtree(root, "/0", "127.0.0.2", 1883)
+			},
+			want: want{
+				changed: []string{"/0", "/0/1/2", "/0/2", "/0/2/3"},
+				hosts:   map[string]string{"/": "127.0.0.1", "/0/1/2": "127.0.0.2", "/0/2/3": "127.0.0.2", "/1": "127.0.0.1"},
+			},
+		},
+		{
+			name: "Error scenario 01 (RemoveNode root)",
+			update: func(root *brokertable.Node) ([]string, error) {
+				return brokertable.RemoveNode(root, "/")
+			},
+			want: want{hosts: map[string]string{"/0/1": "127.0.0.2"}, err: brokertable.RootNodeError{}},
+		},
+		{
+			name: "Error scenario 02 (RemoveNode not found)",
+			update: func(root *brokertable.Node) ([]string, error) {
+				return brokertable.RemoveNode(root, "/0/1/3")
+			},
+			want: want{hosts: map[string]string{"/0/1/3": "127.0.0.2"}, err: brokertable.NodeNotFoundError{}},
+		},
+		{
+			name: "Error scenario 03 (invalid host)",
+			update: func(root *brokertable.Node) ([]string, error) {
+				return brokertable.ReassignHost(root, "/0/1", "hoge..", 1883)
+			},
+			want: want{hosts: map[string]string{"/0/1": "127.0.0.2"}, err: brokertable.HostError{}},
+		},
+		{
+			name: "Error scenario 04 (invalid topic)",
+			update: func(root *brokertable.Node) ([]string, error) {
+				return brokertable.MoveSubtree(root, "/0/4", "127.0.0.2", 1883)
+			},
+			want: want{hosts: map[string]string{"/0/2/3": "127.0.0.1"}, err: brokertable.TopicNameError{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := newReassignRoot(t)
+			changed, err := tt.update(root)
+			if tt.want.err == nil {
+				if err != nil {
+					t.Fatalf("error = %v", err)
+				}
+				if !reflect.DeepEqual(changed, tt.want.changed) {
+					t.Errorf("changed = %v, expected %v", changed, tt.want.changed)
+				}
+			} else if err == nil || reflect.ValueOf(err).Type() != reflect.ValueOf(tt.want.err).Type() {
+				t.Fatalf("error = %v (Type: %T), expected %T", err, err, tt.want.err)
+			}
+			for topic, want := range tt.want.hosts {
+				if host, _, err := brokertable.LookupHost(root, topic); err != nil || host != want {
+					t.Errorf("LookupHost(%v) = %v, %v, expected %v", topic, host, err, want)
+				}
+			}
+		})
+	}
+}
+
+// RemoveNode 関数で不要になったノードが削除されることを確認する
+func TestRemoveNodePrune(t *testing.T) {
+	root := newReassignRoot(t)
+	if _, err := brokertable.RemoveNode(root, "/0/1/2"); err != nil {
+		t.Fatalf("RemoveNode() error = %v", err)
+	}
+	if _, err := brokertable.RemoveNode(root, "/0/1"); err != nil {
+		t.Fatalf("RemoveNode() error = %v", err)
+	}
+	want := `{"host":"127.0.0.1","port":1883,"children":{"0":{"host":"127.0.0.1","port":1883,"children":{"2":{"host":"127.0.0.1","port":1883,"children":{"3":{"host":"127.0.0.1","port":1883,"children":{}}}}}}}}`
+	if got := fmt.Sprint(root); got != want {
+		t.Errorf("String() = %v, expected %v", got, want)
+	}
+}
+
+// newBenchmarkTable 関数は、"/1234567890" 以下を深さ depth まで 4 分木で分割した brokertable を生成する
+// 各ノードは深さごとに異なる分散ブローカが担当する
+func newBenchmarkTable(tb testing.TB, depth int) *brokertable.Table {
+	table := brokertable.NewTable()
+	topics := []string{"/1234567890"}
+	if err := table.UpdateHost(0, "/", "127.0.0.1", 1883); err != nil {
+		tb.Fatalf("UpdateHost() error = %v", err)
+	}
+	err := table.Update(0, func(root *brokertable.Node) error {
+		for d := 0; d <= depth; d++ {
+			next := []string{}
+			for _, topic := range topics {
+				// NOTE: UpdateHost は子ノードを削除するため、浅いノードから順に更新する
+				if err := brokertable.UpdateHost(root, topic, "127.0.0.1", uint16(1883+d)); err != nil {
+					return err
+				}
+				for q := 0; q < 4; q++ {
+					next = append(next, fmt.Sprintf("%v/%v", topic, q))
+				}
+			}
+			topics = next
+		}
+		return nil
+	})
+	if err != nil {
+		tb.Fatalf("Update() error = %v", err)
+	}
+	return table
+}
+
+// benchmarkTopics は、ズームレベル 18 相当の quadkey トピック
+var benchmarkTopics = []string{
+	"/1234567890/0/1/2/3/0/1/2/3/0/1/2/3/0/1/2/3/0",
+	"/1234567890/3/3/3/3/3/3/3/3/3/3/3/3/3/3/3/3/3",
+	"/1234567890/1/0/2/0/3/0/1/1/2/2/3/3/0/0/1/1/2",
+	"/9876543210/1/0/2/0",
+}
+
+func TestSnapshotLookupHost(t *testing.T) {
+	table := newBenchmarkTable(t, 4)
+	snapshot := table.Load()
+	topics := append([]string{"/", "/1234567890", "/1234567890/3/3", "/1234567890/4", "1234567890"}, benchmarkTopics...)
+	for _, topic := range topics {
+		t.Run(topic, func(t *testing.T) {
+			wantHost, wantPort, wantErr := brokertable.LookupHost(snapshot.Root(), topic)
+			host, port, err := snapshot.LookupHost(topic)
+			if host != wantHost || port != wantPort || reflect.TypeOf(err) != reflect.TypeOf(wantErr) {
+				t.Errorf("LookupHost() = %v, %v, %v, expected %v, %v, %v", host, port, err, wantHost, wantPort, wantErr)
+			}
+		})
+	}
+}
+
+func BenchmarkLookupHost(b *testing.B) {
+	for _, depth := range []int{4, 6} {
+		table := newBenchmarkTable(b, depth)
+		root := table.Load().Root()
+		b.Run(fmt.Sprintf("Node/depth=%v", depth), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := brokertable.LookupHost(root, benchmarkTopics[i%len(benchmarkTopics)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		snapshot := table.Load()
+		b.Run(fmt.Sprintf("Snapshot/depth=%v", depth), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := snapshot.LookupHost(benchmarkTopics[i%len(benchmarkTopics)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("SnapshotParallel/depth=%v", depth), func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					if _, _, err := table.Load().LookupHost(benchmarkTopics[i%len(benchmarkTopics)]); err != nil {
+						b.Fatal(err)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkTableUpdateHost(b *testing.B) {
+	table := newBenchmarkTable(b, 4)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := table.UpdateHost(1, "/1234567890/0/1/2/3/0", "127.0.0.2", 1883); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package circuitbreaker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//////////////        以下、Policy 関連              //////////////
+
+// Policy 構造体は、分散ブローカへの Publish に失敗し続けた際に、その分散ブローカを使用しないようにする条件を表す
+// NOTE: PublishTimeout は、サーキットブレーカを使用しない場合（FailureThreshold が 0 の場合）も適用する
+type Policy struct {
+	FailureThreshold uint          // 連続して失敗した回数がこの値に達した場合に開く（0 の場合は開かない）
+	OpenTimeout      time.Duration // 開いてから、分散ブローカが回復したかどうかを 1 回だけ試す（半開）までの時間
+	PublishTimeout   time.Duration // Publish の完了を待つ最大の時間。超えた場合は失敗として扱う（0 の場合は無制限に待つ）
+}
+
+// IsEnabled 関数は、サーキットブレーカを使用するかどうかを返す
+func (p Policy) IsEnabled() bool {
+	return p.FailureThreshold > 0
+}
+
+// Validate 関数は、条件が正しいかどうかを検証する
+func (p Policy) Validate() error {
+	if p.OpenTimeout < 0 {
+		return PolicyError{Msg: fmt.Sprintf("Invalid open timeout (%v). Open timeout must not be negative.", p.OpenTimeout)}
+	}
+	if p.PublishTimeout < 0 {
+		return PolicyError{Msg: fmt.Sprintf("Invalid publish timeout (%v). Publish timeout must not be negative.", p.PublishTimeout)}
+	}
+	if p.IsEnabled() && p.OpenTimeout == 0 {
+		return PolicyError{Msg: "Open timeout must be greater than 0 when failure threshold is set."}
+	}
+	return nil
+}
+
+//////////////        以上、Policy 関連              //////////////
+//////////////        以下、Breaker 関連             //////////////
+
+// State は、サーキットブレーカの状態
+type State int
+
+const (
+	Closed   State = iota // 通常どおり使用する
+	Open                  // 使用しない
+	HalfOpen              // 回復したかどうかを試している（試行中は使用しない）
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("unknown(%d)", int(s))
+}
+
+// Breaker 構造体は、1 つの分散ブローカ（レプリカセット）のサーキットブレーカ
+// NOTE: nil の場合は常に閉じている（使用する）
+type Breaker struct {
+	mu       sync.Mutex
+	name     string
+	policy   Policy
+	state    State
+	failures uint      // 連続して失敗した回数
+	openedAt time.Time // 開いた時刻
+	probing  bool      // 半開の状態で、試行中の Publish があるかどうか
+}
+
+// New 関数は、name の分散ブローカのサーキットブレーカを生成する（policy で使用しない場合は nil）
+func New(policy Policy, name string) *Breaker {
+	if !policy.IsEnabled() {
+		return nil
+	}
+	return &Breaker{name: name, policy: policy}
+}
+
+// Allow 関数は、分散ブローカへ Publish してよいかどうかを返す
+// 開いてから OpenTimeout が経過している場合は半開へ移行し、最初の 1 回のみ true を返す（結果を Success, Failure 関数で通知すること）
+func (b *Breaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case Open:
+		if time.Now().Sub(b.openedAt) < b.policy.OpenTimeout {
+			return false
+		}
+		b.state = HalfOpen
+		b.probing = true
+		log.WithFields(log.Fields{"name": b.name}).Info("Circuit half-open (probing)")
+		return true
+	case HalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// Success 関数は、Publish に成功したことを通知する
+func (b *Breaker) Success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != Closed {
+		log.WithFields(log.Fields{"name": b.name}).Info("Circuit closed")
+	}
+	b.state = Closed
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure 関数は、Publish に失敗したことを通知する
+func (b *Breaker) Failure() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.state == HalfOpen || (b.state == Closed && b.failures >= b.policy.FailureThreshold) {
+		b.state = Open
+		b.openedAt = time.Now()
+		log.WithFields(log.Fields{"name": b.name, "failures": b.failures}).Warn("Circuit opened")
+	}
+}
+
+// State 関数は、現在の状態を返す
+func (b *Breaker) State() State {
+	if b == nil {
+		return Closed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+//////////////        以上、Breaker 関連             //////////////
+//////////////        以下、エラー 関連              //////////////
+
+// PolicyError 構造体
+// 条件が不正な場合に返される
+type PolicyError struct {
+	Msg string
+}
+
+func (e PolicyError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+//////////////        以上、エラー 関連              //////////////
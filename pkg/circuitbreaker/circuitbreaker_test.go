@@ -0,0 +1,82 @@
+package circuitbreaker_test
+
+import (
+	"gamma/pkg/circuitbreaker"
+	"testing"
+	"time"
+)
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       circuitbreaker.Policy
+		wantErr bool
+	}{
+		{name: "Normal scenario 01 (disabled)", p: circuitbreaker.Policy{}},
+		{name: "Normal scenario 02 (publish timeout only)", p: circuitbreaker.Policy{PublishTimeout: time.Second}},
+		{name: "Normal scenario 03", p: circuitbreaker.Policy{FailureThreshold: 3, OpenTimeout: 30 * time.Second}},
+		{name: "Error scenario 01 (open timeout)", p: circuitbreaker.Policy{FailureThreshold: 3}, wantErr: true},
+		{name: "Error scenario 02 (negative publish timeout)", p: circuitbreaker.Policy{PublishTimeout: -time.Second}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.p.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// 連続して失敗すると開き、OpenTimeout の経過後に 1 回だけ試行を許可する
+func TestBreaker(t *testing.T) {
+	b := circuitbreaker.New(circuitbreaker.Policy{FailureThreshold: 2, OpenTimeout: 20 * time.Millisecond}, "localhost:1883")
+
+	// 成功すると、連続して失敗した回数はリセットされる
+	b.Failure()
+	b.Success()
+	b.Failure()
+	if got := b.State(); got != circuitbreaker.Closed {
+		t.Fatalf("State() = %v, expected %v", got, circuitbreaker.Closed)
+	}
+	b.Failure()
+	if got := b.State(); got != circuitbreaker.Open || b.Allow() {
+		t.Fatalf("State() = %v, Allow() = true, expected %v, false", got, circuitbreaker.Open)
+	}
+
+	// 半開の状態で試行に失敗すると、再び開く
+	time.Sleep(30 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatalf("Allow() = false, expected true (half-open)")
+	}
+	if b.Allow() {
+		t.Errorf("Allow() = true, expected false (probing)")
+	}
+	b.Failure()
+	if got := b.State(); got != circuitbreaker.Open {
+		t.Fatalf("State() = %v, expected %v", got, circuitbreaker.Open)
+	}
+
+	// 半開の状態で試行に成功すると、閉じる
+	time.Sleep(30 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatalf("Allow() = false, expected true (half-open)")
+	}
+	b.Success()
+	if got := b.State(); got != circuitbreaker.Closed || !b.Allow() {
+		t.Errorf("State() = %v, expected %v", got, circuitbreaker.Closed)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	b := circuitbreaker.New(circuitbreaker.Policy{}, "localhost:1883")
+	if b != nil {
+		t.Fatalf("New() = %v, expected nil", b)
+	}
+	for i := 0; i < 10; i++ {
+		b.Failure()
+	}
+	if !b.Allow() || b.State() != circuitbreaker.Closed {
+		t.Errorf("Allow() = false, expected true")
+	}
+}
@@ -0,0 +1,224 @@
+package credential
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"gamma/pkg/endpoint"
+	"io/ioutil"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+//////////////        以下、Credential 関連              //////////////
+
+// Credential 構造体は、MQTT ブローカへ接続する際の認証情報と TLS の設定を表す
+// NOTE: ファイルのパスは PEM 形式のファイルを指定する
+type Credential struct {
+	Username           string `json:"username,omitempty"`
+	Password           string `json:"password,omitempty"`
+	CAFile             string `json:"ca_file,omitempty"`   // サーバ証明書の検証に使用する CA 証明書（省略した場合はシステムの CA 証明書）
+	CertFile           string `json:"cert_file,omitempty"` // クライアント証明書
+	KeyFile            string `json:"key_file,omitempty"`  // クライアント証明書の秘密鍵
+	ServerName         string `json:"server_name,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"` // サーバ証明書を検証しない（開発環境でのみ使用すること）
+}
+
+// String 関数は、パスワードを伏せた文字列を返す（ログへの出力用）
+func (c Credential) String() string {
+	password := ""
+	if c.Password != "" {
+		password = "******"
+	}
+	return fmt.Sprintf("{username:%v password:%v ca_file:%v cert_file:%v key_file:%v server_name:%v insecure_skip_verify:%v}",
+		c.Username, password, c.CAFile, c.CertFile, c.KeyFile, c.ServerName, c.InsecureSkipVerify)
+}
+
+// HasTLS 関数は、TLS に関する設定がされているかどうかを返す
+func (c Credential) HasTLS() bool {
+	return c.CAFile != "" || c.CertFile != "" || c.KeyFile != "" || c.ServerName != "" || c.InsecureSkipVerify
+}
+
+// TLSConfig 関数は、TLS の設定を生成する
+// TLS に関する設定がされていない場合は nil を返す（ssl, wss で接続する場合は paho のデフォルトの設定を使用する）
+func (c Credential) TLSConfig() (*tls.Config, error) {
+	if !c.HasTLS() {
+		return nil, nil
+	}
+	cfg := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, TLSError{Msg: fmt.Sprintf("Could not read CA file (%v): %v", c.CAFile, err)}
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, TLSError{Msg: fmt.Sprintf("No certificate was found in CA file (%v)", c.CAFile)}
+		}
+		cfg.RootCAs = pool
+	}
+
+	// クライアント証明書と秘密鍵は両方とも指定する必要がある
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, TLSError{Msg: fmt.Sprintf("Both cert_file (%v) and key_file (%v) must be specified", c.CertFile, c.KeyFile)}
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, TLSError{Msg: fmt.Sprintf("Could not load client certificate (%v, %v): %v", c.CertFile, c.KeyFile, err)}
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// Validate 関数は、設定された証明書を読み込めるかどうかを検証する
+func (c Credential) Validate() error {
+	_, err := c.TLSConfig()
+	return err
+}
+
+// NewClientOptions 関数は、e へ c の認証情報で接続するための mqtt.ClientOptions を生成する
+func NewClientOptions(e endpoint.Endpoint, c Credential) (*mqtt.ClientOptions, error) {
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(e.URL())
+	// NOTE: MQTT v5 は paho.mqtt.golang では扱えないため、mqttv5.NewClientFor でクライアントを生成する
+	if e.ProtocolVersion != 0 && !e.IsV5() {
+		opts.SetProtocolVersion(uint(e.ProtocolVersion))
+	}
+	if c.Username != "" {
+		opts.SetUsername(c.Username)
+		opts.SetPassword(c.Password)
+	}
+
+	cfg, err := c.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cfg != nil {
+		if s := e.GetScheme(); s != endpoint.SchemeSSL && s != endpoint.SchemeWSS {
+			return nil, TLSError{Msg: fmt.Sprintf("TLS is configured, but the scheme of %v is not %v or %v", e.URL(), endpoint.SchemeSSL, endpoint.SchemeWSS)}
+		}
+		opts.SetTLSConfig(cfg)
+	}
+	return opts, nil
+}
+
+//////////////        以上、Credential 関連              //////////////
+//////////////        以下、Store 関連                   //////////////
+
+// Store 構造体は、分散ブローカごとの認証情報を管理する
+// 分散ブローカごとの設定（Endpoint.CredentialRef または "host:port" で引く）がない場合は Default を使用する
+type Store struct {
+	mu      sync.RWMutex
+	Default Credential            `json:"default"`
+	Brokers map[string]Credential `json:"brokers"`
+}
+
+// NewStore 関数は、全ての接続に def を使用する Store 構造体を生成する
+func NewStore(def Credential) *Store {
+	return &Store{Default: def, Brokers: map[string]Credential{}}
+}
+
+// LoadStore 関数は、JSON ファイルから Store 構造体を生成する
+// 例: {"default":{"username":"gamma","password":"secret","ca_file":"/etc/gamma/ca.pem"},
+// "brokers":{"dmb-01":{"username":"dmb01","password":"secret"},"[::1]:8883":{"server_name":"dmb02.example.com"}}}
+func LoadStore(path string) (*Store, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, StoreError{Msg: fmt.Sprintf("Could not read credential file (%v): %v", path, err)}
+	}
+	s := NewStore(Credential{})
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, StoreError{Msg: fmt.Sprintf("Could not parse credential file (%v): %v", path, err)}
+	}
+	if s.Brokers == nil {
+		s.Brokers = map[string]Credential{}
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Validate 関数は、全ての認証情報を検証する
+func (s *Store) Validate() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if err := s.Default.Validate(); err != nil {
+		return err
+	}
+	for key, c := range s.Brokers {
+		if err := c.Validate(); err != nil {
+			return StoreError{Msg: fmt.Sprintf("Invalid credential (%v): %v", key, err)}
+		}
+	}
+	return nil
+}
+
+// Set 関数は、key（Endpoint.CredentialRef または "host:port"）の分散ブローカに使用する認証情報を設定する
+func (s *Store) Set(key string, c Credential) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Brokers[key] = c
+}
+
+// Lookup 関数は、e へ接続する際に使用する認証情報を返す
+// NOTE: Endpoint.CredentialRef、"host:port" の順に引き、どちらもない場合は Default を返す
+// s が nil の場合は、認証情報なしとする
+func (s *Store) Lookup(e endpoint.Endpoint) Credential {
+	if s == nil {
+		return Credential{}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if e.CredentialRef != "" {
+		if c, ok := s.Brokers[e.CredentialRef]; ok {
+			return c
+		}
+	}
+	if c, ok := s.Brokers[e.Address()]; ok {
+		return c
+	}
+	return s.Default
+}
+
+// NewClientOptions 関数は、e へ接続するための mqtt.ClientOptions を、e に対応する認証情報を用いて生成する
+func (s *Store) NewClientOptions(e endpoint.Endpoint) (*mqtt.ClientOptions, error) {
+	return NewClientOptions(e, s.Lookup(e))
+}
+
+//////////////        以上、Store 関連                   //////////////
+//////////////        以下、エラー 関連                  //////////////
+
+// TLSError 構造体
+// TLS の設定が不正な場合に返される
+type TLSError struct {
+	Msg string
+}
+
+func (e TLSError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+// StoreError 構造体
+// 認証情報のファイルを読み込めない場合に返される
+type StoreError struct {
+	Msg string
+}
+
+func (e StoreError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+//////////////        以上、エラー 関連                  //////////////
@@ -0,0 +1,488 @@
+package credential_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"gamma/pkg/credential"
+	"gamma/pkg/endpoint"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// certFiles 構造体は、テスト用に生成した証明書のファイルのパスを保持する
+type certFiles struct {
+	dir        string
+	caFile     string
+	serverCert string
+	serverKey  string
+	clientCert string
+	clientKey  string
+	otherCA    string // サーバ証明書に署名していない CA 証明書
+}
+
+// generateCerts 関数は、テスト用の CA 証明書、サーバ証明書（localhost, 127.0.0.1）、クライアント証明書を生成する
+func generateCerts(t *testing.T) certFiles {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "gamma-credential")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() error = %v", err)
+	}
+	files := certFiles{
+		dir:        dir,
+		caFile:     filepath.Join(dir, "ca.pem"),
+		serverCert: filepath.Join(dir, "server.pem"),
+		serverKey:  filepath.Join(dir, "server-key.pem"),
+		clientCert: filepath.Join(dir, "client.pem"),
+		clientKey:  filepath.Join(dir, "client-key.pem"),
+		otherCA:    filepath.Join(dir, "other-ca.pem"),
+	}
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gamma test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	caKey, caDER := createCert(t, caTemplate, nil, nil)
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate() error = %v", err)
+	}
+	writePEM(t, files.caFile, "CERTIFICATE", caDER)
+
+	serverKey, serverDER := createCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, caKey)
+	writePEM(t, files.serverCert, "CERTIFICATE", serverDER)
+	writeKey(t, files.serverKey, serverKey)
+
+	clientKey, clientDER := createCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "gamma gateway"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCert, caKey)
+	writePEM(t, files.clientCert, "CERTIFICATE", clientDER)
+	writeKey(t, files.clientKey, clientKey)
+
+	caTemplate.SerialNumber = big.NewInt(4)
+	caTemplate.Subject = pkix.Name{CommonName: "gamma other CA"}
+	_, otherDER := createCert(t, caTemplate, nil, nil)
+	writePEM(t, files.otherCA, "CERTIFICATE", otherDER)
+	return files
+}
+
+// createCert 関数は、parent で署名した証明書を生成する（parent が nil の場合は自己署名）
+func createCert(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*ecdsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey() error = %v", err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate() error = %v", err)
+	}
+	return key, der
+}
+
+func writePEM(t *testing.T, path string, blockType string, der []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile() error = %v", err)
+	}
+}
+
+func writeKey(t *testing.T, path string, key *ecdsa.PrivateKey) {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("x509.MarshalECPrivateKey() error = %v", err)
+	}
+	writePEM(t, path, "EC PRIVATE KEY", der)
+}
+
+// serverTLSConfig 関数は、クライアント証明書を必須とするテスト用サーバの TLS の設定を生成する
+func serverTLSConfig(t *testing.T, files certFiles) *tls.Config {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair(files.serverCert, files.serverKey)
+	if err != nil {
+		t.Fatalf("tls.LoadX509KeyPair() error = %v", err)
+	}
+	pemBytes, err := ioutil.ReadFile(files.caFile)
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile() error = %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pemBytes)
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	files := generateCerts(t)
+	defer os.RemoveAll(files.dir)
+
+	tests := []struct {
+		name string
+		c    credential.Credential
+		want error
+	}{
+		{
+			name: "Normal scenario 01 (CA and client certificate)",
+			c:    credential.Credential{CAFile: files.caFile, CertFile: files.clientCert, KeyFile: files.clientKey},
+			want: nil,
+		},
+		{
+			name: "Normal scenario 02 (CA only)",
+			c:    credential.Credential{CAFile: files.caFile, ServerName: "localhost"},
+			want: nil,
+		},
+		{
+			name: "Error scenario 01 (CA file does not exist)",
+			c:    credential.Credential{CAFile: filepath.Join(files.dir, "not-exist.pem")},
+			want: credential.TLSError{},
+		},
+		{
+			name: "Error scenario 02 (CA file has no certificate)",
+			c:    credential.Credential{CAFile: files.clientKey},
+			want: credential.TLSError{},
+		},
+		{
+			name: "Error scenario 03 (key file is missing)",
+			c:    credential.Credential{CertFile: files.clientCert},
+			want: credential.TLSError{},
+		},
+		{
+			name: "Error scenario 04 (key does not match certificate)",
+			c:    credential.Credential{CertFile: files.clientCert, KeyFile: files.serverKey},
+			want: credential.TLSError{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := tt.c.TLSConfig()
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("TLSConfig() error = %v", err)
+				}
+				if cfg == nil {
+					t.Fatalf("TLSConfig() = nil, expected *tls.Config")
+				}
+				return
+			}
+			if err == nil || reflect.TypeOf(err) != reflect.TypeOf(tt.want) {
+				t.Errorf("TLSConfig() error = %v (Type: %T), expected Type: %T", err, err, tt.want)
+			}
+		})
+	}
+
+	// TLS に関する設定がない場合は nil を返す
+	if cfg, err := (credential.Credential{Username: "gamma", Password: "secret"}).TLSConfig(); cfg != nil || err != nil {
+		t.Errorf("TLSConfig() = %v, %v, expected nil, nil", cfg, err)
+	}
+}
+
+func TestTLSHandshake(t *testing.T) {
+	files := generateCerts(t)
+	defer os.RemoveAll(files.dir)
+
+	tests := []struct {
+		name    string
+		c       credential.Credential
+		wantErr bool
+	}{
+		{
+			name: "Normal scenario 01",
+			c:    credential.Credential{CAFile: files.caFile, CertFile: files.clientCert, KeyFile: files.clientKey, ServerName: "localhost"},
+		},
+		{
+			name:    "Error scenario 01 (server certificate is not signed by the CA)",
+			c:       credential.Credential{CAFile: files.otherCA, CertFile: files.clientCert, KeyFile: files.clientKey, ServerName: "localhost"},
+			wantErr: true,
+		},
+		{
+			name:    "Error scenario 02 (server name mismatch)",
+			c:       credential.Credential{CAFile: files.caFile, CertFile: files.clientCert, KeyFile: files.clientKey, ServerName: "example.com"},
+			wantErr: true,
+		},
+		{
+			name:    "Error scenario 03 (no client certificate)",
+			c:       credential.Credential{CAFile: files.caFile, ServerName: "localhost"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := tls.Listen("tcp", "127.0.0.1:0", serverTLSConfig(t, files))
+			if err != nil {
+				t.Fatalf("tls.Listen() error = %v", err)
+			}
+			defer ln.Close()
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+				// クライアント証明書の検証結果をクライアントへ伝えるため、1 バイト書き込む
+				conn.Write([]byte{0})
+			}()
+
+			cfg, err := tt.c.TLSConfig()
+			if err != nil {
+				t.Fatalf("TLSConfig() error = %v", err)
+			}
+			conn, err := tls.Dial("tcp", ln.Addr().String(), cfg)
+			if err == nil {
+				defer conn.Close()
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				_, err = conn.Read(make([]byte, 1))
+			}
+			if tt.wantErr && err == nil {
+				t.Errorf("handshake error = nil, expected error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("handshake error = %v", err)
+			}
+		})
+	}
+}
+
+// TestConnectOverTLS は、生成した mqtt.ClientOptions で TLS 上の MQTT ブローカへ接続し、
+// ユーザ名・パスワードが CONNECT パケットで送られることを確認する
+func TestConnectOverTLS(t *testing.T) {
+	files := generateCerts(t)
+	defer os.RemoveAll(files.dir)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverTLSConfig(t, files))
+	if err != nil {
+		t.Fatalf("tls.Listen() error = %v", err)
+	}
+	defer ln.Close()
+
+	connectCh := make(chan *packets.ConnectPacket, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		cp, ok := p.(*packets.ConnectPacket)
+		if !ok {
+			return
+		}
+		connectCh <- cp
+		ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+		ca.Write(conn)
+		// 切断されるまで待つ
+		packets.ReadPacket(conn)
+	}()
+
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+	e := endpoint.Endpoint{Scheme: endpoint.SchemeSSL, Host: "127.0.0.1", Port: port, CredentialRef: "dmb-01"}
+	s := credential.NewStore(credential.Credential{Username: "default"})
+	s.Set("dmb-01", credential.Credential{
+		Username: "gamma",
+		Password: "secret",
+		CAFile:   files.caFile,
+		CertFile: files.clientCert,
+		KeyFile:  files.clientKey,
+	})
+	opts, err := s.NewClientOptions(e)
+	if err != nil {
+		t.Fatalf("NewClientOptions() error = %v", err)
+	}
+	opts.SetConnectTimeout(5 * time.Second)
+	c := mqtt.NewClient(opts)
+	if token := c.Connect(); !token.WaitTimeout(10*time.Second) || token.Error() != nil {
+		t.Fatalf("Connect() error = %v", token.Error())
+	}
+	defer c.Disconnect(0)
+
+	select {
+	case cp := <-connectCh:
+		if cp.Username != "gamma" || string(cp.Password) != "secret" {
+			t.Errorf("CONNECT username = %v, password = %v, expected gamma, secret", cp.Username, string(cp.Password))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("CONNECT packet was not received")
+	}
+}
+
+func TestNewClientOptions(t *testing.T) {
+	files := generateCerts(t)
+	defer os.RemoveAll(files.dir)
+
+	tests := []struct {
+		name    string
+		e       endpoint.Endpoint
+		c       credential.Credential
+		wantErr bool
+	}{
+		{
+			name: "Normal scenario 01 (username and password over tcp)",
+			e:    endpoint.Endpoint{Host: "localhost", Port: 1883},
+			c:    credential.Credential{Username: "gamma", Password: "secret"},
+		},
+		{
+			name: "Normal scenario 02 (TLS over wss)",
+			e:    endpoint.Endpoint{Scheme: endpoint.SchemeWSS, Host: "localhost", Port: 443},
+			c:    credential.Credential{CAFile: files.caFile},
+		},
+		{
+			name:    "Error scenario 01 (TLS over tcp)",
+			e:       endpoint.Endpoint{Host: "localhost", Port: 1883},
+			c:       credential.Credential{CAFile: files.caFile},
+			wantErr: true,
+		},
+		{
+			name:    "Error scenario 02 (invalid endpoint)",
+			e:       endpoint.Endpoint{Host: "localhost", Port: 0},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := credential.NewClientOptions(tt.e, tt.c)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("NewClientOptions() error = nil, expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewClientOptions() error = %v", err)
+			}
+			if len(opts.Servers) != 1 || opts.Servers[0].String() != tt.e.URL() {
+				t.Errorf("NewClientOptions() servers = %v, expected %v", opts.Servers, tt.e.URL())
+			}
+			if opts.Username != tt.c.Username || opts.Password != tt.c.Password {
+				t.Errorf("NewClientOptions() username = %v, password = %v, expected %v, %v", opts.Username, opts.Password, tt.c.Username, tt.c.Password)
+			}
+			if tt.c.HasTLS() && (opts.TLSConfig == nil || opts.TLSConfig.RootCAs == nil) {
+				t.Errorf("NewClientOptions() TLSConfig = %v, expected RootCAs to be set", opts.TLSConfig)
+			}
+		})
+	}
+}
+
+func TestStoreLookup(t *testing.T) {
+	def := credential.Credential{Username: "default"}
+	s := credential.NewStore(def)
+	s.Set("dmb-01", credential.Credential{Username: "by-ref"})
+	s.Set("[::1]:1883", credential.Credential{Username: "by-address"})
+
+	tests := []struct {
+		name string
+		e    endpoint.Endpoint
+		want string
+	}{
+		{
+			name: "Normal scenario 01 (credential reference)",
+			e:    endpoint.Endpoint{Host: "::1", Port: 1883, CredentialRef: "dmb-01"},
+			want: "by-ref",
+		},
+		{
+			name: "Normal scenario 02 (address)",
+			e:    endpoint.Endpoint{Host: "::1", Port: 1883},
+			want: "by-address",
+		},
+		{
+			name: "Normal scenario 03 (unknown credential reference falls back to address)",
+			e:    endpoint.Endpoint{Host: "::1", Port: 1883, CredentialRef: "dmb-02"},
+			want: "by-address",
+		},
+		{
+			name: "Normal scenario 04 (default)",
+			e:    endpoint.Endpoint{Host: "mqtt-broker", Port: 1883},
+			want: "default",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.Lookup(tt.e); got.Username != tt.want {
+				t.Errorf("Lookup() = %v, expected username %v", got, tt.want)
+			}
+		})
+	}
+
+	// Store が nil の場合は認証情報なし
+	var nilStore *credential.Store
+	if got := nilStore.Lookup(endpoint.Endpoint{Host: "localhost", Port: 1883}); got != (credential.Credential{}) {
+		t.Errorf("Lookup() = %v, expected empty credential", got)
+	}
+}
+
+func TestLoadStore(t *testing.T) {
+	files := generateCerts(t)
+	defer os.RemoveAll(files.dir)
+
+	path := filepath.Join(files.dir, "credentials.json")
+	body := `{"default":{"username":"gamma","password":"secret","ca_file":"` + files.caFile + `"},"brokers":{"dmb-01":{"username":"dmb01","password":"secret01"}}}`
+	if err := ioutil.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile() error = %v", err)
+	}
+	s, err := credential.LoadStore(path)
+	if err != nil {
+		t.Fatalf("LoadStore() error = %v", err)
+	}
+	if got := s.Lookup(endpoint.Endpoint{Host: "localhost", Port: 8883}); got.Username != "gamma" || got.CAFile != files.caFile {
+		t.Errorf("Lookup() = %v, expected default credential", got)
+	}
+	if got := s.Lookup(endpoint.Endpoint{Host: "localhost", Port: 1883, CredentialRef: "dmb-01"}); got.Username != "dmb01" {
+		t.Errorf("Lookup() = %v, expected credential of dmb-01", got)
+	}
+
+	// 存在しない証明書を参照している場合はエラーとする
+	body = `{"brokers":{"dmb-01":{"ca_file":"` + filepath.Join(files.dir, "not-exist.pem") + `"}}}`
+	if err := ioutil.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile() error = %v", err)
+	}
+	if _, err := credential.LoadStore(path); err == nil {
+		t.Errorf("LoadStore() error = nil, expected error")
+	}
+
+	// パスワードはログへ出力しない
+	if got := (credential.Credential{Username: "gamma", Password: "secret"}).String(); got == "" || strings.Contains(got, "secret") {
+		t.Errorf("String() = %v, expected password to be masked", got)
+	}
+}
@@ -0,0 +1,284 @@
+package endpoint
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+//////////////        以下、Endpoint 関連              //////////////
+
+// 接続に使用できる URL スキーム
+const (
+	SchemeTCP = "tcp"
+	SchemeSSL = "ssl"
+	SchemeWS  = "ws"
+	SchemeWSS = "wss"
+)
+
+var schemes = []string{SchemeTCP, SchemeSSL, SchemeWS, SchemeWSS}
+
+// 接続に使用できる MQTT のプロトコルバージョン
+// NOTE: 0 の場合は MQTT 3.1.1 とする（paho.mqtt.golang のデフォルト）
+const (
+	ProtocolVersion31  = 3
+	ProtocolVersion311 = 4
+	ProtocolVersion5   = 5
+)
+
+// Endpoint 構造体は、MQTT ブローカへの接続先を表す
+// NOTE: JSON の "host", "port" は従来の BrokerInfo と互換性がある（"scheme" を省略した場合は tcp とする）
+type Endpoint struct {
+	Scheme          string `json:"scheme,omitempty"`
+	Host            string `json:"host"` // IPv6 アドレスの場合も "[]" で囲まない
+	Port            uint16 `json:"port"`
+	Path            string `json:"path,omitempty"`             // WebSocket (ws, wss) で接続する際のパス（例: リバースプロキシ経由の場合の "/mqtt"）
+	CredentialRef   string `json:"credential_ref,omitempty"`   // 接続に使用する認証情報の参照名（認証情報そのものは含めない）
+	ProtocolVersion uint8  `json:"protocol_version,omitempty"` // MQTT のプロトコルバージョン（3: 3.1, 4: 3.1.1, 5: 5.0。省略した場合は 3.1.1）
+}
+
+// GetScheme 関数は、URL スキームを返す（省略されている場合は tcp）
+func (e Endpoint) GetScheme() string {
+	if e.Scheme == "" {
+		return SchemeTCP
+	}
+	return e.Scheme
+}
+
+// Address 関数は、"host:port" 形式の文字列を返す（IPv6 アドレスの場合は "[host]:port"）
+func (e Endpoint) Address() string {
+	return net.JoinHostPort(e.Host, strconv.Itoa(int(e.Port)))
+}
+
+// IsWebsocket 関数は、WebSocket で接続するかどうかを返す
+func (e Endpoint) IsWebsocket() bool {
+	s := e.GetScheme()
+	return s == SchemeWS || s == SchemeWSS
+}
+
+// IsV5 関数は、MQTT v5 で接続するかどうかを返す
+func (e Endpoint) IsV5() bool {
+	return e.ProtocolVersion == ProtocolVersion5
+}
+
+// URL 関数は、MQTT クライアントの接続先として使用する URL を返す（例: "tcp://localhost:1883", "ws://localhost:9001/mqtt"）
+func (e Endpoint) URL() string {
+	if e.IsWebsocket() {
+		return fmt.Sprintf("%v://%v%v", e.GetScheme(), e.Address(), e.Path)
+	}
+	return fmt.Sprintf("%v://%v", e.GetScheme(), e.Address())
+}
+
+func (e Endpoint) String() string {
+	return e.URL()
+}
+
+// Validate 関数は、接続先として有効かどうかを検証する
+func (e Endpoint) Validate() error {
+	if err := ValidateScheme(e.GetScheme()); err != nil {
+		return err
+	}
+	if err := ValidateHost(e.Host); err != nil {
+		return err
+	}
+	if e.Port == 0 {
+		return PortError{Msg: fmt.Sprintf("Invalid port (%v). Port must be greater than 0.", e.Port)}
+	}
+	if err := e.validatePath(); err != nil {
+		return err
+	}
+	if e.CredentialRef != "" && !isName(e.CredentialRef) {
+		return CredentialRefError{Msg: fmt.Sprintf("Invalid credential reference (%v). Allowed characters are alphanumeric, '_', '-' and '.'.", e.CredentialRef)}
+	}
+	if err := ValidateProtocolVersion(e.ProtocolVersion); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validatePath 関数は、WebSocket で接続する際のパスを検証する
+func (e Endpoint) validatePath() error {
+	if e.Path == "" {
+		return nil
+	}
+	if !e.IsWebsocket() {
+		return PathError{Msg: fmt.Sprintf("Path (%v) is only allowed for %v and %v.", e.Path, SchemeWS, SchemeWSS)}
+	}
+	if e.Path[0] != '/' {
+		return PathError{Msg: fmt.Sprintf("Invalid path (%v). Path must start with '/'.", e.Path)}
+	}
+	for i := 0; i < len(e.Path); i++ {
+		if c := e.Path[i]; c <= ' ' || c >= 0x7f || c == '?' || c == '#' {
+			return PathError{Msg: fmt.Sprintf("Invalid path (%v). Query, fragment, spaces and control characters are not allowed.", e.Path)}
+		}
+	}
+	return nil
+}
+
+// Parse 関数は、"scheme://host:port[/path]" または "host:port" 形式の文字列から Endpoint 構造体を生成する
+// 例: "tcp://localhost:1883", "ws://[::1]:9001", "wss://proxy.example.com:443/mqtt", "mqtt-broker:1883"
+func Parse(s string) (Endpoint, error) {
+	if !strings.Contains(s, "://") {
+		s = SchemeTCP + "://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return Endpoint{}, HostError{Msg: fmt.Sprintf("Invalid endpoint (%v): %v", s, err)}
+	}
+	port, err := strconv.ParseUint(u.Port(), 10, 16)
+	if err != nil {
+		return Endpoint{}, PortError{Msg: fmt.Sprintf("Invalid port (%v).", u.Port())}
+	}
+	e := Endpoint{Scheme: u.Scheme, Host: u.Hostname(), Port: uint16(port), Path: u.EscapedPath()}
+	return e, e.Validate()
+}
+
+// ValidateScheme 関数は、接続に使用できる URL スキームかどうかを検証する
+func ValidateScheme(scheme string) error {
+	for _, s := range schemes {
+		if s == scheme {
+			return nil
+		}
+	}
+	return SchemeError{Msg: fmt.Sprintf("Invalid scheme (%v). Allowed schemes are %v.", scheme, strings.Join(schemes, ", "))}
+}
+
+// ValidateProtocolVersion 関数は、接続に使用できる MQTT のプロトコルバージョンかどうかを検証する（0 は 3.1.1 とみなす）
+func ValidateProtocolVersion(v uint8) error {
+	switch v {
+	case 0, ProtocolVersion31, ProtocolVersion311, ProtocolVersion5:
+		return nil
+	}
+	return ProtocolVersionError{Msg: fmt.Sprintf("Invalid protocol version (%v). Allowed versions are %v (3.1), %v (3.1.1) and %v (5.0).", v, ProtocolVersion31, ProtocolVersion311, ProtocolVersion5)}
+}
+
+// ValidateHost 関数は、ホスト名として有効かどうかを検証する
+// IPv4 アドレス、IPv6 アドレス、ドメイン名に加え、Docker のサービス名（例: "mqtt-broker"）のような
+// ドットを含まないホスト名も許可する
+func ValidateHost(host string) error {
+	err := HostError{Msg: fmt.Sprintf("Invalid host (%v). Allowed 'host' formats are IPv4 address, IPv6 address or host name.", host)}
+	if host == "" || len(host) > 253 {
+		return err
+	}
+	if strings.Contains(host, ":") {
+		// IPv6 アドレス
+		if net.ParseIP(host) == nil {
+			return err
+		}
+		return nil
+	}
+
+	labels := strings.Split(host, ".")
+	for _, label := range labels {
+		if !isLabel(label) {
+			return err
+		}
+	}
+	// NOTE: 最後のラベルが数字のみの場合は IPv4 アドレスとみなす（例: "256.0.0.1" は不正）
+	if isNumeric(labels[len(labels)-1]) && net.ParseIP(host).To4() == nil {
+		return err
+	}
+	return nil
+}
+
+// isLabel 関数は、ホスト名の各ラベルとして有効かどうかを返す
+// NOTE: Docker のコンテナ名に使用されるため、"_" も許可する
+func isLabel(label string) bool {
+	if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func isNumeric(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || '9' < s[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// isName 関数は、認証情報の参照名として有効かどうかを返す
+func isName(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+//////////////        以上、Endpoint 関連              //////////////
+//////////////        以下、エラー 関連                //////////////
+
+// SchemeError 構造体
+// 接続に使用できない URL スキームが指定された際に返される
+type SchemeError struct {
+	Msg string
+}
+
+func (e SchemeError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+// HostError 構造体
+// 不正なホスト名が指定された際に返される
+type HostError struct {
+	Msg string
+}
+
+func (e HostError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+// PortError 構造体
+// 不正なポート番号が指定された際に返される
+type PortError struct {
+	Msg string
+}
+
+func (e PortError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+// PathError 構造体
+// 不正なパスが指定された際に返される
+type PathError struct {
+	Msg string
+}
+
+func (e PathError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+// CredentialRefError 構造体
+// 不正な認証情報の参照名が指定された際に返される
+type CredentialRefError struct {
+	Msg string
+}
+
+func (e CredentialRefError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+// ProtocolVersionError 構造体
+// 不正な MQTT のプロトコルバージョンが指定された際に返される
+type ProtocolVersionError struct {
+	Msg string
+}
+
+func (e ProtocolVersionError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+//////////////        以上、エラー 関連                //////////////
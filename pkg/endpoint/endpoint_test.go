@@ -0,0 +1,205 @@
+package endpoint_test
+
+import (
+	"encoding/json"
+	"gamma/pkg/endpoint"
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		e    endpoint.Endpoint
+		want error
+	}{
+		{
+			name: "Normal scenario 01 (default scheme)",
+			e:    endpoint.Endpoint{Host: "localhost", Port: 1883},
+			want: nil,
+		},
+		{
+			name: "Normal scenario 02 (docker service name)",
+			e:    endpoint.Endpoint{Scheme: "tcp", Host: "mqtt-broker", Port: 1883},
+			want: nil,
+		},
+		{
+			name: "Normal scenario 03 (IPv6 address)",
+			e:    endpoint.Endpoint{Scheme: "wss", Host: "2001:db8::1", Port: 443},
+			want: nil,
+		},
+		{
+			name: "Normal scenario 04 (credential reference)",
+			e:    endpoint.Endpoint{Scheme: "ssl", Host: "broker.example.com", Port: 8883, CredentialRef: "dmb-01.secret"},
+			want: nil,
+		},
+		{
+			name: "Normal scenario 05 (websocket path)",
+			e:    endpoint.Endpoint{Scheme: "ws", Host: "proxy.example.com", Port: 9001, Path: "/mqtt/dmb-01"},
+			want: nil,
+		},
+		{
+			name: "Normal scenario 06 (MQTT v5)",
+			e:    endpoint.Endpoint{Host: "localhost", Port: 1883, ProtocolVersion: 5},
+			want: nil,
+		},
+		{
+			name: "Error scenario 01 (scheme)",
+			e:    endpoint.Endpoint{Scheme: "http", Host: "localhost", Port: 1883},
+			want: endpoint.SchemeError{},
+		},
+		{
+			name: "Error scenario 02 (host)",
+			e:    endpoint.Endpoint{Host: "256.0.0.1", Port: 1883},
+			want: endpoint.HostError{},
+		},
+		{
+			name: "Error scenario 03 (port)",
+			e:    endpoint.Endpoint{Host: "localhost", Port: 0},
+			want: endpoint.PortError{},
+		},
+		{
+			name: "Error scenario 04 (credential reference)",
+			e:    endpoint.Endpoint{Host: "localhost", Port: 1883, CredentialRef: "user:password"},
+			want: endpoint.CredentialRefError{},
+		},
+		{
+			name: "Error scenario 05 (path with tcp)",
+			e:    endpoint.Endpoint{Host: "localhost", Port: 1883, Path: "/mqtt"},
+			want: endpoint.PathError{},
+		},
+		{
+			name: "Error scenario 06 (path without leading slash)",
+			e:    endpoint.Endpoint{Scheme: "wss", Host: "localhost", Port: 443, Path: "mqtt"},
+			want: endpoint.PathError{},
+		},
+		{
+			name: "Error scenario 07 (path with query)",
+			e:    endpoint.Endpoint{Scheme: "ws", Host: "localhost", Port: 9001, Path: "/mqtt?token=secret"},
+			want: endpoint.PathError{},
+		},
+		{
+			name: "Error scenario 08 (protocol version)",
+			e:    endpoint.Endpoint{Host: "localhost", Port: 1883, ProtocolVersion: 6},
+			want: endpoint.ProtocolVersionError{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.e.Validate()
+			if tt.want == nil {
+				if got != nil {
+					t.Errorf("Validate() = %v (Type: %T), expected nil", got, got)
+				}
+			} else if got == nil || reflect.TypeOf(got) != reflect.TypeOf(tt.want) {
+				t.Errorf("Validate() = %v (Type: %T), expected Type: %T", got, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestURL(t *testing.T) {
+	tests := []struct {
+		name string
+		e    endpoint.Endpoint
+		want string
+	}{
+		{
+			name: "Normal scenario 01 (default scheme)",
+			e:    endpoint.Endpoint{Host: "localhost", Port: 1883},
+			want: "tcp://localhost:1883",
+		},
+		{
+			name: "Normal scenario 02 (websocket)",
+			e:    endpoint.Endpoint{Scheme: "ws", Host: "mqtt-broker", Port: 9001},
+			want: "ws://mqtt-broker:9001",
+		},
+		{
+			name: "Normal scenario 03 (IPv6 address)",
+			e:    endpoint.Endpoint{Scheme: "ssl", Host: "::1", Port: 8883},
+			want: "ssl://[::1]:8883",
+		},
+		{
+			name: "Normal scenario 04 (websocket path)",
+			e:    endpoint.Endpoint{Scheme: "wss", Host: "2001:db8::1", Port: 443, Path: "/mqtt"},
+			want: "wss://[2001:db8::1]:443/mqtt",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.e.URL(); got != tt.want {
+				t.Errorf("URL() = %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    endpoint.Endpoint
+		wantErr bool
+	}{
+		{
+			name: "Normal scenario 01 (without scheme)",
+			s:    "mqtt-broker:1883",
+			want: endpoint.Endpoint{Scheme: "tcp", Host: "mqtt-broker", Port: 1883},
+		},
+		{
+			name: "Normal scenario 02 (IPv6 address)",
+			s:    "ws://[::1]:9001",
+			want: endpoint.Endpoint{Scheme: "ws", Host: "::1", Port: 9001},
+		},
+		{
+			name: "Normal scenario 03 (websocket path)",
+			s:    "wss://proxy.example.com:443/mqtt",
+			want: endpoint.Endpoint{Scheme: "wss", Host: "proxy.example.com", Port: 443, Path: "/mqtt"},
+		},
+		{
+			name:    "Error scenario 01 (port)",
+			s:       "tcp://localhost",
+			wantErr: true,
+		},
+		{
+			name:    "Error scenario 02 (scheme)",
+			s:       "mqtt://localhost:1883",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := endpoint.Parse(tt.s)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Parse() error = nil, expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Parse() = %+v, expected %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 従来の {"host":...,"port":...} 形式の JSON は tcp として扱う
+func TestUnmarshalLegacyJSON(t *testing.T) {
+	var got endpoint.Endpoint
+	if err := json.Unmarshal([]byte(`{"host":"localhost","port":1883}`), &got); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	if got.URL() != "tcp://localhost:1883" {
+		t.Errorf("URL() = %v, expected %v", got.URL(), "tcp://localhost:1883")
+	}
+	b, err := json.Marshal(got)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	if string(b) != `{"host":"localhost","port":1883}` {
+		t.Errorf("json.Marshal() = %v, expected %v", string(b), `{"host":"localhost","port":1883}`)
+	}
+}
@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//////////////        以下、Exposition 関連          //////////////
+
+const (
+	textContentType        = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// WriteText 関数は、登録されている全てのメトリクスを名前の順に w へ出力する
+// openMetrics が true の場合は OpenMetrics 形式、false の場合は Prometheus のテキスト形式（0.0.4）
+func (r *Registry) WriteText(w io.Writer, openMetrics bool) error {
+	r.mu.RLock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.RUnlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		name := f.name
+		if openMetrics && f.typ == counterType {
+			// OpenMetrics では、カウンタのメトリクス名に "_total" を含めない
+			name = strings.TrimSuffix(name, "_total")
+		}
+		if f.help != "" {
+			fmt.Fprintf(bw, "# HELP %v %v\n", name, helpEscaper.Replace(f.help))
+		}
+		fmt.Fprintf(bw, "# TYPE %v %v\n", name, f.typ)
+		for _, s := range f.snapshot() {
+			if f.typ != histogramType {
+				fmt.Fprintf(bw, "%v%v %v\n", f.name, formatLabels(f.labelNames, s.labelValues, "", ""), formatFloat(s.value))
+				continue
+			}
+			var cumulative uint64
+			for i, upper := range f.buckets {
+				cumulative += s.counts[i]
+				fmt.Fprintf(bw, "%v_bucket%v %v\n", f.name, formatLabels(f.labelNames, s.labelValues, "le", formatFloat(upper)), cumulative)
+			}
+			fmt.Fprintf(bw, "%v_bucket%v %v\n", f.name, formatLabels(f.labelNames, s.labelValues, "le", "+Inf"), s.count)
+			fmt.Fprintf(bw, "%v_sum%v %v\n", f.name, formatLabels(f.labelNames, s.labelValues, "", ""), formatFloat(s.sum))
+			fmt.Fprintf(bw, "%v_count%v %v\n", f.name, formatLabels(f.labelNames, s.labelValues, "", ""), s.count)
+		}
+	}
+	if openMetrics {
+		fmt.Fprint(bw, "# EOF\n")
+	}
+	return bw.Flush()
+}
+
+// formatLabels 関数は、ラベルを `{name="value",...}` の形式で表す（extraName が空でない場合は最後に追加する）
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+1)
+	for i, n := range names {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, n, labelValueEscaper.Replace(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, extraName, extraValue))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Handler 関数は、メトリクスを公開する HTTP ハンドラを返す
+// Accept ヘッダで application/openmetrics-text を要求された場合は OpenMetrics 形式で応答する
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		openMetrics := strings.Contains(req.Header.Get("Accept"), "application/openmetrics-text")
+		if openMetrics {
+			w.Header().Set("Content-Type", openMetricsContentType)
+		} else {
+			w.Header().Set("Content-Type", textContentType)
+		}
+		if err := r.WriteText(w, openMetrics); err != nil {
+			log.WithFields(log.Fields{"error": err}).Debug("Failed to write metrics")
+		}
+	})
+}
+
+// ListenAndServe 関数は、addr（例: ":9100"）の /metrics で r のメトリクスを公開する（戻らない）
+func ListenAndServe(addr string, r *Registry) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r.Handler())
+	log.WithFields(log.Fields{"addr": addr}).Info("Serving metrics")
+	return http.ListenAndServe(addr, mux)
+}
+
+//////////////        以上、Exposition 関連          //////////////
@@ -1,88 +1,43 @@
 package metrics
 
 import (
-	"sync"
-	"time"
-
 	log "github.com/sirupsen/logrus"
 )
 
+// Metrics 構造体は、名前付きのカウンタ（Registry の Counter をログ出力用の名前で参照するアダプタ）
+// NOTE: 参照しても値・レートはリセットされないため、複数の goroutine から同時に参照できる
 type Metrics struct {
-	sync.RWMutex
-	name        string
-	time        int64
-	rate        uint64
-	rateRead    bool
-	counter     uint64
-	counterRead bool
-	isDone      bool
+	name    string
+	counter *Counter
 }
 
+// NewMetrics 関数は、Registry に登録しない（/metrics で公開しない）カウンタを生成する
 func NewMetrics(name string) *Metrics {
+	return NewMetricsFor(name, NewRegistry().NewCounter("metrics_total", name))
+}
+
+// NewMetricsFor 関数は、Registry に登録済みのカウンタ c を name で参照する
+func NewMetricsFor(name string, c *Counter) *Metrics {
 	log.WithFields(log.Fields{"name": name}).Trace("New metrics created")
-	return &Metrics{name: name, time: time.Now().Unix(), rate: 0, counter: 0, isDone: false, rateRead: false, counterRead: false}
+	return &Metrics{name: name, counter: c}
 }
 
+// Countup 関数は、カウンタを 1 増やす
 func (m *Metrics) Countup() {
-	m.Lock()
-	defer m.Unlock()
-	now := time.Now().Unix()
-	if m.time != now {
-		m.rate = m.counter
-		m.counter = 0
-		m.time = now
-		m.rateRead = false
-		log.WithFields(log.Fields{"name": m.name, "rate": m.rate}).Trace("[Metrics] updated rate")
-	}
-	m.counter++
-	log.WithFields(log.Fields{"name": m.name, "counter": m.counter}).Trace("[Metrics] countuped")
+	m.counter.Inc()
 }
 
-func (m *Metrics) GetIsDone() bool {
-	m.RLock()
-	defer m.RUnlock()
-	return m.isDone
+// Name 関数は、名前を返す
+func (m *Metrics) Name() string {
+	return m.name
 }
 
-func (m *Metrics) SetIsDone() {
-	log.WithFields(log.Fields{"name": m.name}).Trace("[Metrics] called SetIsDone()")
-	m.Lock()
-	defer m.Unlock()
-	m.isDone = true
+// Count 関数は、カウンタの値を返す
+func (m *Metrics) Count() uint64 {
+	return uint64(m.counter.Value())
 }
 
-func (m *Metrics) GetRate() (bool, uint64, string) {
-	log.WithFields(log.Fields{"name": m.name}).Trace("[Metrics] called GetRate()")
-	m.Lock()
-	defer m.Unlock()
-	if !m.isDone && m.rateRead {
-		log.WithFields(log.Fields{
-			"name":        m.name,
-			"isDone":      m.isDone,
-			"rateRead":    m.rateRead,
-			"counterRead": m.counterRead,
-		}).Debug("[Metrics] `rate` is not updated")
-		return false, m.rate, m.name
-	}
-	if m.isDone && m.rateRead && !m.counterRead {
-		log.WithFields(log.Fields{
-			"name":        m.name,
-			"isDone":      m.isDone,
-			"rateRead":    m.rateRead,
-			"counterRead": m.counterRead,
-		}).Debug("[Metrics] will return `counter` not `rate`")
-		m.counterRead = true
-		return true, m.counter, m.name
-	}
-	if m.isDone && m.rateRead && m.counterRead {
-		log.WithFields(log.Fields{
-			"name":        m.name,
-			"isDone":      m.isDone,
-			"rateRead":    m.rateRead,
-			"counterRead": m.counterRead,
-		}).Debug("[Metrics] `rate` and `counter` are not updated")
-		return false, 0, m.name
-	}
-	m.rateRead = true
-	return true, m.rate, m.name
+// Rates 関数は、直近 1 秒・1 分・5 分の 1 秒あたりの平均増加量を返す
+func (m *Metrics) Rates() Rates {
+	return m.counter.Rates()
 }
@@ -0,0 +1,423 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//////////////        以下、Registry 関連            //////////////
+
+// Default は、各コンポーネントが使用する Registry（/metrics で公開する）
+var Default = NewRegistry()
+
+// DefaultLatencyBuckets は、Publish 等の所要時間（秒）のヒストグラムのバケットの上限
+var DefaultLatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+var metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+type metricType string
+
+const (
+	counterType   metricType = "counter"
+	gaugeType     metricType = "gauge"
+	histogramType metricType = "histogram"
+)
+
+// Registry 構造体は、ラベル付きのカウンタ・ゲージ・ヒストグラムを名前ごとに管理する
+// NOTE: 複数の goroutine から安全に更新・参照できる
+type Registry struct {
+	mu       sync.RWMutex
+	families map[string]*family
+}
+
+// NewRegistry 関数は、空の Registry を生成する
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+// family 構造体は、同じ名前のメトリクス（ラベルの値ごとの series）
+type family struct {
+	name       string
+	help       string
+	typ        metricType
+	labelNames []string
+	buckets    []float64 // ヒストグラムのみ
+
+	mu      sync.Mutex
+	series  map[string]*series // ラベルの値を連結したものから引く
+	collect CollectFunc        // nil でない場合は、参照時に値を取得する
+}
+
+// series 構造体は、ラベルの値の組み合わせごとの値
+type series struct {
+	mu          sync.Mutex
+	labelValues []string
+	value       float64
+	counts      []uint64 // ヒストグラムの各バケットの数（累積でない）
+	sum         float64
+	count       uint64
+	window      *rateWindow // カウンタのみ
+}
+
+// sample 構造体は、参照時に複製した series の値
+type sample struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+// CollectFunc は、参照時に値を取得するメトリクスの値を emit で出力する関数
+type CollectFunc func(emit func(value float64, labelValues ...string))
+
+// register 関数は、name のメトリクスを登録する
+// 既に同じ名前・種類・ラベルで登録されている場合は、登録済みのものを返す
+func (r *Registry) register(name, help string, typ metricType, labelNames []string, buckets []float64, collect CollectFunc) *family {
+	if !metricNameRegexp.MatchString(name) {
+		log.WithFields(log.Fields{"name": name}).Fatal("Invalid metric name")
+	}
+	if typ == counterType && !strings.HasSuffix(name, "_total") {
+		log.WithFields(log.Fields{"name": name}).Fatal("Counter name must end with \"_total\"")
+	}
+	for _, l := range labelNames {
+		if !labelNameRegexp.MatchString(l) || l == "le" {
+			log.WithFields(log.Fields{"name": name, "label": l}).Fatal("Invalid label name")
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.families[name]; ok {
+		if f.typ != typ || strings.Join(f.labelNames, ",") != strings.Join(labelNames, ",") || (f.collect == nil) != (collect == nil) {
+			log.WithFields(log.Fields{"name": name, "type": typ, "registered_type": f.typ}).Fatal("Metric is already registered with different type or labels")
+		}
+		return f
+	}
+	f := &family{name: name, help: help, typ: typ, labelNames: labelNames, buckets: buckets, series: map[string]*series{}, collect: collect}
+	r.families[name] = f
+	return f
+}
+
+// with 関数は、labelValues の series を返す（存在しない場合は生成する）
+func (f *family) with(labelValues []string) *series {
+	if len(labelValues) != len(f.labelNames) {
+		log.WithFields(log.Fields{"name": f.name, "labels": f.labelNames, "values": labelValues}).Fatal("Number of label values is mismatched")
+	}
+	key := strings.Join(labelValues, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		switch f.typ {
+		case counterType:
+			s.window = &rateWindow{}
+		case histogramType:
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// snapshot 関数は、series の値を複製して返す（ラベルの値の順）
+func (f *family) snapshot() []sample {
+	var result []sample
+	if f.collect != nil {
+		f.collect(func(value float64, labelValues ...string) {
+			if len(labelValues) != len(f.labelNames) {
+				log.WithFields(log.Fields{"name": f.name, "labels": f.labelNames, "values": labelValues}).Error("Number of label values is mismatched")
+				return
+			}
+			result = append(result, sample{labelValues: append([]string{}, labelValues...), value: value})
+		})
+	} else {
+		f.mu.Lock()
+		for _, s := range f.series {
+			s.mu.Lock()
+			result = append(result, sample{labelValues: s.labelValues, value: s.value, counts: append([]uint64{}, s.counts...), sum: s.sum, count: s.count})
+			s.mu.Unlock()
+		}
+		f.mu.Unlock()
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return strings.Join(result[i].labelValues, "\xff") < strings.Join(result[j].labelValues, "\xff")
+	})
+	return result
+}
+
+//////////////        以上、Registry 関連            //////////////
+//////////////        以下、Counter 関連             //////////////
+
+// CounterVec 構造体は、ラベル付きのカウンタ（単調増加する値）
+type CounterVec struct {
+	f *family
+}
+
+// Counter 構造体は、ラベルの値ごとのカウンタ
+type Counter struct {
+	s *series
+}
+
+// NewCounterVec 関数は、ラベル付きのカウンタを登録する（name は "_total" で終わること）
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{f: r.register(name, help, counterType, labelNames, nil, nil)}
+}
+
+// NewCounter 関数は、ラベルの無いカウンタを登録する
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return r.NewCounterVec(name, help).With()
+}
+
+// NewCounterFunc 関数は、参照時に collect で値を取得するカウンタを登録する
+func (r *Registry) NewCounterFunc(name, help string, labelNames []string, collect CollectFunc) {
+	r.register(name, help, counterType, labelNames, nil, collect)
+}
+
+// With 関数は、labelValues（ラベル名と同じ順）のカウンタを返す
+func (v *CounterVec) With(labelValues ...string) *Counter {
+	return &Counter{s: v.f.with(labelValues)}
+}
+
+// Inc 関数は、カウンタを 1 増やす
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add 関数は、カウンタを v 増やす（v が負の場合は何もしない）
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	c.s.value += v
+	c.s.window.add(nowFunc().Unix(), v)
+}
+
+// Value 関数は、現在の値を返す
+func (c *Counter) Value() float64 {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	return c.s.value
+}
+
+// Rate 関数は、直近 window（1 秒単位に切り捨て、1 秒〜MaxRateWindow）の 1 秒あたりの平均増加量を返す
+// NOTE: 集計中の現在の 1 秒は含まない。また、起動直後など window 分の記録が無い場合も window で割る
+func (c *Counter) Rate(window time.Duration) float64 {
+	seconds := int64(window / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	if seconds > rateWindowSeconds {
+		seconds = rateWindowSeconds
+	}
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	return c.s.window.sum(nowFunc().Unix(), seconds) / float64(seconds)
+}
+
+// Rates 構造体は、直近 1 秒・1 分・5 分の 1 秒あたりの平均増加量
+type Rates struct {
+	OneSecond   float64 // 直近 1 秒
+	OneMinute   float64 // 直近 1 分の平均
+	FiveMinutes float64 // 直近 5 分の平均
+}
+
+// Rates 関数は、直近 1 秒・1 分・5 分の 1 秒あたりの平均増加量を返す
+func (c *Counter) Rates() Rates {
+	return Rates{
+		OneSecond:   c.Rate(time.Second),
+		OneMinute:   c.Rate(time.Minute),
+		FiveMinutes: c.Rate(5 * time.Minute),
+	}
+}
+
+//////////////        以上、Counter 関連             //////////////
+//////////////        以下、Rate 関連                //////////////
+
+// MaxRateWindow は、Counter.Rate 関数で指定できる最大の期間
+const MaxRateWindow = rateWindowSeconds * time.Second
+
+const rateWindowSeconds = 300
+
+// nowFunc は、現在時刻を返す（テスト用に差し替える）
+var nowFunc = time.Now
+
+// rateWindow 構造体は、直近 rateWindowSeconds 秒の 1 秒ごとの増加量（リングバッファ）
+// NOTE: series.mu で保護する
+type rateWindow struct {
+	buckets [rateWindowSeconds]float64
+	head    int64 // 最後に記録した時刻（UNIX 時間の秒）
+}
+
+// add 関数は、時刻 now（秒）の増加量として v を記録する
+func (w *rateWindow) add(now int64, v float64) {
+	if now > w.head {
+		if now-w.head >= rateWindowSeconds {
+			w.buckets = [rateWindowSeconds]float64{}
+		} else {
+			for t := w.head + 1; t <= now; t++ {
+				w.buckets[t%rateWindowSeconds] = 0
+			}
+		}
+		w.head = now
+	}
+	if now <= w.head-rateWindowSeconds {
+		return // 時刻が戻った場合など、リングバッファより古い
+	}
+	w.buckets[now%rateWindowSeconds] += v
+}
+
+// sum 関数は、時刻 now（秒）の直前 seconds 秒（now は含まない）の増加量の合計を返す
+// NOTE: 参照のみでリングバッファを更新しないため、複数の参照が互いに影響しない
+func (w *rateWindow) sum(now, seconds int64) float64 {
+	total := 0.0
+	for t := now - seconds; t < now; t++ {
+		if t > w.head || t <= w.head-rateWindowSeconds {
+			continue
+		}
+		total += w.buckets[t%rateWindowSeconds]
+	}
+	return total
+}
+
+//////////////        以上、Rate 関連                //////////////
+//////////////        以下、Gauge 関連               //////////////
+
+// GaugeVec 構造体は、ラベル付きのゲージ（増減する値）
+type GaugeVec struct {
+	f *family
+}
+
+// Gauge 構造体は、ラベルの値ごとのゲージ
+type Gauge struct {
+	s *series
+}
+
+// NewGaugeVec 関数は、ラベル付きのゲージを登録する
+func (r *Registry) NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{f: r.register(name, help, gaugeType, labelNames, nil, nil)}
+}
+
+// NewGauge 関数は、ラベルの無いゲージを登録する
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	return r.NewGaugeVec(name, help).With()
+}
+
+// NewGaugeFunc 関数は、参照時に collect で値を取得するゲージを登録する
+func (r *Registry) NewGaugeFunc(name, help string, labelNames []string, collect CollectFunc) {
+	r.register(name, help, gaugeType, labelNames, nil, collect)
+}
+
+// With 関数は、labelValues（ラベル名と同じ順）のゲージを返す
+func (v *GaugeVec) With(labelValues ...string) *Gauge {
+	return &Gauge{s: v.f.with(labelValues)}
+}
+
+// Set 関数は、ゲージを v にする
+func (g *Gauge) Set(v float64) {
+	g.s.mu.Lock()
+	defer g.s.mu.Unlock()
+	g.s.value = v
+}
+
+// Add 関数は、ゲージを v 増やす（v が負の場合は減らす）
+func (g *Gauge) Add(v float64) {
+	g.s.mu.Lock()
+	defer g.s.mu.Unlock()
+	g.s.value += v
+}
+
+// Inc 関数は、ゲージを 1 増やす
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+// Dec 関数は、ゲージを 1 減らす
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+// Value 関数は、現在の値を返す
+func (g *Gauge) Value() float64 {
+	g.s.mu.Lock()
+	defer g.s.mu.Unlock()
+	return g.s.value
+}
+
+//////////////        以上、Gauge 関連               //////////////
+//////////////        以下、Histogram 関連           //////////////
+
+// HistogramVec 構造体は、ラベル付きのヒストグラム
+type HistogramVec struct {
+	f *family
+}
+
+// Histogram 構造体は、ラベルの値ごとのヒストグラム
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+// NewHistogramVec 関数は、ラベル付きのヒストグラムを登録する（buckets は各バケットの上限の昇順。nil の場合は DefaultLatencyBuckets）
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultLatencyBuckets
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		log.WithFields(log.Fields{"name": name, "buckets": buckets}).Fatal("Histogram buckets must be sorted")
+	}
+	return &HistogramVec{f: r.register(name, help, histogramType, labelNames, buckets, nil)}
+}
+
+// NewHistogram 関数は、ラベルの無いヒストグラムを登録する
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	return r.NewHistogramVec(name, help, buckets).With()
+}
+
+// With 関数は、labelValues（ラベル名と同じ順）のヒストグラムを返す
+func (v *HistogramVec) With(labelValues ...string) *Histogram {
+	return &Histogram{s: v.f.with(labelValues), buckets: v.f.buckets}
+}
+
+// Observe 関数は、v を記録する
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v) // v 以上となる最初のバケット
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	if i < len(h.s.counts) {
+		h.s.counts[i]++
+	}
+	h.s.sum += v
+	h.s.count++
+}
+
+// ObserveSince 関数は、start からの経過時間（秒）を記録する
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+//////////////        以上、Histogram 関連           //////////////
+
+// formatFloat 関数は、値を Prometheus のテキスト形式で表す
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+// setNow 関数は、nowFunc を sec（UNIX 時間の秒）を返す関数へ差し替える
+func setNow(sec *int64) func() {
+	nowFunc = func() time.Time { return time.Unix(*sec, 0) }
+	return func() { nowFunc = time.Now }
+}
+
+func TestCounterRate(t *testing.T) {
+	sec := int64(1000000)
+	defer setNow(&sec)()
+
+	c := NewRegistry().NewCounter("gamma_rate_total", "")
+	// 1000000 〜 1000059 の 60 秒間、毎秒 2 回カウントする
+	for i := 0; i < 60; i++ {
+		c.Add(2)
+		sec++
+	}
+	// 5 分後の時点で、さらに 1 秒間に 10 回カウントする
+	sec += 240
+	c.Add(10)
+	sec++
+
+	tests := []struct {
+		name   string
+		window time.Duration
+		want   float64
+	}{
+		{name: "Normal scenario 01 (1s)", window: time.Second, want: 10},
+		{name: "Normal scenario 02 (1m)", window: time.Minute, want: 10.0 / 60},
+		{name: "Normal scenario 03 (5m, older buckets are dropped)", window: 5 * time.Minute, want: (10.0 + 2*59) / 300},
+		{name: "Normal scenario 04 (shorter than 1s)", window: time.Millisecond, want: 10},
+		{name: "Normal scenario 05 (longer than max)", window: time.Hour, want: (10.0 + 2*59) / 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 複数回参照しても同じ値を返す
+			for i := 0; i < 2; i++ {
+				if got := c.Rate(tt.window); got != tt.want {
+					t.Errorf("Rate(%v) = %v, expected %v", tt.window, got, tt.want)
+				}
+			}
+		})
+	}
+
+	// 記録が無い期間が 5 分以上続いた場合は 0 となる
+	sec += 600
+	if got := c.Rates(); got != (Rates{}) {
+		t.Errorf("Rates() = %+v, expected zero", got)
+	}
+	if got := c.Value(); got != 130 {
+		t.Errorf("Value() = %v, expected 130", got)
+	}
+}
@@ -0,0 +1,193 @@
+package metrics_test
+
+import (
+	"bytes"
+	"gamma/pkg/metrics"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := metrics.NewRegistry()
+	forwards := r.NewCounterVec("gamma_forwards_total", "Forwarded messages.", "direction")
+	forwards.With("to_gateway").Inc()
+	forwards.With("to_gateway").Add(2)
+	forwards.With("to_distributed").Inc()
+	forwards.With("to_distributed").Add(-1) // 負の値は無視する
+	version := r.NewGauge("gamma_brokertable_version", "Version of the broker table.")
+	version.Set(3)
+	version.Dec()
+	r.NewGaugeFunc("gamma_queue_depth", "Queued messages.", []string{"queue"}, func(emit func(float64, ...string)) {
+		emit(5, "register")
+		emit(1, `a"b\c`)
+	})
+	latency := r.NewHistogramVec("gamma_publish_duration_seconds", "Publish latency.", []float64{0.1, 1}, "direction")
+	latency.With("to_gateway").Observe(0.05)
+	latency.With("to_gateway").Observe(0.5)
+	latency.With("to_gateway").Observe(2)
+
+	// 同じ名前で登録した場合は、登録済みのものを返す
+	r.NewCounterVec("gamma_forwards_total", "Forwarded messages.", "direction").With("to_gateway").Inc()
+
+	tests := []struct {
+		name        string
+		openMetrics bool
+		want        string
+	}{
+		{
+			name:        "Normal scenario 01 (text format)",
+			openMetrics: false,
+			want: `# HELP gamma_brokertable_version Version of the broker table.
+# TYPE gamma_brokertable_version gauge
+gamma_brokertable_version 2
+# HELP gamma_forwards_total Forwarded messages.
+# TYPE gamma_forwards_total counter
+gamma_forwards_total{direction="to_distributed"} 1
+gamma_forwards_total{direction="to_gateway"} 4
+# HELP gamma_publish_duration_seconds Publish latency.
+# TYPE gamma_publish_duration_seconds histogram
+gamma_publish_duration_seconds_bucket{direction="to_gateway",le="0.1"} 1
+gamma_publish_duration_seconds_bucket{direction="to_gateway",le="1"} 2
+gamma_publish_duration_seconds_bucket{direction="to_gateway",le="+Inf"} 3
+gamma_publish_duration_seconds_sum{direction="to_gateway"} 2.55
+gamma_publish_duration_seconds_count{direction="to_gateway"} 3
+# HELP gamma_queue_depth Queued messages.
+# TYPE gamma_queue_depth gauge
+gamma_queue_depth{queue="a\"b\\c"} 1
+gamma_queue_depth{queue="register"} 5
+`,
+		},
+		{
+			name:        "Normal scenario 02 (OpenMetrics)",
+			openMetrics: true,
+			want: `# HELP gamma_brokertable_version Version of the broker table.
+# TYPE gamma_brokertable_version gauge
+gamma_brokertable_version 2
+# HELP gamma_forwards Forwarded messages.
+# TYPE gamma_forwards counter
+gamma_forwards_total{direction="to_distributed"} 1
+gamma_forwards_total{direction="to_gateway"} 4
+# HELP gamma_publish_duration_seconds Publish latency.
+# TYPE gamma_publish_duration_seconds histogram
+gamma_publish_duration_seconds_bucket{direction="to_gateway",le="0.1"} 1
+gamma_publish_duration_seconds_bucket{direction="to_gateway",le="1"} 2
+gamma_publish_duration_seconds_bucket{direction="to_gateway",le="+Inf"} 3
+gamma_publish_duration_seconds_sum{direction="to_gateway"} 2.55
+gamma_publish_duration_seconds_count{direction="to_gateway"} 3
+# HELP gamma_queue_depth Queued messages.
+# TYPE gamma_queue_depth gauge
+gamma_queue_depth{queue="a\"b\\c"} 1
+gamma_queue_depth{queue="register"} 5
+# EOF
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := r.WriteText(&buf, tt.openMetrics); err != nil {
+				t.Fatalf("WriteText() error = %v", err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("WriteText() =\n%v\nexpected\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := metrics.NewRegistry()
+	r.NewCounter("gamma_requests_total", "Requests.").Inc()
+
+	tests := []struct {
+		name            string
+		accept          string
+		wantContentType string
+		wantEOF         bool
+	}{
+		{
+			name:            "Normal scenario 01 (text format)",
+			accept:          "",
+			wantContentType: "text/plain; version=0.0.4; charset=utf-8",
+			wantEOF:         false,
+		},
+		{
+			name:            "Normal scenario 02 (OpenMetrics)",
+			accept:          "application/openmetrics-text; version=1.0.0,text/plain;q=0.5",
+			wantContentType: "application/openmetrics-text; version=1.0.0; charset=utf-8",
+			wantEOF:         true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			r.Handler().ServeHTTP(rec, req)
+			if got := rec.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %v, expected %v", got, tt.wantContentType)
+			}
+			body := rec.Body.String()
+			if !strings.Contains(body, "gamma_requests_total 1\n") {
+				t.Errorf("body = %v, expected to contain the counter", body)
+			}
+			if got := strings.HasSuffix(body, "# EOF\n"); got != tt.wantEOF {
+				t.Errorf("body ends with # EOF = %v, expected %v", got, tt.wantEOF)
+			}
+		})
+	}
+}
+
+// 複数の goroutine から同時に更新・参照しても、値が失われない
+func TestConcurrentUpdate(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := r.NewCounterVec("gamma_concurrent_total", "", "worker")
+	h := r.NewHistogram("gamma_concurrent_seconds", "", nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.With("0").Inc()
+				h.Observe(0.001)
+				if j%100 == 0 {
+					r.WriteText(&bytes.Buffer{}, false)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got := c.With("0").Value(); got != 8000 {
+		t.Errorf("Value() = %v, expected 8000", got)
+	}
+}
+
+// Metrics は Registry のカウンタを参照し、参照しても値がリセットされない
+func TestMetrics(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := r.NewCounterVec("gamma_api_requests_total", "", "api").With("register")
+	m := metrics.NewMetricsFor("API_register_message", c)
+	for i := 0; i < 3; i++ {
+		m.Countup()
+	}
+	for i := 0; i < 2; i++ {
+		if got := m.Count(); got != 3 {
+			t.Errorf("Count() = %v, expected 3", got)
+		}
+	}
+	if got := c.Value(); got != 3 {
+		t.Errorf("Value() = %v, expected 3", got)
+	}
+	if got := m.Name(); got != "API_register_message" {
+		t.Errorf("Name() = %v, expected API_register_message", got)
+	}
+	if got := metrics.NewMetrics("standalone").Count(); got != 0 {
+		t.Errorf("Count() = %v, expected 0", got)
+	}
+}
@@ -0,0 +1,700 @@
+package mqttv5
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"gamma/pkg/endpoint"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+//////////////        以下、Properties 関連              //////////////
+
+// UserProperty 構造体は、MQTT v5 のユーザプロパティ（キーと値の組）を表す
+type UserProperty struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Properties 構造体は、転送時に引き継ぐ MQTT v5 の PUBLISH プロパティを表す
+// NOTE: Topic Alias, Subscription Identifier は接続ごとの値のため引き継がない
+type Properties struct {
+	User            []UserProperty
+	MessageExpiry   *uint32 // メッセージの有効期限（秒）。nil の場合は無期限
+	ContentType     string
+	ResponseTopic   string
+	CorrelationData []byte
+}
+
+// IsZero 関数は、プロパティが一つも設定されていないかどうかを返す
+func (p Properties) IsZero() bool {
+	return len(p.User) == 0 && p.MessageExpiry == nil && p.ContentType == "" && p.ResponseTopic == "" && len(p.CorrelationData) == 0
+}
+
+// Get 関数は、key のユーザプロパティのうち最初のものの値を返す（存在しない場合は空文字列）
+func (p Properties) Get(key string) string {
+	for _, u := range p.User {
+		if u.Key == key {
+			return u.Value
+		}
+	}
+	return ""
+}
+
+func (p Properties) publishProperties() *paho.PublishProperties {
+	if p.IsZero() {
+		return nil
+	}
+	pp := &paho.PublishProperties{
+		MessageExpiry:   p.MessageExpiry,
+		ContentType:     p.ContentType,
+		ResponseTopic:   p.ResponseTopic,
+		CorrelationData: p.CorrelationData,
+	}
+	for _, u := range p.User {
+		pp.User.Add(u.Key, u.Value)
+	}
+	return pp
+}
+
+func propertiesFrom(pp *paho.PublishProperties) Properties {
+	if pp == nil {
+		return Properties{}
+	}
+	p := Properties{
+		MessageExpiry:   pp.MessageExpiry,
+		ContentType:     pp.ContentType,
+		ResponseTopic:   pp.ResponseTopic,
+		CorrelationData: pp.CorrelationData,
+	}
+	for _, u := range pp.User {
+		p.User = append(p.User, UserProperty{Key: u.Key, Value: u.Value})
+	}
+	return p
+}
+
+// PropertiesMessage インタフェースは、MQTT v5 のプロパティを持つメッセージ
+type PropertiesMessage interface {
+	mqtt.Message
+	Properties() Properties
+}
+
+// PropertiesOf 関数は、m の MQTT v5 のプロパティを返す（MQTT 3.1.1 で受信したメッセージの場合は空）
+func PropertiesOf(m mqtt.Message) Properties {
+	if pm, ok := m.(PropertiesMessage); ok {
+		return pm.Properties()
+	}
+	return Properties{}
+}
+
+// Publication 構造体は、MQTT v5 のプロパティ付きで Publish するペイロード
+// mqtt.Client.Publish の payload に指定する
+type Publication struct {
+	Payload    []byte
+	Properties Properties
+}
+
+// NewPublication 関数は、m をプロパティごと転送するための payload を返す
+// m がプロパティを持たない場合は、従来どおり []byte を返す
+func NewPublication(m mqtt.Message) interface{} {
+	if p := PropertiesOf(m); !p.IsZero() {
+		return Publication{Payload: m.Payload(), Properties: p}
+	}
+	return m.Payload()
+}
+
+// PayloadFor 関数は、c で Publish できる payload を返す
+// NOTE: c が MQTT 3.1.1 のクライアントの場合は、プロパティを捨ててペイロードのみにする
+func PayloadFor(c mqtt.Client, payload interface{}) interface{} {
+	if _, ok := c.(*Client); ok {
+		return payload
+	}
+	switch p := payload.(type) {
+	case Publication:
+		return p.Payload
+	case *Publication:
+		return p.Payload
+	}
+	return payload
+}
+
+//////////////        以上、Properties 関連              //////////////
+//////////////        以下、Message 関連                 //////////////
+
+// Message 構造体は、MQTT v5 で受信したメッセージ（mqtt.Message を満たす）
+type Message struct {
+	p *paho.Publish
+}
+
+// NewMessage 関数は、プロパティ付きのメッセージを生成する
+func NewMessage(topic string, qos byte, payload []byte, props Properties) *Message {
+	return &Message{p: &paho.Publish{Topic: topic, QoS: qos, Payload: payload, Properties: props.publishProperties()}}
+}
+
+// Duplicate 関数は、常に false を返す（paho.golang は DUP フラグを公開していないため）
+func (m *Message) Duplicate() bool { return false }
+
+func (m *Message) Qos() byte { return m.p.QoS }
+
+func (m *Message) Retained() bool { return m.p.Retain }
+
+func (m *Message) Topic() string { return m.p.Topic }
+
+func (m *Message) MessageID() uint16 { return m.p.PacketID }
+
+func (m *Message) Payload() []byte { return m.p.Payload }
+
+// Ack 関数は、何もしない（受信時に paho.golang が自動で応答する）
+func (m *Message) Ack() {}
+
+func (m *Message) Properties() Properties { return propertiesFrom(m.p.Properties) }
+
+//////////////        以上、Message 関連                 //////////////
+//////////////        以下、Client 関連                  //////////////
+
+// NewClientFor 関数は、e のプロトコルバージョンに応じた MQTT クライアントを生成する
+// MQTT v5 の場合は Client 構造体を、それ以外の場合は paho.mqtt.golang のクライアントを返す
+func NewClientFor(e endpoint.Endpoint, opts *mqtt.ClientOptions) mqtt.Client {
+	if e.IsV5() {
+		return NewClient(opts)
+	}
+	return mqtt.NewClient(opts)
+}
+
+// initialReconnectInterval は、接続が切れてから最初に再接続を試みるまでの間隔（以降は MaxReconnectInterval まで倍にする）
+const initialReconnectInterval = time.Second
+
+// Client 構造体は、paho.golang を用いて MQTT v5 で接続する mqtt.Client
+// 接続先・認証情報・TLS・WebSocket の設定は mqtt.ClientOptions から引き継ぐ
+// AutoReconnect が有効な場合は、接続が切れると Disconnect が呼ばれるまで再接続を試み、再接続後に Subscribe 中だったトピックを全て Subscribe し直す
+// NOTE: 再接続中は IsConnectionOpen が false になり、レプリカのフェイルオーバーの対象となる
+type Client struct {
+	opts   mqtt.ClientOptions
+	reader mqtt.ClientOptionsReader
+	router *paho.StandardRouter
+
+	mu            sync.RWMutex
+	c             *paho.Client
+	connected     bool
+	reconnecting  bool
+	stop          chan struct{}                  // Disconnect で閉じる（再接続を止める）
+	handlers      map[string]paho.MessageHandler // Subscribe 中のトピックのメッセージハンドラ
+	subscriptions map[string]byte                // Subscribe 中のトピックと QoS（再接続時に Subscribe し直す）
+}
+
+// NewClient 関数は、MQTT v5 のクライアントを生成する（接続は Connect で行う）
+func NewClient(opts *mqtt.ClientOptions) *Client {
+	return &Client{
+		opts: *opts,
+		// NOTE: mqtt.ClientOptionsReader は paho.mqtt.golang のクライアントからしか生成できない（接続はしない）
+		reader:        mqtt.NewClient(opts).OptionsReader(),
+		router:        paho.NewStandardRouter(),
+		handlers:      map[string]paho.MessageHandler{},
+		subscriptions: map[string]byte{},
+	}
+}
+
+func (c *Client) getClient() (*paho.Client, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.connected {
+		return nil, NotConnectedError{Msg: "MQTT v5 client is not connected"}
+	}
+	return c.c, nil
+}
+
+// IsConnected 関数は、接続中または再接続中かどうかを返す（paho.mqtt.golang と同じ）
+func (c *Client) IsConnected() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.connected || c.reconnecting
+}
+
+// IsConnectionOpen 関数は、接続中かどうかを返す（再接続中は false）
+func (c *Client) IsConnectionOpen() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.connected
+}
+
+func (c *Client) OptionsReader() mqtt.ClientOptionsReader {
+	return c.reader
+}
+
+func (c *Client) Connect() mqtt.Token {
+	t := newToken()
+	c.mu.Lock()
+	if c.stop == nil {
+		c.stop = make(chan struct{})
+	}
+	c.mu.Unlock()
+	go func() {
+		err := c.connect()
+		if err == nil && c.opts.OnConnect != nil {
+			go c.opts.OnConnect(c)
+		}
+		t.complete(err)
+	}()
+	return t
+}
+
+func (c *Client) connect() error {
+	if len(c.opts.Servers) == 0 {
+		return ConnectError{Msg: "No broker is specified"}
+	}
+	u := c.opts.Servers[0]
+	conn, err := dial(u, &c.opts)
+	if err != nil {
+		return ConnectError{Msg: fmt.Sprintf("Could not connect to %v: %v", u, err)}
+	}
+
+	pc := paho.NewClient(paho.ClientConfig{
+		ClientID:      c.opts.ClientID,
+		Conn:          packets.NewThreadSafeConn(conn),
+		Router:        c.router,
+		OnClientError: c.connectionLost,
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			c.connectionLost(fmt.Errorf("disconnected by server (reason code = %#02x)", d.ReasonCode))
+		},
+	})
+	cp := &paho.Connect{
+		ClientID:     c.opts.ClientID,
+		KeepAlive:    uint16(c.opts.KeepAlive),
+		CleanStart:   c.opts.CleanSession,
+		Username:     c.opts.Username,
+		UsernameFlag: c.opts.Username != "",
+		Password:     []byte(c.opts.Password),
+		PasswordFlag: c.opts.Password != "",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.ConnectTimeout)
+	defer cancel()
+	ca, err := pc.Connect(ctx, cp)
+	if err != nil {
+		conn.Close()
+		if ca != nil {
+			reason := ""
+			if ca.Properties != nil {
+				reason = ca.Properties.ReasonString
+			}
+			return ConnectError{Msg: fmt.Sprintf("Connection to %v was refused (reason code = %#02x, reason = %v)", u, ca.ReasonCode, reason)}
+		}
+		return ConnectError{Msg: fmt.Sprintf("Could not connect to %v: %v", u, err)}
+	}
+
+	c.mu.Lock()
+	c.c = pc
+	c.connected = true
+	c.mu.Unlock()
+	return nil
+}
+
+// connectionLost 関数は、接続が切れた際に呼ばれる
+// AutoReconnect が無効な場合は、Subscribe 中のトピックのメッセージを受信できなくなるため、エラーログを出力する
+func (c *Client) connectionLost(err error) {
+	c.mu.Lock()
+	wasConnected := c.connected
+	c.connected = false
+	stop := c.stop
+	c.reconnecting = wasConnected && c.opts.AutoReconnect && stop != nil
+	reconnecting := c.reconnecting
+	c.mu.Unlock()
+	if !wasConnected {
+		return
+	}
+	if c.opts.OnConnectionLost != nil {
+		go c.opts.OnConnectionLost(c, err)
+	}
+	if !reconnecting {
+		log.WithFields(log.Fields{"broker": fmt.Sprint(c.opts.Servers), "error": err}).Error("MQTT v5 connection lost (auto reconnect is disabled)")
+		return
+	}
+	log.WithFields(log.Fields{"broker": fmt.Sprint(c.opts.Servers), "error": err}).Warn("MQTT v5 connection lost, reconnecting")
+	go c.reconnect(stop)
+}
+
+// reconnect 関数は、stop が閉じられる（Disconnect が呼ばれる）まで、間隔を倍にしながら（最大 MaxReconnectInterval）再接続を試みる
+// 再接続後は、Subscribe 中だったトピックを全て Subscribe し直してから OnConnect を呼ぶ
+func (c *Client) reconnect(stop chan struct{}) {
+	interval := initialReconnectInterval
+	if c.opts.MaxReconnectInterval > 0 && interval > c.opts.MaxReconnectInterval {
+		interval = c.opts.MaxReconnectInterval
+	}
+	for {
+		timer := time.NewTimer(interval)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if c.opts.OnReconnecting != nil {
+			c.opts.OnReconnecting(c, &c.opts)
+		}
+		err := c.connect()
+		if err == nil {
+			break
+		}
+		log.WithFields(log.Fields{"broker": fmt.Sprint(c.opts.Servers), "interval": interval, "error": err}).Warn("MQTT v5 reconnect error")
+		if interval *= 2; c.opts.MaxReconnectInterval > 0 && interval > c.opts.MaxReconnectInterval {
+			interval = c.opts.MaxReconnectInterval
+		}
+	}
+
+	c.mu.Lock()
+	c.reconnecting = false
+	select {
+	case <-stop:
+		// 再接続中に Disconnect された
+		pc := c.c
+		c.connected = false
+		c.mu.Unlock()
+		pc.Disconnect(&paho.Disconnect{ReasonCode: 0})
+		return
+	default:
+	}
+	c.mu.Unlock()
+	log.WithFields(log.Fields{"broker": fmt.Sprint(c.opts.Servers)}).Info("MQTT v5 reconnected")
+
+	if err := c.resubscribe(); err != nil {
+		log.WithFields(log.Fields{"broker": fmt.Sprint(c.opts.Servers), "error": err}).Error("MQTT v5 resubscribe error")
+	}
+	if c.opts.OnConnect != nil {
+		go c.opts.OnConnect(c)
+	}
+}
+
+// resubscribe 関数は、再接続後に Subscribe 中だったトピックを全て Subscribe し直す
+// NOTE: メッセージハンドラは router に登録されたままのため、SUBSCRIBE のみを送信する
+func (c *Client) resubscribe() error {
+	c.mu.RLock()
+	s := &paho.Subscribe{Subscriptions: map[string]paho.SubscribeOptions{}}
+	topics := make([]string, 0, len(c.subscriptions))
+	for topic, qos := range c.subscriptions {
+		s.Subscriptions[topic] = paho.SubscribeOptions{QoS: qos}
+		topics = append(topics, topic)
+	}
+	c.mu.RUnlock()
+	if len(topics) == 0 {
+		return nil
+	}
+
+	pc, err := c.getClient()
+	if err != nil {
+		return err
+	}
+	sa, err := pc.Subscribe(context.Background(), s)
+	if err != nil && sa != nil {
+		return subscribeError(topics, sa)
+	}
+	return err
+}
+
+// ForgetSubscriptions 関数は、再接続時に Subscribe し直すトピックを全て削除する
+// 接続が切れている間に、Subscribe 中のトピックを他のクライアントへ移した（レプリカへフェイルオーバーした）場合に使用する
+// （再接続後に両方のクライアントがメッセージを受信しないようにするため）
+func (c *Client) ForgetSubscriptions() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for topic := range c.subscriptions {
+		delete(c.handlers, topic)
+		c.router.UnregisterHandler(topic)
+	}
+	c.subscriptions = map[string]byte{}
+}
+
+// dial 関数は、URL スキーム（tcp, ssl, ws, wss）に応じて接続する
+func dial(u *url.URL, opts *mqtt.ClientOptions) (net.Conn, error) {
+	switch u.Scheme {
+	case endpoint.SchemeTCP:
+		return net.DialTimeout("tcp", u.Host, opts.ConnectTimeout)
+	case endpoint.SchemeSSL:
+		return tls.DialWithDialer(&net.Dialer{Timeout: opts.ConnectTimeout}, "tcp", u.Host, opts.TLSConfig)
+	case endpoint.SchemeWS:
+		return mqtt.NewWebsocket(u.String(), nil, opts.ConnectTimeout, opts.HTTPHeaders, opts.WebsocketOptions)
+	case endpoint.SchemeWSS:
+		return mqtt.NewWebsocket(u.String(), opts.TLSConfig, opts.ConnectTimeout, opts.HTTPHeaders, opts.WebsocketOptions)
+	}
+	return nil, endpoint.SchemeError{Msg: fmt.Sprintf("Invalid scheme (%v).", u.Scheme)}
+}
+
+// Disconnect 関数は、DISCONNECT を送信して切断する
+// NOTE: paho.golang は送信中のメッセージを待たないため、quiesce は使用しない
+func (c *Client) Disconnect(quiesce uint) {
+	c.mu.Lock()
+	pc := c.c
+	connected := c.connected
+	c.connected = false
+	c.reconnecting = false
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+	c.mu.Unlock()
+	if !connected {
+		return
+	}
+	if err := pc.Disconnect(&paho.Disconnect{ReasonCode: 0}); err != nil {
+		log.WithFields(log.Fields{"broker": fmt.Sprint(c.opts.Servers), "error": err}).Debug("MQTT v5 disconnect error")
+	}
+}
+
+func (c *Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	t := newToken()
+	p := &paho.Publish{Topic: topic, QoS: qos, Retain: retained}
+	switch v := payload.(type) {
+	case string:
+		p.Payload = []byte(v)
+	case []byte:
+		p.Payload = v
+	case bytes.Buffer:
+		p.Payload = v.Bytes()
+	case *bytes.Buffer:
+		p.Payload = v.Bytes()
+	case Publication:
+		p.Payload = v.Payload
+		p.Properties = v.Properties.publishProperties()
+	case *Publication:
+		p.Payload = v.Payload
+		p.Properties = v.Properties.publishProperties()
+	default:
+		t.complete(fmt.Errorf("unknown payload type (%T)", payload))
+		return t
+	}
+	pc, err := c.getClient()
+	if err != nil {
+		t.complete(err)
+		return t
+	}
+	go func() {
+		_, err := pc.Publish(context.Background(), p)
+		t.complete(err)
+	}()
+	return t
+}
+
+func (c *Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+// SubscribeMultiple 関数は、filters のトピックを Subscribe する
+// SUBACK の理由コードが失敗（0x80 以上）の場合は、SubscribeError を返す
+func (c *Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	t := newToken()
+	pc, err := c.getClient()
+	if err != nil {
+		t.complete(err)
+		return t
+	}
+
+	s := &paho.Subscribe{Subscriptions: map[string]paho.SubscribeOptions{}}
+	topics := make([]string, 0, len(filters))
+	for topic, qos := range filters {
+		s.Subscriptions[topic] = paho.SubscribeOptions{QoS: qos}
+		topics = append(topics, topic)
+	}
+	go func() {
+		// NOTE: SUBACK より先に PUBLISH が届く場合があるため、メッセージハンドラは先に登録する
+		previous := c.setHandlers(topics, c.handlerFor(callback))
+		sa, err := pc.Subscribe(context.Background(), s)
+		if err != nil {
+			c.restoreHandlers(previous)
+			// NOTE: paho.golang は SUBACK を受信した場合、理由コードによらず sa を返す
+			// SUBSCRIBE 時のトピックの順序は保証されないため、失敗した理由コードのみを返す
+			if sa != nil {
+				err = subscribeError(topics, sa)
+			}
+		} else {
+			c.mu.Lock()
+			for topic, qos := range filters {
+				c.subscriptions[topic] = qos
+			}
+			c.mu.Unlock()
+		}
+		t.complete(err)
+	}()
+	return t
+}
+
+// subscribeError 関数は、SUBACK の理由コードから SubscribeError を生成する
+func subscribeError(topics []string, sa *paho.Suback) error {
+	reason := ""
+	if sa.Properties != nil {
+		reason = sa.Properties.ReasonString
+	}
+	topic := fmt.Sprint(topics)
+	if len(topics) == 1 {
+		topic = topics[0]
+	}
+	for _, code := range sa.Reasons {
+		if code < 0x80 {
+			continue
+		}
+		return SubscribeError{
+			Msg:        fmt.Sprintf("Subscribe to %v was rejected (reason code = %#02x, reason = %v)", topic, code, reason),
+			ReasonCode: code,
+			Reason:     reason,
+		}
+	}
+	return SubscribeError{Msg: fmt.Sprintf("Subscribe to %v failed (reason = %v)", topic, reason), Reason: reason}
+}
+
+func (c *Client) handlerFor(callback mqtt.MessageHandler) paho.MessageHandler {
+	if callback == nil {
+		callback = c.opts.DefaultPublishHandler
+	}
+	return func(p *paho.Publish) {
+		if callback != nil {
+			callback(c, &Message{p: p})
+		}
+	}
+}
+
+// setHandlers 関数は、topics のメッセージハンドラを h に差し替え、差し替える前のメッセージハンドラを返す
+func (c *Client) setHandlers(topics []string, h paho.MessageHandler) map[string]paho.MessageHandler {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	previous := map[string]paho.MessageHandler{}
+	for _, topic := range topics {
+		previous[topic] = c.handlers[topic]
+		c.handlers[topic] = h
+		// NOTE: StandardRouter は同じトピックに複数のメッセージハンドラを登録できるため、先に削除する
+		c.router.UnregisterHandler(topic)
+		c.router.RegisterHandler(topic, h)
+	}
+	return previous
+}
+
+// restoreHandlers 関数は、Subscribe に失敗したトピックのメッセージハンドラを元に戻す
+func (c *Client) restoreHandlers(previous map[string]paho.MessageHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for topic, h := range previous {
+		c.router.UnregisterHandler(topic)
+		if h == nil {
+			delete(c.handlers, topic)
+			continue
+		}
+		c.handlers[topic] = h
+		c.router.RegisterHandler(topic, h)
+	}
+}
+
+func (c *Client) Unsubscribe(topics ...string) mqtt.Token {
+	t := newToken()
+	pc, err := c.getClient()
+	if err != nil {
+		t.complete(err)
+		return t
+	}
+	go func() {
+		_, err := pc.Unsubscribe(context.Background(), &paho.Unsubscribe{Topics: topics})
+		if err == nil {
+			c.mu.Lock()
+			for _, topic := range topics {
+				delete(c.handlers, topic)
+				delete(c.subscriptions, topic)
+				c.router.UnregisterHandler(topic)
+			}
+			c.mu.Unlock()
+		}
+		t.complete(err)
+	}()
+	return t
+}
+
+// AddRoute 関数は、Subscribe せずにメッセージハンドラのみを登録する
+func (c *Client) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.setHandlers([]string{topic}, c.handlerFor(callback))
+}
+
+// token 構造体は、Client の非同期処理の完了を表す mqtt.Token
+type token struct {
+	done chan struct{}
+	err  error
+}
+
+func newToken() *token {
+	return &token{done: make(chan struct{})}
+}
+
+func (t *token) complete(err error) {
+	t.err = err
+	close(t.done)
+}
+
+func (t *token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *token) WaitTimeout(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (t *token) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+//////////////        以上、Client 関連                  //////////////
+//////////////        以下、エラー 関連                  //////////////
+
+// ConnectError 構造体
+// MQTT v5 での接続に失敗した場合に返される
+type ConnectError struct {
+	Msg string
+}
+
+func (e ConnectError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+// NotConnectedError 構造体
+// 接続していない状態で Publish, Subscribe, Unsubscribe した場合に返される
+type NotConnectedError struct {
+	Msg string
+}
+
+func (e NotConnectedError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+// SubscribeError 構造体
+// SUBACK の理由コードが失敗（0x80 以上）の場合に返される
+// 例: 0x87 (Not authorized), 0x8F (Topic Filter invalid), 0x97 (Quota exceeded), 0x9E (Shared Subscriptions not supported)
+type SubscribeError struct {
+	Msg        string
+	ReasonCode byte
+	Reason     string // サーバから返された Reason String（ない場合は空）
+}
+
+func (e SubscribeError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+//////////////        以上、エラー 関連                  //////////////
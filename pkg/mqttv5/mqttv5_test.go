@@ -0,0 +1,329 @@
+package mqttv5_test
+
+import (
+	"errors"
+	"gamma/pkg/credential"
+	"gamma/pkg/endpoint"
+	"gamma/pkg/mqttv5"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// newV5Broker 関数は、MQTT v5 のブローカの代わりとなるサーバを起動する
+// 受信した PUBLISH をプロパティごと送信元へ折り返す。denied のトピックの SUBSCRIBE には理由コード 0x87 (Not authorized) を返す
+func newV5Broker(t *testing.T, denied string) (endpoint.Endpoint, net.Listener) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			p, err := packets.ReadPacket(conn)
+			if err != nil {
+				return
+			}
+			switch c := p.Content.(type) {
+			case *packets.Connect:
+				packets.NewControlPacket(packets.CONNACK).WriteTo(conn)
+			case *packets.Subscribe:
+				sa := packets.NewControlPacket(packets.SUBACK)
+				suback := sa.Content.(*packets.Suback)
+				suback.PacketID = c.PacketID
+				for topic, opts := range c.Subscriptions {
+					if topic == denied {
+						suback.Reasons = append(suback.Reasons, 0x87)
+						suback.Properties.ReasonString = "not authorized"
+					} else {
+						suback.Reasons = append(suback.Reasons, opts.QoS)
+					}
+				}
+				sa.WriteTo(conn)
+			case *packets.Publish:
+				c.PacketID = 0
+				c.QoS = 0
+				c.WriteTo(conn)
+			case *packets.Disconnect:
+				return
+			}
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	n, _ := strconv.Atoi(port)
+	return endpoint.Endpoint{Host: "127.0.0.1", Port: uint16(n), ProtocolVersion: endpoint.ProtocolVersion5}, l
+}
+
+func connectV5(t *testing.T, e endpoint.Endpoint) mqtt.Client {
+	t.Helper()
+	opts, err := credential.NewClientOptions(e, credential.Credential{})
+	if err != nil {
+		t.Fatalf("NewClientOptions() error = %v", err)
+	}
+	c := mqttv5.NewClientFor(e, opts)
+	if _, ok := c.(*mqttv5.Client); !ok {
+		t.Fatalf("NewClientFor() = %T, expected *mqttv5.Client", c)
+	}
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("Connect() error = %v", token.Error())
+	}
+	return c
+}
+
+// ユーザプロパティと Message Expiry が Publish から受信まで引き継がれる
+func TestPublishProperties(t *testing.T) {
+	e, l := newV5Broker(t, "")
+	defer l.Close()
+	c := connectV5(t, e)
+	defer c.Disconnect(0)
+
+	ch := make(chan mqtt.Message, 1)
+	if token := c.Subscribe("/0/1/#", 0, func(_ mqtt.Client, m mqtt.Message) { ch <- m }); token.Wait() && token.Error() != nil {
+		t.Fatalf("Subscribe() error = %v", token.Error())
+	}
+
+	expiry := uint32(30)
+	want := mqttv5.Properties{
+		User:          []mqttv5.UserProperty{{Key: "device", Value: "sensor-01"}, {Key: "unit", Value: "celsius"}},
+		MessageExpiry: &expiry,
+	}
+	if token := c.Publish("/0/1/2", 0, false, mqttv5.Publication{Payload: []byte("23.5"), Properties: want}); token.Wait() && token.Error() != nil {
+		t.Fatalf("Publish() error = %v", token.Error())
+	}
+
+	select {
+	case m := <-ch:
+		if string(m.Payload()) != "23.5" {
+			t.Errorf("Payload() = %v, expected %v", string(m.Payload()), "23.5")
+		}
+		got := mqttv5.PropertiesOf(m)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("PropertiesOf() = %+v, expected %+v", got, want)
+		}
+		pub, ok := mqttv5.NewPublication(m).(mqttv5.Publication)
+		if !ok || !reflect.DeepEqual(pub.Properties, want) {
+			t.Errorf("NewPublication() = %+v, expected properties %+v", pub, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not received")
+	}
+}
+
+func TestSubscribeReasonCode(t *testing.T) {
+	e, l := newV5Broker(t, "/denied")
+	defer l.Close()
+	c := connectV5(t, e)
+	defer c.Disconnect(0)
+
+	tests := []struct {
+		name     string
+		topic    string
+		wantCode byte
+		wantErr  bool
+	}{
+		{
+			name:  "Normal scenario 01",
+			topic: "/0/1",
+		},
+		{
+			name:     "Error scenario 01 (not authorized)",
+			topic:    "/denied",
+			wantCode: 0x87,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := c.Subscribe(tt.topic, 0, nil)
+			token.Wait()
+			err := token.Error()
+			if !tt.wantErr {
+				if err != nil {
+					t.Errorf("Subscribe() error = %v, expected nil", err)
+				}
+				return
+			}
+			var se mqttv5.SubscribeError
+			if !errors.As(err, &se) {
+				t.Fatalf("Subscribe() error = %v (Type: %T), expected Type: %T", err, err, mqttv5.SubscribeError{})
+			}
+			if se.ReasonCode != tt.wantCode || se.Reason != "not authorized" {
+				t.Errorf("Subscribe() reason code = %#02x (%v), expected %#02x", se.ReasonCode, se.Reason, tt.wantCode)
+			}
+		})
+	}
+}
+
+// MQTT 3.1.1 のクライアントへはプロパティを捨ててペイロードのみを渡す
+func TestPayloadFor(t *testing.T) {
+	e := endpoint.Endpoint{Host: "127.0.0.1", Port: 1883}
+	opts, err := credential.NewClientOptions(e, credential.Credential{})
+	if err != nil {
+		t.Fatalf("NewClientOptions() error = %v", err)
+	}
+	v3 := mqttv5.NewClientFor(e, opts)
+	e.ProtocolVersion = endpoint.ProtocolVersion5
+	v5 := mqttv5.NewClientFor(e, opts)
+
+	pub := mqttv5.Publication{Payload: []byte("payload"), Properties: mqttv5.Properties{ContentType: "text/plain"}}
+	tests := []struct {
+		name    string
+		c       mqtt.Client
+		payload interface{}
+		want    interface{}
+	}{
+		{
+			name:    "Normal scenario 01 (v3 client)",
+			c:       v3,
+			payload: pub,
+			want:    []byte("payload"),
+		},
+		{
+			name:    "Normal scenario 02 (v5 client)",
+			c:       v5,
+			payload: pub,
+			want:    pub,
+		},
+		{
+			name:    "Normal scenario 03 (without properties)",
+			c:       v3,
+			payload: mqttv5.NewPublication(mqttv5.NewMessage("/0/1", 0, []byte("payload"), mqttv5.Properties{})),
+			want:    []byte("payload"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mqttv5.PayloadFor(tt.c, tt.payload); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("PayloadFor() = %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newDroppingV5Broker 関数は、接続を受け付けるたびに CONNACK を返し、受信した SUBSCRIBE のトピックを subscribed へ送るサーバを起動する
+// drop へ送ると、その時点の接続を切断する
+func newDroppingV5Broker(t *testing.T) (endpoint.Endpoint, net.Listener, <-chan string, chan<- struct{}) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	subscribed := make(chan string, 10)
+	drop := make(chan struct{})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				<-drop
+				conn.Close()
+			}()
+			for {
+				p, err := packets.ReadPacket(conn)
+				if err != nil {
+					break
+				}
+				switch c := p.Content.(type) {
+				case *packets.Connect:
+					packets.NewControlPacket(packets.CONNACK).WriteTo(conn)
+				case *packets.Subscribe:
+					sa := packets.NewControlPacket(packets.SUBACK)
+					suback := sa.Content.(*packets.Suback)
+					suback.PacketID = c.PacketID
+					for topic, opts := range c.Subscriptions {
+						suback.Reasons = append(suback.Reasons, opts.QoS)
+						subscribed <- topic
+					}
+					sa.WriteTo(conn)
+				}
+			}
+			conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	n, _ := strconv.Atoi(port)
+	return endpoint.Endpoint{Host: "127.0.0.1", Port: uint16(n), ProtocolVersion: endpoint.ProtocolVersion5}, l, subscribed, drop
+}
+
+// 接続が切れた場合は、AutoReconnect が有効なら再接続して Subscribe 中だったトピックを Subscribe し直す
+func TestReconnect(t *testing.T) {
+	tests := []struct {
+		name          string
+		autoReconnect bool
+		forget        bool // 切断中に ForgetSubscriptions を呼ぶ（レプリカへのフェイルオーバー）
+	}{
+		{name: "Normal scenario 01 (auto reconnect)", autoReconnect: true},
+		{name: "Normal scenario 02 (auto reconnect is disabled)", autoReconnect: false},
+		{name: "Normal scenario 03 (forget subscriptions)", autoReconnect: true, forget: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, l, subscribed, drop := newDroppingV5Broker(t)
+			defer l.Close()
+			opts, err := credential.NewClientOptions(e, credential.Credential{})
+			if err != nil {
+				t.Fatalf("NewClientOptions() error = %v", err)
+			}
+			opts.SetAutoReconnect(tt.autoReconnect)
+			opts.SetMaxReconnectInterval(10 * time.Millisecond)
+			if tt.forget {
+				// 再接続より先に ForgetSubscriptions を呼ぶ
+				opts.SetMaxReconnectInterval(200 * time.Millisecond)
+				opts.SetConnectionLostHandler(func(c mqtt.Client, _ error) { c.(*mqttv5.Client).ForgetSubscriptions() })
+			}
+			connected := make(chan struct{}, 2)
+			opts.SetOnConnectHandler(func(mqtt.Client) { connected <- struct{}{} })
+			c := mqttv5.NewClientFor(e, opts)
+			if token := c.Connect(); token.Wait() && token.Error() != nil {
+				t.Fatalf("Connect() error = %v", token.Error())
+			}
+			defer c.Disconnect(0)
+			<-connected
+			if token := c.Subscribe("/0/1", 0, nil); token.Wait() && token.Error() != nil {
+				t.Fatalf("Subscribe() error = %v", token.Error())
+			}
+			<-subscribed
+
+			drop <- struct{}{}
+			select {
+			case topic := <-subscribed:
+				if !tt.autoReconnect || tt.forget {
+					t.Fatalf("resubscribed %v, expected not to resubscribe", topic)
+				}
+				if topic != "/0/1" {
+					t.Errorf("resubscribed %v, expected /0/1", topic)
+				}
+			case <-time.After(500 * time.Millisecond):
+				if tt.autoReconnect && !tt.forget {
+					t.Fatal("did not resubscribe after reconnect")
+				}
+			}
+			if tt.autoReconnect {
+				select {
+				case <-connected:
+				case <-time.After(time.Second):
+					t.Error("OnConnect was not called after reconnect")
+				}
+			}
+			if got := c.IsConnectionOpen(); got != tt.autoReconnect {
+				t.Errorf("IsConnectionOpen() = %v, expected %v", got, tt.autoReconnect)
+			}
+		})
+	}
+}
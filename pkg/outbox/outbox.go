@@ -0,0 +1,420 @@
+package outbox
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"gamma/pkg/mqttv5"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//////////////        以下、Policy 関連              //////////////
+
+// Policy 構造体は、分散ブローカと接続できない間に Publish するメッセージを保持する方法を表す
+type Policy struct {
+	MaxMessages      uint          // メモリ上に保持するメッセージの最大数（0 の場合は保持しない）
+	MaxAge           time.Duration // メッセージを保持する最大の時間（0 の場合は無期限）。超えたメッセージは再送せずに破棄する
+	SpillDir         string        // メモリ上に保持できないメッセージを書き出すディレクトリ（空の場合は書き出さずに破棄する）
+	MaxSpillMessages uint          // ディスクへ書き出すメッセージの最大数（0 の場合は無制限）
+}
+
+// IsEnabled 関数は、メッセージを保持するかどうかを返す
+func (p Policy) IsEnabled() bool {
+	return p.MaxMessages > 0
+}
+
+// Validate 関数は、保持する方法が正しいかどうかを検証する
+func (p Policy) Validate() error {
+	if p.MaxAge < 0 {
+		return PolicyError{Msg: fmt.Sprintf("Invalid max age (%v). Max age must not be negative.", p.MaxAge)}
+	}
+	if !p.IsEnabled() && (p.SpillDir != "" || p.MaxSpillMessages > 0) {
+		return PolicyError{Msg: "Spill settings require max messages to be greater than 0."}
+	}
+	if p.SpillDir != "" {
+		info, err := os.Stat(p.SpillDir)
+		if err != nil {
+			return PolicyError{Msg: fmt.Sprintf("Invalid spill directory (%v): %v", p.SpillDir, err)}
+		}
+		if !info.IsDir() {
+			return PolicyError{Msg: fmt.Sprintf("Invalid spill directory (%v). It is not a directory.", p.SpillDir)}
+		}
+	}
+	return nil
+}
+
+//////////////        以上、Policy 関連              //////////////
+//////////////        以下、Outbox 関連              //////////////
+
+// Stats 構造体は、保持しているメッセージに関する統計
+type Stats struct {
+	Pending  int    // 保持しているメッセージの数（ディスクへ書き出したものを含む）
+	Buffered uint64 // 保持したメッセージの数
+	Replayed uint64 // 再送したメッセージの数
+	Expired  uint64 // MaxAge（または MQTT v5 の Message Expiry）を超えたため破棄したメッセージの数
+	Dropped  uint64 // 保持できる数を超えたため破棄したメッセージの数
+}
+
+// Add 関数は、s と other を合計した統計を返す
+func (s Stats) Add(other Stats) Stats {
+	return Stats{
+		Pending:  s.Pending + other.Pending,
+		Buffered: s.Buffered + other.Buffered,
+		Replayed: s.Replayed + other.Replayed,
+		Expired:  s.Expired + other.Expired,
+		Dropped:  s.Dropped + other.Dropped,
+	}
+}
+
+// Entry 構造体は、保持しているメッセージ
+type Entry struct {
+	Topic      string            `json:"topic"`
+	Retained   bool              `json:"retained,omitempty"`
+	Payload    []byte            `json:"payload"`
+	Properties mqttv5.Properties `json:"properties"`
+	Enqueued   time.Time         `json:"enqueued"`
+}
+
+// PublishPayload 関数は、mqtt.Client.Publish の payload に指定する値を返す
+// MQTT v5 の Message Expiry は、保持していた時間だけ短くする
+func (e Entry) PublishPayload(now time.Time) interface{} {
+	if e.Properties.IsZero() {
+		return e.Payload
+	}
+	props := e.Properties
+	if props.MessageExpiry != nil {
+		remaining := uint32(0)
+		if elapsed := uint32(now.Sub(e.Enqueued) / time.Second); elapsed < *props.MessageExpiry {
+			remaining = *props.MessageExpiry - elapsed
+		}
+		props.MessageExpiry = &remaining
+	}
+	return mqttv5.Publication{Payload: e.Payload, Properties: props}
+}
+
+// expired 関数は、now の時点で e を破棄するかどうかを返す
+func (e Entry) expired(now time.Time, maxAge time.Duration) bool {
+	age := now.Sub(e.Enqueued)
+	if maxAge > 0 && age > maxAge {
+		return true
+	}
+	return e.Properties.MessageExpiry != nil && age >= time.Duration(*e.Properties.MessageExpiry)*time.Second
+}
+
+// Outbox 構造体は、1 つの分散ブローカ（レプリカセット）と接続できない間に Publish するメッセージを、Publish した順に保持する
+// メモリ上に保持できない分は SpillDir のファイルへ書き出し、メモリ上のメッセージを再送し終えた後に読み込む
+// NOTE: nil の場合は何も保持しない
+type Outbox struct {
+	mu     sync.Mutex
+	policy Policy
+	queue  []Entry
+	spill  *spillFile // nil の場合はディスクへ書き出さない
+	stats  Stats
+}
+
+// New 関数は、name の分散ブローカへ Publish するメッセージを保持する Outbox を生成する
+// policy.SpillDir が指定されている場合は、前回の実行時に書き出したメッセージも引き継ぐ
+func New(policy Policy, name string) (*Outbox, error) {
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	if !policy.IsEnabled() {
+		return nil, nil
+	}
+	o := &Outbox{policy: policy}
+	if policy.SpillDir != "" {
+		s, err := openSpillFile(filepath.Join(policy.SpillDir, spillFileName(name)))
+		if err != nil {
+			return nil, err
+		}
+		o.spill = s
+		if s.count > 0 {
+			log.WithFields(log.Fields{"name": name, "pending": s.count}).Info("Resumed spilled messages")
+		}
+	}
+	return o, nil
+}
+
+// Enqueue 関数は、payload を保持する
+// 保持できる数を超えた場合は破棄し、false を返す
+func (o *Outbox) Enqueue(topic string, retained bool, payload interface{}) bool {
+	if o == nil {
+		return false
+	}
+	e := Entry{Topic: topic, Retained: retained, Enqueued: time.Now()}
+	switch p := payload.(type) {
+	case []byte:
+		e.Payload = p
+	case string:
+		e.Payload = []byte(p)
+	case mqttv5.Publication:
+		e.Payload, e.Properties = p.Payload, p.Properties
+	case *mqttv5.Publication:
+		e.Payload, e.Properties = p.Payload, p.Properties
+	default:
+		e.Payload = []byte(fmt.Sprint(p))
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.dropExpired(e.Enqueued)
+	// ディスクへ書き出したメッセージがある間は、Publish した順に再送するため新たなメッセージもディスクへ書き出す
+	if uint(len(o.queue)) < o.policy.MaxMessages && (o.spill == nil || o.spill.count == 0) {
+		o.queue = append(o.queue, e)
+		o.stats.Buffered++
+		return true
+	}
+	if o.spill != nil && (o.policy.MaxSpillMessages == 0 || uint(o.spill.count) < o.policy.MaxSpillMessages) {
+		if err := o.spill.append(e); err != nil {
+			log.WithFields(log.Fields{"topic": topic, "error": err}).Error("Outbox spill error")
+		} else {
+			o.stats.Buffered++
+			return true
+		}
+	}
+	o.stats.Dropped++
+	return false
+}
+
+// Replay 関数は、保持しているメッセージを保持した順に publish で再送し、再送した数を返す
+// publish が false を返した場合（配送できなかった場合）は、そのメッセージ以降を保持したまま終了する
+func (o *Outbox) Replay(publish func(e Entry) bool) int {
+	if o == nil {
+		return 0
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	replayed := 0
+	for {
+		if len(o.queue) == 0 {
+			if err := o.loadSpilled(); err != nil {
+				log.WithFields(log.Fields{"error": err}).Error("Outbox load spilled messages error")
+				return replayed
+			}
+			if len(o.queue) == 0 {
+				return replayed
+			}
+		}
+		e := o.queue[0]
+		if e.expired(time.Now(), o.policy.MaxAge) {
+			o.queue = o.queue[1:]
+			o.stats.Expired++
+			continue
+		}
+		if !publish(e) {
+			return replayed
+		}
+		o.queue = o.queue[1:]
+		o.stats.Replayed++
+		replayed++
+	}
+}
+
+// Len 関数は、保持しているメッセージの数を返す（ディスクへ書き出したものを含む）
+func (o *Outbox) Len() int {
+	if o == nil {
+		return 0
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.len()
+}
+
+func (o *Outbox) len() int {
+	n := len(o.queue)
+	if o.spill != nil {
+		n += o.spill.count
+	}
+	return n
+}
+
+// Stats 関数は、保持しているメッセージに関する統計を返す
+func (o *Outbox) Stats() Stats {
+	if o == nil {
+		return Stats{}
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	stats := o.stats
+	stats.Pending = o.len()
+	return stats
+}
+
+// Close 関数は、ディスクへ書き出したファイルを閉じる
+// メモリ上に保持しているメッセージもファイルの先頭へ書き出し、次回の実行時に引き継ぐ
+// NOTE: SpillDir が指定されていない場合は、メモリ上に保持しているメッセージを破棄する
+func (o *Outbox) Close() error {
+	if o == nil {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.spill == nil {
+		if len(o.queue) > 0 {
+			log.WithFields(log.Fields{"pending": len(o.queue)}).Warn("Discarded buffered messages")
+		}
+		return nil
+	}
+	err := o.spill.close(o.queue)
+	o.queue = nil
+	return err
+}
+
+// dropExpired 関数は、メモリ上に保持しているメッセージのうち、先頭から連続して期限切れとなっているものを破棄する
+func (o *Outbox) dropExpired(now time.Time) {
+	for len(o.queue) > 0 && o.queue[0].expired(now, o.policy.MaxAge) {
+		o.queue = o.queue[1:]
+		o.stats.Expired++
+	}
+}
+
+// loadSpilled 関数は、ディスクへ書き出したメッセージを MaxMessages 個まで読み込む
+func (o *Outbox) loadSpilled() error {
+	if o.spill == nil || o.spill.count == 0 {
+		return nil
+	}
+	entries, err := o.spill.read(int(o.policy.MaxMessages))
+	if err != nil {
+		return err
+	}
+	o.queue = append(o.queue, entries...)
+	return nil
+}
+
+//////////////        以上、Outbox 関連              //////////////
+//////////////        以下、spillFile 関連           //////////////
+
+// spillFile 構造体は、ディスクへ書き出したメッセージ（1 行に 1 つの JSON）
+// offset 以降の count 行が未読み込みのメッセージ。全て読み込んだ時点でファイルを空にする
+type spillFile struct {
+	path   string
+	f      *os.File
+	offset int64
+	count  int
+}
+
+func openSpillFile(path string) (*spillFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := &spillFile{path: path, f: f}
+	// 前回の実行時に書き出したメッセージの数を数える
+	r := bufio.NewReader(io.NewSectionReader(f, 0, 1<<62))
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			s.count++
+		}
+		if err != nil {
+			break
+		}
+	}
+	return s, nil
+}
+
+func (s *spillFile) append(e Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := s.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	s.count++
+	return nil
+}
+
+// read 関数は、未読み込みのメッセージを先頭から最大 n 個読み込む
+func (s *spillFile) read(n int) ([]Entry, error) {
+	r := bufio.NewReader(io.NewSectionReader(s.f, s.offset, 1<<62))
+	entries := make([]Entry, 0, n)
+	for len(entries) < n && s.count > 0 {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return entries, err
+		}
+		s.offset += int64(len(line))
+		s.count--
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			log.WithFields(log.Fields{"path": s.path, "error": err}).Error("Invalid spilled message")
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if s.count == 0 {
+		if err := s.f.Truncate(0); err != nil {
+			return entries, err
+		}
+		s.offset = 0
+	}
+	return entries, nil
+}
+
+// close 関数は、読み込み済みのメッセージを取り除き、head を未読み込みのメッセージの前に書き出してファイルを閉じる
+// 保持しているメッセージが無い場合はファイルを削除する
+func (s *spillFile) close(head []Entry) error {
+	if s.count == 0 && len(head) == 0 {
+		s.f.Close()
+		return os.Remove(s.path)
+	}
+	defer s.f.Close()
+	var b []byte
+	for _, e := range head {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		b = append(append(b, line...), '\n')
+	}
+	rest, err := readFrom(s.f, s.offset)
+	if err != nil {
+		return err
+	}
+	if err := s.f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = s.f.Write(append(b, rest...))
+	return err
+}
+
+// readFrom 関数は、f の offset 以降を読み込む
+func readFrom(f *os.File, offset int64) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(b, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return b, nil
+}
+
+// spillFileName 関数は、name（"host:port"）の分散ブローカのメッセージを書き出すファイル名を返す
+func spillFileName(name string) string {
+	return strings.NewReplacer(":", "_", "/", "_", "[", "", "]", "").Replace(name) + ".spill"
+}
+
+//////////////        以上、spillFile 関連           //////////////
+//////////////        以下、エラー 関連              //////////////
+
+// PolicyError 構造体
+// 保持する方法が不正な場合に返される
+type PolicyError struct {
+	Msg string
+}
+
+func (e PolicyError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+//////////////        以上、エラー 関連              //////////////
@@ -0,0 +1,165 @@
+package outbox_test
+
+import (
+	"gamma/pkg/mqttv5"
+	"gamma/pkg/outbox"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// replayTopics 関数は、o が保持しているメッセージを全て再送し、再送したトピックを返す
+func replayTopics(o *outbox.Outbox) []string {
+	topics := []string{}
+	o.Replay(func(e outbox.Entry) bool {
+		topics = append(topics, e.Topic)
+		return true
+	})
+	return topics
+}
+
+func TestPolicyValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		p       outbox.Policy
+		wantErr bool
+	}{
+		{name: "Normal scenario 01 (disabled)", p: outbox.Policy{}},
+		{name: "Normal scenario 02 (spill)", p: outbox.Policy{MaxMessages: 10, MaxAge: time.Minute, SpillDir: dir}},
+		{name: "Error scenario 01 (negative max age)", p: outbox.Policy{MaxMessages: 10, MaxAge: -time.Second}, wantErr: true},
+		{name: "Error scenario 02 (spill without memory buffer)", p: outbox.Policy{SpillDir: dir}, wantErr: true},
+		{name: "Error scenario 03 (spill directory)", p: outbox.Policy{MaxMessages: 10, SpillDir: dir + "/not-found"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.p.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// メモリ上に保持できない分はディスクへ書き出し、保持した順に再送する
+func TestReplayOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	o, err := outbox.New(outbox.Policy{MaxMessages: 2, SpillDir: dir, MaxSpillMessages: 3}, "localhost:1883")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer o.Close()
+	for _, topic := range []string{"/0/1", "/0/2", "/0/3", "/0/4", "/0/5"} {
+		if !o.Enqueue(topic, false, []byte(topic)) {
+			t.Fatalf("Enqueue(%v) = false, expected true", topic)
+		}
+	}
+	if o.Enqueue("/0/6", false, []byte("/0/6")) {
+		t.Errorf("Enqueue() = true, expected false (exceeded max spill messages)")
+	}
+
+	// 1 件目の再送に失敗した場合は、全て保持したままとなる
+	if got := o.Replay(func(outbox.Entry) bool { return false }); got != 0 {
+		t.Errorf("Replay() = %v, expected %v", got, 0)
+	}
+	want := []string{"/0/1", "/0/2", "/0/3", "/0/4", "/0/5"}
+	if got := replayTopics(o); !reflect.DeepEqual(got, want) {
+		t.Errorf("Replay() topics = %v, expected %v", got, want)
+	}
+
+	wantStats := outbox.Stats{Pending: 0, Buffered: 5, Replayed: 5, Dropped: 1}
+	if got := o.Stats(); got != wantStats {
+		t.Errorf("Stats() = %+v, expected %+v", got, wantStats)
+	}
+}
+
+// MaxAge、MQTT v5 の Message Expiry を超えたメッセージは再送しない
+func TestReplayExpired(t *testing.T) {
+	o, err := outbox.New(outbox.Policy{MaxMessages: 10, MaxAge: 20 * time.Millisecond}, "localhost:1883")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	expiry := uint32(0)
+	o.Enqueue("/0/1", false, []byte("old"))
+	o.Enqueue("/0/2", false, mqttv5.Publication{Payload: []byte("expiry"), Properties: mqttv5.Properties{MessageExpiry: &expiry}})
+	time.Sleep(30 * time.Millisecond)
+	o.Enqueue("/0/3", false, "new")
+
+	if got := replayTopics(o); !reflect.DeepEqual(got, []string{"/0/3"}) {
+		t.Errorf("Replay() topics = %v, expected %v", got, []string{"/0/3"})
+	}
+	if got := o.Stats().Expired; got != 2 {
+		t.Errorf("Stats().Expired = %v, expected %v", got, 2)
+	}
+}
+
+// 閉じた時点で保持しているメッセージは、次回の実行時に引き継ぐ
+func TestResumeSpilled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	policy := outbox.Policy{MaxMessages: 1, SpillDir: dir}
+
+	o, err := outbox.New(policy, "[::1]:1883")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	for _, topic := range []string{"/0/1", "/0/2", "/0/3"} {
+		o.Enqueue(topic, false, []byte(topic))
+	}
+	// "/0/1" のみ再送できた
+	first := true
+	o.Replay(func(outbox.Entry) bool {
+		ok := first
+		first = false
+		return ok
+	})
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	resumed, err := outbox.New(policy, "[::1]:1883")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if got := resumed.Len(); got != 2 {
+		t.Errorf("Len() = %v, expected %v", got, 2)
+	}
+	if got := replayTopics(resumed); !reflect.DeepEqual(got, []string{"/0/2", "/0/3"}) {
+		t.Errorf("Replay() topics = %v, expected %v", got, []string{"/0/2", "/0/3"})
+	}
+	if err := resumed.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	// 全て再送した場合はファイルを削除する
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("spill files = %v, expected none", len(files))
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	o, err := outbox.New(outbox.Policy{}, "localhost:1883")
+	if err != nil || o != nil {
+		t.Fatalf("New() = (%v, %v), expected (nil, nil)", o, err)
+	}
+	if o.Enqueue("/0/1", false, []byte("payload")) {
+		t.Errorf("Enqueue() = true, expected false")
+	}
+	if got := o.Stats(); got != (outbox.Stats{}) {
+		t.Errorf("Stats() = %+v, expected zero", got)
+	}
+}
@@ -2,8 +2,8 @@ package subsctable
 
 import (
 	"fmt"
-	"reflect"
-	"regexp"
+	"gamma/pkg/topicscheme"
+	"math"
 	"sort"
 	"strings"
 	"sync"
@@ -21,7 +21,13 @@ type Subsctable interface {
 	DecreaseSubscriber(topic string) error
 	GetSubsetSubsctable(c mqtt.Client, qos byte, ch chan<- mqtt.Message, topic string) (Subsctable, error)
 	SubscribeAll()
-	UnsubscribeSubsetTopics(topic string) error
+	ReplaceClient(c mqtt.Client)
+	UnsubscribeSubsetTopics(topic string) (uint, error)
+	UnsubscribeAll() (uint, error)
+	MergeSubsctable(child Subsctable, topic string) (uint, error)
+	CountSubscribers() uint
+	CountSubscribersByTopic() map[string]uint
+	SetAggregationPolicy(policy AggregationPolicy) error
 	getRootNode() *node
 }
 
@@ -30,18 +36,29 @@ type subsctable struct {
 	rootNode *node
 	qos      byte
 	msgCh    chan<- mqtt.Message
+	policy   AggregationPolicy
 }
 
 func (st *subsctable) String() string {
 	return fmt.Sprintf("{\"rootNode\":%v}", st.rootNode)
 }
 
+// NOTE: トピック名の形式は topicscheme.ValidateTopicFilter と同じ（brokertable パッケージと共通）
+// ルーティング用のトピック（topicscheme.Current() で設定されたスキームに従う）の後に、
+// ワイルドカード "#" または任意の単語を 1 レベルだけ付けることができる
+// また、ルーティング用のトピックの各レベルはワイルドカード "+" に置き換えることができる（例: "/0/+/2"）
+// NOTE: Subscribe 要求ごとに呼び出されるため、メモリ割り当てを行わないこと（エラー時を除く）
 func validateTopic(topic string) error {
-	rTopic := regexp.MustCompile(`^((/)|(/[0-9]+(/[0-3])*))?((/#)|(/[\w]+))?$`)
-	if rTopic.MatchString(topic) {
-		return nil
+	s := topicscheme.Current()
+	if err := topicscheme.ValidateTopicFilter(s, topic); err != nil {
+		return newTopicNameError(s, topic)
 	}
-	return TopicNameError{Msg: fmt.Sprintf("Invalid topic name(%v). Allowed topic name`s regular expressions is '^(/[0-9]+(/[0-3])*)?((/#)|(/[\\w]+))?$' .", topic)}
+	return nil
+}
+
+func newTopicNameError(s topicscheme.Scheme, topic string) error {
+	pattern := strings.TrimSuffix(strings.TrimPrefix(s.Pattern(), "^"), "$")
+	return TopicNameError{Msg: fmt.Sprintf("Invalid topic name(%v). Allowed topic name`s regular expressions is '^%v?((/#)|(/[\\w]+))?$' (each level can be replaced by '+') .", topic, pattern)}
 }
 
 func NewSubsctable(c mqtt.Client, qos byte, ch chan<- mqtt.Message) Subsctable {
@@ -54,16 +71,16 @@ func (st *subsctable) getRootNode() *node {
 
 // GetSubset 関数は、与えられたトピック以下の Subsctable を返す
 // 新たな分散ブローカが追加された際に使用する
+// NOTE: 与えられたトピック以下のノードは元の Subsctable と共有される
+// また、与えられたトピック以下にマッチし得るワイルドカードトピック（例: "/0/+/2"）は、
+// 新たな分散ブローカでも受信する必要があるため、カウンタごと複製する
 func (st *subsctable) GetSubsetSubsctable(c mqtt.Client, qos byte, ch chan<- mqtt.Message, topic string) (Subsctable, error) {
 	// トピック名の前処理
 	err := validateTopic(topic)
 	if err != nil {
 		return nil, err
 	}
-	rep := regexp.MustCompile(`^/`) // 先頭の "/" が邪魔なため、削除
-	editedTopic := rep.ReplaceAllString(topic, "")
-	editedTopic = strings.Replace(editedTopic, "/#", "", 1) // ワイルドカードがあると都合が悪いため削除
-	topicSlice := strings.Split(editedTopic, "/")
+	topicSlice := topicLevels(strings.TrimSuffix(topic, "/#")) // ワイルドカードがあると都合が悪いため削除
 
 	newSubsctable := NewSubsctable(c, qos, ch)
 	newRootNode := newSubsctable.getRootNode()
@@ -72,94 +89,221 @@ func (st *subsctable) GetSubsetSubsctable(c mqtt.Client, qos byte, ch chan<- mqt
 	// NOTE: 以下のループに当たるトピック名は新たな Subsctable の担当ではないことに注意
 	currentNewNode := newRootNode
 	currentOldNode := oldRootNode
-	typeNotFoundErr := reflect.ValueOf(NotFoundError{}).Type()
 	for i, child := range topicSlice {
-		// currentOldNode の更新
-		tmpNode, err := currentOldNode.children.Load(child)
-		// 子ノードが存在しない場合は、追加する
-		if err == nil {
-			currentOldNode = tmpNode
-		} else if reflect.ValueOf(err).Type() == typeNotFoundErr {
-			log.WithFields(log.Fields{
-				"root_node":    fmt.Sprint(st.rootNode),
-				"current_node": fmt.Sprint(currentOldNode),
-				"children":     child,
-			}).Debug("Add children")
-			newNode := &node{parent: currentOldNode, children: nodeMap{}}
-			currentOldNode.children.Store(child, newNode)
-			currentOldNode = newNode
-		} else if err != nil {
+		// currentOldNode の更新（子ノードが存在しない場合は、追加する）
+		currentOldNode, err = currentOldNode.loadOrCreateChild(child)
+		if err != nil {
 			return nil, err
 		}
 
 		if i == len(topicSlice)-1 {
 			currentNewNode.children.Store(child, currentOldNode)
 		} else {
-			newNode := &node{parent: currentNewNode, children: nodeMap{}}
-			currentNewNode.children.Store(child, newNode)
-			currentNewNode = newNode
+			currentNewNode, err = currentNewNode.loadOrCreateChild(child)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// ワイルドカードトピックの複製
+	for _, n := range oldRootNode.collectIntersectingNodes(topicSlice, true) {
+		if n.GetSubCnt() == 0 {
+			continue // 集約用のワイルドカードトピックは、新たな Subsctable 側で改めて集約する
+		}
+		copiedNode, err := newRootNode.loadOrCreateDescendant(topicLevels(n.topic))
+		if err != nil {
+			return nil, err
 		}
+		copiedNode.topic = n.topic
+		copiedNode.subCnt = n.GetSubCnt()
 	}
-	currentNewNode.topic = topic
+
+	newSubsctable.(*subsctable).policy = st.policy
 
 	return newSubsctable, nil
 }
 
-func (st *subsctable) SubscribeAll() {
-	var fForwardMsg mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-		st.msgCh <- msg
+// MergeSubsctable 関数は、GetSubsetSubsctable 関数の逆の操作として、与えられたトピック以下を担当していた
+// Subsctable（child）のノードを自身へ統合し、必要なトピックを Subscribe する
+// 分散ブローカを削除・統合する際に使用する
+// 戻り値は、自身に追加された Subscriber 数の合計
+// NOTE: 与えられたトピック以下のノードは、どちらか一方の Subsctable のみに登録された Subscriber を表すため、カウンタを合算する
+// 一方、与えられたトピック以下にマッチし得るワイルドカードトピック（例: "/0/+/2"）は、両方の Subsctable に同じ Subscriber が
+// 登録されているため、カウンタの大きい方に合わせる
+func (st *subsctable) MergeSubsctable(child Subsctable, topic string) (uint, error) {
+	// トピック名の前処理
+	err := validateTopic(topic)
+	if err != nil {
+		return 0, err
+	}
+	topicSlice := topicLevels(strings.TrimSuffix(topic, "/#")) // ワイルドカードがあると都合が悪いため削除
+
+	subscribedNodes := st.rootNode.collectSubscribedNodes()
+	childRootNode := child.getRootNode()
+	var mergedCnt uint = 0
+
+	// 与えられたトピック以下のノードの統合
+	childNode, err := childRootNode.loadDescendant(topicSlice)
+	if err == nil {
+		// 集約は統合後にやり直す
+		for _, n := range childNode.collectAggregatedNodes() {
+			n.setAggregateHandler(nil)
+		}
+
+		parentNode, err := st.rootNode.loadOrCreateDescendant(topicSlice[:len(topicSlice)-1])
+		if err != nil {
+			return 0, err
+		}
+		key := topicSlice[len(topicSlice)-1]
+		if n, err := parentNode.children.Load(key); err == nil {
+			// NOTE: UnsubscribeSubsetTopics 関数で切り離す前のノードは、両方の Subsctable で共有されている
+			if n != childNode {
+				mergedCnt += n.mergeNode(childNode)
+			}
+		} else {
+			childNode.parent = parentNode
+			parentNode.children.Store(key, childNode)
+			mergedCnt += childNode.countSubscribers()
+		}
+	} else if _, ok := err.(NotFoundError); !ok {
+		return 0, err
+	}
+
+	// ワイルドカードトピックの統合
+	for _, n := range childRootNode.collectIntersectingNodes(topicSlice, true) {
+		cnt := n.GetSubCnt()
+		if cnt == 0 {
+			continue // 集約用のワイルドカードトピック
+		}
+		mergedNode, err := st.rootNode.loadOrCreateDescendant(topicLevels(n.topic))
+		if err != nil {
+			return 0, err
+		}
+		mergedNode.topic = n.topic
+		if currentCnt := mergedNode.GetSubCnt(); cnt > currentCnt {
+			mergedNode.setSubCnt(cnt)
+			mergedCnt += cnt - currentCnt
+		}
+	}
+
+	// 統合前後で Subscribe すべきトピックの差分を Subscribe・Unsubscribe する
+	newSubscribedNodes := st.rootNode.collectSubscribedNodes()
+	for n := range newSubscribedNodes {
+		if subscribedNodes[n] {
+			continue
+		}
+		if token := st.client.Subscribe(n.topic, st.qos, st.handlerFor(n)); token.Wait() && token.Error() != nil {
+			return mergedCnt, token.Error()
+		}
+	}
+	for n := range subscribedNodes {
+		if newSubscribedNodes[n] {
+			continue
+		}
+		if token := st.client.Unsubscribe(n.topic); token.Wait() && token.Error() != nil {
+			return mergedCnt, token.Error()
+		}
 	}
+	log.WithFields(log.Fields{
+		"topic":      topic,
+		"merged_cnt": mergedCnt,
+	}).Debug("Merged subsctable")
+
+	st.rebalanceAggregationOrLog()
+	return mergedCnt, nil
+}
+
+// SubscribeAll 関数は、Subscribe すべきトピックを全て Subscribe する
+// GetSubsetSubsctable 関数で生成した Subsctable の場合は、ここで改めて集約する
+func (st *subsctable) SubscribeAll() {
 	rootNode := st.getRootNode()
-	rootNode.SubscribeChildrenTopics(st.client, st.qos, fForwardMsg)
+	rootNode.SubscribeChildrenTopics(rootNode, st.client, st.qos, st.handlerFor)
+	st.rebalanceAggregationOrLog()
 }
 
-// GetSubset 関数は、与えられたトピック以下の Subsctable を返す
+// ReplaceClient 関数は、Subscribe に使用するクライアントを差し替え、Subscribe 中のトピックを全て Subscribe し直す
+// レプリカセットの分散ブローカへのフェイルオーバー時に使用する
+// NOTE: 元のクライアントは切断されている前提のため、Unsubscribe は行わない
+func (st *subsctable) ReplaceClient(c mqtt.Client) {
+	st.client = c
+	st.SubscribeAll()
+}
+
+// UnsubscribeSubsetTopics 関数は、与えられたトピック以下のトピックを全て Unsubscribe し、Subsctable から切り離す
 // 新たな分散ブローカが追加された際に使用する
-func (st *subsctable) UnsubscribeSubsetTopics(topic string) error {
+// 戻り値は、切り離したトピックの Subscriber 数の合計（新たな分散ブローカへ引き継がれる Subscriber 数）
+// NOTE: 切り離したノードは GetSubsetSubsctable 関数で生成した新たな Subsctable と共有されているため、カウンタはそのまま
+func (st *subsctable) UnsubscribeSubsetTopics(topic string) (uint, error) {
 	// トピック名の前処理
 	err := validateTopic(topic)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	rep := regexp.MustCompile(`^/`) // 先頭の "/" が邪魔なため、削除
-	editedTopic := rep.ReplaceAllString(topic, "")
-	editedTopic = strings.Replace(editedTopic, "/#", "", 1) // ワイルドカードがあると都合が悪いため削除
-	topicSlice := strings.Split(editedTopic, "/")
+	topicSlice := topicLevels(strings.TrimSuffix(topic, "/#")) // ワイルドカードがあると都合が悪いため削除
 
-	oldRootNode := st.getRootNode()
-
-	// NOTE: 以下のループに当たるトピック名は新たな Subsctable の担当ではないことに注意
-	currentNode := oldRootNode
-	typeNotFoundErr := reflect.ValueOf(NotFoundError{}).Type()
-	for _, child := range topicSlice {
-		// currentNode の更新
-		tmpNode, err := currentNode.children.Load(child)
-		// 子ノードが存在しない場合は、追加する
-		if err == nil {
-			currentNode = tmpNode
-		} else if reflect.ValueOf(err).Type() == typeNotFoundErr {
-			log.WithFields(log.Fields{
-				"root_node":    fmt.Sprint(st.rootNode),
-				"current_node": fmt.Sprint(currentNode),
-				"children":     child,
-			}).Debug("Not found children")
-			return nil
-		} else if err != nil {
-			return err
-		}
+	parentNode, err := st.rootNode.loadDescendant(topicSlice[:len(topicSlice)-1])
+	if err == nil {
+		_, err = parentNode.children.Load(topicSlice[len(topicSlice)-1])
+	}
+	if _, ok := err.(NotFoundError); ok {
+		log.WithFields(log.Fields{
+			"root_node": fmt.Sprint(st.rootNode),
+			"topic":     topic,
+		}).Debug("Not found children")
+		return 0, nil
+	} else if err != nil {
+		return 0, err
 	}
+	currentNode, _ := parentNode.children.Load(topicSlice[len(topicSlice)-1])
 
 	// Unsubscribe する
-	if currentNode.topic != "" && currentNode.GetSubCnt() > 0 {
-		if token := st.client.Unsubscribe(currentNode.topic); token.Wait() && token.Error() != nil {
-			log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT unsubscribe error")
-			return token.Error()
-		}
+	if err := currentNode.UnsubscribeChildrenTopics(st.rootNode, st.client); err != nil {
+		return 0, err
 	}
-	// 再帰関数に渡す
-	currentNode.unsubscribeAllChildrenTopics(st.client)
 
-	return nil
+	// Subsctable から切り離す
+	parentNode.children.Delete(topicSlice[len(topicSlice)-1])
+	movedCnt := currentNode.countSubscribers()
+	log.WithFields(log.Fields{
+		"topic":     topic,
+		"moved_cnt": movedCnt,
+	}).Debug("Detached subset topics")
+
+	// 切り離したトピックが集約の対象外になるため、集約をやり直す
+	st.rebalanceAggregationOrLog()
+	return movedCnt, nil
+}
+
+// UnsubscribeAll 関数は、Subscribe しているトピックを全て Unsubscribe し、全てのノードを Subsctable から切り離す
+// 分散ブローカを親ノードの分散ブローカへ統合した後に、複製したワイルドカードトピック（例: "/0/+/2"）を切り離す際に使用する
+// 戻り値は、切り離したトピックの Subscriber 数の合計
+// NOTE: 複製したワイルドカードトピックの Subscriber は親ノードの Subsctable にも登録されているため、カウンタは引き継がない
+func (st *subsctable) UnsubscribeAll() (uint, error) {
+	if err := st.rootNode.UnsubscribeChildrenTopics(st.rootNode, st.client); err != nil {
+		return 0, err
+	}
+	removedCnt := st.rootNode.countSubscribers()
+	for _, key := range st.rootNode.children.Keys() {
+		st.rootNode.children.Delete(key)
+	}
+	log.WithFields(log.Fields{"removed_cnt": removedCnt}).Debug("Detached all topics")
+
+	st.rebalanceAggregationOrLog()
+	return removedCnt, nil
+}
+
+// CountSubscribers 関数は、Subsctable に登録されている全てのトピックの Subscriber 数の合計を返す
+// NOTE: 各分散ブローカの SubCnt と一致する必要がある
+func (st *subsctable) CountSubscribers() uint {
+	return st.rootNode.countSubscribers()
+}
+
+// CountSubscribersByTopic 関数は、Subscriber が存在するトピックごとの Subscriber 数を返す
+func (st *subsctable) CountSubscribersByTopic() map[string]uint {
+	counts := map[string]uint{}
+	st.rootNode.collectSubscribers(counts)
+	return counts
 }
 
 func (st *subsctable) IncreaseSubscriber(topic string) error {
@@ -168,127 +312,592 @@ func (st *subsctable) IncreaseSubscriber(topic string) error {
 	if err != nil {
 		return err
 	}
-	rep := regexp.MustCompile(`^/`) // 先頭の "/" が邪魔なため、削除
-	editedTopic := rep.ReplaceAllString(topic, "")
+	// 子ノードが存在しない場合は、追加する
+	currentNode, err := st.rootNode.loadOrCreateTopic(topic)
+	if err != nil {
+		return err
+	}
 
-	currentNode := st.rootNode
-	hasActiveWildcardNode := false
-	topicSlice := strings.Split(editedTopic, "/")
-	typeNotFoundErr := reflect.ValueOf(NotFoundError{}).Type()
-	for _, child := range topicSlice {
-		// 与えられたトピックをカバーするワイルドカードトピックが既に Subscribe されていた場合
-		if !hasActiveWildcardNode && currentNode.HasActiveWildcardNode() {
-			hasActiveWildcardNode = true
-		}
+	// トピック名の設定
+	currentNode.topic = topic
 
-		tmpNode, err := currentNode.children.Load(child)
+	// カウンターのカウントアップ
+	err = currentNode.AddSubCnt()
+	if err != nil {
+		return err
+	}
 
-		// 子ノードが存在しない場合は、追加する
-		if err == nil {
-			currentNode = tmpNode
-		} else if reflect.ValueOf(err).Type() == typeNotFoundErr {
+	// 既に Subscribe 済み（集約用のワイルドカードトピックとして Subscribe されていた場合を除く）の場合
+	if currentNode.GetSubCnt() > 1 {
+		if log.IsLevelEnabled(log.DebugLevel) {
 			log.WithFields(log.Fields{
 				"root_node":    fmt.Sprint(st.rootNode),
 				"current_node": fmt.Sprint(currentNode),
-				"children":     child,
-			}).Debug("Add children")
-			newNode := &node{parent: currentNode, children: nodeMap{}}
-			currentNode.children.Store(child, newNode)
-			currentNode = newNode
-		} else if err != nil {
-			return err
+			}).Debug("End IncreaseSubscriber() (already subscribed)")
 		}
+		st.rebalanceAggregationAlongOrLog(topic)
+		return nil
+	}
+	if currentNode.isAggregated() {
+		// メッセージハンドラをフィルタリングしないものに差し替える
+		err = st.resubscribe(currentNode)
+	} else {
+		err = st.activate(currentNode)
 	}
+	if err != nil {
+		// 分散ブローカの SubCnt と一致させるため、カウンタを元に戻す
+		currentNode.DecreaseSubCnt()
+		return err
+	}
+	if log.IsLevelEnabled(log.DebugLevel) {
+		log.WithFields(log.Fields{
+			"root_node":    fmt.Sprint(st.rootNode),
+			"current_node": fmt.Sprint(currentNode),
+		}).Debug("End IncreaseSubscriber()")
+	}
+	st.rebalanceAggregationAlongOrLog(topic)
+	return nil
+}
 
-	// トピック名の設定
-	currentNode.topic = topic
+func (st *subsctable) DecreaseSubscriber(topic string) error {
+	// トピック名の前処理
+	err := validateTopic(topic)
+	if err != nil {
+		return err
+	}
+	currentNode, err := st.rootNode.loadTopic(topic)
+	if err != nil {
+		return err
+	}
 
-	// カウンターのカウントアップ
-	err = currentNode.AddSubCnt()
+	err = currentNode.DecreaseSubCnt()
+	if err != nil {
+		return err
+	}
+
+	// まだ Subscriber が残っている場合
+	if currentNode.GetSubCnt() > 0 {
+		if log.IsLevelEnabled(log.DebugLevel) {
+			log.WithFields(log.Fields{
+				"root_node":    fmt.Sprint(st.rootNode),
+				"current_node": fmt.Sprint(currentNode),
+			}).Debug("End DecreaseSubscriber() (still subscribed)")
+		}
+		st.rebalanceAggregationAlongOrLog(topic)
+		return nil
+	}
+	if currentNode.isAggregated() {
+		// 集約用のワイルドカードトピックとしては引き続き必要なため、メッセージハンドラをフィルタリングするものに差し替える
+		err = st.resubscribe(currentNode)
+	} else {
+		err = st.deactivate(currentNode)
+	}
 	if err != nil {
+		// 分散ブローカの SubCnt と一致させるため、カウンタを元に戻す
+		currentNode.AddSubCnt()
 		return err
 	}
+	if log.IsLevelEnabled(log.DebugLevel) {
+		log.WithFields(log.Fields{
+			"root_node":    fmt.Sprint(st.rootNode),
+			"current_node": fmt.Sprint(currentNode),
+		}).Debug("End DecreaseSubscriber()")
+	}
+	st.rebalanceAggregationAlongOrLog(topic)
+	return nil
+}
+
+// activate 関数は、有効になったノードのトピックを Subscribe し、そのトピックにカバーされるトピックを Unsubscribe する
+// 与えられたトピックをカバーするトピック（"/0/#", "/0/+/2" など）が既に Subscribe されていた場合は何もしない
+func (st *subsctable) activate(n *node) error {
+	levels := topicLevels(n.topic)
+	if st.rootNode.hasCoveringNode(levels, n) {
+		return nil
+	}
 
-	// メッセージハンドラ
-	var fForwardMsg mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-		st.msgCh <- msg
+	if token := st.client.Subscribe(n.topic, st.qos, st.handlerFor(n)); token.Wait() && token.Error() != nil {
+		return token.Error()
 	}
 
-	// 与えられたトピックをカバーするワイルドカードトピックが Subscribe されていなかった場合
-	if !hasActiveWildcardNode {
-		if token := st.client.Subscribe(currentNode.topic, st.qos, fForwardMsg); token.Wait() && token.Error() != nil {
+	// 与えられたトピックにカバーされるトピックのうち、Subscribe されていたものを Unsubscribe する
+	for _, covered := range st.rootNode.collectCoveredNodes(levels, n) {
+		if st.rootNode.hasCoveringNode(topicLevels(covered.topic), covered, n) {
+			continue
+		}
+		if token := st.client.Unsubscribe(covered.topic); token.Wait() && token.Error() != nil {
 			return token.Error()
 		}
-		if strings.HasSuffix(topic, "/#") {
-			// 子ノードのトピックを全て Unsubscribe する
-			// REVIEW: 次のようなトピック名を与えられた場合の挙動が心配 : "/#"
-			currentNode.parent.UnsubscribeChildrenTopics(st.client)
+	}
+	return nil
+}
+
+// deactivate 関数は、無効になったノードのトピックを Unsubscribe し、そのトピックにカバーされていたトピックを必要に応じて Subscribe する
+// 与えられたトピックをカバーするトピックが Subscribe されている場合は何もしない
+func (st *subsctable) deactivate(n *node) error {
+	levels := topicLevels(n.topic)
+	if st.rootNode.hasCoveringNode(levels, n) {
+		return nil
+	}
+
+	// 与えられたトピックにカバーされていたトピックを、必要に応じて Subscribe する
+	for _, covered := range st.rootNode.collectCoveredNodes(levels, n) {
+		if st.rootNode.hasCoveringNode(topicLevels(covered.topic), covered, n) {
+			continue
+		}
+		if token := st.client.Subscribe(covered.topic, st.qos, st.handlerFor(covered)); token.Wait() && token.Error() != nil {
+			return token.Error()
 		}
 	}
-	log.WithFields(log.Fields{
-		"root_node":    fmt.Sprint(st.rootNode),
-		"current_node": fmt.Sprint(currentNode),
-	}).Debug("End IncreaseSubscriber()")
+
+	// Unsubscribe する
+	if token := st.client.Unsubscribe(n.topic); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
 	return nil
 }
 
-func (st *subsctable) DecreaseSubscriber(topic string) error {
-	// トピック名の前処理
-	err := validateTopic(topic)
-	if err != nil {
+// resubscribe 関数は、Subscribe 済みのトピックのメッセージハンドラを差し替える
+func (st *subsctable) resubscribe(n *node) error {
+	if st.rootNode.hasCoveringNode(topicLevels(n.topic), n) {
+		return nil
+	}
+	if token := st.client.Subscribe(n.topic, st.qos, st.handlerFor(n)); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+// handlerFor 関数は、ノードのトピックを Subscribe する際のメッセージハンドラを返す
+// 集約用のワイルドカードトピックのみを表すノードの場合は、他のトピックにマッチするメッセージのみを転送するハンドラを返す
+func (st *subsctable) handlerFor(n *node) mqtt.MessageHandler {
+	if h := n.getAggregateHandler(); h != nil && n.GetSubCnt() == 0 {
+		return h
+	}
+	return st.forwardMsg
+}
+
+// メッセージハンドラ
+func (st *subsctable) forwardMsg(client mqtt.Client, msg mqtt.Message) {
+	st.msgCh <- msg
+}
+
+// topicLevels 関数は、トピック名を先頭の "/" を除いてレベルごとに分割する
+func topicLevels(topic string) []string {
+	return strings.Split(strings.TrimPrefix(topic, "/"), "/")
+}
+
+//////////////          以上、Subsctable 関連              //////////////
+//////////////            以下、集約 関連                  //////////////
+
+// AggregationPolicy 構造体は、子孫ノードのトピックを親ノードのワイルドカードトピック（例: "/0/1/#"）へ集約する条件を表す
+// 被覆率は、ノードが表す領域のうち有効なトピックでカバーされている割合（例: "/0/1/0" 〜 "/0/1/3" が全て有効な場合、"/0/1" の被覆率は 1.0）
+// NOTE: 集約中は、ワイルドカードトピックで受信したメッセージのうち、有効なトピックにマッチするもののみを転送する
+type AggregationPolicy struct {
+	Threshold        float64 // 集約を開始する被覆率（0 の場合は集約しない）
+	ReleaseThreshold float64 // 集約を解除する被覆率（集約と解除を繰り返さないよう、Threshold 以下の値を設定する）
+	MinTopics        uint    // 集約を開始するために必要な、子孫ノードの有効なトピックの数
+}
+
+// IsEnabled 関数は、集約が有効かどうかを返す
+func (p AggregationPolicy) IsEnabled() bool {
+	return p.Threshold > 0
+}
+
+// Validate 関数は、集約の条件が正しいかどうかを検証する
+func (p AggregationPolicy) Validate() error {
+	if !p.IsEnabled() {
+		return nil
+	}
+	if p.Threshold > 1 {
+		return AggregationPolicyError{Msg: fmt.Sprintf("Invalid threshold (%v). Threshold must be in (0, 1].", p.Threshold)}
+	}
+	if p.ReleaseThreshold <= 0 || p.Threshold < p.ReleaseThreshold {
+		return AggregationPolicyError{Msg: fmt.Sprintf("Invalid release threshold (%v). Release threshold must be in (0, %v].", p.ReleaseThreshold, p.Threshold)}
+	}
+	return nil
+}
+
+// SetAggregationPolicy 関数は、集約の条件を設定し、現在のトピックに適用する
+// 集約を無効にした場合は、全ての集約を解除する
+func (st *subsctable) SetAggregationPolicy(policy AggregationPolicy) error {
+	if err := policy.Validate(); err != nil {
 		return err
 	}
-	rep := regexp.MustCompile(`^/`) // 先頭の "/" が邪魔なため、削除
-	editedTopic := rep.ReplaceAllString(topic, "")
-
-	currentNode := st.rootNode
-	hasActiveWildcardNode := false
-	var activeWildcardNode *node
-	topicSlice := strings.Split(editedTopic, "/")
-	for _, child := range topicSlice {
-		// 与えられたトピックをカバーするワイルドカードトピックが既に Subscribe されていた場合
-		if !hasActiveWildcardNode && currentNode.HasActiveWildcardNode() {
-			hasActiveWildcardNode = true
-			activeWildcardNode, err = currentNode.children.Load("#")
-			if err != nil {
+	st.policy = policy
+	if !policy.IsEnabled() {
+		for _, n := range st.rootNode.collectAggregatedNodes() {
+			if err := st.releaseAggregation(n); err != nil {
 				return err
 			}
 		}
-		currentNode, err = currentNode.children.Load(child)
-		if err != nil {
+		return nil
+	}
+	return st.rebalanceAggregation()
+}
+
+type aggregationTarget struct {
+	n      *node
+	prefix string // n のトピック名（ルートの場合は ""）
+	depth  int    // n の子ノードの深さ
+}
+
+// rebalanceAggregation 関数は、集約の条件に従って全てのノードの集約の開始・解除を行う
+// ノードの追加・切り離し・統合など、Subscriber 数の増減以外で Subsctable が変わった場合に使用する
+func (st *subsctable) rebalanceAggregation() error {
+	if !st.policy.IsEnabled() {
+		return nil
+	}
+
+	sc := topicscheme.Current()
+	st.rootNode.refreshAggregationState(sc, 0)
+	targets := []aggregationTarget{}
+	releases := []*node{}
+	st.rootNode.planAggregation(st.policy, sc, "", 0, &targets, &releases)
+	return st.applyAggregation(targets, releases)
+}
+
+// rebalanceAggregationAlong 関数は、topic の Subscriber 数が増減した際に、topic の祖先ノードについてのみ集約の開始・解除を行う
+// NOTE: 被覆率・有効なトピックの数が変わるのは祖先ノードのみのため、その他のノードは判定し直さない
+// Subscribe 要求ごとに呼び出されるため、集約が変わらない場合はメモリ割り当てを行わないこと
+func (st *subsctable) rebalanceAggregationAlong(topic string) error {
+	if !st.policy.IsEnabled() {
+		return nil
+	}
+
+	sc := topicscheme.Current()
+	st.rootNode.updateAggregationStateAlong(sc, topic, 1, 0)
+	var targets []aggregationTarget
+	var releases []*node
+	st.rootNode.planAggregationAlong(st.policy, sc, topic, 1, 0, &targets, &releases)
+	return st.applyAggregation(targets, releases)
+}
+
+// applyAggregation 関数は、planAggregation 関数で求めた集約の開始・解除を行う
+// NOTE: Subscribe 数の増減を抑えるため、集約の開始（上位ノードへの集約を含む）を先に行い、その後に不要になった集約を解除する
+func (st *subsctable) applyAggregation(targets []aggregationTarget, releases []*node) error {
+	for _, t := range targets {
+		if err := st.aggregate(t); err != nil {
 			return err
 		}
 	}
+	for _, n := range releases {
+		if err := st.releaseAggregation(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebalanceAggregationOrLog 関数は、集約をやり直し、失敗した場合はエラーログを出力する
+// NOTE: Subscriber 数の増減は完了しているため、集約の失敗は呼び出し元へ返さない
+func (st *subsctable) rebalanceAggregationOrLog() {
+	if err := st.rebalanceAggregation(); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Failed to rebalance aggregation")
+	}
+}
+
+// rebalanceAggregationAlongOrLog 関数は、topic の祖先ノードの集約をやり直し、失敗した場合はエラーログを出力する
+func (st *subsctable) rebalanceAggregationAlongOrLog(topic string) {
+	if err := st.rebalanceAggregationAlong(topic); err != nil {
+		log.WithFields(log.Fields{"topic": topic, "error": err}).Error("Failed to rebalance aggregation")
+	}
+}
 
-	// currentNode と activeWildcardNode が同じ場合
-	currentNode.DecreaseSubCnt()
-	if hasActiveWildcardNode && currentNode.topic == activeWildcardNode.topic && currentNode.GetSubCnt() == 0 {
-		// メッセージハンドラ
-		var fForwardMsg mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-			st.msgCh <- msg
+// aggregate 関数は、ノードの子孫ノードのトピックを "#" ノードのワイルドカードトピックへ集約する
+func (st *subsctable) aggregate(t aggregationTarget) error {
+	n, err := t.n.loadOrCreateChild("#")
+	if err != nil {
+		return err
+	}
+	n.topic = t.prefix + "/#"
+
+	parent := t.n
+	depth := t.depth
+	n.setAggregateHandler(func(client mqtt.Client, msg mqtt.Message) {
+		// NOTE: メッセージごとに呼び出されるため、トピック名を分割せずに走査する
+		topic := strings.TrimPrefix(msg.Topic(), "/")
+		i := 0
+		for d := 0; d < depth && i <= len(topic); d++ {
+			_, i = topicscheme.NextLevel(topic, i)
+		}
+		if i <= len(topic) && parent.hasMatchingNode(topic, i) {
+			st.forwardMsg(client, msg)
 		}
+	})
+	log.WithFields(log.Fields{"topic": n.topic}).Debug("Aggregate topics")
+	return st.activate(n)
+}
 
-		// 子ノードのトピックを必要に応じて Subscribe する
-		currentNode.SubscribeChildrenTopics(st.client, st.qos, fForwardMsg)
+// releaseAggregation 関数は、集約を解除し、集約されていたトピックを必要に応じて Subscribe し直す
+func (st *subsctable) releaseAggregation(n *node) error {
+	n.setAggregateHandler(nil)
+	log.WithFields(log.Fields{"topic": n.topic}).Debug("Release aggregated topics")
+	if n.GetSubCnt() > 0 {
+		// Subscriber が存在するため、メッセージハンドラのみを差し替える
+		return st.resubscribe(n)
+	}
+	return st.deactivate(n)
+}
 
-		// Unsubscribe する
-		if token := st.client.Unsubscribe(currentNode.topic); token.Wait() && token.Error() != nil {
-			return token.Error()
+// planAggregation 関数は、自身以下のノードのうち、新たに集約するノードと集約を解除するノードを求める
+// 上位のノードで集約できる場合は、下位のノードでは集約しない
+// NOTE: 被覆率・有効なトピックの数は、refreshAggregationState 関数で求めた値を使用する
+func (s *node) planAggregation(p AggregationPolicy, sc topicscheme.Scheme, prefix string, depth int, targets *[]aggregationTarget, releases *[]*node) {
+	wildcardNode, err := s.children.Load("#")
+	if err == nil && wildcardNode.GetSubCnt() > 0 {
+		// "#" が既に Subscribe されているため、集約は不要
+		*releases = append(*releases, s.collectAggregatedNodes()...)
+		return
+	}
+	isAggregated := err == nil && wildcardNode.isAggregated()
+
+	if sc.Fanout(depth) > 0 {
+		if s.shouldAggregate(p, isAggregated) {
+			if !isAggregated {
+				*targets = append(*targets, aggregationTarget{n: s, prefix: prefix, depth: depth})
+			}
+			// 下位のノードの集約は不要
+			for _, n := range s.collectAggregatedNodes() {
+				if n != wildcardNode {
+					*releases = append(*releases, n)
+				}
+			}
+			return
 		}
-	} else if !hasActiveWildcardNode && currentNode.GetSubCnt() == 0 {
-		if token := st.client.Unsubscribe(currentNode.topic); token.Wait() && token.Error() != nil {
-			return token.Error()
+	}
+	if isAggregated {
+		*releases = append(*releases, wildcardNode)
+	}
+
+	for _, k := range s.children.Keys() {
+		if k == "#" || k == "+" || !sc.ValidateLevel(depth, k) {
+			continue
 		}
+		n, err := s.children.Load(k)
+		if err != nil {
+			continue
+		}
+		n.planAggregation(p, sc, prefix+"/"+k, depth+1, targets, releases)
 	}
-	log.WithFields(log.Fields{
-		"root_node":            fmt.Sprint(st.rootNode),
-		"current_node":         fmt.Sprint(currentNode),
-		"active_wildcard_node": fmt.Sprint(activeWildcardNode),
-	}).Debug("End DecreaseSubscriber()")
-	return nil
 }
 
-//////////////          以上、Subsctable 関連              //////////////
+// planAggregationAlong 関数は、topic の i バイト目以降のレベルで表される自身の子孫ノードが変わった場合に、
+// 祖先ノードのうち集約が変わるノードのみを判定し、新たに集約するノードと集約を解除するノードを求める
+// NOTE: 変更前は planAggregation 関数の結果どおりに集約されている（集約したノードの下位には集約が無い）前提とする
+func (s *node) planAggregationAlong(p AggregationPolicy, sc topicscheme.Scheme, topic string, i int, depth int, targets *[]aggregationTarget, releases *[]*node) {
+	prefix := topic[:i-1]
+	level, next := "", i
+	if i <= len(topic) {
+		level, next = topicscheme.NextLevel(topic, i)
+	}
+	// "#" の Subscriber 数が変わった場合は、自身以下の全てのノードの集約が変わり得る
+	if level == "#" {
+		s.planAggregation(p, sc, prefix, depth, targets, releases)
+		return
+	}
+
+	wildcardNode, ok := s.children.get("#")
+	if ok && wildcardNode.GetSubCnt() > 0 {
+		// "#" が既に Subscribe されているため、自身以下に集約は無い
+		return
+	}
+	isAggregated := ok && wildcardNode.isAggregated()
+
+	if sc.Fanout(depth) > 0 && s.shouldAggregate(p, isAggregated) {
+		if !isAggregated {
+			*targets = append(*targets, aggregationTarget{n: s, prefix: prefix, depth: depth})
+			// 下位のノードの集約は不要
+			*releases = append(*releases, s.collectAggregatedNodes()...)
+		}
+		return
+	}
+	if isAggregated {
+		// 集約を解除するため、集約されていた下位のノードを全て判定し直す
+		s.planAggregation(p, sc, prefix, depth, targets, releases)
+		return
+	}
+
+	if i > len(topic) || level == "+" || !sc.ValidateLevel(depth, level) {
+		return
+	}
+	if n, ok := s.children.get(level); ok {
+		n.planAggregationAlong(p, sc, topic, next, depth+1, targets, releases)
+	}
+}
+
+// shouldAggregate 関数は、集約の条件に従って自身の子孫ノードのトピックを集約すべきかどうかを返す
+// isAggregated は、現在集約しているかどうか（集約と解除を繰り返さないよう、解除は ReleaseThreshold で判定する）
+func (s *node) shouldAggregate(p AggregationPolicy, isAggregated bool) bool {
+	if isAggregated {
+		return s.coverage >= p.ReleaseThreshold
+	}
+	return s.coverage >= p.Threshold && s.descendantTopics >= p.MinTopics
+}
+
+// refreshAggregationState 関数は、自身を含む子孫ノードの被覆率・有効なトピックの数を全て求め直す
+// depth は、自身の子ノードの深さ
+func (s *node) refreshAggregationState(sc topicscheme.Scheme, depth int) {
+	s.children.rangeNodes(func(_ string, n *node) bool {
+		n.refreshAggregationState(sc, depth+1)
+		return true
+	})
+	s.updateAggregationState(sc, depth)
+}
+
+// updateAggregationStateAlong 関数は、topic の i バイト目以降のレベルで表される子孫ノードと、自身の被覆率・有効なトピックの数を求め直す
+// NOTE: Subscribe 要求ごとに呼び出されるため、メモリ割り当てを行わないこと
+func (s *node) updateAggregationStateAlong(sc topicscheme.Scheme, topic string, i int, depth int) {
+	if i <= len(topic) {
+		level, next := topicscheme.NextLevel(topic, i)
+		if n, ok := s.children.get(level); ok {
+			n.updateAggregationStateAlong(sc, topic, next, depth+1)
+		}
+	}
+	s.updateAggregationState(sc, depth)
+}
+
+// updateAggregationState 関数は、子ノードの値から、自身の被覆率（自身が表す領域のうち、子孫ノードの有効なトピックでカバーされている割合）と
+// 子孫ノードのうち Subscriber が存在するトピックの数（自身は含まない）を求め直す
+// 子ノードの数に上限が無い場合、被覆率は 0 とする
+func (s *node) updateAggregationState(sc topicscheme.Scheme, depth int) {
+	fanout := sc.Fanout(depth)
+
+	// "+" ノードは、全ての子ノードをカバーする
+	wildcardCoverage := 0.0
+	if n, ok := s.children.get("+"); ok {
+		wildcardCoverage = n.coverageAsChild()
+	}
+
+	var topics uint = 0
+	sum := 0.0
+	cnt := 0
+	s.children.rangeNodes(func(k string, n *node) bool {
+		if n.topic != "" && n.GetSubCnt() > 0 {
+			topics++
+		}
+		topics += n.descendantTopics
+		if fanout == 0 || k == "#" || k == "+" || !sc.ValidateLevel(depth, k) {
+			return true
+		}
+		sum += math.Max(n.coverageAsChild(), wildcardCoverage)
+		cnt++
+		return true
+	})
+	s.descendantTopics = topics
+	if fanout == 0 {
+		s.coverage = 0
+		return
+	}
+	sum += float64(fanout-cnt) * wildcardCoverage
+	s.coverage = sum / float64(fanout)
+}
+
+func (s *node) coverageAsChild() float64 {
+	if s.GetSubCnt() > 0 || s.HasActiveWildcardNode() {
+		return 1
+	}
+	return s.coverage
+}
+
+// countSubscribers 関数は、自身を含む子孫ノードの Subscriber 数の合計を返す
+func (s *node) countSubscribers() uint {
+	cnt := s.GetSubCnt()
+	for _, k := range s.children.Keys() {
+		n, err := s.children.Load(k)
+		if err != nil {
+			continue
+		}
+		cnt += n.countSubscribers()
+	}
+	return cnt
+}
+
+// collectSubscribers 関数は、自身を含む子孫ノードのうち Subscriber が存在するトピックの Subscriber 数を counts に加える
+func (s *node) collectSubscribers(counts map[string]uint) {
+	if cnt := s.GetSubCnt(); s.topic != "" && cnt > 0 {
+		counts[s.topic] += cnt
+	}
+	for _, k := range s.children.Keys() {
+		n, err := s.children.Load(k)
+		if err != nil {
+			continue
+		}
+		n.collectSubscribers(counts)
+	}
+}
+
+// collectSubscribedNodes 関数は、自身を含む子孫ノードのうち、Subscribe されるべき（有効かつ他のトピックにカバーされない）ノードを返す
+func (s *node) collectSubscribedNodes() map[*node]bool {
+	nodes := map[*node]bool{}
+	for _, n := range s.collectActiveNodes() {
+		if !s.hasCoveringNode(topicLevels(n.topic), n) {
+			nodes[n] = true
+		}
+	}
+	return nodes
+}
+
+// mergeNode 関数は、other 以下のノードを自身へ統合し、追加された Subscriber 数の合計を返す
+// 同じトピックのノードが両方に存在する場合は、カウンタを合算する
+func (s *node) mergeNode(other *node) uint {
+	cnt := other.GetSubCnt()
+	if cnt > 0 {
+		s.topic = other.topic
+		s.setSubCnt(s.GetSubCnt() + cnt)
+	}
+	for _, k := range other.children.Keys() {
+		o, err := other.children.Load(k)
+		if err != nil {
+			continue
+		}
+		if n, err := s.children.Load(k); err == nil {
+			if n != o {
+				cnt += n.mergeNode(o)
+			}
+			continue
+		}
+		o.parent = s
+		s.children.Store(k, o)
+		cnt += o.countSubscribers()
+	}
+	return cnt
+}
+
+// collectAggregatedNodes 関数は、自身を含む子孫ノードのうち集約用のワイルドカードトピックを表すノードを全て返す
+func (s *node) collectAggregatedNodes() []*node {
+	nodes := []*node{}
+	if s.isAggregated() {
+		nodes = append(nodes, s)
+	}
+	for _, k := range s.children.Keys() {
+		n, err := s.children.Load(k)
+		if err != nil {
+			continue
+		}
+		nodes = append(nodes, n.collectAggregatedNodes()...)
+	}
+	return nodes
+}
+
+// hasMatchingNode 関数は、自身以下のノードに、topic の i バイト目以降のレベルで表されるトピック（ワイルドカードを含まない）に
+// マッチする、Subscriber が存在するトピックがあるかどうかを返す
+// NOTE: 集約用のワイルドカードトピックで受信したメッセージごとに呼び出されるため、メモリ割り当てを行わないこと
+func (s *node) hasMatchingNode(topic string, i int) bool {
+	if i > len(topic) {
+		return s.topic != "" && s.GetSubCnt() > 0
+	}
+	if s.HasActiveWildcardNode() {
+		return true
+	}
+	level, next := topicscheme.NextLevel(topic, i)
+	if n, ok := s.children.get("+"); ok && n.hasMatchingNode(topic, next) {
+		return true
+	}
+	n, ok := s.children.get(level)
+	return ok && n.hasMatchingNode(topic, next)
+}
+
+//////////////            以上、集約 関連                  //////////////
 //////////////           以下、nodeMap 関連                //////////////
 
 type nodeMap struct {
@@ -315,6 +924,35 @@ func (s *nodeMap) Load(key string) (*node, error) {
 	return t, nil
 }
 
+// get 関数は、Load 関数と異なり、キーが存在しない場合にエラーを生成しない
+// NOTE: Subscribe 要求やメッセージごとに呼び出される関数では、メモリ割り当てを避けるためこちらを使用する
+func (s *nodeMap) get(key string) (*node, bool) {
+	v, ok := s.s.Load(key)
+	if !ok {
+		return nil, false
+	}
+	n, ok := v.(*node)
+	return n, ok
+}
+
+// rangeNodes 関数は、全ての子ノードについて f を呼び出す（f が false を返した場合は終了する）
+// NOTE: Keys 関数と異なりメモリ割り当てを行わない
+func (s *nodeMap) rangeNodes(f func(key string, n *node) bool) {
+	s.s.Range(func(key, value interface{}) bool {
+		k, _ := key.(string)
+		n, ok := value.(*node)
+		if !ok {
+			return true
+		}
+		return f(k, n)
+	})
+}
+
+// Delete 関数
+func (s *nodeMap) Delete(key string) {
+	s.s.Delete(key)
+}
+
 func (s *nodeMap) Keys() []string {
 	ks := []string{}
 	s.s.Range(func(key, _ interface{}) bool {
@@ -339,6 +977,12 @@ type node struct {
 	subCntMu sync.RWMutex
 	subCnt   uint
 	topic    string
+	// 集約用のワイルドカードトピックを表す場合の、メッセージをフィルタリングするハンドラ（集約されていない場合は nil）
+	aggregateHandler mqtt.MessageHandler
+	// 集約の判定に使用する、自身の被覆率と子孫ノードの有効なトピックの数（集約が有効な場合のみ updateAggregationState 関数で更新する）
+	// NOTE: Subsctable の変更と同じゴルーチンでのみ参照・更新する
+	coverage         float64
+	descendantTopics uint
 }
 
 // 再帰的に node 構造体を JSON 形式の文字列に変換する
@@ -367,14 +1011,6 @@ func (n *node) String() string {
 	return result
 }
 
-func (s *node) HasActiveWildcardNode() bool {
-	n, err := s.children.Load("#")
-	if err != nil {
-		return false
-	}
-	return n.GetSubCnt() > 0
-}
-
 func (s *node) GetSubCnt() uint {
 	s.subCntMu.RLock()
 	defer s.subCntMu.RUnlock()
@@ -393,6 +1029,12 @@ func (s *node) AddSubCnt() error {
 	return MaxSubCntError{Msg: fmt.Sprintf("Already reached max ubCnt (%v)", maxSubCnt)}
 }
 
+func (s *node) setSubCnt(cnt uint) {
+	s.subCntMu.Lock()
+	defer s.subCntMu.Unlock()
+	s.subCnt = cnt
+}
+
 func (s *node) DecreaseSubCnt() error {
 	s.subCntMu.Lock()
 	defer s.subCntMu.Unlock()
@@ -404,87 +1046,271 @@ func (s *node) DecreaseSubCnt() error {
 	return ZeroSubCntError{Msg: "SubCnt is already zero"}
 }
 
-// 子ノードが Subscribe している Topic を必要に応じて Subscribe する
-func (s *node) SubscribeChildrenTopics(c mqtt.Client, qos byte, callback mqtt.MessageHandler) {
-	// 子ノードに有効なワイルドカードノードが存在する場合は、そのワイルドカードトピックのみを Subscribe し、
-	// 自身や他の子ノードのトピックは Subscribe しない
-	if s.HasActiveWildcardNode() {
-		n, err := s.children.Load("#")
+func (s *node) HasActiveWildcardNode() bool {
+	n, ok := s.children.get("#")
+	return ok && n.GetSubCnt() > 0
+}
+
+// HasActiveSingleLevelWildcardNode 関数は、子ノードに有効な "+" ノードが存在するかどうかを返す
+func (s *node) HasActiveSingleLevelWildcardNode() bool {
+	n, ok := s.children.get("+")
+	return ok && n.GetSubCnt() > 0
+}
+
+// isActive 関数は、ノードのトピックが Subscribe されるべきかどうか（Subscriber が存在する、または集約用のトピックである）を返す
+func (s *node) isActive() bool {
+	return s.topic != "" && (s.GetSubCnt() > 0 || s.isAggregated())
+}
+
+// isAggregated 関数は、ノードが集約用のワイルドカードトピックを表しているかどうかを返す
+func (s *node) isAggregated() bool {
+	return s.getAggregateHandler() != nil
+}
+
+func (s *node) getAggregateHandler() mqtt.MessageHandler {
+	s.subCntMu.RLock()
+	defer s.subCntMu.RUnlock()
+	return s.aggregateHandler
+}
+
+func (s *node) setAggregateHandler(h mqtt.MessageHandler) {
+	s.subCntMu.Lock()
+	defer s.subCntMu.Unlock()
+	s.aggregateHandler = h
+}
+
+func (s *node) loadOrCreateChild(key string) (*node, error) {
+	if n, ok := s.children.get(key); ok {
+		return n, nil
+	}
+	n, err := s.children.Load(key)
+	if _, ok := err.(NotFoundError); ok {
+		if log.IsLevelEnabled(log.DebugLevel) {
+			log.WithFields(log.Fields{
+				"current_node": fmt.Sprint(s),
+				"children":     key,
+			}).Debug("Add children")
+		}
+		newNode := &node{parent: s, children: nodeMap{}}
+		s.children.Store(key, newNode)
+		return newNode, nil
+	}
+	return n, err
+}
+
+func (s *node) loadOrCreateDescendant(levels []string) (*node, error) {
+	currentNode := s
+	for _, child := range levels {
+		var err error
+		currentNode, err = currentNode.loadOrCreateChild(child)
 		if err != nil {
-			log.WithFields(log.Fields{"error": err}).Fatal()
+			return nil, err
 		}
-		if token := c.Subscribe(n.topic, qos, callback); token.Wait() && token.Error() != nil {
-			log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT subscribe error")
+	}
+	return currentNode, nil
+}
+
+// loadOrCreateTopic 関数は、トピック名に対応するノードを返す（ノードが存在しない場合は追加する）
+// NOTE: loadOrCreateDescendant(topicLevels(topic)) と同じだが、トピック名を分割せずに走査する
+func (s *node) loadOrCreateTopic(topic string) (*node, error) {
+	t := strings.TrimPrefix(topic, "/")
+	currentNode := s
+	for i := 0; i <= len(t); {
+		var child string
+		child, i = topicscheme.NextLevel(t, i)
+		var err error
+		currentNode, err = currentNode.loadOrCreateChild(child)
+		if err != nil {
+			return nil, err
 		}
-		return
 	}
+	return currentNode, nil
+}
 
-	// 子ノードに有効なワイルドカードノードが存在しない場合は、自身のトピックの Subscribe を試行する
-	if s.GetSubCnt() > 0 {
-		if token := c.Subscribe(s.topic, qos, callback); token.Wait() && token.Error() != nil {
-			log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT subscribe error")
+// loadTopic 関数は、トピック名に対応するノードを返す
+// NOTE: loadDescendant(topicLevels(topic)) と同じだが、トピック名を分割せずに走査する
+func (s *node) loadTopic(topic string) (*node, error) {
+	t := strings.TrimPrefix(topic, "/")
+	currentNode := s
+	for i := 0; i <= len(t); {
+		var child string
+		child, i = topicscheme.NextLevel(t, i)
+		n, ok := currentNode.children.get(child)
+		if !ok {
+			return nil, NotFoundError{Msg: fmt.Sprintf("Not found (key = %v)", child)}
 		}
+		currentNode = n
 	}
+	return currentNode, nil
+}
 
-	// 子ノードに対して再帰処理を行う
-	keys := s.children.Keys()
-	for _, k := range keys {
-		n, err := s.children.Load(k)
+func (s *node) loadDescendant(levels []string) (*node, error) {
+	currentNode := s
+	for _, child := range levels {
+		var err error
+		currentNode, err = currentNode.children.Load(child)
 		if err != nil {
-			log.WithFields(log.Fields{"error": err}).Error("")
-			continue
+			return nil, err
+		}
+	}
+	return currentNode, nil
+}
+
+// hasCoveringNode 関数は、自身以下のノードに、levels で表されるトピックにマッチする全てのトピックをカバーする
+// 有効なトピック（例: levels が "/0/1/2" の場合の "/0/#", "/0/+/2", "/+/+/+"）が存在するかどうかを返す
+// excludes に含まれるノードは対象外とする
+// NOTE: "/0/#" は "/0" をカバーしない（"/0" より深いレベルのトピックのみを表す）ものとして扱う
+func (s *node) hasCoveringNode(levels []string, excludes ...*node) bool {
+	if len(levels) == 0 {
+		return s.isActive() && !containsNode(excludes, s)
+	}
+	if n, ok := s.children.get("#"); ok && n.isActive() && !containsNode(excludes, n) {
+		return true
+	}
+	if levels[0] == "#" {
+		return false
+	}
+	if n, ok := s.children.get("+"); ok && n.hasCoveringNode(levels[1:], excludes...) {
+		return true
+	}
+	if levels[0] == "+" {
+		return false
+	}
+	n, ok := s.children.get(levels[0])
+	return ok && n.hasCoveringNode(levels[1:], excludes...)
+}
+
+// collectCoveredNodes 関数は、自身以下のノードのうち、levels で表されるトピックフィルタにカバーされる有効なノードを返す
+// exclude は対象外とする
+func (s *node) collectCoveredNodes(levels []string, exclude *node) []*node {
+	nodes := []*node{}
+	if len(levels) == 0 {
+		return nodes
+	}
+	switch levels[0] {
+	case "#":
+		for _, k := range s.children.Keys() {
+			n, err := s.children.Load(k)
+			if err != nil {
+				continue
+			}
+			for _, active := range n.collectActiveNodes() {
+				if active != exclude {
+					nodes = append(nodes, active)
+				}
+			}
+		}
+	case "+":
+		for _, k := range s.children.Keys() {
+			if k == "#" {
+				continue
+			}
+			n, err := s.children.Load(k)
+			if err != nil {
+				continue
+			}
+			nodes = append(nodes, n.collectCoveredNodesOrSelf(levels[1:], exclude)...)
+		}
+	default:
+		n, err := s.children.Load(levels[0])
+		if err != nil {
+			return nodes
 		}
+		nodes = append(nodes, n.collectCoveredNodesOrSelf(levels[1:], exclude)...)
+	}
+	return nodes
+}
 
-		// 再帰関数に渡す
-		n.SubscribeChildrenTopics(c, qos, callback)
+func (s *node) collectCoveredNodesOrSelf(levels []string, exclude *node) []*node {
+	if len(levels) == 0 {
+		if s != exclude && s.isActive() {
+			return []*node{s}
+		}
+		return []*node{}
 	}
+	return s.collectCoveredNodes(levels, exclude)
 }
 
-// 子ノードが Subscribe している Topic を全て Unsubscribe する
-// ただし、node.subCnt はそのまま
-// また、直接の子ノードになるワイルドカードトピックは Unsubscribe しない
-func (s *node) UnsubscribeChildrenTopics(c mqtt.Client) {
-	keys := s.children.Keys()
-	for _, k := range keys {
-		if k == "#" {
-			continue
+// collectIntersectingNodes 関数は、prefix 以下のトピックにマッチし得るワイルドカードトピックを持つ有効なノードのうち、
+// prefix 以下に存在しないノードを返す
+// 例: prefix が "/0/1" の場合の "/#", "/0/#", "/0/+/2", "/+/1"
+// NOTE: isOnPath は、自身が prefix 上の（ワイルドカードを経由していない）ノードかどうかを表す
+func (s *node) collectIntersectingNodes(prefix []string, isOnPath bool) []*node {
+	if len(prefix) == 0 {
+		if isOnPath {
+			// prefix 以下のノードは新たな Subsctable と共有されるため対象外
+			return []*node{}
 		}
+		return s.collectActiveNodes()
+	}
+
+	nodes := []*node{}
+	if n, err := s.children.Load("#"); err == nil && n.isActive() {
+		nodes = append(nodes, n)
+	}
+	if n, err := s.children.Load("+"); err == nil {
+		nodes = append(nodes, n.collectIntersectingNodes(prefix[1:], false)...)
+	}
+	if n, err := s.children.Load(prefix[0]); err == nil {
+		nodes = append(nodes, n.collectIntersectingNodes(prefix[1:], isOnPath)...)
+	}
+	return nodes
+}
+
+// collectActiveNodes 関数は、自身を含む子孫ノードのうち有効なノードを全て返す
+func (s *node) collectActiveNodes() []*node {
+	nodes := []*node{}
+	if s.isActive() {
+		nodes = append(nodes, s)
+	}
+	for _, k := range s.children.Keys() {
 		n, err := s.children.Load(k)
 		if err != nil {
 			log.WithFields(log.Fields{"error": err}).Error("")
 			continue
 		}
-		// Unsubscribe する
-		if n.GetSubCnt() > 0 {
-			if token := c.Unsubscribe(n.topic); token.Wait() && token.Error() != nil {
-				log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT unsubscribe error")
-			}
+		nodes = append(nodes, n.collectActiveNodes()...)
+	}
+	return nodes
+}
+
+func containsNode(nodes []*node, target *node) bool {
+	for _, n := range nodes {
+		if n == target {
+			return true
+		}
+	}
+	return false
+}
+
+// 自身を含む子孫ノードが Subscribe しているトピックのうち、root 以下の他のトピックにカバーされていないものを Subscribe する
+// NOTE: "/0/#" や "/0/+/2" が有効な場合は、それらにカバーされるトピック（"/0/1/2" など）は Subscribe しない
+// handlerFor は、ノードごとのメッセージハンドラを返す関数
+func (s *node) SubscribeChildrenTopics(root *node, c mqtt.Client, qos byte, handlerFor func(*node) mqtt.MessageHandler) {
+	for _, n := range s.collectActiveNodes() {
+		if root.hasCoveringNode(topicLevels(n.topic), n) {
+			continue
+		}
+		if token := c.Subscribe(n.topic, qos, handlerFor(n)); token.Wait() && token.Error() != nil {
+			log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT subscribe error")
 		}
-		// 再帰関数に渡す
-		n.unsubscribeAllChildrenTopics(c)
 	}
 }
 
-// 子ノードが Subscribe している Topic を全て Unsubscribe する
+// 自身を含む子孫ノードが Subscribe しているトピックを全て Unsubscribe する
 // ただし、node.subCnt はそのまま
-func (s *node) unsubscribeAllChildrenTopics(c mqtt.Client) {
-	keys := s.children.Keys()
-	for _, k := range keys {
-		n, err := s.children.Load(k)
-		if err != nil {
-			log.WithFields(log.Fields{"error": err}).Error("")
+// また、root 以下の他のトピックにカバーされている（Subscribe されていない）トピックは Unsubscribe しない
+func (s *node) UnsubscribeChildrenTopics(root *node, c mqtt.Client) error {
+	for _, n := range s.collectActiveNodes() {
+		if root.hasCoveringNode(topicLevels(n.topic), n) {
 			continue
 		}
-		// Unsubscribe する
-		if n.topic != "" && n.GetSubCnt() > 0 {
-			if token := c.Unsubscribe(n.topic); token.Wait() && token.Error() != nil {
-				log.WithFields(log.Fields{"error": token.Error()}).Fatal("MQTT unsubscribe error")
-				return
-			}
+		if token := c.Unsubscribe(n.topic); token.Wait() && token.Error() != nil {
+			log.WithFields(log.Fields{"error": token.Error()}).Error("MQTT unsubscribe error")
+			return token.Error()
 		}
-		// 再帰処理
-		n.unsubscribeAllChildrenTopics(c)
 	}
+	return nil
 }
 
 //////////////            以上、node 関連                  //////////////
@@ -538,4 +1364,14 @@ func (e ZeroSubCntError) Error() string {
 	return fmt.Sprintf("Error: %v", e.Msg)
 }
 
+// AggregationPolicyError 構造体
+// 集約の条件が不正な際に返される
+type AggregationPolicyError struct {
+	Msg string
+}
+
+func (e AggregationPolicyError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
 //////////////           以上、エラー 関連                 //////////////
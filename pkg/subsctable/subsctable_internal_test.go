@@ -1,10 +1,110 @@
 package subsctable
 
 import (
+	"fmt"
+	"gamma/pkg/topicscheme"
+	"math/rand"
 	"reflect"
+	"sort"
+	"sync"
 	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
+//////////////          以下、テスト用 MQTT クライアント    //////////////
+
+// fakeClient 構造体は、Subscribe 中のトピックとメッセージハンドラを記録するだけの mqtt.Client
+type fakeClient struct {
+	mu         sync.Mutex
+	subscribed map[string]mqtt.MessageHandler
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{subscribed: map[string]mqtt.MessageHandler{}}
+}
+
+// deliver 関数は、Subscribe 中のトピック filter のメッセージハンドラへメッセージを渡す
+func (c *fakeClient) deliver(filter, topic string) {
+	c.mu.Lock()
+	h := c.subscribed[filter]
+	c.mu.Unlock()
+	if h != nil {
+		h(c, &fakeMessage{topic: topic})
+	}
+}
+
+func (c *fakeClient) topics() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ts := []string{}
+	for t := range c.subscribed {
+		ts = append(ts, t)
+	}
+	sort.Strings(ts)
+	return ts
+}
+
+func (c *fakeClient) IsConnected() bool      { return true }
+func (c *fakeClient) IsConnectionOpen() bool { return true }
+func (c *fakeClient) Connect() mqtt.Token    { return &fakeToken{} }
+func (c *fakeClient) Disconnect(uint)        {}
+func (c *fakeClient) Publish(string, byte, bool, interface{}) mqtt.Token {
+	return &fakeToken{}
+}
+func (c *fakeClient) Subscribe(topic string, _ byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscribed[topic] = callback
+	return &fakeToken{}
+}
+func (c *fakeClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for t := range filters {
+		c.subscribed[t] = callback
+	}
+	return &fakeToken{}
+}
+func (c *fakeClient) Unsubscribe(topics ...string) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, t := range topics {
+		delete(c.subscribed, t)
+	}
+	return &fakeToken{}
+}
+func (c *fakeClient) AddRoute(string, mqtt.MessageHandler) {}
+func (c *fakeClient) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.NewClient(mqtt.NewClientOptions()).OptionsReader()
+}
+
+type fakeToken struct{}
+
+func (t *fakeToken) Wait() bool                     { return true }
+func (t *fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (t *fakeToken) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+func (t *fakeToken) Error() error { return nil }
+
+type fakeMessage struct {
+	topic string
+}
+
+func (m *fakeMessage) Duplicate() bool   { return false }
+func (m *fakeMessage) Qos() byte         { return 0 }
+func (m *fakeMessage) Retained() bool    { return false }
+func (m *fakeMessage) Topic() string     { return m.topic }
+func (m *fakeMessage) MessageID() uint16 { return 0 }
+func (m *fakeMessage) Payload() []byte   { return []byte{} }
+func (m *fakeMessage) Ack()              {}
+
+//////////////          以上、テスト用 MQTT クライアント    //////////////
+
 //////////////          以下、Subsctable 関連              //////////////
 func TestValidateTopic(t *testing.T) {
 	type args struct {
@@ -63,6 +163,24 @@ func TestValidateTopic(t *testing.T) {
 				err: nil,
 			},
 		},
+		{
+			name: "Normal scenario 06",
+			args: args{
+				topic: "/0/+/2",
+			},
+			want: want{
+				err: nil,
+			},
+		},
+		{
+			name: "Normal scenario 07",
+			args: args{
+				topic: "/+/+/#",
+			},
+			want: want{
+				err: nil,
+			},
+		},
 		{
 			name: "Error scenario 01",
 			args: args{
@@ -90,6 +208,24 @@ func TestValidateTopic(t *testing.T) {
 				err: TopicNameError{},
 			},
 		},
+		{
+			name: "Error scenario 04",
+			args: args{
+				topic: "/0/hoge/+",
+			},
+			want: want{
+				err: TopicNameError{},
+			},
+		},
+		{
+			name: "Error scenario 05",
+			args: args{
+				topic: "/0/1+",
+			},
+			want: want{
+				err: TopicNameError{},
+			},
+		},
 	}
 	_ = tests
 	for _, tt := range tests {
@@ -108,6 +244,152 @@ func TestValidateTopic(t *testing.T) {
 	}
 }
 
+func TestValidateTopicGeohash(t *testing.T) {
+	topicscheme.SetCurrent(topicscheme.Geohash)
+	defer topicscheme.SetCurrent(topicscheme.Quadkey)
+
+	tests := []struct {
+		name  string
+		topic string
+		want  error
+	}{
+		{name: "Normal scenario 01", topic: "/#", want: nil},
+		{name: "Normal scenario 02", topic: "/x/n/7/6", want: nil},
+		{name: "Normal scenario 03", topic: "/x/n/7/6/#", want: nil},
+		{name: "Normal scenario 04", topic: "/x/n/hoge", want: nil},
+		{name: "Error scenario 01", topic: "/x/n/hoge/#", want: TopicNameError{}},
+		{name: "Error scenario 02", topic: "/x/#/n", want: TopicNameError{}},
+		{name: "Error scenario 03", topic: "/x/n/a-b", want: TopicNameError{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTopic(tt.topic)
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("Expected: %v, Result: %v", tt.want, err)
+				}
+			} else {
+				if err == nil || reflect.ValueOf(err).Type() != reflect.ValueOf(tt.want).Type() {
+					t.Errorf("Expected: %v, Result: %v", tt.want, err)
+				}
+			}
+		})
+	}
+}
+
+// register, unregister を順に実行し、その都度 MQTT クライアントが Subscribe しているトピックを確認する
+func TestIncreaseDecreaseSubscriber(t *testing.T) {
+	type step struct {
+		topic      string
+		isDecrease bool
+		want       []string // Subscribe 中のトピック（ソート済み）
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "Multi level wildcard",
+			steps: []step{
+				{topic: "/0/1", want: []string{"/0/1"}},
+				{topic: "/0/1/2", want: []string{"/0/1", "/0/1/2"}},
+				{topic: "/0/#", want: []string{"/0/#"}},
+				{topic: "/0/1/3", want: []string{"/0/#"}},
+				{topic: "/0/#", isDecrease: true, want: []string{"/0/1", "/0/1/2", "/0/1/3"}},
+			},
+		},
+		{
+			name: "Multi level wildcard does not cover its parent level",
+			steps: []step{
+				{topic: "/0", want: []string{"/0"}},
+				{topic: "/0/#", want: []string{"/0", "/0/#"}},
+			},
+		},
+		{
+			name: "Single level wildcard",
+			steps: []step{
+				{topic: "/0/1/2", want: []string{"/0/1/2"}},
+				{topic: "/0/3/2", want: []string{"/0/1/2", "/0/3/2"}},
+				{topic: "/0/1/3", want: []string{"/0/1/2", "/0/1/3", "/0/3/2"}},
+				{topic: "/0/+/2", want: []string{"/0/+/2", "/0/1/3"}},
+				{topic: "/0/2/2", want: []string{"/0/+/2", "/0/1/3"}},
+				{topic: "/0/+/2", isDecrease: true, want: []string{"/0/1/2", "/0/1/3", "/0/2/2", "/0/3/2"}},
+			},
+		},
+		{
+			name: "Overlapping single level and multi level wildcard",
+			steps: []step{
+				{topic: "/0/+/2", want: []string{"/0/+/2"}},
+				{topic: "/0/1/+", want: []string{"/0/+/2", "/0/1/+"}},
+				{topic: "/0/1/2", want: []string{"/0/+/2", "/0/1/+"}},
+				{topic: "/0/+/#", want: []string{"/0/+/#"}},
+				{topic: "/0/#", want: []string{"/0/#"}},
+				{topic: "/0/+/#", isDecrease: true, want: []string{"/0/#"}},
+				{topic: "/0/#", isDecrease: true, want: []string{"/0/+/2", "/0/1/+"}},
+				{topic: "/0/+/2", isDecrease: true, want: []string{"/0/1/+"}},
+				{topic: "/0/1/+", isDecrease: true, want: []string{"/0/1/2"}},
+			},
+		},
+		{
+			name: "Same topic subscribed twice",
+			steps: []step{
+				{topic: "/0/+", want: []string{"/0/+"}},
+				{topic: "/0/+", want: []string{"/0/+"}},
+				{topic: "/0/1", want: []string{"/0/+"}},
+				{topic: "/0/+", isDecrease: true, want: []string{"/0/+"}},
+				{topic: "/0/+", isDecrease: true, want: []string{"/0/1"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeClient()
+			st := NewSubsctable(c, 0, make(chan mqtt.Message))
+			for i, s := range tt.steps {
+				var err error
+				if s.isDecrease {
+					err = st.DecreaseSubscriber(s.topic)
+				} else {
+					err = st.IncreaseSubscriber(s.topic)
+				}
+				if err != nil {
+					t.Fatalf("step %v (%v): unexpected error %v", i, s.topic, err)
+				}
+				if got := c.topics(); !reflect.DeepEqual(got, s.want) {
+					t.Errorf("step %v (%v): subscribed = %v, expected %v", i, s.topic, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+// 分散ブローカを分割した際に、分割先の分散ブローカでもワイルドカードトピックを Subscribe することを確認する
+func TestGetSubsetSubsctableWithWildcard(t *testing.T) {
+	oldClient := newFakeClient()
+	st := NewSubsctable(oldClient, 0, make(chan mqtt.Message))
+	for _, topic := range []string{"/0/+/2", "/0/1/3", "/0/2/3", "/+/1", "/#", "/0/1/#", "/1/+"} {
+		if err := st.IncreaseSubscriber(topic); err != nil {
+			t.Fatalf("IncreaseSubscriber(%v) = %v", topic, err)
+		}
+	}
+
+	newClient := newFakeClient()
+	subset, err := st.GetSubsetSubsctable(newClient, 0, make(chan mqtt.Message), "/0/1")
+	if err != nil {
+		t.Fatalf("GetSubsetSubsctable() = %v", err)
+	}
+	subset.SubscribeAll()
+	if got, want := newClient.topics(), []string{"/#"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("subscribed = %v, expected %v", got, want)
+	}
+	if err := subset.DecreaseSubscriber("/#"); err != nil {
+		t.Fatalf("DecreaseSubscriber() = %v", err)
+	}
+	if got, want := newClient.topics(), []string{"/+/1", "/0/+/2", "/0/1/#"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("subscribed = %v, expected %v", got, want)
+	}
+}
+
 //////////////          以上、Subsctable 関連              //////////////
 //////////////           以下、nodeMap 関連                //////////////
 
@@ -115,3 +397,419 @@ func TestValidateTopic(t *testing.T) {
 //////////////            以下、node 関連                  //////////////
 
 //////////////            以上、node 関連                  //////////////
+
+func TestAggregationPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy AggregationPolicy
+		isErr  bool
+	}{
+		{name: "Normal scenario 01 (disabled)", policy: AggregationPolicy{}},
+		{name: "Normal scenario 02", policy: AggregationPolicy{Threshold: 0.75, ReleaseThreshold: 0.5, MinTopics: 2}},
+		{name: "Normal scenario 03 (境界値)", policy: AggregationPolicy{Threshold: 1, ReleaseThreshold: 1}},
+		{name: "Error scenario 01 (threshold)", policy: AggregationPolicy{Threshold: 1.5, ReleaseThreshold: 0.5}, isErr: true},
+		{name: "Error scenario 02 (release threshold > threshold)", policy: AggregationPolicy{Threshold: 0.5, ReleaseThreshold: 0.75}, isErr: true},
+		{name: "Error scenario 03 (release threshold = 0)", policy: AggregationPolicy{Threshold: 0.5}, isErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Validate()
+			if tt.isErr {
+				if _, ok := err.(AggregationPolicyError); !ok {
+					t.Errorf("Validate() = %v (Type: %T), expected %T", err, err, AggregationPolicyError{})
+				}
+			} else if err != nil {
+				t.Errorf("Validate() = %v, expected nil", err)
+			}
+		})
+	}
+}
+
+func TestAggregation(t *testing.T) {
+	type step struct {
+		topic      string
+		isDecrease bool
+		want       []string // Subscribe 中のトピック
+	}
+	tests := []struct {
+		name   string
+		policy AggregationPolicy
+		steps  []step
+	}{
+		{
+			name:   "Aggregate all children and release with hysteresis",
+			policy: AggregationPolicy{Threshold: 1, ReleaseThreshold: 0.5, MinTopics: 2},
+			steps: []step{
+				{topic: "/0/1/0", want: []string{"/0/1/0"}},
+				{topic: "/0/1/1", want: []string{"/0/1/0", "/0/1/1"}},
+				{topic: "/0/1/2", want: []string{"/0/1/0", "/0/1/1", "/0/1/2"}},
+				{topic: "/0/1/3", want: []string{"/0/1/#"}},
+				{topic: "/0/1/3/2", want: []string{"/0/1/#"}},
+				{topic: "/0/1/3/2", isDecrease: true, want: []string{"/0/1/#"}},
+				{topic: "/0/1/2", isDecrease: true, want: []string{"/0/1/#"}},
+				{topic: "/0/1/1", isDecrease: true, want: []string{"/0/1/#"}},
+				{topic: "/0/1/0", isDecrease: true, want: []string{"/0/1/3"}},
+			},
+		},
+		{
+			name:   "Aggregate deep leaves into the highest node",
+			policy: AggregationPolicy{Threshold: 0.25, ReleaseThreshold: 0.15, MinTopics: 2},
+			steps: []step{
+				{topic: "/0/1/0/0", want: []string{"/0/1/0/0"}},
+				{topic: "/0/1/0/1", want: []string{"/0/1/0/#"}},
+				{topic: "/0/1/1/0", want: []string{"/0/1/0/#", "/0/1/1/0"}},
+				{topic: "/0/1/1/1", want: []string{"/0/1/#"}},
+				{topic: "/0/1/1/1", isDecrease: true, want: []string{"/0/1/#"}},
+				{topic: "/0/1/0/1", isDecrease: true, want: []string{"/0/1/0/0", "/0/1/1/0"}},
+				{topic: "/0/1/0/1", want: []string{"/0/1/0/#", "/0/1/1/0"}},
+			},
+		},
+		{
+			name:   "Real subscriber of aggregated wildcard topic",
+			policy: AggregationPolicy{Threshold: 1, ReleaseThreshold: 0.5, MinTopics: 2},
+			steps: []step{
+				{topic: "/0/+", want: []string{"/0/+"}},
+				{topic: "/0/1/2", want: []string{"/0/#"}},
+				{topic: "/0/#", want: []string{"/0/#"}},
+				{topic: "/0/#", isDecrease: true, want: []string{"/0/#"}},
+				{topic: "/0/+", isDecrease: true, want: []string{"/0/1/2"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeClient()
+			st := NewSubsctable(c, 0, make(chan mqtt.Message))
+			if err := st.SetAggregationPolicy(tt.policy); err != nil {
+				t.Fatalf("SetAggregationPolicy() error = %v", err)
+			}
+			for i, s := range tt.steps {
+				var err error
+				if s.isDecrease {
+					err = st.DecreaseSubscriber(s.topic)
+				} else {
+					err = st.IncreaseSubscriber(s.topic)
+				}
+				if err != nil {
+					t.Fatalf("step %v (%v): unexpected error %v", i, s.topic, err)
+				}
+				if got := c.topics(); !reflect.DeepEqual(got, s.want) {
+					t.Errorf("step %v (%v): subscribed = %v, expected %v", i, s.topic, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+// Subscriber 数の増減時に祖先ノードのみで判定した集約が、全てのノードで判定し直した場合と一致することを確認する
+func TestAggregationAlongTopic(t *testing.T) {
+	c := newFakeClient()
+	st := NewSubsctable(c, 0, make(chan mqtt.Message)).(*subsctable)
+	if err := st.SetAggregationPolicy(AggregationPolicy{Threshold: 0.5, ReleaseThreshold: 0.25, MinTopics: 2}); err != nil {
+		t.Fatalf("SetAggregationPolicy() error = %v", err)
+	}
+	topics := []string{"/0/1/0", "/0/1/1/2", "/0/1/2", "/0/1/+", "/0/2/3", "/0/1/3/0", "/0/1/#", "/0/2/1/data", "/0/3", "/0/+/0"}
+	rnd := rand.New(rand.NewSource(1))
+	counts := map[string]int{}
+	for i := 0; i < 500; i++ {
+		topic := topics[rnd.Intn(len(topics))]
+		var err error
+		if counts[topic] > 0 && rnd.Intn(2) == 0 {
+			counts[topic]--
+			err = st.DecreaseSubscriber(topic)
+		} else {
+			counts[topic]++
+			err = st.IncreaseSubscriber(topic)
+		}
+		if err != nil {
+			t.Fatalf("step %v (%v): unexpected error %v", i, topic, err)
+		}
+		got := c.topics()
+		if err := st.rebalanceAggregation(); err != nil {
+			t.Fatalf("step %v (%v): rebalanceAggregation() error = %v", i, topic, err)
+		}
+		if want := c.topics(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("step %v (%v): subscribed = %v, expected %v", i, topic, got, want)
+		}
+	}
+}
+
+// 集約用のワイルドカードトピックで受信したメッセージは、有効なトピックにマッチするもののみ転送されることを確認する
+func TestAggregationFilter(t *testing.T) {
+	c := newFakeClient()
+	ch := make(chan mqtt.Message, 10)
+	st := NewSubsctable(c, 0, ch)
+	if err := st.SetAggregationPolicy(AggregationPolicy{Threshold: 1, ReleaseThreshold: 0.5, MinTopics: 2}); err != nil {
+		t.Fatalf("SetAggregationPolicy() error = %v", err)
+	}
+	for _, topic := range []string{"/0/+", "/0/1/2"} {
+		if err := st.IncreaseSubscriber(topic); err != nil {
+			t.Fatalf("IncreaseSubscriber() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		topic       string
+		isForwarded bool
+	}{
+		{topic: "/0/3", isForwarded: true},
+		{topic: "/0/1/2", isForwarded: true},
+		{topic: "/0/1/3", isForwarded: false},
+		{topic: "/0/3/1/2", isForwarded: false},
+	}
+	for _, tt := range tests {
+		c.deliver("/0/#", tt.topic)
+		if got := len(ch) == 1; got != tt.isForwarded {
+			t.Errorf("topic = %v, forwarded = %v, expected %v", tt.topic, got, tt.isForwarded)
+		}
+		for len(ch) > 0 {
+			<-ch
+		}
+	}
+
+	// 集約を無効にすると、元のトピックを Subscribe し直す
+	if err := st.SetAggregationPolicy(AggregationPolicy{}); err != nil {
+		t.Fatalf("SetAggregationPolicy() error = %v", err)
+	}
+	if got, want := c.topics(), []string{"/0/+", "/0/1/2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("subscribed = %v, expected %v", got, want)
+	}
+}
+
+func TestUnsubscribeSubsetTopics(t *testing.T) {
+	c := newFakeClient()
+	st := NewSubsctable(c, 0, make(chan mqtt.Message))
+	for _, topic := range []string{"/0/1/2", "/0/1/2", "/0/1/3", "/0/2/0", "/0/+/2"} {
+		if err := st.IncreaseSubscriber(topic); err != nil {
+			t.Fatalf("IncreaseSubscriber() error = %v", err)
+		}
+	}
+	newClient := newFakeClient()
+	newSt, err := st.GetSubsetSubsctable(newClient, 0, make(chan mqtt.Message), "/0/1")
+	if err != nil {
+		t.Fatalf("GetSubsetSubsctable() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		topic     string
+		wantMoved uint
+		wantCnt   uint
+		want      []string // Subscribe 中のトピック
+	}{
+		{name: "Normal scenario 01", topic: "/0/1", wantMoved: 3, wantCnt: 2, want: []string{"/0/+/2", "/0/2/0"}},
+		{name: "Normal scenario 02 (already detached)", topic: "/0/1", wantMoved: 0, wantCnt: 2, want: []string{"/0/+/2", "/0/2/0"}},
+		{name: "Normal scenario 03 (not found)", topic: "/0/3/1", wantMoved: 0, wantCnt: 2, want: []string{"/0/+/2", "/0/2/0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			moved, err := st.UnsubscribeSubsetTopics(tt.topic)
+			if err != nil {
+				t.Fatalf("UnsubscribeSubsetTopics() error = %v", err)
+			}
+			if moved != tt.wantMoved {
+				t.Errorf("UnsubscribeSubsetTopics() = %v, expected %v", moved, tt.wantMoved)
+			}
+			if got := st.CountSubscribers(); got != tt.wantCnt {
+				t.Errorf("CountSubscribers() = %v, expected %v", got, tt.wantCnt)
+			}
+			if got := c.topics(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("subscribed = %v, expected %v", got, tt.want)
+			}
+		})
+	}
+
+	// 切り離したトピックと、複製したワイルドカードトピックは新たな Subsctable に残る
+	if got := newSt.CountSubscribers(); got != 4 {
+		t.Errorf("CountSubscribers() of new subsctable = %v, expected %v", got, 4)
+	}
+}
+
+func TestMergeSubsctable(t *testing.T) {
+	c := newFakeClient()
+	st := NewSubsctable(c, 0, make(chan mqtt.Message))
+	for _, topic := range []string{"/0/1/2", "/0/1/2", "/0/1/3", "/0/2/0", "/0/+/2"} {
+		if err := st.IncreaseSubscriber(topic); err != nil {
+			t.Fatalf("IncreaseSubscriber() error = %v", err)
+		}
+	}
+	childClient := newFakeClient()
+	child, err := st.GetSubsetSubsctable(childClient, 0, make(chan mqtt.Message), "/0/1")
+	if err != nil {
+		t.Fatalf("GetSubsetSubsctable() error = %v", err)
+	}
+	if _, err := st.UnsubscribeSubsetTopics("/0/1"); err != nil {
+		t.Fatalf("UnsubscribeSubsetTopics() error = %v", err)
+	}
+
+	// 分割後の Subscribe 要求
+	// "/0/1/1": child のみ, "/0/+/2": 両方, "/+/1/0": child のみ（親側の登録漏れ）, "/0/1/3": 親のみ（brokertable 更新前）
+	for _, topic := range []string{"/0/1/1", "/0/+/2", "/+/1/0"} {
+		if err := child.IncreaseSubscriber(topic); err != nil {
+			t.Fatalf("IncreaseSubscriber() error = %v", err)
+		}
+	}
+	for _, topic := range []string{"/0/+/2", "/0/1/3"} {
+		if err := st.IncreaseSubscriber(topic); err != nil {
+			t.Fatalf("IncreaseSubscriber() error = %v", err)
+		}
+	}
+	beforeCnt := st.CountSubscribers()
+
+	merged, err := st.MergeSubsctable(child, "/0/1")
+	if err != nil {
+		t.Fatalf("MergeSubsctable() error = %v", err)
+	}
+
+	// "/0/1/2" x2, "/0/1/3", "/0/1/1", "/+/1/0"
+	if merged != 5 {
+		t.Errorf("MergeSubsctable() = %v, expected %v", merged, 5)
+	}
+	if got := st.CountSubscribers(); got != beforeCnt+merged {
+		t.Errorf("CountSubscribers() = %v, expected %v", got, beforeCnt+merged)
+	}
+
+	tests := []struct {
+		name  string
+		topic string
+		want  uint
+	}{
+		{name: "Normal scenario 01 (summed)", topic: "/0/1/3", want: 2},
+		{name: "Normal scenario 02 (moved)", topic: "/0/1/2", want: 2},
+		{name: "Normal scenario 03 (wildcard in both trees)", topic: "/0/+/2", want: 2},
+		{name: "Normal scenario 04 (wildcard only in child)", topic: "/+/1/0", want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := st.getRootNode().loadDescendant(topicLevels(tt.topic))
+			if err != nil {
+				t.Fatalf("loadDescendant() error = %v", err)
+			}
+			if got := n.GetSubCnt(); got != tt.want {
+				t.Errorf("subCnt = %v, expected %v", got, tt.want)
+			}
+		})
+	}
+
+	want := []string{"/+/1/0", "/0/+/2", "/0/1/1", "/0/1/3", "/0/2/0"}
+	if got := c.topics(); !reflect.DeepEqual(got, want) {
+		t.Errorf("subscribed = %v, expected %v", got, want)
+	}
+}
+
+// フェイルオーバー時に、集約用のワイルドカードトピックを含めて新たなクライアントで Subscribe し直すことを確認する
+func TestReplaceClient(t *testing.T) {
+	oldClient := newFakeClient()
+	ch := make(chan mqtt.Message, 10)
+	st := NewSubsctable(oldClient, 0, ch)
+	if err := st.SetAggregationPolicy(AggregationPolicy{Threshold: 1, ReleaseThreshold: 0.5, MinTopics: 2}); err != nil {
+		t.Fatalf("SetAggregationPolicy() error = %v", err)
+	}
+	for _, topic := range []string{"/0/+", "/0/1/2", "/1/2"} {
+		if err := st.IncreaseSubscriber(topic); err != nil {
+			t.Fatalf("IncreaseSubscriber() error = %v", err)
+		}
+	}
+
+	newClient := newFakeClient()
+	st.ReplaceClient(newClient)
+	if got, want := newClient.topics(), oldClient.topics(); !reflect.DeepEqual(got, want) {
+		t.Errorf("subscribed = %v, expected %v", got, want)
+	}
+
+	// 集約用のワイルドカードトピックのメッセージハンドラは、引き続きフィルタリングを行う
+	newClient.deliver("/0/#", "/0/1/3")
+	newClient.deliver("/0/#", "/0/1/2")
+	if len(ch) != 1 {
+		t.Errorf("forwarded = %v, expected %v", len(ch), 1)
+	}
+}
+
+func BenchmarkIncreaseDecreaseSubscriber(b *testing.B) {
+	c := newFakeClient()
+	st := NewSubsctable(c, 0, make(chan mqtt.Message))
+	// Subscribe 済みのトピックに対する Subscriber の増減（MQTT の Subscribe が発生しない経路）を計測する
+	topic := "/0/1/2/3/0/1"
+	if err := st.IncreaseSubscriber(topic); err != nil {
+		b.Fatalf("IncreaseSubscriber() error = %v", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := st.IncreaseSubscriber(topic); err != nil {
+			b.Fatalf("IncreaseSubscriber() error = %v", err)
+		}
+		if err := st.DecreaseSubscriber(topic); err != nil {
+			b.Fatalf("DecreaseSubscriber() error = %v", err)
+		}
+	}
+}
+
+func BenchmarkIncreaseDecreaseSubscriberWithAggregation(b *testing.B) {
+	c := newFakeClient()
+	st := NewSubsctable(c, 0, make(chan mqtt.Message))
+	if err := st.SetAggregationPolicy(AggregationPolicy{Threshold: 1, ReleaseThreshold: 0.5, MinTopics: 2}); err != nil {
+		b.Fatalf("SetAggregationPolicy() error = %v", err)
+	}
+	// 集約されないトピック（各ノードの子ノードのうち 3 つ）を登録し、ノード数の多い Subsctable を計測する
+	for i := 0; i < 3*3*3*3; i++ {
+		topic := fmt.Sprintf("/0/%v/%v/%v/%v", i/27, i/9%3, i/3%3, i%3)
+		if err := st.IncreaseSubscriber(topic); err != nil {
+			b.Fatalf("IncreaseSubscriber() error = %v", err)
+		}
+	}
+	// Subscribe 済みのトピックに対する Subscriber の増減（MQTT の Subscribe・集約の変更が発生しない経路）を計測する
+	topic := "/0/1/2/0/1"
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := st.IncreaseSubscriber(topic); err != nil {
+			b.Fatalf("IncreaseSubscriber() error = %v", err)
+		}
+		if err := st.DecreaseSubscriber(topic); err != nil {
+			b.Fatalf("DecreaseSubscriber() error = %v", err)
+		}
+	}
+}
+
+func BenchmarkAggregationFilter(b *testing.B) {
+	c := newFakeClient()
+	st := NewSubsctable(c, 0, make(chan mqtt.Message, 1))
+	if err := st.SetAggregationPolicy(AggregationPolicy{Threshold: 1, ReleaseThreshold: 0.5, MinTopics: 2}); err != nil {
+		b.Fatalf("SetAggregationPolicy() error = %v", err)
+	}
+	for _, topic := range []string{"/0/+", "/0/1/2"} {
+		if err := st.IncreaseSubscriber(topic); err != nil {
+			b.Fatalf("IncreaseSubscriber() error = %v", err)
+		}
+	}
+	c.mu.Lock()
+	h := c.subscribed["/0/#"]
+	c.mu.Unlock()
+	// 転送されないメッセージ（フィルタリングのみ）を計測する
+	msg := &fakeMessage{topic: "/0/1/3"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h(c, msg)
+	}
+}
+
+func TestCountSubscribersByTopic(t *testing.T) {
+	st := NewSubsctable(newFakeClient(), 0, make(chan mqtt.Message))
+	for _, topic := range []string{"/0/1/2", "/0/1/2", "/0/1", "/0/+/2"} {
+		if err := st.IncreaseSubscriber(topic); err != nil {
+			t.Fatalf("IncreaseSubscriber() error = %v", err)
+		}
+	}
+	if err := st.DecreaseSubscriber("/0/1"); err != nil {
+		t.Fatalf("DecreaseSubscriber() error = %v", err)
+	}
+	want := map[string]uint{"/0/1/2": 2, "/0/+/2": 1}
+	if got := st.CountSubscribersByTopic(); !reflect.DeepEqual(got, want) {
+		t.Errorf("CountSubscribersByTopic() = %v, expected %v", got, want)
+	}
+}
@@ -0,0 +1,389 @@
+package topicscheme
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
+)
+
+//////////////        以下、Scheme 関連              //////////////
+
+// Scheme is the interface definition
+// ルーティング用トピック（"/" 区切りの各レベルが空間の分割に対応するトピック）の形式を表す
+type Scheme interface {
+	Name() string
+	// ValidateLevel は、深さ depth (先頭レベルが 0) のレベル名として level が有効かどうかを返す
+	ValidateLevel(depth int, level string) bool
+	// Fanout は、深さ depth のノードが持ち得る子ノードの数を返す（上限が無い場合は 0）
+	Fanout(depth int) int
+	// Pattern は、エラーメッセージ用にトピック名の形式を正規表現で返す
+	Pattern() string
+}
+
+var current atomic.Value
+
+func init() {
+	current.Store(schemeHolder{s: Quadkey})
+}
+
+// NOTE: atomic.Value には常に同じ型を格納する必要があるため、ラップしている
+type schemeHolder struct {
+	s Scheme
+}
+
+// Current 関数は、プロセス全体で使用するトピックスキームを返す
+func Current() Scheme {
+	return current.Load().(schemeHolder).s
+}
+
+// SetCurrent 関数は、プロセス全体で使用するトピックスキームを設定する
+// 起動時に一度だけ呼び出すことを想定している
+func SetCurrent(s Scheme) {
+	current.Store(schemeHolder{s: s})
+}
+
+// Lookup 関数は、名前からトピックスキームを検索する
+func Lookup(name string) (Scheme, error) {
+	for _, s := range []Scheme{Quadkey, Geohash} {
+		if s.Name() == name {
+			return s, nil
+		}
+	}
+	return nil, UnknownSchemeError{Msg: fmt.Sprintf("Unknown topic scheme (%v). Allowed topic schemes are '%v' and '%v'.", name, Quadkey.Name(), Geohash.Name())}
+}
+
+// ValidateTopic 関数は、与えられたトピック名がスキームに沿ったルーティング用トピックかどうかを検証する
+// "/" はルートを表す
+// NOTE: メッセージの転送ごとに呼び出されるため、メモリ割り当てを行わないこと（エラー時を除く）
+func ValidateTopic(s Scheme, topic string) error {
+	if topic == "/" {
+		return nil
+	}
+	if !strings.HasPrefix(topic, "/") {
+		return TopicNameError{Msg: fmt.Sprintf("Invalid topic name(%v). Allowed topic name`s regular expressions is '%v' .", topic, s.Pattern())}
+	}
+	depth := 0
+	for i := 1; i <= len(topic); depth++ {
+		var level string
+		level, i = NextLevel(topic, i)
+		if !s.ValidateLevel(depth, level) {
+			return TopicNameError{Msg: fmt.Sprintf("Invalid topic name(%v). Allowed topic name`s regular expressions is '%v' .", topic, s.Pattern())}
+		}
+	}
+	return nil
+}
+
+// ValidateTopicFilter 関数は、与えられたトピックフィルタがスキームに沿っているかどうかを検証する
+// ルーティング用のトピックの各レベルはワイルドカード "+" に置き換えることができ（例: "/0/+/2"）、
+// その後にワイルドカード "#" または任意の単語を 1 レベルだけ付けることができる（例: "/0/+/data"）
+// "" と "/" はルートを表す
+// NOTE: Subscribe 要求ごとに呼び出されるため、メモリ割り当てを行わないこと（エラー時を除く）
+func ValidateTopicFilter(s Scheme, filter string) error {
+	if filter == "" || filter == "/" {
+		return nil
+	}
+	if !strings.HasPrefix(filter, "/") {
+		return newTopicFilterError(s, filter)
+	}
+	depth := 0
+	for i := 1; i <= len(filter); depth++ {
+		var level string
+		level, i = NextLevel(filter, i)
+		if level == "+" || s.ValidateLevel(depth, level) {
+			continue
+		}
+		// ルーティング用のトピックの後には、"#" または任意の単語を最後のレベルにのみ付けることができる
+		if i > len(filter) && (level == "#" || IsWord(level)) {
+			return nil
+		}
+		return newTopicFilterError(s, filter)
+	}
+	return nil
+}
+
+func newTopicFilterError(s Scheme, filter string) error {
+	pattern := strings.TrimSuffix(strings.TrimPrefix(s.Pattern(), "^"), "$")
+	return TopicNameError{Msg: fmt.Sprintf("Invalid topic name(%v). Allowed topic name`s regular expressions is '^%v?((/#)|(/[\\w]+))?$' (each level can be replaced by '+') .", filter, pattern)}
+}
+
+// IsWord 関数は、与えられた文字列が正規表現の `[\w]+` に一致するかどうかを返す
+func IsWord(level string) bool {
+	if len(level) == 0 {
+		return false
+	}
+	for i := 0; i < len(level); i++ {
+		c := level[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// NextLevel 関数は、トピック名の i バイト目から始まるレベルと、次のレベルの開始位置を返す
+// 最後のレベルの場合、次のレベルの開始位置は len(topic) より大きくなる
+// strings.Split と異なりメモリ割り当てを行わないため、以下のようにレベルを順に処理する際に使用する
+//
+//	for i := 1; i <= len(topic); {
+//		level, i = NextLevel(topic, i)
+//	}
+func NextLevel(topic string, i int) (string, int) {
+	j := strings.IndexByte(topic[i:], '/')
+	if j < 0 {
+		return topic[i:], len(topic) + 1
+	}
+	return topic[i : i+j], i + j + 1
+}
+
+//////////////        以上、Scheme 関連              //////////////
+//////////////        以下、Quadkey 関連             //////////////
+
+// Quadkey は、先頭レベルが任意の数字列、以降のレベルが 0〜3 の象限番号となるスキーム
+// 例: "/1234567890/0/1/2/3"
+var Quadkey Scheme = quadkey{}
+
+type quadkey struct{}
+
+func (quadkey) Name() string {
+	return "quadkey"
+}
+
+func (quadkey) ValidateLevel(depth int, level string) bool {
+	if len(level) == 0 {
+		return false
+	}
+	if depth == 0 {
+		for i := 0; i < len(level); i++ {
+			if level[i] < '0' || '9' < level[i] {
+				return false
+			}
+		}
+		return true
+	}
+	return len(level) == 1 && '0' <= level[0] && level[0] <= '3'
+}
+
+func (quadkey) Fanout(depth int) int {
+	if depth == 0 {
+		return 0
+	}
+	return 4
+}
+
+func (quadkey) Pattern() string {
+	return "^/([0-9]+(/[0-3])*)?$"
+}
+
+// maxMercatorLat は、Web メルカトル図法で表せる最大の緯度
+var maxMercatorLat = mercatorLat(0)
+
+// QuadkeyTopicBounds 関数は、quadkey トピックが表すタイル（Web メルカトル図法）の矩形範囲を返す
+// NOTE: 先頭レベル（任意の数字列）は空間の分割に対応しないため、"/" および先頭レベルのみのトピックは全球を表す
+// 2 番目以降のレベルを Bing Maps の quadkey（0: 北西, 1: 北東, 2: 南西, 3: 南東）として扱う
+// 例: "/0/1/2" => quadkey "12"
+func QuadkeyTopicBounds(topic string) (Bounds, error) {
+	b := Bounds{MinLat: -maxMercatorLat, MinLon: -180, MaxLat: maxMercatorLat, MaxLon: 180}
+	if err := ValidateTopic(Quadkey, topic); err != nil {
+		return b, err
+	}
+	levels := strings.Split(topic, "/")
+	if len(levels) <= 2 {
+		return b, nil
+	}
+	x, y, n := 0, 0, 1
+	for _, level := range levels[2:] {
+		d := int(level[0] - '0')
+		x = x*2 + d&1
+		y = y*2 + (d>>1)&1
+		n *= 2
+	}
+	return Bounds{
+		MinLat: mercatorLat(float64(y+1) / float64(n)),
+		MinLon: float64(x)/float64(n)*360 - 180,
+		MaxLat: mercatorLat(float64(y) / float64(n)),
+		MaxLon: float64(x+1)/float64(n)*360 - 180,
+	}, nil
+}
+
+// mercatorLat 関数は、Web メルカトル図法の北端を 0、南端を 1 とした位置 y の緯度を返す
+func mercatorLat(y float64) float64 {
+	return math.Atan(math.Sinh(math.Pi*(1-2*y))) * 180 / math.Pi
+}
+
+//////////////        以上、Quadkey 関連             //////////////
+//////////////        以下、Geohash 関連             //////////////
+
+// Geohash は、各レベルが geohash の 1 文字となるスキーム
+// 例: "/x/n/7/6" (geohash "xn76")
+var Geohash Scheme = geohash{}
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+type geohash struct{}
+
+func (geohash) Name() string {
+	return "geohash"
+}
+
+func (geohash) ValidateLevel(_ int, level string) bool {
+	return len(level) == 1 && geohashIndex(level[0]) >= 0
+}
+
+func (geohash) Fanout(_ int) int {
+	return len(geohashAlphabet)
+}
+
+func (geohash) Pattern() string {
+	return "^/([0-9b-hjkmnp-z](/[0-9b-hjkmnp-z])*)?$"
+}
+
+func geohashIndex(c byte) int {
+	return strings.IndexByte(geohashAlphabet, c)
+}
+
+// Bounds 構造体は、緯度経度の矩形範囲を表す
+type Bounds struct {
+	MinLat float64 `json:"min_lat"`
+	MinLon float64 `json:"min_lon"`
+	MaxLat float64 `json:"max_lat"`
+	MaxLon float64 `json:"max_lon"`
+}
+
+// Center 関数は、矩形範囲の中心座標を返す
+func (b Bounds) Center() (float64, float64) {
+	return (b.MinLat + b.MaxLat) / 2, (b.MinLon + b.MaxLon) / 2
+}
+
+// GeohashTopicFromLatLon 関数は、緯度経度から指定した長さの geohash トピックを生成する
+// 例: (35.681, 139.767, 4) => "/x/n/7/6"
+func GeohashTopicFromLatLon(lat, lon float64, precision int) (string, error) {
+	if lat < -90 || 90 < lat || lon < -180 || 180 < lon {
+		return "", CoordinateError{Msg: fmt.Sprintf("Invalid coordinate (lat = %v, lon = %v).", lat, lon)}
+	}
+	if precision < 1 {
+		return "", CoordinateError{Msg: fmt.Sprintf("Invalid precision (%v). Precision must be greater than 0.", precision)}
+	}
+
+	b := Bounds{MinLat: -90, MinLon: -180, MaxLat: 90, MaxLon: 180}
+	var sb strings.Builder
+	isLon := true // geohash は経度のビットから始まる
+	for i := 0; i < precision; i++ {
+		idx := 0
+		for bit := 0; bit < 5; bit++ {
+			idx <<= 1
+			if isLon {
+				mid := (b.MinLon + b.MaxLon) / 2
+				if lon >= mid {
+					idx |= 1
+					b.MinLon = mid
+				} else {
+					b.MaxLon = mid
+				}
+			} else {
+				mid := (b.MinLat + b.MaxLat) / 2
+				if lat >= mid {
+					idx |= 1
+					b.MinLat = mid
+				} else {
+					b.MaxLat = mid
+				}
+			}
+			isLon = !isLon
+		}
+		sb.WriteByte('/')
+		sb.WriteByte(geohashAlphabet[idx])
+	}
+	return sb.String(), nil
+}
+
+// GeohashTopicBounds 関数は、geohash トピックが表す矩形範囲を返す
+// "/" は全球を表す
+func GeohashTopicBounds(topic string) (Bounds, error) {
+	b := Bounds{MinLat: -90, MinLon: -180, MaxLat: 90, MaxLon: 180}
+	if err := ValidateTopic(Geohash, topic); err != nil {
+		return b, err
+	}
+	if topic == "/" {
+		return b, nil
+	}
+
+	isLon := true
+	for _, level := range strings.Split(topic[1:], "/") {
+		idx := geohashIndex(level[0])
+		for bit := 4; bit >= 0; bit-- {
+			isSet := idx&(1<<uint(bit)) != 0
+			if isLon {
+				mid := (b.MinLon + b.MaxLon) / 2
+				if isSet {
+					b.MinLon = mid
+				} else {
+					b.MaxLon = mid
+				}
+			} else {
+				mid := (b.MinLat + b.MaxLat) / 2
+				if isSet {
+					b.MinLat = mid
+				} else {
+					b.MaxLat = mid
+				}
+			}
+			isLon = !isLon
+		}
+	}
+	return b, nil
+}
+
+// LatLonFromGeohashTopic 関数は、geohash トピックが表す矩形範囲の中心座標を返す
+func LatLonFromGeohashTopic(topic string) (float64, float64, error) {
+	b, err := GeohashTopicBounds(topic)
+	if err != nil {
+		return 0, 0, err
+	}
+	lat, lon := b.Center()
+	return lat, lon, nil
+}
+
+// TopicBounds 関数は、スキーム s のトピックが表す矩形範囲を返す
+func TopicBounds(s Scheme, topic string) (Bounds, error) {
+	switch s {
+	case Quadkey:
+		return QuadkeyTopicBounds(topic)
+	case Geohash:
+		return GeohashTopicBounds(topic)
+	}
+	return Bounds{}, UnknownSchemeError{Msg: fmt.Sprintf("Topic scheme (%v) has no spatial bounds.", s.Name())}
+}
+
+//////////////        以上、Geohash 関連             //////////////
+//////////////        以下、エラー 関連              //////////////
+
+type TopicNameError struct {
+	Msg string
+}
+
+func (e TopicNameError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+// UnknownSchemeError 構造体
+// 存在しないトピックスキーム名が指定された際に返される
+type UnknownSchemeError struct {
+	Msg string
+}
+
+func (e UnknownSchemeError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+// CoordinateError 構造体
+// 緯度経度や geohash の長さが範囲外の際に返される
+type CoordinateError struct {
+	Msg string
+}
+
+func (e CoordinateError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+//////////////        以上、エラー 関連              //////////////
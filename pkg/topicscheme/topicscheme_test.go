@@ -0,0 +1,340 @@
+package topicscheme_test
+
+import (
+	"gamma/pkg/topicscheme"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// テストケース分類
+//   正常系
+//   準正常系（仕様に無いテストケースなど?）
+//   異常系（エラーが発生するテストケース）
+//   境界値
+
+func TestValidateTopic(t *testing.T) {
+	type args struct {
+		scheme topicscheme.Scheme
+		topic  string
+	}
+	tests := []struct {
+		name string
+		args args
+		want error
+	}{
+		{
+			name: "Normal scenario 01 (quadkey)",
+			args: args{scheme: topicscheme.Quadkey, topic: "/1234567890/0/1/2/3"},
+			want: nil,
+		},
+		{
+			name: "Normal scenario 02 (quadkey, root)",
+			args: args{scheme: topicscheme.Quadkey, topic: "/"},
+			want: nil,
+		},
+		{
+			name: "Normal scenario 03 (geohash)",
+			args: args{scheme: topicscheme.Geohash, topic: "/x/n/7/7"},
+			want: nil,
+		},
+		{
+			name: "Normal scenario 04 (geohash, root)",
+			args: args{scheme: topicscheme.Geohash, topic: "/"},
+			want: nil,
+		},
+		{
+			name: "Normal scenario 05 (geohash, 12 characters)",
+			args: args{scheme: topicscheme.Geohash, topic: "/x/n/7/6/u/r/2/6/d/z/b/j"},
+			want: nil,
+		},
+		{
+			name: "Error scenario 01 (quadkey, 境界値)",
+			args: args{scheme: topicscheme.Quadkey, topic: "/1234567890/0/1/2/4"},
+			want: topicscheme.TopicNameError{},
+		},
+		{
+			name: "Error scenario 02 (quadkey, geohash topic)",
+			args: args{scheme: topicscheme.Quadkey, topic: "/x/n/7/7"},
+			want: topicscheme.TopicNameError{},
+		},
+		{
+			name: "Error scenario 03 (geohash, not allowed charactor 'a')",
+			args: args{scheme: topicscheme.Geohash, topic: "/x/n/a"},
+			want: topicscheme.TopicNameError{},
+		},
+		{
+			name: "Error scenario 04 (geohash, not allowed charactor 'i', 'l', 'o')",
+			args: args{scheme: topicscheme.Geohash, topic: "/i/l/o"},
+			want: topicscheme.TopicNameError{},
+		},
+		{
+			name: "Error scenario 05 (geohash, multiple charactors in one level)",
+			args: args{scheme: topicscheme.Geohash, topic: "/xn/7/7"},
+			want: topicscheme.TopicNameError{},
+		},
+		{
+			name: "Error scenario 06 (geohash, wildcard)",
+			args: args{scheme: topicscheme.Geohash, topic: "/x/#"},
+			want: topicscheme.TopicNameError{},
+		},
+		{
+			name: "Error scenario 07 (geohash, trailing slash)",
+			args: args{scheme: topicscheme.Geohash, topic: "/x/n/"},
+			want: topicscheme.TopicNameError{},
+		},
+		{
+			name: "Error scenario 08 (geohash, no leading slash)",
+			args: args{scheme: topicscheme.Geohash, topic: "x/n"},
+			want: topicscheme.TopicNameError{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := topicscheme.ValidateTopic(tt.args.scheme, tt.args.topic)
+			if tt.want == nil {
+				if got != nil {
+					t.Errorf("ValidateTopic() = %v (Type: %T), expected %v (Type: %T)", got, got, tt.want, tt.want)
+				}
+			} else {
+				if got == nil || reflect.ValueOf(got).Type() != reflect.ValueOf(tt.want).Type() {
+					t.Errorf("ValidateTopic() = %v (Type: %T), expected %v (Type: %T)", got, got, tt.want, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		scheme  topicscheme.Scheme
+		filter  string
+		wantErr bool
+	}{
+		{name: "Normal scenario 01 (quadkey, root)", scheme: topicscheme.Quadkey, filter: "/"},
+		{name: "Normal scenario 02 (quadkey, single level wildcard)", scheme: topicscheme.Quadkey, filter: "/0/+/2"},
+		{name: "Normal scenario 03 (quadkey, multi level wildcard)", scheme: topicscheme.Quadkey, filter: "/0/+/#"},
+		{name: "Normal scenario 04 (quadkey, trailing word)", scheme: topicscheme.Quadkey, filter: "/0/+/data"},
+		{name: "Normal scenario 05 (geohash, trailing word)", scheme: topicscheme.Geohash, filter: "/x/+/hoge"},
+		{name: "Error scenario 01 (quadkey, word before routing level)", scheme: topicscheme.Quadkey, filter: "/0/data/1", wantErr: true},
+		{name: "Error scenario 02 (quadkey, multi level wildcard before last level)", scheme: topicscheme.Quadkey, filter: "/0/#/1", wantErr: true},
+		{name: "Error scenario 03 (quadkey, word after multi level wildcard)", scheme: topicscheme.Quadkey, filter: "/0/data/#", wantErr: true},
+		{name: "Error scenario 04 (geohash, no leading slash)", scheme: topicscheme.Geohash, filter: "x/+", wantErr: true},
+		{name: "Error scenario 05 (geohash, not word)", scheme: topicscheme.Geohash, filter: "/x/a-b", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := topicscheme.ValidateTopicFilter(tt.scheme, tt.filter)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateTopicFilter() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		name  string
+		arg   string
+		want  topicscheme.Scheme
+		isErr bool
+	}{
+		{name: "Normal scenario 01", arg: "quadkey", want: topicscheme.Quadkey},
+		{name: "Normal scenario 02", arg: "geohash", want: topicscheme.Geohash},
+		{name: "Error scenario 01", arg: "hoge", isErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := topicscheme.Lookup(tt.arg)
+			if tt.isErr {
+				if _, ok := err.(topicscheme.UnknownSchemeError); !ok {
+					t.Errorf("Lookup() error = %v (Type: %T), expected %T", err, err, topicscheme.UnknownSchemeError{})
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Lookup() = %v, %v, expected %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestGeohashTopicFromLatLon(t *testing.T) {
+	type args struct {
+		lat       float64
+		lon       float64
+		precision int
+	}
+	tests := []struct {
+		name  string
+		args  args
+		want  string
+		isErr bool
+	}{
+		{
+			name: "Normal scenario 01 (Tokyo station)",
+			args: args{lat: 35.681236, lon: 139.767125, precision: 6},
+			want: "/x/n/7/6/u/r",
+		},
+		{
+			name: "Normal scenario 02 (1 character)",
+			args: args{lat: 35.681236, lon: 139.767125, precision: 1},
+			want: "/x",
+		},
+		{
+			name: "Normal scenario 03 (南西端, 境界値)",
+			args: args{lat: -90, lon: -180, precision: 3},
+			want: "/0/0/0",
+		},
+		{
+			name: "Normal scenario 04 (北東端, 境界値)",
+			args: args{lat: 90, lon: 180, precision: 3},
+			want: "/z/z/z",
+		},
+		{
+			name:  "Error scenario 01 (latitude)",
+			args:  args{lat: 90.1, lon: 0, precision: 3},
+			isErr: true,
+		},
+		{
+			name:  "Error scenario 02 (precision)",
+			args:  args{lat: 0, lon: 0, precision: 0},
+			isErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := topicscheme.GeohashTopicFromLatLon(tt.args.lat, tt.args.lon, tt.args.precision)
+			if tt.isErr {
+				if _, ok := err.(topicscheme.CoordinateError); !ok {
+					t.Errorf("GeohashTopicFromLatLon() error = %v (Type: %T), expected %T", err, err, topicscheme.CoordinateError{})
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("GeohashTopicFromLatLon() = %v, %v, expected %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestGeohashTopicBounds(t *testing.T) {
+	tests := []struct {
+		name  string
+		topic string
+		want  topicscheme.Bounds
+		isErr bool
+	}{
+		{
+			name:  "Normal scenario 01 (root)",
+			topic: "/",
+			want:  topicscheme.Bounds{MinLat: -90, MinLon: -180, MaxLat: 90, MaxLon: 180},
+		},
+		{
+			name:  "Normal scenario 02 (1 character)",
+			topic: "/x",
+			want:  topicscheme.Bounds{MinLat: 0, MinLon: 135, MaxLat: 45, MaxLon: 180},
+		},
+		{
+			name:  "Normal scenario 03 (2 characters)",
+			topic: "/x/n",
+			want:  topicscheme.Bounds{MinLat: 33.75, MinLon: 135, MaxLat: 39.375, MaxLon: 146.25},
+		},
+		{
+			name:  "Error scenario 01",
+			topic: "/x/a",
+			isErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := topicscheme.GeohashTopicBounds(tt.topic)
+			if tt.isErr {
+				if err == nil {
+					t.Errorf("GeohashTopicBounds() error = nil, expected %T", topicscheme.TopicNameError{})
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("GeohashTopicBounds() = %v, %v, expected %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// 緯度経度 => トピック => 緯度経度 の変換で、誤差が geohash の精度に収まることを確認する
+func TestGeohashTopicRoundTrip(t *testing.T) {
+	lat, lon := 35.681236, 139.767125
+	for precision := 1; precision <= 12; precision++ {
+		topic, err := topicscheme.GeohashTopicFromLatLon(lat, lon, precision)
+		if err != nil {
+			t.Fatalf("GeohashTopicFromLatLon() error = %v", err)
+		}
+		b, err := topicscheme.GeohashTopicBounds(topic)
+		if err != nil {
+			t.Fatalf("GeohashTopicBounds() error = %v", err)
+		}
+		if lat < b.MinLat || b.MaxLat < lat || lon < b.MinLon || b.MaxLon < lon {
+			t.Errorf("precision = %v, bounds %v does not contain (%v, %v)", precision, b, lat, lon)
+		}
+		centerLat, centerLon, err := topicscheme.LatLonFromGeohashTopic(topic)
+		if err != nil {
+			t.Fatalf("LatLonFromGeohashTopic() error = %v", err)
+		}
+		if math.Abs(centerLat-lat) > (b.MaxLat-b.MinLat)/2 || math.Abs(centerLon-lon) > (b.MaxLon-b.MinLon)/2 {
+			t.Errorf("precision = %v, center (%v, %v) is too far from (%v, %v)", precision, centerLat, centerLon, lat, lon)
+		}
+	}
+}
+
+func TestQuadkeyTopicBounds(t *testing.T) {
+	const maxLat = 85.0511287798066
+	tests := []struct {
+		name  string
+		topic string
+		want  topicscheme.Bounds
+		isErr bool
+	}{
+		{
+			name:  "Normal scenario 01 (root)",
+			topic: "/",
+			want:  topicscheme.Bounds{MinLat: -maxLat, MinLon: -180, MaxLat: maxLat, MaxLon: 180},
+		},
+		{
+			name:  "Normal scenario 02 (first level only)",
+			topic: "/1234",
+			want:  topicscheme.Bounds{MinLat: -maxLat, MinLon: -180, MaxLat: maxLat, MaxLon: 180},
+		},
+		{
+			name:  "Normal scenario 03 (north east)",
+			topic: "/0/1",
+			want:  topicscheme.Bounds{MinLat: 0, MinLon: 0, MaxLat: maxLat, MaxLon: 180},
+		},
+		{
+			name:  "Normal scenario 04 (2 levels)",
+			topic: "/0/2/1",
+			want:  topicscheme.Bounds{MinLat: -66.51326044311186, MinLon: -90, MaxLat: 0, MaxLon: 0},
+		},
+		{
+			name:  "Error scenario 01",
+			topic: "/0/4",
+			isErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := topicscheme.TopicBounds(topicscheme.Quadkey, tt.topic)
+			if tt.isErr {
+				if err == nil {
+					t.Errorf("QuadkeyTopicBounds() error = nil, expected %T", topicscheme.TopicNameError{})
+				}
+				return
+			}
+			near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+			if err != nil || !near(got.MinLat, tt.want.MinLat) || !near(got.MinLon, tt.want.MinLon) || !near(got.MaxLat, tt.want.MaxLat) || !near(got.MaxLon, tt.want.MaxLon) {
+				t.Errorf("QuadkeyTopicBounds() = %v, %v, expected %v", got, err, tt.want)
+			}
+		})
+	}
+}
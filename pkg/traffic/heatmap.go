@@ -0,0 +1,142 @@
+package traffic
+
+import (
+	"encoding/json"
+	"fmt"
+	"gamma/pkg/topicscheme"
+	"sort"
+	"sync"
+	"time"
+)
+
+//////////////        以下、Heatmap 関連             //////////////
+
+// 出力形式
+const (
+	FormatJSON    = "json"
+	FormatGeoJSON = "geojson"
+)
+
+// staleIntervals は、通知の間隔の何倍の期間、次の通知が無い場合に統計を破棄するか
+const staleIntervals = 3
+
+// TileRate 構造体は、全てのゲートウェイの統計を合計した、1 つのタイルの 1 秒あたりのメッセージの数
+type TileRate struct {
+	Topic        string  `json:"topic"`
+	PublishRate  float64 `json:"publish_rate"`
+	DeliveryRate float64 `json:"delivery_rate"`
+	Rate         float64 `json:"rate"` // PublishRate + DeliveryRate
+}
+
+// Heatmap 構造体は、各ゲートウェイ（ワーカ）から最後に通知された統計を保持し、タイルごとに合計する
+type Heatmap struct {
+	mu      sync.Mutex
+	reports map[string]receivedReport // Report.Key() から引く
+}
+
+type receivedReport struct {
+	report   Report
+	received time.Time
+}
+
+// NewHeatmap 関数は、空の Heatmap を生成する
+func NewHeatmap() *Heatmap {
+	return &Heatmap{reports: map[string]receivedReport{}}
+}
+
+// Add 関数は、ゲートウェイから通知された統計を保持する（同じワーカの以前の統計は置き換える）
+func (h *Heatmap) Add(r Report, now time.Time) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reports[r.Key()] = receivedReport{report: r, received: now}
+	return nil
+}
+
+// Tiles 関数は、時刻 now の時点で有効な統計をタイルごとに合計し、トピックの順に返す
+// 通知の間隔の staleIntervals 倍以上、次の通知が無いゲートウェイの統計は破棄する
+// NOTE: ゲートウェイごとに集計するレベルの数が異なる場合は、異なるタイルとして扱う
+func (h *Heatmap) Tiles(now time.Time) []TileRate {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sum := map[string]*TileRate{}
+	for key, rr := range h.reports {
+		interval := time.Duration(rr.report.IntervalSeconds * float64(time.Second))
+		if now.Sub(rr.received) >= staleIntervals*interval {
+			delete(h.reports, key)
+			continue
+		}
+		for _, t := range rr.report.Tiles {
+			tr, ok := sum[t.Topic]
+			if !ok {
+				tr = &TileRate{Topic: t.Topic}
+				sum[t.Topic] = tr
+			}
+			tr.PublishRate += float64(t.Publishes) / rr.report.IntervalSeconds
+			tr.DeliveryRate += float64(t.Deliveries) / rr.report.IntervalSeconds
+		}
+	}
+	result := make([]TileRate, 0, len(sum))
+	for _, tr := range sum {
+		tr.Rate = tr.PublishRate + tr.DeliveryRate
+		result = append(result, *tr)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Topic < result[j].Topic })
+	return result
+}
+
+// Export 関数は、タイルごとの統計を format（FormatJSON, FormatGeoJSON）で出力する
+// GeoJSON の場合は、タイルを scheme の矩形範囲のポリゴンとし、properties に統計を含める
+func Export(tiles []TileRate, format string, scheme topicscheme.Scheme) ([]byte, error) {
+	switch format {
+	case FormatJSON, "":
+		return json.Marshal(tiles)
+	case FormatGeoJSON:
+		return geoJSON(tiles, scheme)
+	}
+	return nil, FormatError{Msg: fmt.Sprintf("Unknown format (%v). Allowed formats are '%v' and '%v'.", format, FormatJSON, FormatGeoJSON)}
+}
+
+type featureCollection struct {
+	Type     string    `json:"type"`
+	Features []feature `json:"features"`
+}
+
+type feature struct {
+	Type       string   `json:"type"`
+	Geometry   geometry `json:"geometry"`
+	Properties TileRate `json:"properties"`
+}
+
+type geometry struct {
+	Type        string         `json:"type"`
+	Coordinates [][][2]float64 `json:"coordinates"`
+}
+
+func geoJSON(tiles []TileRate, scheme topicscheme.Scheme) ([]byte, error) {
+	fc := featureCollection{Type: "FeatureCollection", Features: []feature{}}
+	for _, t := range tiles {
+		b, err := topicscheme.TopicBounds(scheme, t.Topic)
+		if err != nil {
+			return nil, err
+		}
+		// NOTE: GeoJSON の座標は [経度, 緯度] の順で、外周は反時計回りに閉じる
+		ring := [][2]float64{
+			{b.MinLon, b.MinLat},
+			{b.MaxLon, b.MinLat},
+			{b.MaxLon, b.MaxLat},
+			{b.MinLon, b.MaxLat},
+			{b.MinLon, b.MinLat},
+		}
+		fc.Features = append(fc.Features, feature{
+			Type:       "Feature",
+			Geometry:   geometry{Type: "Polygon", Coordinates: [][][2]float64{ring}},
+			Properties: t,
+		})
+	}
+	return json.Marshal(fc)
+}
+
+//////////////        以上、Heatmap 関連             //////////////
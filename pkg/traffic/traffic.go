@@ -0,0 +1,198 @@
+package traffic
+
+import (
+	"fmt"
+	"gamma/pkg/endpoint"
+	"gamma/pkg/topicscheme"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////////////        以下、Policy 関連              //////////////
+
+// Policy 構造体は、ゲートウェイがタイルごとの統計を取り、マネージャへ通知する方法を表す
+type Policy struct {
+	Depth          uint          // 統計を取るトピックのレベルの数（0 の場合は統計を取らない）
+	ReportInterval time.Duration // マネージャへ通知する間隔
+}
+
+// IsEnabled 関数は、統計を取るかどうかを返す
+func (p Policy) IsEnabled() bool {
+	return p.Depth > 0
+}
+
+// Validate 関数は、条件が正しいかどうかを検証する
+func (p Policy) Validate() error {
+	if p.IsEnabled() && p.ReportInterval <= 0 {
+		return PolicyError{Msg: fmt.Sprintf("Invalid report interval (%v). Report interval must be greater than 0 when depth is set.", p.ReportInterval)}
+	}
+	return nil
+}
+
+//////////////        以上、Policy 関連              //////////////
+//////////////        以下、Counter 関連             //////////////
+
+// Counter 構造体は、トピックの先頭 depth レベル（タイル）ごとに、Publish されたメッセージと配送したメッセージを数える
+// NOTE: nil の場合は数えない（統計を取らない）
+type Counter struct {
+	mu    sync.Mutex
+	depth int
+	tiles map[string]*TileCount
+}
+
+// NewCounter 関数は、先頭 depth レベルごとに数える Counter を生成する（depth が 0 の場合は nil）
+func NewCounter(depth uint) *Counter {
+	if depth == 0 {
+		return nil
+	}
+	return &Counter{depth: int(depth), tiles: map[string]*TileCount{}}
+}
+
+// CountPublish 関数は、topic へ Publish されたメッセージ（ゲートウェイブローカ ==> 分散ブローカ）を数える
+func (c *Counter) CountPublish(topic string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tile(topic).Publishes++
+}
+
+// CountDelivery 関数は、topic の Subscriber へ配送したメッセージ（分散ブローカ ==> ゲートウェイブローカ）を数える
+func (c *Counter) CountDelivery(topic string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tile(topic).Deliveries++
+}
+
+// tile 関数は、topic を含むタイルの TileCount を返す（c.mu を取得した状態で呼び出すこと）
+func (c *Counter) tile(topic string) *TileCount {
+	prefix := Prefix(topic, c.depth)
+	t, ok := c.tiles[prefix]
+	if !ok {
+		t = &TileCount{Topic: prefix}
+		c.tiles[prefix] = t
+	}
+	return t
+}
+
+// Depth 関数は、集計するレベルの数を返す
+func (c *Counter) Depth() uint {
+	if c == nil {
+		return 0
+	}
+	return uint(c.depth)
+}
+
+// Flush 関数は、前回の Flush 以降に数えたタイルごとの数をトピックの順に返し、リセットする
+func (c *Counter) Flush() []TileCount {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	tiles := c.tiles
+	c.tiles = map[string]*TileCount{}
+	c.mu.Unlock()
+
+	result := make([]TileCount, 0, len(tiles))
+	for _, t := range tiles {
+		result = append(result, *t)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Topic < result[j].Topic })
+	return result
+}
+
+// Prefix 関数は、topic の先頭 depth レベルを返す（depth レベル以下の場合は topic をそのまま返す）
+// 例: ("/0/1/2/3", 2) => "/0/1"
+func Prefix(topic string, depth int) string {
+	if !strings.HasPrefix(topic, "/") || depth <= 0 {
+		return "/"
+	}
+	for i, n := 1, 0; i <= len(topic); n++ {
+		if n == depth {
+			return topic[:i-1]
+		}
+		_, i = topicscheme.NextLevel(topic, i)
+	}
+	return topic
+}
+
+//////////////        以上、Counter 関連             //////////////
+//////////////        以下、Report 関連              //////////////
+
+// ReportTopic は、ゲートウェイがマネージャへタイルごとの統計を通知するトピック
+const ReportTopic = "/api/notice/gatewaybroker/traffic"
+
+// TileCount 構造体は、1 つのタイルについて数えたメッセージの数
+type TileCount struct {
+	Topic      string `json:"topic"`
+	Publishes  uint64 `json:"publishes"`
+	Deliveries uint64 `json:"deliveries"`
+}
+
+// Report 構造体は、ゲートウェイ（ワーカ）がマネージャへ定期的に通知するタイルごとの統計
+type Report struct {
+	BrokerInfo      endpoint.Endpoint `json:"broker_info"`
+	Worker          uint              `json:"worker,omitempty"`
+	Depth           uint              `json:"depth"`
+	IntervalSeconds float64           `json:"interval_seconds"` // Tiles を数えた期間
+	Tiles           []TileCount       `json:"tiles"`
+}
+
+// Key 関数は、通知したゲートウェイのワーカを識別する文字列を返す
+func (r Report) Key() string {
+	return fmt.Sprintf("%v-%v", r.BrokerInfo.Address(), r.Worker)
+}
+
+// Validate 関数は、通知された統計が正しいかどうかを検証する
+func (r Report) Validate() error {
+	if r.IntervalSeconds <= 0 {
+		return ReportError{Msg: fmt.Sprintf("Invalid interval (%v). Interval must be greater than 0.", r.IntervalSeconds)}
+	}
+	for _, t := range r.Tiles {
+		if !strings.HasPrefix(t.Topic, "/") {
+			return ReportError{Msg: fmt.Sprintf("Invalid tile topic (%v).", t.Topic)}
+		}
+	}
+	return nil
+}
+
+//////////////        以上、Report 関連              //////////////
+//////////////        以下、エラー 関連              //////////////
+
+// PolicyError 構造体
+// 条件が不正な場合に返される
+type PolicyError struct {
+	Msg string
+}
+
+func (e PolicyError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+// ReportError 構造体
+// 通知された統計が不正な場合に返される
+type ReportError struct {
+	Msg string
+}
+
+func (e ReportError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+// FormatError 構造体
+// 存在しない出力形式が指定された場合に返される
+type FormatError struct {
+	Msg string
+}
+
+func (e FormatError) Error() string {
+	return fmt.Sprintf("Error: %v", e.Msg)
+}
+
+//////////////        以上、エラー 関連              //////////////
@@ -0,0 +1,178 @@
+package traffic_test
+
+import (
+	"encoding/json"
+	"gamma/pkg/endpoint"
+	"gamma/pkg/topicscheme"
+	"gamma/pkg/traffic"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPrefix(t *testing.T) {
+	tests := []struct {
+		name  string
+		topic string
+		depth int
+		want  string
+	}{
+		{name: "Normal scenario 01 (truncated)", topic: "/0/1/2/3", depth: 2, want: "/0/1"},
+		{name: "Normal scenario 02 (shorter than depth)", topic: "/0/1", depth: 3, want: "/0/1"},
+		{name: "Normal scenario 03 (same as depth)", topic: "/0/1", depth: 2, want: "/0/1"},
+		{name: "Normal scenario 04 (root)", topic: "/", depth: 2, want: "/"},
+		{name: "Error scenario 01 (no leading slash)", topic: "0/1", depth: 1, want: "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := traffic.Prefix(tt.topic, tt.depth); got != tt.want {
+				t.Errorf("Prefix(%v, %v) = %v, expected %v", tt.topic, tt.depth, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCounter(t *testing.T) {
+	c := traffic.NewCounter(2)
+	c.CountPublish("/0/1/2")
+	c.CountPublish("/0/1/3")
+	c.CountDelivery("/0/1/2")
+	c.CountDelivery("/0/2")
+
+	want := []traffic.TileCount{
+		{Topic: "/0/1", Publishes: 2, Deliveries: 1},
+		{Topic: "/0/2", Publishes: 0, Deliveries: 1},
+	}
+	if got := c.Flush(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Flush() = %+v, expected %+v", got, want)
+	}
+	// Flush 後はリセットされる
+	if got := c.Flush(); len(got) != 0 {
+		t.Errorf("Flush() = %+v, expected empty", got)
+	}
+
+	// depth が 0 の場合は数えない
+	var disabled *traffic.Counter = traffic.NewCounter(0)
+	disabled.CountPublish("/0/1")
+	if disabled != nil || disabled.Flush() != nil {
+		t.Errorf("NewCounter(0) = %v, expected nil", disabled)
+	}
+}
+
+func TestHeatmapTiles(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	h := traffic.NewHeatmap()
+	reports := []traffic.Report{
+		{
+			BrokerInfo:      endpoint.Endpoint{Host: "localhost", Port: 1884},
+			IntervalSeconds: 10,
+			Tiles:           []traffic.TileCount{{Topic: "/0/1", Publishes: 20, Deliveries: 10}},
+		},
+		{
+			BrokerInfo:      endpoint.Endpoint{Host: "localhost", Port: 1885},
+			IntervalSeconds: 5,
+			Tiles:           []traffic.TileCount{{Topic: "/0/1", Publishes: 5}, {Topic: "/0/2", Deliveries: 5}},
+		},
+	}
+	for _, r := range reports {
+		if err := h.Add(r, now); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	if err := h.Add(traffic.Report{IntervalSeconds: 0}, now); err == nil {
+		t.Errorf("Add() error = nil, expected %T", traffic.ReportError{})
+	}
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want []traffic.TileRate
+	}{
+		{
+			name: "Normal scenario 01 (merged)",
+			now:  now.Add(time.Second),
+			want: []traffic.TileRate{
+				{Topic: "/0/1", PublishRate: 3, DeliveryRate: 1, Rate: 4},
+				{Topic: "/0/2", PublishRate: 0, DeliveryRate: 1, Rate: 1},
+			},
+		},
+		{
+			// 1885 は通知の間隔（5 秒）の 3 倍以上、次の通知が無いため破棄する
+			name: "Normal scenario 02 (stale report is dropped)",
+			now:  now.Add(20 * time.Second),
+			want: []traffic.TileRate{
+				{Topic: "/0/1", PublishRate: 2, DeliveryRate: 1, Rate: 3},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := h.Tiles(tt.now); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Tiles() = %+v, expected %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExport(t *testing.T) {
+	tiles := []traffic.TileRate{{Topic: "/x", PublishRate: 2, DeliveryRate: 1, Rate: 3}}
+
+	tests := []struct {
+		name   string
+		format string
+		want   string
+		isErr  bool
+	}{
+		{
+			name:   "Normal scenario 01 (json)",
+			format: traffic.FormatJSON,
+			want:   `[{"topic":"/x","publish_rate":2,"delivery_rate":1,"rate":3}]`,
+		},
+		{
+			name:   "Normal scenario 02 (geojson)",
+			format: traffic.FormatGeoJSON,
+			want:   `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Polygon","coordinates":[[[135,0],[180,0],[180,45],[135,45],[135,0]]]},"properties":{"topic":"/x","publish_rate":2,"delivery_rate":1,"rate":3}}]}`,
+		},
+		{
+			name:   "Error scenario 01 (unknown format)",
+			format: "csv",
+			isErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := traffic.Export(tiles, tt.format, topicscheme.Geohash)
+			if tt.isErr {
+				if err == nil {
+					t.Errorf("Export() error = nil, expected %T", traffic.FormatError{})
+				}
+				return
+			}
+			if err != nil || string(got) != tt.want {
+				t.Errorf("Export() = %v, %v, expected %v", string(got), err, tt.want)
+			}
+			if !json.Valid(got) {
+				t.Errorf("Export() = %v, expected valid JSON", string(got))
+			}
+		})
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  traffic.Policy
+		wantErr bool
+	}{
+		{name: "Normal scenario 01 (disabled)", policy: traffic.Policy{}},
+		{name: "Normal scenario 02 (enabled)", policy: traffic.Policy{Depth: 3, ReportInterval: time.Minute}},
+		{name: "Error scenario 01 (no interval)", policy: traffic.Policy{Depth: 3}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -103,3 +103,29 @@ fi
 # gateway -> manager への通信確認コマンド
 # mosquitto_sub -h localhost -p 1883 -t /api/notice/gatewaybroker
 
+
+# manager からヒートマップを出力するコマンド（gateway を -trafficDepth 付きで起動しておく）
+# mosquitto_sub -h localhost -p 1883 -t /api/heatmap/geojson &
+# mosquitto_pub -h localhost -p 1883 -t /api/tool/heatmap/export -m geojson
+
+# 予備の分散ブローカの起動（manager を -splitThreshold 付きで起動すると、負荷に応じてトピックが割り当てられる）
+# go run cmd/dmb/main.go -managerHost localhost -managerPort 1883 -dmbHost localhost -dmbPort 1895 -dmbSpare
+# mosquitto_sub -h localhost -p 1883 -t /api/distributedbroker/spare/info
+
+# 負荷が下がった分散ブローカを親ノードへ戻さないようにするコマンド（manager を -consolidateThreshold 付きで起動した場合）
+# mosquitto_pub -h localhost -p 1883 -t /api/tool/distributedbroker/pin -m "/0"
+# mosquitto_pub -h localhost -p 1883 -t /api/tool/distributedbroker/unpin -m "/0"
+
+# 分散ブローカの追加・削除を適用せずに評価するコマンド（action は "add" または "remove"）
+# mosquitto_sub -h localhost -p 1883 -t /api/plan/result &
+# mosquitto_pub -h localhost -p 1883 -t /api/tool/plan -m '{"action":"add","broker":{"topic":"/1","broker_info":{"host":"localhost","port":1895}}}'
+
+# ブローカテーブル・ゲートウェイの担当エリアの変更の履歴を取得し、ブローカテーブルをバージョン 1 の構成へ戻すコマンド
+# NOTE: 送信元クライアントを履歴に記録する場合は、MQTT v5 のユーザプロパティ client を指定する（-V 5 -D publish user-property client <名前>）
+# mosquitto_sub -h localhost -p 1883 -t /api/history/result -t /api/rollback/result &
+# mosquitto_pub -h localhost -p 1883 -t /api/tool/history -m '{"since":0,"kind":"brokertable"}'
+# mosquitto_pub -h localhost -p 1883 -t /api/tool/rollback -m '{"version":1}'
+
+# トポロジファイルに記述した構成で起動するコマンド（分散ブローカ・ゲートウェイは起動した順によらず記述した構成で登録され、gatewaybroker/set は不要）
+# go run cmd/manager/main.go -host localhost -port 1883 -topology scripts/local/topology.json
+# mosquitto_sub -h localhost -p 1883 -t /api/topology/status